@@ -3,33 +3,64 @@ package main
 import (
 	"github.com/kimuraz/golang-json-db/client"
 	"github.com/kimuraz/golang-json-db/server"
+	"github.com/kimuraz/golang-json-db/sql"
+	"github.com/kimuraz/golang-json-db/table"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func startServer(cCtx *cli.Context) error {
 	config := NewConfig("config.json")
+	if config.DataDir != "" {
+		if err := table.SetDataDir(config.DataDir); err != nil {
+			return err
+		}
+	}
+	if config.LockTimeout > 0 {
+		table.SetLockTimeout(time.Duration(config.LockTimeout) * time.Millisecond)
+	}
+	if config.StatementTimeout > 0 {
+		sql.SetStatementTimeout(time.Duration(config.StatementTimeout) * time.Millisecond)
+	}
 	server := server.NewServer(config.ServerPort)
+	server.PostgresPort = config.PostgresPort
+	server.HTTPPort = config.HTTPPort
+	if config.ShutdownTimeout > 0 {
+		server.ShutdownTimeout = time.Duration(config.ShutdownTimeout) * time.Millisecond
+	}
 
 	go server.StartServer()
 
 	log.Info().Msg("Server started")
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 	for {
-		message := <-server.MessageChan
-		if message != "" {
-			log.Info().Msg(message)
+		select {
+		case message := <-server.MessageChan:
+			if message != "" {
+				log.Info().Msg(message)
+			}
+		case <-signals:
+			// A second signal kills the process without waiting
+			signal.Stop(signals)
+			go server.Shutdown()
+		case <-server.Done():
+			return nil
 		}
 	}
-
-	return nil
 }
 
 func connClient(cCtx *cli.Context) error {
 	port := cCtx.Args().First()
 	cl := client.NewClient()
+	cl.User = cCtx.String("user")
+	cl.Password = cCtx.String("password")
 	cl.Connect(port)
 
 	return nil
@@ -63,6 +94,18 @@ func main() {
 					Category: "client",
 					Usage:    "Connects to a server",
 					Action:   connClient,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "user",
+							Aliases: []string{"u"},
+							Usage:   "User to authenticate as, the password is asked for",
+						},
+						&cli.StringFlag{
+							Name:    "password",
+							Usage:   "Password of the user",
+							EnvVars: []string{"GJDB_PASSWORD"},
+						},
+					},
 				},
 			},
 		},
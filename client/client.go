@@ -2,23 +2,47 @@ package client
 
 import (
 	"bufio"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"github.com/kimuraz/golang-json-db/protocol"
 	"github.com/rs/zerolog/log"
-	"net"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
 )
 
 type Client struct {
-	Conn net.Conn
+	Conn *protocol.Conn
+	// Format renders rows as table, json or csv, SET output_format
+	// changes it
+	Format string
+	// User and Password authenticate the connection, the password is asked
+	// for when only the user is given
+	User     string
+	Password string
+	// running is the id of the statement waiting for its response, Ctrl-C
+	// cancels it
+	running atomic.Uint32
 }
 
 func NewClient() *Client {
-	return &Client{}
+	return &Client{Format: "table"}
 }
 
 func (c *Client) Connect(port string) {
-	conn, err := net.Dial("tcp", ":"+port)
+	reader := bufio.NewReader(os.Stdin)
+	if c.User != "" && c.Password == "" {
+		fmt.Print("Password: ")
+		password, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			panic(err)
+		}
+		c.Password = strings.TrimRight(password, "\r\n")
+	}
+	conn, err := protocol.Dial(":"+port, protocol.Hello{Name: "gjdb-cli", User: c.User, Password: c.Password})
 	if err != nil {
 		panic(err)
 	}
@@ -26,35 +50,144 @@ func (c *Client) Connect(port string) {
 	defer c.Conn.Close()
 
 	log.Info().Msgf("Connection established on server %s\n", c.Conn.RemoteAddr())
+	go c.cancelOnInterrupt()
 	for {
-		if conn == nil {
-			panic("Connection dropped")
-			os.Exit(1)
-		}
 		fmt.Print("> ")
-		reader := bufio.NewReader(os.Stdin)
 		query, err := reader.ReadString('\n')
 
 		if err != nil {
 			log.Error().Msgf("Error reading from stdin: %s", err.Error())
+			if err == io.EOF {
+				return
+			}
 			continue
 		}
 
 		query = strings.Replace(query, "\n", "", -1)
 
-		conn.Write([]byte(query))
-
-		buffer := make([]byte, 1024)
-		n, err := conn.Read(buffer)
+		id, err := conn.Send(protocol.TypeQuery, []byte(query))
+		if err != nil {
+			log.Error().Msgf("Error sending to server: %s", err.Error())
+			os.Exit(1)
+		}
+		c.running.Store(id)
+		err = c.render(id)
+		c.running.Store(0)
 		if err != nil {
 			log.Error().Msgf("Error reading from server: %s", err.Error())
 			os.Exit(1)
 		}
-		srvMsg := fmt.Sprintf("SERVER: %s\n", string(buffer[:n]))
-		if strings.Contains(srvMsg, "\"ok\":false") {
-			log.Error().Msgf(srvMsg)
-		} else {
-			log.Info().Msgf(srvMsg)
+	}
+}
+
+// cancelOnInterrupt cancels the running statement on Ctrl-C, at the prompt
+// it quits
+func (c *Client) cancelOnInterrupt() {
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	for range interrupts {
+		id := c.running.Load()
+		if id == 0 {
+			fmt.Println()
+			os.Exit(0)
+		}
+		log.Info().Msg("Canceling statement...")
+		if err := c.Conn.Cancel(id); err != nil {
+			log.Error().Msgf("Error canceling statement: %s", err.Error())
 		}
 	}
 }
+
+// render prints the response to request id as it arrives, rows batch by
+// batch under a header of their columns
+func (c *Client) render(id uint32) error {
+	var columns []protocol.Column
+	out := csv.NewWriter(os.Stdout)
+	for {
+		frame, err := c.Conn.ReadFrame()
+		if err != nil {
+			return err
+		}
+		if frame.ID != id {
+			continue
+		}
+		switch frame.Type {
+		case protocol.TypeError:
+			log.Error().Msgf("SERVER: %s\n", frame.Err().Error())
+			return nil
+		case protocol.TypeColumns:
+			if err = frame.Decode(&columns); err != nil {
+				return err
+			}
+			names := make([]string, len(columns))
+			for i, column := range columns {
+				names[i] = column.Name
+			}
+			switch c.Format {
+			case "csv":
+				out.Write(names)
+				out.Flush()
+			case "table":
+				header := strings.Join(names, " | ")
+				fmt.Println(header)
+				fmt.Println(strings.Repeat("-", len(header)))
+			}
+		case protocol.TypeRows:
+			var rows []map[string]json.RawMessage
+			if err = frame.Decode(&rows); err != nil {
+				return err
+			}
+			for _, row := range rows {
+				if c.Format == "json" {
+					data, _ := json.Marshal(row)
+					fmt.Println(string(data))
+					continue
+				}
+				values := make([]string, len(columns))
+				for i, column := range columns {
+					values[i] = formatValue(row[column.Name])
+				}
+				if c.Format == "csv" {
+					out.Write(values)
+					continue
+				}
+				fmt.Println(strings.Join(values, " | "))
+			}
+			out.Flush()
+		case protocol.TypeComplete:
+			var response map[string]interface{}
+			if err = frame.Decode(&response); err != nil {
+				return err
+			}
+			switch response["setting"] {
+			case "output_format":
+				c.Format, _ = response["value"].(string)
+			case "all":
+				c.Format = "table"
+			}
+			if columns != nil {
+				fmt.Printf("(%v rows, %v ms)\n", response["row_count"], response["elapsed_ms"])
+				return nil
+			}
+			srvMsg := fmt.Sprintf("SERVER: %s\n", string(frame.Payload))
+			if ok, _ := response["ok"].(bool); !ok {
+				log.Error().Msgf(srvMsg)
+			} else {
+				log.Info().Msgf(srvMsg)
+			}
+			return nil
+		}
+	}
+}
+
+// formatValue prints strings without quotes and missing values as NULL
+func formatValue(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "NULL"
+	}
+	var str string
+	if json.Unmarshal(raw, &str) == nil {
+		return str
+	}
+	return string(raw)
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"encoding/json"
+	"github.com/kimuraz/golang-json-db/protocol"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{raw: "", want: "NULL"},
+		{raw: "null", want: "NULL"},
+		{raw: `"Tom"`, want: "Tom"},
+		{raw: "42", want: "42"},
+		{raw: "true", want: "true"},
+		{raw: `{"a":[1,2]}`, want: `{"a":[1,2]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			if got := formatValue(json.RawMessage(tt.raw)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// captureStdout returns what f prints
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+	f()
+	os.Stdout = stdout
+	writer.Close()
+	return <-output
+}
+
+func TestRender(t *testing.T) {
+	columns := []protocol.Column{{Name: "id", Type: "INTEGER"}, {Name: "name", Type: "TEXT"}}
+	batches := [][]map[string]interface{}{
+		{{"id": 1, "name": "Tom"}},
+		{{"id": 2}},
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: "table", want: "id | name\n---------\n1 | Tom\n2 | NULL\n(2 rows, 3 ms)\n"},
+		{format: "csv", want: "id,name\n1,Tom\n2,NULL\n(2 rows, 3 ms)\n"},
+		{format: "json", want: "{\"id\":1,\"name\":\"Tom\"}\n{\"id\":2}\n(2 rows, 3 ms)\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			go func() {
+				conn := protocol.NewConn(serverConn)
+				// Responses to other requests are skipped
+				frames := []*protocol.Frame{protocol.ErrorFrame(6, protocol.CodeProtocol, "not this one")}
+				frame, _ := protocol.NewFrame(protocol.TypeColumns, 7, columns)
+				frames = append(frames, frame)
+				for _, batch := range batches {
+					frame, _ = protocol.NewFrame(protocol.TypeRows, 7, batch)
+					frames = append(frames, frame)
+				}
+				frame, _ = protocol.NewFrame(protocol.TypeComplete, 7, map[string]interface{}{"ok": true, "row_count": 2, "elapsed_ms": 3})
+				frames = append(frames, frame)
+				for _, frame := range frames {
+					conn.WriteFrame(frame)
+				}
+			}()
+
+			c := &Client{Conn: protocol.NewConn(clientConn), Format: tt.format}
+			var err error
+			got := captureStdout(t, func() { err = c.render(7) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderSetsFormat(t *testing.T) {
+	tests := []struct {
+		response map[string]interface{}
+		want     string
+	}{
+		{response: map[string]interface{}{"ok": true, "setting": "output_format", "value": "csv"}, want: "csv"},
+		{response: map[string]interface{}{"ok": true, "setting": "all"}, want: "table"},
+		{response: map[string]interface{}{"ok": true, "setting": "statement_timeout", "value": "1s"}, want: "json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			go func() {
+				frame, _ := protocol.NewFrame(protocol.TypeComplete, 1, tt.response)
+				protocol.NewConn(serverConn).WriteFrame(frame)
+			}()
+			c := &Client{Conn: protocol.NewConn(clientConn), Format: "json"}
+			if err := c.render(1); err != nil {
+				t.Fatal(err)
+			}
+			if c.Format != tt.want {
+				t.Errorf("format is %s, want %s", c.Format, tt.want)
+			}
+		})
+	}
+}
@@ -9,6 +9,20 @@ import (
 
 type Config struct {
 	ServerPort int `json:"server_port"`
+	// PostgresPort is where PostgreSQL clients connect, 0 leaves it off
+	PostgresPort int `json:"postgres_port"`
+	// HTTPPort serves the HTTP API, 0 leaves it off
+	HTTPPort int `json:"http_port"`
+	// DataDir holds every database, ./data unless set
+	DataDir string `json:"data_dir"`
+	// LockTimeout is how long a transaction waits for a lock, in milliseconds
+	LockTimeout int `json:"lock_timeout_ms"`
+	// ShutdownTimeout is how long a shutdown waits for running statements,
+	// in milliseconds
+	ShutdownTimeout int `json:"shutdown_timeout_ms"`
+	// StatementTimeout cancels statements running longer, in milliseconds.
+	// 0 leaves them without one, SET timeout changes it for a session
+	StatementTimeout int `json:"statement_timeout_ms"`
 }
 
 func NewConfig(filePath string) *Config {
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewConfigDataDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "unset", content: `{"server_port": 9875}`, want: ""},
+		{name: "set", content: `{"server_port": 9875, "data_dir": "/var/lib/gjdb"}`, want: "/var/lib/gjdb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := NewConfig(path).DataDir; got != tt.want {
+				t.Errorf("got data_dir %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package driver
+
+import (
+	sqldriver "database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/protocol"
+)
+
+// executePayload encodes the arguments of a prepared statement, with query
+// set the server prepares it as the unnamed statement first. Bytes go as
+// base64 and times as RFC 3339 strings, the server reads them back by the
+// type of their column
+func executePayload(name string, query string, args []sqldriver.NamedValue) ([]byte, error) {
+	params := make([]interface{}, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("Named arguments are not supported, use ? or $n")
+		}
+		params[i] = arg.Value
+	}
+	payload, err := json.Marshal(&protocol.Execute{Name: name, SQL: query, Params: params})
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding arguments: %s", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,286 @@
+package driver
+
+import (
+	"context"
+	sqldriver "database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/protocol"
+	"time"
+)
+
+// cancelWait is how long a canceled statement is waited for before the
+// connection is given up
+const cancelWait = 5 * time.Second
+
+// conn is a connection to the server, which keeps a session for it. A
+// statement interrupted by its context is canceled on the server and the
+// connection stays usable, unless the server does not answer the cancel in
+// time. The connection is dropped from the pool then
+type conn struct {
+	netConn *protocol.Conn
+	bad     bool
+	// statements numbers the prepared statements of the connection
+	statements int
+}
+
+// query runs a statement without arguments
+func (c *conn) query(ctx context.Context, query string) (*reply, error) {
+	return c.roundTrip(ctx, protocol.TypeQuery, []byte(query))
+}
+
+// roundTrip sends a request frame and waits for its response, a nil context
+// waits forever
+func (c *conn) roundTrip(ctx context.Context, t protocol.MessageType, payload []byte) (*reply, error) {
+	if c.bad {
+		return nil, sqldriver.ErrBadConn
+	}
+	if ctx != nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	c.netConn.SetDeadline(time.Time{})
+	id, err := c.netConn.Send(t, payload)
+	if err != nil {
+		c.bad = true
+		return nil, fmt.Errorf("Error sending statement: %s", err)
+	}
+	if ctx != nil {
+		// The cancel is sent before the next request can clear the deadline
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		defer func() {
+			close(done)
+			<-stopped
+		}()
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				c.netConn.Cancel(id)
+				c.netConn.SetReadDeadline(time.Now().Add(cancelWait))
+			case <-done:
+			}
+		}()
+	}
+
+	reply, err := c.receive(id)
+	e, ok := err.(*protocol.Error)
+	if err != nil && !ok {
+		c.bad = true
+	}
+	if err != nil && ctx != nil && ctx.Err() != nil && (!ok || e.Code == protocol.CodeCanceled) {
+		return nil, ctx.Err()
+	}
+	return reply, err
+}
+
+// reply is the response to a statement, with its rows when it returned some
+type reply struct {
+	response map[string]interface{}
+	columns  []column
+	rows     []map[string]json.RawMessage
+}
+
+// receive reads the response to request id, a *protocol.Error when the
+// statement failed leaves the connection usable. The rows are read whole
+func (c *conn) receive(id uint32) (*reply, error) {
+	r := &reply{}
+	for {
+		frame, err := c.netConn.ReadFrame()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading response: %s", err)
+		}
+		if frame.ID != id {
+			continue
+		}
+		switch frame.Type {
+		case protocol.TypeError:
+			return nil, frame.Err()
+		case protocol.TypeColumns:
+			err = frame.Decode(&r.columns)
+		case protocol.TypeRows:
+			var batch []map[string]json.RawMessage
+			err = frame.Decode(&batch)
+			r.rows = append(r.rows, batch...)
+		case protocol.TypeComplete:
+			err = frame.Decode(&r.response)
+			if err == nil {
+				return r, nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *conn) Prepare(query string) (sqldriver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext keeps the statement parsed in the session of the
+// connection, until the statement is closed
+func (c *conn) PrepareContext(ctx context.Context, query string) (sqldriver.Stmt, error) {
+	c.statements++
+	name := fmt.Sprintf("gjdb_%d", c.statements)
+	payload, err := json.Marshal(&protocol.Prepare{Name: name, SQL: query})
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding statement: %s", err)
+	}
+	reply, err := c.roundTrip(ctx, protocol.TypePrepare, payload)
+	if err != nil {
+		return nil, err
+	}
+	parameters, _ := reply.response["parameters"].([]interface{})
+	return &stmt{conn: c, name: name, numInput: len(parameters)}, nil
+}
+
+func (c *conn) Close() error {
+	return c.netConn.Close()
+}
+
+func (c *conn) Begin() (sqldriver.Tx, error) {
+	return c.BeginTx(context.Background(), sqldriver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts sqldriver.TxOptions) (sqldriver.Tx, error) {
+	if opts.ReadOnly || opts.Isolation != sqldriver.IsolationLevel(0) {
+		return nil, fmt.Errorf("Only the default isolation level is supported")
+	}
+	_, err := c.query(ctx, "BEGIN")
+	if err != nil {
+		return nil, err
+	}
+	return &tx{conn: c}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	reply, err := c.execute(ctx, "", query, args)
+	if err != nil {
+		return nil, err
+	}
+	return newResult(reply), nil
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	reply, err := c.execute(ctx, "", query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{columns: reply.columns, rows: reply.rows}, nil
+}
+
+// execute runs the statement prepared under name, or query with the
+// arguments bound by the server. A query without arguments is sent as it is
+func (c *conn) execute(ctx context.Context, name string, query string, args []sqldriver.NamedValue) (*reply, error) {
+	if name == "" && len(args) == 0 {
+		return c.query(ctx, query)
+	}
+	payload, err := executePayload(name, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return c.roundTrip(ctx, protocol.TypeExecute, payload)
+}
+
+func (c *conn) Ping(ctx context.Context) error {
+	_, err := c.query(ctx, "SELECT 1")
+	return err
+}
+
+// ResetSession keeps broken connections out of the pool
+func (c *conn) ResetSession(ctx context.Context) error {
+	if c.bad {
+		return sqldriver.ErrBadConn
+	}
+	return nil
+}
+
+func (c *conn) IsValid() bool {
+	return !c.bad
+}
+
+type tx struct {
+	conn *conn
+}
+
+func (t *tx) Commit() error {
+	_, err := t.conn.query(nil, "COMMIT")
+	return err
+}
+
+func (t *tx) Rollback() error {
+	_, err := t.conn.query(nil, "ROLLBACK")
+	return err
+}
+
+type result struct {
+	rowsAffected int64
+}
+
+func newResult(reply *reply) result {
+	affected, _ := reply.response["rows_affected"].(float64)
+	return result{rowsAffected: int64(affected)}
+}
+
+func (r result) LastInsertId() (int64, error) {
+	return 0, fmt.Errorf("LastInsertId is not supported, select the row back")
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
+}
+
+// stmt is a statement prepared in the session of the connection
+type stmt struct {
+	conn     *conn
+	name     string
+	numInput int
+}
+
+// Close deallocates the statement, a broken connection has lost it already
+func (s *stmt) Close() error {
+	if s.conn.bad {
+		return nil
+	}
+	_, err := s.conn.query(nil, fmt.Sprintf("DEALLOCATE %s", s.name))
+	return err
+}
+
+func (s *stmt) NumInput() int {
+	return s.numInput
+}
+
+func (s *stmt) Exec(args []sqldriver.Value) (sqldriver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Result, error) {
+	reply, err := s.conn.execute(ctx, s.name, "", args)
+	if err != nil {
+		return nil, err
+	}
+	return newResult(reply), nil
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []sqldriver.NamedValue) (sqldriver.Rows, error) {
+	reply, err := s.conn.execute(ctx, s.name, "", args)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{columns: reply.columns, rows: reply.rows}, nil
+}
+
+func namedValues(args []sqldriver.Value) []sqldriver.NamedValue {
+	named := make([]sqldriver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = sqldriver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
@@ -0,0 +1,227 @@
+package driver
+
+import (
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"encoding/json"
+	"errors"
+	"github.com/kimuraz/golang-json-db/internal/testutil"
+	"github.com/kimuraz/golang-json-db/server"
+	gjdbsql "github.com/kimuraz/golang-json-db/sql"
+	"github.com/kimuraz/golang-json-db/table"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testAddress is a server every test of the package talks to
+var testAddress string
+
+func TestMain(m *testing.M) {
+	testutil.Main(m, startServer)
+}
+
+// startServer serves the data directory on testAddress
+func startServer(dir string) error {
+	if err := table.SetDataDir(dir); err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	testAddress = listener.Addr().String()
+	messages := make(chan string, 100)
+	go func() {
+		for range messages {
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.ConnectServerClient(conn, gjdbsql.NewSession(), messages, func() {})
+		}
+	}()
+	return nil
+}
+
+func openTestDB(t *testing.T, database string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("gjdb", "gjdb://"+testAddress+"/"+database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestParseDSN(t *testing.T) {
+	tests := []struct {
+		dsn      string
+		address  string
+		database string
+		user     string
+		password string
+		wantErr  bool
+	}{
+		{dsn: "gjdb://localhost", address: "localhost:9875"},
+		{dsn: "gjdb://localhost:1234/shop", address: "localhost:1234", database: "shop"},
+		{dsn: "gjdb://admin:change%40me@[::1]/shop/", address: "[::1]:9875", database: "shop", user: "admin", password: "change@me"},
+		{dsn: "gjdb://admin@localhost", address: "localhost:9875", user: "admin"},
+		{dsn: "postgres://localhost/shop", wantErr: true},
+		{dsn: "gjdb://local host:%zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dsn, func(t *testing.T) {
+			address, database, user, err := parseDSN(tt.dsn)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if address != tt.address || database != tt.database {
+				t.Errorf("got %s and %q, want %s and %q", address, database, tt.address, tt.database)
+			}
+			password, _ := user.Password()
+			if user.Username() != tt.user || password != tt.password {
+				t.Errorf("got user %v, want %s:%s", user, tt.user, tt.password)
+			}
+		})
+	}
+}
+
+func TestColumnValue(t *testing.T) {
+	tests := []struct {
+		column  string
+		raw     string
+		want    sqldriver.Value
+		wantErr bool
+	}{
+		{column: "INTEGER", raw: "42", want: int64(42)},
+		{column: "INTEGER", raw: "4.5", wantErr: true},
+		{column: "DOUBLE", raw: "4.5", want: 4.5},
+		{column: "BOOLEAN", raw: "true", want: true},
+		{column: "TEXT", raw: `"Tom"`, want: "Tom"},
+		{column: "DATE", raw: `"2020-01-02"`, want: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{column: "TIMESTAMP", raw: `"2020-01-02T03:04:05Z"`, want: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{column: "DATE", raw: `"yesterday"`, wantErr: true},
+		{column: "BLOB", raw: `"aGk="`, want: []byte("hi")},
+		{column: "JSON", raw: `{"a":1}`, want: []byte(`{"a":1}`)},
+		{column: "TEXT", raw: "null", want: nil},
+		{column: "TEXT", raw: "", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.column+" "+tt.raw, func(t *testing.T) {
+			got, err := columnValue(column{Name: "c", Type: tt.column}, json.RawMessage(tt.raw))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, expected an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecutePayloadRefusesNamedArguments(t *testing.T) {
+	_, err := executePayload("", "SELECT 1", []sqldriver.NamedValue{{Name: "id", Ordinal: 1, Value: int64(1)}})
+	if err == nil {
+		t.Fatal("named argument accepted")
+	}
+}
+
+func TestDriver(t *testing.T) {
+	if _, err := table.CreateDatabase("drivershop"); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t, "drivershop")
+	if _, err := db.Exec("CREATE TABLE cats (id INT PRIMARY KEY, name VARCHAR(20), weight DOUBLE, born DATE)"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		args   []interface{}
+		commit bool
+		want   int64
+	}{
+		{name: "question marks", query: "INSERT INTO cats (id, name, weight, born) VALUES (?, ?, ?, ?)", args: []interface{}{1, "Tom", 4.5, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)}, commit: true, want: 1},
+		{name: "numbered", query: "INSERT INTO cats (id, name) VALUES ($1, $2)", args: []interface{}{2, "Felix"}, commit: true, want: 1},
+		{name: "rolled back", query: "INSERT INTO cats (id, name) VALUES (?, ?)", args: []interface{}{3, "Garfield"}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := tx.Exec(tt.query, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if affected, _ := result.RowsAffected(); affected != 1 {
+				t.Errorf("insert affected %d rows", affected)
+			}
+			if tt.commit {
+				err = tx.Commit()
+			} else {
+				err = tx.Rollback()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var count int64
+			rows, err := db.Query("SELECT * FROM cats WHERE id = ?", tt.args[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				count++
+			}
+			if err = rows.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if count != tt.want {
+				t.Errorf("got %d rows, want %d", count, tt.want)
+			}
+		})
+	}
+
+	// id comes first, the other columns by name
+	var id int64
+	var name string
+	var weight float64
+	var born time.Time
+	err := db.QueryRow("SELECT * FROM cats WHERE id = $1", 1).Scan(&id, &born, &name, &weight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 || name != "Tom" || weight != 4.5 || !born.Equal(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %d %s %v %v", id, name, weight, born)
+	}
+	if err = db.QueryRow("SELECT * FROM cats WHERE id = ?", 3).Scan(&id, &born, &name, &weight); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("got %v, want no rows", err)
+	}
+}
+
+func TestOpenUnknownDatabase(t *testing.T) {
+	db := openTestDB(t, "nosuchdatabase")
+	if err := db.Ping(); err == nil {
+		t.Fatal("connected to a database that does not exist")
+	}
+}
@@ -0,0 +1,122 @@
+package driver
+
+import (
+	sqldriver "database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/protocol"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type column = protocol.Column
+
+// rows are read whole with the response, values are converted to the type
+// of their column: INTEGER to int64, DOUBLE to float64, BOOLEAN to bool,
+// DATE and TIMESTAMP to time.Time, BLOB to bytes and JSON to its text
+type rows struct {
+	columns []column
+	rows    []map[string]json.RawMessage
+	pos     int
+}
+
+func (r *rows) Columns() []string {
+	names := make([]string, len(r.columns))
+	for i, column := range r.columns {
+		names[i] = column.Name
+	}
+	return names
+}
+
+func (r *rows) Close() error {
+	r.rows = nil
+	return nil
+}
+
+func (r *rows) Next(dest []sqldriver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	row := r.rows[r.pos]
+	r.pos++
+	for i, column := range r.columns {
+		value, err := columnValue(column, row[column.Name])
+		if err != nil {
+			return fmt.Errorf("Error reading column %s: %s", column.Name, err)
+		}
+		dest[i] = value
+	}
+	return nil
+}
+
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.columns[index].Type
+}
+
+func (r *rows) ColumnTypeScanType(index int) reflect.Type {
+	switch r.columns[index].Type {
+	case "INTEGER":
+		return reflect.TypeOf(int64(0))
+	case "DOUBLE":
+		return reflect.TypeOf(float64(0))
+	case "BOOLEAN":
+		return reflect.TypeOf(false)
+	case "DATE", "TIMESTAMP":
+		return reflect.TypeOf(time.Time{})
+	case "TEXT":
+		return reflect.TypeOf("")
+	}
+	return reflect.TypeOf([]byte(nil))
+}
+
+func (r *rows) ColumnTypeNullable(index int) (bool, bool) {
+	return true, true
+}
+
+func columnValue(column column, raw json.RawMessage) (sqldriver.Value, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var err error
+	switch column.Type {
+	case "INTEGER":
+		var value int64
+		err = json.Unmarshal(raw, &value)
+		return value, err
+	case "DOUBLE":
+		var value float64
+		err = json.Unmarshal(raw, &value)
+		return value, err
+	case "BOOLEAN":
+		var value bool
+		err = json.Unmarshal(raw, &value)
+		return value, err
+	case "TEXT", "DATE", "TIMESTAMP", "BLOB":
+		var value string
+		err = json.Unmarshal(raw, &value)
+		if err != nil {
+			return nil, err
+		}
+		switch column.Type {
+		case "DATE", "TIMESTAMP":
+			return parseTime(value)
+		case "BLOB":
+			return base64.StdEncoding.DecodeString(value)
+		}
+		return value, nil
+	}
+	return []byte(raw), nil
+}
+
+// Dates are stored as UTC in one of these layouts
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04:05Z", "2006-01-02"} {
+		if parsed, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid date: %s", value)
+}
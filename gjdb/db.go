@@ -0,0 +1,254 @@
+// Package gjdb embeds the database in a Go program, statements run in
+// process on the same engine the server uses
+package gjdb
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/sql"
+	"github.com/kimuraz/golang-json-db/table"
+	"github.com/kimuraz/golang-json-db/utils"
+	"sync"
+	"time"
+)
+
+// Options tune an opened directory, the zero value is valid
+type Options struct {
+	// Database is the database statements start in, the default one when
+	// empty
+	Database string
+	// LockTimeout is how long transactions wait for a lock, 5s when zero
+	LockTimeout time.Duration
+}
+
+// Tables and transactions are shared by the whole process, so a single data
+// directory can be open at a time
+var openMu sync.Mutex
+var openDir string
+var openCount int
+
+var registerOnce sync.Once
+
+// DB is an open data directory, it is safe for concurrent use. Every Exec
+// and Query runs in a transaction of its own, Begin groups statements
+type DB struct {
+	mu       sync.Mutex
+	database string
+	txs      map[*Tx]bool
+	running  sync.WaitGroup
+	closed   bool
+}
+
+// Result tells what a statement changed
+type Result struct {
+	RowsAffected int64
+}
+
+// Open opens the databases stored in dir, creating it when needed
+func Open(dir string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	openMu.Lock()
+	defer openMu.Unlock()
+	if openCount > 0 && dir != openDir {
+		return nil, fmt.Errorf("Data directory %s is already open, close it first", openDir)
+	}
+
+	registerOnce.Do(func() {
+		gob.Register(table.GobIndex{})
+		gob.Register(table.BTreeStringIndex{})
+		gob.Register(utils.BTree{})
+		gob.Register(utils.BTreeNode{})
+	})
+	if openCount == 0 {
+		err := table.SetDataDir(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.LockTimeout > 0 {
+		table.SetLockTimeout(opts.LockTimeout)
+	}
+	database := opts.Database
+	if database == "" {
+		database = table.DefaultDatabaseName
+	}
+	if _, err := table.OpenDatabase(database); err != nil {
+		return nil, err
+	}
+
+	openDir = dir
+	openCount++
+	return &DB{database: database, txs: make(map[*Tx]bool)}, nil
+}
+
+// session starts a statement, done has to be called once it ran
+func (db *DB) session() (*sql.Session, func(), error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, nil, fmt.Errorf("Database is closed")
+	}
+	session := sql.NewSession()
+	err := session.Use(db.database)
+	if err != nil {
+		return nil, nil, err
+	}
+	db.running.Add(1)
+	return session, db.running.Done, nil
+}
+
+// run executes a statement outside of Begin, USE changes the database of
+// the next ones
+func (db *DB) run(query string) (map[string]interface{}, error) {
+	session, done, err := db.session()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	response, err := session.Execute(query)
+	if session.InTransaction() {
+		session.Close()
+		return nil, fmt.Errorf("Transactions are started with DB.Begin")
+	}
+	if err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	db.database = session.Database().Name
+	db.mu.Unlock()
+	return response, nil
+}
+
+// Exec runs a statement that returns no rows
+func (db *DB) Exec(query string) (Result, error) {
+	response, err := db.run(query)
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(response), nil
+}
+
+// Query runs a statement that returns rows
+func (db *DB) Query(query string) (*Rows, error) {
+	response, err := db.run(query)
+	if err != nil {
+		return nil, err
+	}
+	return newRows(response)
+}
+
+// Begin starts a transaction, it has to end with Commit or Rollback
+func (db *DB) Begin() (*Tx, error) {
+	session, done, err := db.session()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	_, err = session.Execute("BEGIN")
+	if err != nil {
+		return nil, err
+	}
+	tx := &Tx{db: db, session: session}
+	db.mu.Lock()
+	db.txs[tx] = true
+	db.mu.Unlock()
+	return tx, nil
+}
+
+// Close waits for the running statements and rolls back the transactions
+// left open. Changes are on disk once their statement ends, the tables are
+// read again when the directory is opened next
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	txs := make([]*Tx, 0, len(db.txs))
+	for tx := range db.txs {
+		txs = append(txs, tx)
+	}
+	db.mu.Unlock()
+
+	db.running.Wait()
+	var err error
+	for _, tx := range txs {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && err == nil {
+			err = rollbackErr
+		}
+	}
+
+	openMu.Lock()
+	defer openMu.Unlock()
+	openCount--
+	if openCount == 0 {
+		table.CloseTables()
+	}
+	return err
+}
+
+// Tx is a transaction started by Begin. Its statements run one at a time
+type Tx struct {
+	mu      sync.Mutex
+	db      *DB
+	session *sql.Session
+	done    bool
+}
+
+func (tx *Tx) run(query string) (map[string]interface{}, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return nil, fmt.Errorf("Transaction has already been committed or rolled back")
+	}
+	response, err := tx.session.Execute(query)
+	// Deadlocks roll the whole transaction back
+	if !tx.session.InTransaction() {
+		tx.end()
+	}
+	return response, err
+}
+
+// Exec runs a statement of the transaction that returns no rows
+func (tx *Tx) Exec(query string) (Result, error) {
+	response, err := tx.run(query)
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(response), nil
+}
+
+// Query runs a statement of the transaction that returns rows
+func (tx *Tx) Query(query string) (*Rows, error) {
+	response, err := tx.run(query)
+	if err != nil {
+		return nil, err
+	}
+	return newRows(response)
+}
+
+func (tx *Tx) Commit() error {
+	_, err := tx.run("COMMIT")
+	return err
+}
+
+func (tx *Tx) Rollback() error {
+	_, err := tx.run("ROLLBACK")
+	return err
+}
+
+// end forgets the transaction, callers hold mu
+func (tx *Tx) end() {
+	tx.done = true
+	tx.db.mu.Lock()
+	delete(tx.db.txs, tx)
+	tx.db.mu.Unlock()
+}
+
+func newResult(response map[string]interface{}) Result {
+	affected, _ := response["rows_affected"].(int)
+	return Result{RowsAffected: int64(affected)}
+}
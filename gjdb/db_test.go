@@ -0,0 +1,211 @@
+package gjdb
+
+import (
+	"fmt"
+	"github.com/kimuraz/golang-json-db/internal/testutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testDir string
+
+// Every test of the package opens the same data directory
+func TestMain(m *testing.M) {
+	testutil.Main(m, func(dir string) error {
+		testDir = dir
+		return nil
+	})
+}
+
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open(testDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func mustExec(t *testing.T, db *DB, query string) Result {
+	t.Helper()
+	result, err := db.Exec(query)
+	if err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+	return result
+}
+
+func TestQueryTypes(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, "CREATE TABLE querytypes (id INT PRIMARY KEY, name VARCHAR(20), active BOOLEAN, price DOUBLE, born DATE, tags JSON)")
+	mustExec(t, db, `INSERT INTO querytypes (id, name, active, price, born, tags) VALUES (1, 'Tom', true, 2.5, '2020-01-02', '{"a": [1, 2.5]}')`)
+	mustExec(t, db, "INSERT INTO querytypes (id) VALUES (2)")
+
+	tests := []struct {
+		column string
+		want   []interface{}
+	}{
+		{"id", []interface{}{int64(1), int64(2)}},
+		{"name", []interface{}{"Tom", nil}},
+		{"active", []interface{}{true, nil}},
+		{"price", []interface{}{2.5, nil}},
+		{"born", []interface{}{time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), nil}},
+		{"tags", []interface{}{map[string]interface{}{"a": []interface{}{int64(1), 2.5}}, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.column, func(t *testing.T) {
+			rows, err := db.Query("SELECT * FROM querytypes ORDER BY id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var got []interface{}
+			for rows.Next() {
+				got = append(got, rows.Map()[tt.column])
+			}
+			if rows.Err() != nil {
+				t.Fatal(rows.Err())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, "CREATE TABLE scan (id INT PRIMARY KEY, name VARCHAR(20), price DOUBLE)")
+	mustExec(t, db, "INSERT INTO scan (id, name, price) VALUES (7, 'Felix', 3)")
+
+	tests := []struct {
+		name    string
+		dest    []interface{}
+		want    []interface{}
+		wantErr string
+	}{
+		{name: "typed", dest: []interface{}{new(int64), new(string), new(float64)}, want: []interface{}{int64(7), "Felix", 3.0}},
+		{name: "converted", dest: []interface{}{new(string), new([]byte), new(int)}, want: []interface{}{"7", []byte("Felix"), 3}},
+		{name: "any", dest: []interface{}{new(interface{}), new(interface{}), new(interface{})}, want: []interface{}{int64(7), "Felix", 3.0}},
+		{name: "too few", dest: []interface{}{new(int64)}, wantErr: "Expected 3 destinations"},
+		{name: "wrong type", dest: []interface{}{new(bool), new(string), new(float64)}, wantErr: "cannot scan int64 into *bool"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := db.Query("SELECT * FROM scan")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !rows.Next() {
+				t.Fatal("no row")
+			}
+			err = rows.Scan(tt.dest...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, dest := range tt.dest {
+				if got := reflect.ValueOf(dest).Elem().Interface(); !reflect.DeepEqual(got, tt.want[i]) {
+					t.Errorf("column %d: got %#v, want %#v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTx(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, "CREATE TABLE tx (id INT PRIMARY KEY, name VARCHAR(20))")
+
+	tests := []struct {
+		name   string
+		commit bool
+		want   int
+	}{
+		{name: "commit", commit: true, want: 1},
+		{name: "rollback", commit: false, want: 0},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := tx.Exec(fmt.Sprintf("INSERT INTO tx (id, name) VALUES (%d, 'Tom')", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.RowsAffected != 1 {
+				t.Errorf("insert affected %d rows", result.RowsAffected)
+			}
+			if tt.commit {
+				err = tx.Commit()
+			} else {
+				err = tx.Rollback()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = tx.Exec("SELECT * FROM tx"); err == nil {
+				t.Error("statement ran after the transaction ended")
+			}
+
+			rows, err := db.Query(fmt.Sprintf("SELECT id FROM tx WHERE id = %d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			count := 0
+			for rows.Next() {
+				count++
+			}
+			if count != tt.want {
+				t.Errorf("got %d rows, want %d", count, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenAndClose(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := Open(t.TempDir(), nil); err == nil {
+		t.Error("opened a second data directory")
+	}
+	if _, err := db.Exec("BEGIN"); err == nil {
+		t.Error("Exec started a transaction")
+	}
+
+	other, err := Open(testDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, other, "CREATE TABLE openandclose (id INT PRIMARY KEY)")
+	tx, err := other.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Exec("INSERT INTO openandclose (id) VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	// Close rolls back what is left open
+	if err = other.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.Exec("SELECT * FROM openandclose"); err == nil {
+		t.Error("statement ran on a closed DB")
+	}
+	rows, err := db.Query("SELECT * FROM openandclose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows.Next() {
+		t.Error("Close committed the open transaction")
+	}
+}
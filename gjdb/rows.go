@@ -0,0 +1,253 @@
+package gjdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"time"
+)
+
+// Column describes a column of the rows, Type is one of BOOLEAN, INTEGER,
+// DOUBLE, TEXT, DATE, TIMESTAMP, BLOB or JSON
+type Column = table.Column
+
+// Rows iterates the rows returned by Query, values come back as the Go type
+// of their column: bool, int64, float64, string, time.Time, []byte or the
+// decoded JSON. Missing values are nil
+type Rows struct {
+	columns []Column
+	rows    []map[string]interface{}
+	current []interface{}
+	pos     int
+	err     error
+}
+
+func newRows(response map[string]interface{}) (*Rows, error) {
+	result, ok := response["result"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Statement returned no rows")
+	}
+	columns, _ := response["columns"].([]table.Column)
+	decoder := json.NewDecoder(bytes.NewReader([]byte(result)))
+	decoder.UseNumber()
+	var rows []map[string]interface{}
+	err := decoder.Decode(&rows)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding rows: %s", err)
+	}
+	return &Rows{columns: columns, rows: rows}, nil
+}
+
+// Columns returns the names of the columns in the order Scan fills them
+func (r *Rows) Columns() []string {
+	names := make([]string, len(r.columns))
+	for i, column := range r.columns {
+		names[i] = column.Name
+	}
+	return names
+}
+
+func (r *Rows) ColumnTypes() []Column {
+	return r.columns
+}
+
+// Next moves to the next row, false once there is none or a value could not
+// be converted
+func (r *Rows) Next() bool {
+	if r.err != nil || r.pos >= len(r.rows) {
+		r.current = nil
+		return false
+	}
+	row := r.rows[r.pos]
+	r.pos++
+	r.current = make([]interface{}, len(r.columns))
+	for i, column := range r.columns {
+		r.current[i], r.err = typedValue(column, row[column.Name])
+		if r.err != nil {
+			r.current = nil
+			return false
+		}
+	}
+	return true
+}
+
+// Values returns the values of the current row
+func (r *Rows) Values() []interface{} {
+	return r.current
+}
+
+// Map returns the current row by column name
+func (r *Rows) Map() map[string]interface{} {
+	if r.current == nil {
+		return nil
+	}
+	row := make(map[string]interface{}, len(r.columns))
+	for i, column := range r.columns {
+		row[column.Name] = r.current[i]
+	}
+	return row
+}
+
+// Scan copies the values of the current row into dest, one pointer per
+// column
+func (r *Rows) Scan(dest ...interface{}) error {
+	if r.current == nil {
+		return fmt.Errorf("Scan called without a row, call Next first")
+	}
+	if len(dest) != len(r.current) {
+		return fmt.Errorf("Expected %d destinations, got %d", len(r.current), len(dest))
+	}
+	for i, value := range r.current {
+		err := assign(dest[i], value)
+		if err != nil {
+			return fmt.Errorf("Error scanning column %s: %s", r.columns[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// Err returns the error that stopped Next
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close releases the rows, they are all read by Query already
+func (r *Rows) Close() error {
+	r.rows = nil
+	r.current = nil
+	return nil
+}
+
+// typedValue converts a decoded JSON value to the Go type of its column
+func typedValue(column Column, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch column.Type {
+	case "INTEGER":
+		if number, ok := value.(json.Number); ok {
+			return number.Int64()
+		}
+	case "DOUBLE":
+		if number, ok := value.(json.Number); ok {
+			return number.Float64()
+		}
+	case "DATE", "TIMESTAMP":
+		if str, ok := value.(string); ok {
+			return table.ParseTime(str)
+		}
+	case "BLOB":
+		if str, ok := value.(string); ok {
+			return base64.StdEncoding.DecodeString(str)
+		}
+	}
+	return plainNumbers(value), nil
+}
+
+// plainNumbers turns the numbers of a JSON value into int64 when they are
+// integral and float64 otherwise
+func plainNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if integer, err := v.Int64(); err == nil {
+			return integer
+		}
+		float, _ := v.Float64()
+		return float
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = plainNumbers(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = plainNumbers(elem)
+		}
+	}
+	return value
+}
+
+func assign(dest interface{}, value interface{}) error {
+	if d, ok := dest.(*interface{}); ok {
+		*d = value
+		return nil
+	}
+	if value == nil {
+		return fmt.Errorf("value is null, scan into a *interface{}")
+	}
+	switch d := dest.(type) {
+	case *string:
+		switch v := value.(type) {
+		case string:
+			*d = v
+		case time.Time:
+			*d = v.Format(time.RFC3339)
+		case []byte:
+			*d = string(v)
+		case map[string]interface{}, []interface{}:
+			data, _ := json.Marshal(v)
+			*d = string(data)
+		default:
+			*d = fmt.Sprintf("%v", v)
+		}
+		return nil
+	case *int64:
+		switch v := value.(type) {
+		case int64:
+			*d = v
+			return nil
+		case float64:
+			*d = int64(v)
+			return nil
+		}
+	case *int:
+		switch v := value.(type) {
+		case int64:
+			*d = int(v)
+			return nil
+		case float64:
+			*d = int(v)
+			return nil
+		}
+	case *float64:
+		switch v := value.(type) {
+		case int64:
+			*d = float64(v)
+			return nil
+		case float64:
+			*d = v
+			return nil
+		}
+	case *bool:
+		if v, ok := value.(bool); ok {
+			*d = v
+			return nil
+		}
+	case *time.Time:
+		if v, ok := value.(time.Time); ok {
+			*d = v
+			return nil
+		}
+	case *[]byte:
+		switch v := value.(type) {
+		case []byte:
+			*d = v
+			return nil
+		case string:
+			*d = []byte(v)
+			return nil
+		}
+	case *map[string]interface{}:
+		if v, ok := value.(map[string]interface{}); ok {
+			*d = v
+			return nil
+		}
+	case *[]interface{}:
+		if v, ok := value.([]interface{}); ok {
+			*d = v
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot scan %T into %T", value, dest)
+}
@@ -37,7 +37,7 @@ func PlayingWithTables() {
 
 	for i, str := range strs {
 		fmt.Println(str)
-		table.Insert(fmt.Sprintf(`{ "id": "id%s", "name": "%s", "value": %d, "cost": %f }`, i, str, rand.Int63n(100000), rand.Float32()))
+		table.Insert(fmt.Sprintf(`{ "id": "id%d", "name": "%s", "value": %d, "cost": %f }`, i, str, rand.Int63n(100000), rand.Float32()))
 	}
 
 	data, err := table.SelectAll()
@@ -0,0 +1,24 @@
+// Package testutil holds the setup the tests of every package share
+package testutil
+
+import (
+	"os"
+	"testing"
+)
+
+// Main runs the tests of a package in a data directory of their own, removed
+// once they are done. Tables are named after the test creating them so they
+// never collide. setup points the package at the directory
+func Main(m *testing.M, setup func(dir string) error) {
+	dir, err := os.MkdirTemp("", "gjdb-test")
+	if err != nil {
+		panic(err)
+	}
+	if err = setup(dir); err != nil {
+		os.RemoveAll(dir)
+		panic(err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,239 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Hello is exchanged when a connection opens, Name identifies the program.
+// Clients with a User authenticate with SCRAM-SHA-256 once the server has
+// users: their hello carries the client-first-message in Auth, the server
+// answers with an auth frame and the client with another one, then the
+// ready frame carries the server-final-message. Password never leaves the
+// client, the rest of the connection travels in the clear
+type Hello struct {
+	Version  int    `json:"version"`
+	Name     string `json:"name,omitempty"`
+	User     string `json:"user,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+	Password string `json:"-"`
+}
+
+// LegacyMessage answers clients that send statements without frames, the
+// old clients print the text they read back
+const LegacyMessage = "Error parsing command: The server speaks the framed protocol, upgrade the client\n"
+
+// Conn is a framed connection. Reads happen from one goroutine, writes may
+// come from any
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	mu     sync.Mutex
+	nextID uint32
+}
+
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Dial connects to a server and introduces itself with the hello, its
+// version is set to the one of the package
+func Dial(address string, hello Hello) (*Conn, error) {
+	netConn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to %s: %s", address, err)
+	}
+	c := NewConn(netConn)
+	err = c.Handshake(hello)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) ReadFrame() (*Frame, error) {
+	return ReadFrame(c.reader)
+}
+
+func (c *Conn) WriteFrame(f *Frame) error {
+	return WriteFrame(c.Conn, f)
+}
+
+// Send writes a request under a new id, the responses carry the same id
+func (c *Conn) Send(t MessageType, payload []byte) (uint32, error) {
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	c.mu.Unlock()
+	return id, c.WriteFrame(&Frame{Type: t, ID: id, Payload: payload})
+}
+
+// Cancel asks the server to stop the request with the given id
+func (c *Conn) Cancel(id uint32) error {
+	return c.WriteFrame(&Frame{Type: TypeCancel, ID: id})
+}
+
+// Handshake sends the hello of a client and waits for the server to accept
+// it, authenticating as its user when the server asks for it
+func (c *Conn) Handshake(hello Hello) error {
+	hello.Version = Version
+	var scram *ScramClient
+	if hello.User != "" {
+		var err error
+		scram, err = NewScramClient(hello.User, hello.Password)
+		if err != nil {
+			return err
+		}
+		hello.Auth = scram.First()
+	}
+	frame, err := NewFrame(TypeHello, 0, &hello)
+	if err != nil {
+		return err
+	}
+	err = c.WriteFrame(frame)
+	if err != nil {
+		return fmt.Errorf("Error sending hello: %s", err)
+	}
+	f, err := c.readHello()
+	if err != nil {
+		return err
+	}
+	if scram == nil {
+		if f.Type != TypeReady {
+			return fmt.Errorf("Expected a ready frame, got %s", f.Type)
+		}
+		return nil
+	}
+
+	// Once credentials were sent the server has to prove it knows the
+	// password too, a bare ready frame could come from anyone
+	if f.Type != TypeAuth {
+		return fmt.Errorf("Expected an auth frame, got %s", f.Type)
+	}
+	challenge := &Hello{}
+	if err = f.Decode(challenge); err != nil {
+		return err
+	}
+	final, err := scram.Final(challenge.Auth)
+	if err != nil {
+		return err
+	}
+	frame, err = NewFrame(TypeAuth, f.ID, &Hello{Auth: final})
+	if err != nil {
+		return err
+	}
+	if err = c.WriteFrame(frame); err != nil {
+		return fmt.Errorf("Error sending hello: %s", err)
+	}
+	if f, err = c.readHello(); err != nil {
+		return err
+	}
+	if f.Type != TypeReady {
+		return fmt.Errorf("Expected a ready frame, got %s", f.Type)
+	}
+	ready := &Hello{}
+	if err = f.Decode(ready); err != nil {
+		return err
+	}
+	return scram.Verify(ready.Auth)
+}
+
+// readHello reads a frame of the handshake, an error frame is returned as
+// its error
+func (c *Conn) readHello() (*Frame, error) {
+	f, err := c.ReadFrame()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading hello: %s", err)
+	}
+	if err = f.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Accept reads the hello of a new connection and answers it. Versions it
+// does not speak get an error frame, connections that do not start with a
+// frame get the LegacyMessage. keys returns the salted password of the user
+// of the hello, nil when anyone may connect, and the client proves it
+// knows the password. A failed exchange gets a CodeAuth error frame
+func (c *Conn) Accept(name string, keys func(hello *Hello) (*ScramKeys, error)) (*Hello, error) {
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if MessageType(first[0]) != TypeHello {
+		c.Write([]byte(LegacyMessage))
+		return nil, fmt.Errorf("Client does not speak the framed protocol")
+	}
+	f, err := c.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	hello := &Hello{}
+	if err = f.Decode(hello); err != nil {
+		c.WriteFrame(ErrorFrame(f.ID, CodeProtocol, err.Error()))
+		return nil, err
+	}
+	if hello.Version != Version {
+		err = fmt.Errorf("Protocol version %d is not supported, the server speaks version %d", hello.Version, Version)
+		c.WriteFrame(ErrorFrame(f.ID, CodeVersion, err.Error()))
+		return nil, err
+	}
+	serverFinal, err := c.authenticate(f.ID, hello, keys)
+	if err != nil {
+		c.WriteFrame(ErrorFrame(f.ID, CodeAuth, err.Error()))
+		return nil, err
+	}
+	ready, err := NewFrame(TypeReady, f.ID, &Hello{Version: Version, Name: name, Auth: serverFinal})
+	if err != nil {
+		return nil, err
+	}
+	return hello, c.WriteFrame(ready)
+}
+
+// authenticate runs the SCRAM-SHA-256 exchange of a hello and returns the
+// server-final-message, empty when anyone may connect
+func (c *Conn) authenticate(id uint32, hello *Hello, keys func(hello *Hello) (*ScramKeys, error)) (string, error) {
+	k, err := keys(hello)
+	if err != nil || k == nil {
+		return "", err
+	}
+	failed := fmt.Errorf("Password authentication failed for user %s", hello.User)
+	if hello.Auth == "" {
+		return "", failed
+	}
+	scram, err := NewScramServer(k)
+	if err != nil {
+		return "", err
+	}
+	serverFirst, err := scram.First(hello.Auth)
+	if err != nil {
+		return "", err
+	}
+	frame, err := NewFrame(TypeAuth, id, &Hello{Auth: serverFirst})
+	if err != nil {
+		return "", err
+	}
+	if err = c.WriteFrame(frame); err != nil {
+		return "", err
+	}
+	f, err := c.ReadFrame()
+	if err != nil {
+		return "", err
+	}
+	if f.Type != TypeAuth {
+		return "", fmt.Errorf("Expected an auth frame, got %s", f.Type)
+	}
+	answer := &Hello{}
+	if err = f.Decode(answer); err != nil {
+		return "", err
+	}
+	serverFinal, err := scram.Final(answer.Auth)
+	if err != nil {
+		return "", failed
+	}
+	return serverFinal, nil
+}
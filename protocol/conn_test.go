@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name string
+		// users maps the users of the server to their password, nil when it
+		// has none
+		users    map[string]string
+		hello    Hello
+		wantCode string
+	}{
+		{name: "no users", hello: Hello{Name: "test"}},
+		{name: "right password", users: map[string]string{"user": "pencil"}, hello: Hello{User: "user", Password: "pencil"}},
+		{name: "wrong password", users: map[string]string{"user": "pencil"}, hello: Hello{User: "user", Password: "pen"}, wantCode: CodeAuth},
+		{name: "unknown user", users: map[string]string{"user": "pencil"}, hello: Hello{User: "other", Password: "pencil"}, wantCode: CodeAuth},
+		{name: "no user", users: map[string]string{"user": "pencil"}, hello: Hello{}, wantCode: CodeAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			type accepted struct {
+				hello *Hello
+				err   error
+			}
+			done := make(chan accepted, 1)
+			go func() {
+				hello, err := NewConn(serverConn).Accept("server", func(hello *Hello) (*ScramKeys, error) {
+					if tt.users == nil {
+						return nil, nil
+					}
+					// Unknown users get keys of a password nobody has
+					password, ok := tt.users[hello.User]
+					if !ok {
+						password = "unknown"
+					}
+					return rfcKeys(t, password), nil
+				})
+				done <- accepted{hello, err}
+				if err != nil {
+					serverConn.Close()
+				}
+			}()
+
+			err := NewConn(clientConn).Handshake(tt.hello)
+			server := <-done
+			if tt.wantCode == "" {
+				if err != nil || server.err != nil {
+					t.Fatalf("client: %v, server: %v", err, server.err)
+				}
+				if server.hello.User != tt.hello.User || server.hello.Password != "" {
+					t.Errorf("server got hello %+v", server.hello)
+				}
+				return
+			}
+			if e, ok := err.(*Error); !ok || e.Code != tt.wantCode {
+				t.Errorf("client got %v, want a %s error", err, tt.wantCode)
+			}
+			if server.err == nil {
+				t.Errorf("server accepted the hello")
+			}
+		})
+	}
+}
+
+// TestHandshakeForgedServer checks that a server not knowing the password
+// cannot make the client believe it authenticated, by skipping the exchange
+// or its signature or by signing with another password
+func TestHandshakeForgedServer(t *testing.T) {
+	tests := []struct {
+		name string
+		// exchange runs SCRAM with a guessed password before the ready frame
+		exchange bool
+		auth     string
+	}{
+		{name: "bare ready"},
+		{name: "ready without signature", exchange: true},
+		{name: "forged signature", exchange: true, auth: "v=AAAA"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			go func() {
+				conn := NewConn(serverConn)
+				f, err := conn.ReadFrame()
+				if err != nil {
+					return
+				}
+				if tt.exchange {
+					hello := &Hello{}
+					f.Decode(hello)
+					scram := &ScramServer{keys: rfcKeys(t, "guess"), nonce: "forged"}
+					serverFirst, _ := scram.First(hello.Auth)
+					frame, _ := NewFrame(TypeAuth, f.ID, &Hello{Auth: serverFirst})
+					conn.WriteFrame(frame)
+					if f, err = conn.ReadFrame(); err != nil {
+						return
+					}
+				}
+				frame, _ := NewFrame(TypeReady, f.ID, &Hello{Version: Version, Auth: tt.auth})
+				conn.WriteFrame(frame)
+			}()
+			err := NewConn(clientConn).Handshake(Hello{User: "user", Password: "pencil"})
+			if err == nil {
+				t.Fatal("Handshake accepted a server that did not prove it knows the password")
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package protocol
+
+// Error codes sent in error frames
+const (
+	// CodeStatement is a statement that failed, the connection stays usable
+	CodeStatement = "statement"
+	// CodeProtocol is a malformed or unexpected frame
+	CodeProtocol = "protocol"
+	// CodeVersion is a hello with a version the server does not speak
+	CodeVersion = "version"
+	// CodeAuth is a hello whose user and password do not match, the
+	// connection is closed
+	CodeAuth = "auth"
+	// CodeCanceled is a statement stopped by a cancel frame, KILL QUERY or
+	// its timeout, the connection stays usable
+	CodeCanceled = "canceled"
+)
+
+// Error is the payload of an error frame
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorFrame builds the error frame answering request id
+func ErrorFrame(id uint32, code string, message string) *Frame {
+	f, _ := NewFrame(TypeError, id, &Error{Code: code, Message: message})
+	return f
+}
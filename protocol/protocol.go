@@ -0,0 +1,178 @@
+// Package protocol is the wire format spoken between the server and its
+// clients. Every message is a frame: a header with the message type, the id
+// of the request it belongs to and the length of the payload, all big
+// endian, followed by the payload
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Version is bumped on every change to the frames or their payloads
+const Version = 6
+
+// MaxPayloadSize keeps a corrupt header from allocating without bound
+const MaxPayloadSize = 64 << 20
+
+const headerSize = 9
+
+type MessageType byte
+
+const (
+	// TypeHello opens a connection, sent by the client with a Hello payload
+	TypeHello MessageType = iota + 1
+	// TypeReady accepts the hello, the payload is the Hello of the server
+	TypeReady
+	// TypeQuery carries the text of a statement
+	TypeQuery
+	// TypeComplete ends the response to a statement, the payload is its JSON
+	// response with the row_count and elapsed_ms of the statement
+	TypeComplete
+	// TypeError carries an Error, in place of the complete frame
+	TypeError
+	// TypeColumns starts the rows of a statement, the payload is a JSON list
+	// of Column
+	TypeColumns
+	// TypeRows carries a batch of rows as a JSON list of objects, there are as
+	// many as the rows need
+	TypeRows
+	// TypePrepare parses a Prepare statement and keeps it in the session, it
+	// is answered with a complete frame listing its parameters and columns
+	TypePrepare
+	// TypeExecute runs a prepared statement with the arguments of an Execute
+	// payload, answered like a query
+	TypeExecute
+	// TypeCancel stops the request with the id of the frame, it has no
+	// payload and no answer. The request ends with a CodeCanceled error
+	// unless it was already over
+	TypeCancel
+	// TypeAuth carries a message of the SCRAM-SHA-256 exchange authenticating
+	// a hello, as the Auth of a Hello payload
+	TypeAuth
+)
+
+// Prepare is the payload of a prepare frame, placeholders are ? in order
+// of appearance or $n by position
+type Prepare struct {
+	Name string `json:"name"`
+	SQL  string `json:"sql"`
+}
+
+// Execute is the payload of an execute frame. With SQL set the statement is
+// prepared as the unnamed one and run at once
+type Execute struct {
+	Name   string        `json:"name"`
+	SQL    string        `json:"sql,omitempty"`
+	Params []interface{} `json:"params"`
+}
+
+// Column names a column of the rows and its SQL type
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func (t MessageType) String() string {
+	switch t {
+	case TypeHello:
+		return "hello"
+	case TypeReady:
+		return "ready"
+	case TypeQuery:
+		return "query"
+	case TypeComplete:
+		return "complete"
+	case TypeError:
+		return "error"
+	case TypeColumns:
+		return "columns"
+	case TypeRows:
+		return "rows"
+	case TypePrepare:
+		return "prepare"
+	case TypeExecute:
+		return "execute"
+	case TypeCancel:
+		return "cancel"
+	case TypeAuth:
+		return "auth"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+// Frame is one message, ID pairs the responses with their request
+type Frame struct {
+	Type    MessageType
+	ID      uint32
+	Payload []byte
+}
+
+// NewFrame builds a frame with v encoded as JSON
+func NewFrame(t MessageType, id uint32, v interface{}) (*Frame, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding %s payload: %s", t, err)
+	}
+	return &Frame{Type: t, ID: id, Payload: payload}, nil
+}
+
+// Decode reads the JSON payload of the frame into v
+func (f *Frame) Decode(v interface{}) error {
+	err := json.Unmarshal(f.Payload, v)
+	if err != nil {
+		return fmt.Errorf("Error decoding %s payload: %s", f.Type, err)
+	}
+	return nil
+}
+
+// Err returns the Error of an error frame, nil for any other frame
+func (f *Frame) Err() error {
+	if f.Type != TypeError {
+		return nil
+	}
+	e := &Error{}
+	if err := f.Decode(e); err != nil {
+		return err
+	}
+	return e
+}
+
+func ReadFrame(r io.Reader) (*Frame, error) {
+	header := make([]byte, headerSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	f := &Frame{
+		Type: MessageType(header[0]),
+		ID:   binary.BigEndian.Uint32(header[1:5]),
+	}
+	size := binary.BigEndian.Uint32(header[5:9])
+	if size > MaxPayloadSize {
+		return nil, fmt.Errorf("Frame of %d bytes is over the limit of %d", size, MaxPayloadSize)
+	}
+	f.Payload = make([]byte, size)
+	_, err = io.ReadFull(r, f.Payload)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// WriteFrame sends the frame with a single write, so frames written from
+// different goroutines do not interleave
+func WriteFrame(w io.Writer, f *Frame) error {
+	if len(f.Payload) > MaxPayloadSize {
+		return fmt.Errorf("Frame of %d bytes is over the limit of %d", len(f.Payload), MaxPayloadSize)
+	}
+	data := make([]byte, headerSize+len(f.Payload))
+	data[0] = byte(f.Type)
+	binary.BigEndian.PutUint32(data[1:5], f.ID)
+	binary.BigEndian.PutUint32(data[5:9], uint32(len(f.Payload)))
+	copy(data[headerSize:], f.Payload)
+	_, err := w.Write(data)
+	return err
+}
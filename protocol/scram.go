@@ -0,0 +1,222 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"strconv"
+	"strings"
+)
+
+// ScramMechanism is the SASL name of the exchange both listeners
+// authenticate with, RFC 7677. The password never travels: the client
+// proves it knows it and the server proves it knows the salted password
+const ScramMechanism = "SCRAM-SHA-256"
+
+// scramNonceSize is the number of random bytes in a nonce
+const scramNonceSize = 18
+
+// scramMaxIterations keeps a server from making its clients hash without
+// bound
+const scramMaxIterations = 10000000
+
+// ScramKeys is what the server keeps of a password: the salt and iterations
+// it was hashed with and the PBKDF2-SHA256 key, which SCRAM calls the
+// salted password
+type ScramKeys struct {
+	Salt           []byte
+	Iterations     int
+	SaltedPassword []byte
+}
+
+// ScramClient is the client side of an exchange, First, Final and Verify
+// are called in order
+type ScramClient struct {
+	user            string
+	password        string
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// ScramServer is the server side of an exchange, First and Final are
+// called in order
+type ScramServer struct {
+	keys            *ScramKeys
+	nonce           string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+}
+
+func scramNonce() (string, error) {
+	nonce := make([]byte, scramNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("Error generating nonce: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// scramKeys derives the client and server keys of a salted password
+func scramKeys(saltedPassword []byte) (clientKey []byte, storedKey []byte, serverKey []byte) {
+	clientKey = scramHMAC(saltedPassword, "Client Key")
+	stored := sha256.Sum256(clientKey)
+	return clientKey, stored[:], scramHMAC(saltedPassword, "Server Key")
+}
+
+// scramAttributes splits a message into its attributes by their letter,
+// the ones outside of known are refused like extensions
+func scramAttributes(message string, known string) (map[byte]string, error) {
+	attributes := make(map[byte]string)
+	for _, part := range strings.Split(message, ",") {
+		if len(part) < 2 || part[1] != '=' {
+			return nil, fmt.Errorf("Malformed SCRAM message %q", message)
+		}
+		if !strings.ContainsRune(known, rune(part[0])) {
+			return nil, fmt.Errorf("Unsupported SCRAM attribute %c", part[0])
+		}
+		attributes[part[0]] = part[2:]
+	}
+	return attributes, nil
+}
+
+// NewScramClient starts an exchange for the password of user
+func NewScramClient(user string, password string) (*ScramClient, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	return &ScramClient{user: user, password: password, nonce: nonce}, nil
+}
+
+// First is the client-first-message, without channel binding
+func (c *ScramClient) First() string {
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.user)
+	c.clientFirstBare = "n=" + user + ",r=" + c.nonce
+	return "n,," + c.clientFirstBare
+}
+
+// Final answers the server-first-message with the proof of the password
+func (c *ScramClient) Final(serverFirst string) (string, error) {
+	attributes, err := scramAttributes(serverFirst, "rsi")
+	if err != nil {
+		return "", err
+	}
+	nonce := attributes['r']
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return "", fmt.Errorf("Invalid SCRAM nonce from the server")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes['s'])
+	if err != nil || len(salt) == 0 {
+		return "", fmt.Errorf("Invalid SCRAM salt from the server")
+	}
+	iterations, err := strconv.Atoi(attributes['i'])
+	if err != nil || iterations < 1 || iterations > scramMaxIterations {
+		return "", fmt.Errorf("Invalid SCRAM iteration count from the server")
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(c.password), salt, iterations, sha256.Size, sha256.New)
+	clientKey, storedKey, serverKey := scramKeys(saltedPassword)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := scramHMAC(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	c.serverSignature = scramHMAC(serverKey, authMessage)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// Verify checks the server-final-message, only a server knowing the salted
+// password can sign it
+func (c *ScramClient) Verify(serverFinal string) error {
+	if message, ok := strings.CutPrefix(serverFinal, "e="); ok {
+		return fmt.Errorf("SCRAM authentication failed: %s", message)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(serverFinal, "v="))
+	if err != nil || !strings.HasPrefix(serverFinal, "v=") || c.serverSignature == nil ||
+		subtle.ConstantTimeCompare(signature, c.serverSignature) != 1 {
+		return fmt.Errorf("Invalid SCRAM signature from the server")
+	}
+	return nil
+}
+
+// NewScramServer starts an exchange checking a password against keys
+func NewScramServer(keys *ScramKeys) (*ScramServer, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+	return &ScramServer{keys: keys, nonce: nonce}, nil
+}
+
+// First reads the client-first-message and returns the server-first-message.
+// The user name of the message is ignored, the connection names its user
+func (s *ScramServer) First(clientFirst string) (string, error) {
+	// The gs2 header, channel binding is not offered so a client that
+	// requires it is refused
+	var bare string
+	switch {
+	case strings.HasPrefix(clientFirst, "n,,"), strings.HasPrefix(clientFirst, "y,,"):
+		s.gs2Header, bare = clientFirst[:3], clientFirst[3:]
+	default:
+		return "", fmt.Errorf("Unsupported SCRAM channel binding or authorization identity")
+	}
+	attributes, err := scramAttributes(bare, "nr")
+	if err != nil {
+		return "", err
+	}
+	if attributes['r'] == "" {
+		return "", fmt.Errorf("Missing SCRAM nonce")
+	}
+	s.clientFirstBare = bare
+	s.nonce = attributes['r'] + s.nonce
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(s.keys.Salt), s.keys.Iterations)
+	return s.serverFirst, nil
+}
+
+// Final checks the proof of the client-final-message and returns the
+// server-final-message, a wrong password fails
+func (s *ScramServer) Final(clientFinal string) (string, error) {
+	i := strings.LastIndex(clientFinal, ",p=")
+	if i < 0 {
+		return "", fmt.Errorf("Missing SCRAM proof")
+	}
+	withoutProof := clientFinal[:i]
+	attributes, err := scramAttributes(withoutProof, "cr")
+	if err != nil {
+		return "", err
+	}
+	if attributes['c'] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) {
+		return "", fmt.Errorf("Invalid SCRAM channel binding")
+	}
+	if attributes['r'] != s.nonce {
+		return "", fmt.Errorf("Invalid SCRAM nonce")
+	}
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return "", fmt.Errorf("Invalid SCRAM proof")
+	}
+
+	_, storedKey, serverKey := scramKeys(s.keys.SaltedPassword)
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	clientKey := scramHMAC(storedKey, authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= proof[i]
+	}
+	stored := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(stored[:], storedKey) != 1 {
+		return "", fmt.Errorf("Wrong SCRAM proof")
+	}
+	return "v=" + base64.StdEncoding.EncodeToString(scramHMAC(serverKey, authMessage)), nil
+}
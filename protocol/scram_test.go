@@ -0,0 +1,201 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"golang.org/x/crypto/pbkdf2"
+	"strings"
+	"testing"
+)
+
+// The exchange of RFC 7677, section 3
+const (
+	rfcClientNonce = "rOprNGfwEbeRWgbNEkqO"
+	rfcServerNonce = "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	rfcSalt        = "W22ZaJ0SNY7soEsUEjb6gQ=="
+	rfcClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfcServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfcClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfcServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func rfcKeys(t *testing.T, password string) *ScramKeys {
+	t.Helper()
+	salt, err := base64.StdEncoding.DecodeString(rfcSalt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ScramKeys{Salt: salt, Iterations: 4096, SaltedPassword: pbkdf2.Key([]byte(password), salt, 4096, sha256.Size, sha256.New)}
+}
+
+func TestScramClientRFC7677(t *testing.T) {
+	c := &ScramClient{user: "user", password: "pencil", nonce: rfcClientNonce}
+	if got := c.First(); got != rfcClientFirst {
+		t.Fatalf("First = %q, want %q", got, rfcClientFirst)
+	}
+	got, err := c.Final(rfcServerFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != rfcClientFinal {
+		t.Fatalf("Final = %q, want %q", got, rfcClientFinal)
+	}
+	if err = c.Verify(rfcServerFinal); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScramServerRFC7677(t *testing.T) {
+	s := &ScramServer{keys: rfcKeys(t, "pencil"), nonce: rfcServerNonce}
+	got, err := s.First(rfcClientFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != rfcServerFirst {
+		t.Fatalf("First = %q, want %q", got, rfcServerFirst)
+	}
+	got, err = s.Final(rfcClientFinal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != rfcServerFinal {
+		t.Fatalf("Final = %q, want %q", got, rfcServerFinal)
+	}
+}
+
+func TestScramServerRefuses(t *testing.T) {
+	tests := []struct {
+		name        string
+		keys        *ScramKeys
+		clientFirst string
+		clientFinal string
+		// fails is the step expected to fail
+		fails string
+	}{
+		{name: "wrong password", keys: rfcKeys(t, "pen"), clientFirst: rfcClientFirst, clientFinal: rfcClientFinal, fails: "final"},
+		{name: "channel binding required", clientFirst: "p=tls-server-end-point,,n=user,r=" + rfcClientNonce, fails: "first"},
+		{name: "authorization identity", clientFirst: "n,a=admin,n=user,r=" + rfcClientNonce, fails: "first"},
+		{name: "mandatory extension", clientFirst: "n,,m=ext,n=user,r=" + rfcClientNonce, fails: "first"},
+		{name: "missing nonce", clientFirst: "n,,n=user", fails: "first"},
+		{name: "garbage", clientFirst: "hello", fails: "first"},
+		{
+			name:        "other nonce",
+			clientFirst: rfcClientFirst,
+			clientFinal: strings.Replace(rfcClientFinal, "$k0", "$k1", 1),
+			fails:       "final",
+		},
+		{
+			name:        "other channel binding",
+			clientFirst: rfcClientFirst,
+			clientFinal: strings.Replace(rfcClientFinal, "c=biws", "c=eSws", 1),
+			fails:       "final",
+		},
+		{
+			name:        "missing proof",
+			clientFirst: rfcClientFirst,
+			clientFinal: "c=biws,r=" + rfcClientNonce + rfcServerNonce,
+			fails:       "final",
+		},
+		{
+			name:        "short proof",
+			clientFirst: rfcClientFirst,
+			clientFinal: "c=biws,r=" + rfcClientNonce + rfcServerNonce + ",p=AAAA",
+			fails:       "final",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := tt.keys
+			if keys == nil {
+				keys = rfcKeys(t, "pencil")
+			}
+			s := &ScramServer{keys: keys, nonce: rfcServerNonce}
+			_, err := s.First(tt.clientFirst)
+			if (err != nil) != (tt.fails == "first") {
+				t.Fatalf("First: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if _, err = s.Final(tt.clientFinal); err == nil {
+				t.Fatalf("Final accepted %q", tt.clientFinal)
+			}
+		})
+	}
+}
+
+func TestScramClientRefuses(t *testing.T) {
+	tests := []struct {
+		name        string
+		serverFirst string
+		serverFinal string
+		fails       string
+	}{
+		{name: "other nonce", serverFirst: "r=abc,s=" + rfcSalt + ",i=4096", fails: "final"},
+		{name: "nonce not extended", serverFirst: "r=" + rfcClientNonce + ",s=" + rfcSalt + ",i=4096", fails: "final"},
+		{name: "no iterations", serverFirst: "r=" + rfcClientNonce + "x,s=" + rfcSalt + ",i=0", fails: "final"},
+		{name: "too many iterations", serverFirst: "r=" + rfcClientNonce + "x,s=" + rfcSalt + ",i=100000000", fails: "final"},
+		{name: "bad salt", serverFirst: "r=" + rfcClientNonce + "x,s=!,i=4096", fails: "final"},
+		{name: "mandatory extension", serverFirst: "m=ext,r=" + rfcClientNonce + "x,s=" + rfcSalt + ",i=4096", fails: "final"},
+		{name: "server error", serverFirst: rfcServerFirst, serverFinal: "e=invalid-proof", fails: "verify"},
+		{name: "wrong signature", serverFirst: rfcServerFirst, serverFinal: "v=AAAA", fails: "verify"},
+		{name: "no signature", serverFirst: rfcServerFirst, serverFinal: "", fails: "verify"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ScramClient{user: "user", password: "pencil", nonce: rfcClientNonce}
+			c.First()
+			_, err := c.Final(tt.serverFirst)
+			if (err != nil) != (tt.fails == "final") {
+				t.Fatalf("Final: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if err = c.Verify(tt.serverFinal); err == nil {
+				t.Fatalf("Verify accepted %q", tt.serverFinal)
+			}
+		})
+	}
+}
+
+func TestScramExchange(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		ok       bool
+	}{
+		{name: "right password", password: "pencil", ok: true},
+		{name: "wrong password", password: "Pencil"},
+		{name: "empty password", password: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewScramClient("user", tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := NewScramServer(rfcKeys(t, "pencil"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverFirst, err := s.First(c.First())
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientFinal, err := c.Final(serverFirst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverFinal, err := s.Final(clientFinal)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Final: %v", err)
+			}
+			if err == nil {
+				if err = c.Verify(serverFinal); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
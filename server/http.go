@@ -0,0 +1,418 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/protocol"
+	"github.com/kimuraz/golang-json-db/sql"
+	"github.com/kimuraz/golang-json-db/table"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tableNameRe = regexp.MustCompile(`^\w+$`)
+
+// The HTTP API, every request runs in a transaction of its own on the
+// database named by the database query parameter, the default one without
+// it:
+//
+//	POST   /sql                      {"sql": "...", "params": [...]}
+//	GET    /tables/{name}?filter=... rows matching a WHERE expression
+//	GET    /tables/{name}/schema
+//	GET    /tables/{name}/docs/{id}
+//	POST   /tables/{name}/docs/{id}  inserts the document
+//	PUT    /tables/{name}/docs/{id}  replaces or inserts the document
+//	PATCH  /tables/{name}/docs/{id}  changes the given fields
+//	DELETE /tables/{name}/docs/{id}
+//
+// Errors come back as {"ok": false, "error": {"code": ..., "message": ...}}
+// with the SQLSTATE code of the PostgreSQL listener. Once the server has
+// users every request needs their name and password as basic auth
+type httpAPI struct {
+	messages  chan string
+	processes sql.ProcessList
+	// running counts the requests being answered, Shutdown waits for them
+	running *sync.WaitGroup
+	// credentials spares PBKDF2 to the basic auth of the requests after the
+	// first one
+	credentials *table.CredentialCache
+}
+
+// credentialTTL is how long the API trusts basic auth credentials it
+// verified
+const credentialTTL = time.Minute
+
+// userKey keeps the authenticated user in the context of a request
+type userKey struct{}
+
+type sqlRequest struct {
+	SQL    string        `json:"sql"`
+	Params []interface{} `json:"params"`
+}
+
+// StartHTTP serves the HTTP API on HTTPPort
+func (s *Server) StartHTTP() {
+	credentials, err := table.NewCredentialCache(credentialTTL)
+	if err != nil {
+		s.MessageChan <- fmt.Sprintf("Error serving the HTTP API: %s", err.Error())
+		return
+	}
+	api := &httpAPI{messages: s.MessageChan, processes: s.registry, running: &s.httpRequests, credentials: credentials}
+	portStr := strconv.Itoa(s.HTTPPort)
+	httpServer := &http.Server{Addr: ":" + portStr, Handler: api.handler()}
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return
+	}
+	s.httpServer = httpServer
+	s.mu.Unlock()
+	s.MessageChan <- fmt.Sprintf("Starting HTTP API on port %s...", portStr)
+	err = httpServer.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		s.MessageChan <- fmt.Sprintf("Error serving the HTTP API: %s", err.Error())
+	}
+}
+
+// handler routes the requests of the API
+func (api *httpAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /sql", api.sql)
+	mux.HandleFunc("GET /tables/{name}", api.selectRows)
+	mux.HandleFunc("GET /tables/{name}/schema", api.schema)
+	mux.HandleFunc("GET /tables/{name}/docs/{id}", api.getDoc)
+	mux.HandleFunc("POST /tables/{name}/docs/{id}", api.insertDoc)
+	mux.HandleFunc("PUT /tables/{name}/docs/{id}", api.replaceDoc)
+	mux.HandleFunc("PATCH /tables/{name}/docs/{id}", api.updateDoc)
+	mux.HandleFunc("DELETE /tables/{name}/docs/{id}", api.deleteDoc)
+	return api.logged(mux)
+}
+
+func (api *httpAPI) logged(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.running.Add(1)
+		defer api.running.Done()
+		api.messages <- fmt.Sprintf("[%s]: %s %s", r.RemoteAddr, r.Method, r.URL.RequestURI())
+		r.Body = http.MaxBytesReader(w, r.Body, protocol.MaxPayloadSize)
+		hasUsers, err := table.HasUsers()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if hasUsers {
+			user, password, _ := r.BasicAuth()
+			if err = api.credentials.Authenticate(user, password); err != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="gjdb"`)
+				writeError(w, err)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (api *httpAPI) sql(w http.ResponseWriter, r *http.Request) {
+	var request sqlRequest
+	err := decodeBody(r, &request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	args := make([]interface{}, len(request.Params))
+	for i, param := range request.Params {
+		args[i] = jsonArg(param)
+	}
+	api.run(w, r, func(session *sql.Session) (map[string]interface{}, error) {
+		p, err := session.Prepare("", request.SQL)
+		if err != nil {
+			return nil, err
+		}
+		return session.ExecutePreparedContext(r.Context(), p, args)
+	})
+}
+
+func (api *httpAPI) selectRows(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !tableNameRe.MatchString(name) {
+		writeError(w, &pgError{code: "42602", message: fmt.Sprintf("Invalid table name %s", name)})
+		return
+	}
+	query, err := sql.FilterQuery(name, r.URL.Query().Get("filter"))
+	if err != nil {
+		writeError(w, &pgError{code: "42601", message: err.Error()})
+		return
+	}
+	api.run(w, r, func(session *sql.Session) (map[string]interface{}, error) {
+		return session.ExecuteContext(r.Context(), query)
+	})
+}
+
+// run calls fn with a session of its own and answers with its response,
+// rows are sent as JSON instead of a string of it
+func (api *httpAPI) run(w http.ResponseWriter, r *http.Request, fn func(session *sql.Session) (map[string]interface{}, error)) {
+	session := sql.NewSession()
+	session.SetProcessList(api.processes)
+	defer session.Close()
+	if user, ok := r.Context().Value(userKey{}).(string); ok {
+		session.SetUser(user)
+	}
+	if database := r.URL.Query().Get("database"); database != "" {
+		if err := session.Use(database); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	response, err := fn(session)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if result, ok := response["result"].(string); ok {
+		response["result"] = json.RawMessage(result)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (api *httpAPI) schema(w http.ResponseWriter, r *http.Request) {
+	api.withTable(w, r, func(t *table.Table) (int, interface{}, error) {
+		columns, err := t.Columns()
+		if err != nil {
+			return 0, nil, err
+		}
+		versions := t.SchemaVersions()
+		return http.StatusOK, map[string]interface{}{
+			"ok":      true,
+			"table":   r.PathValue("name"),
+			"version": t.Version(),
+			"schema":  versions[len(versions)-1].Schema,
+			"columns": columns,
+		}, nil
+	})
+}
+
+func (api *httpAPI) getDoc(w http.ResponseWriter, r *http.Request) {
+	api.withTable(w, r, func(t *table.Table) (int, interface{}, error) {
+		doc, err := t.GetById(r.PathValue("id"))
+		return http.StatusOK, doc, err
+	})
+}
+
+func (api *httpAPI) insertDoc(w http.ResponseWriter, r *http.Request) {
+	api.withDoc(w, r, func(t *table.Table, id string, doc map[string]interface{}) (int, error) {
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return 0, err
+		}
+		return http.StatusCreated, t.Insert(string(data))
+	})
+}
+
+// replaceDoc clears the columns missing from the document, or inserts it
+// when the id is new
+func (api *httpAPI) replaceDoc(w http.ResponseWriter, r *http.Request) {
+	api.withDoc(w, r, func(t *table.Table, id string, doc map[string]interface{}) (int, error) {
+		_, err := t.GetById(id)
+		if errors.Is(err, table.ErrNotFound) {
+			data, err := json.Marshal(doc)
+			if err != nil {
+				return 0, err
+			}
+			return http.StatusCreated, t.Insert(string(data))
+		}
+		if err != nil {
+			return 0, err
+		}
+		columns, err := t.GetColumnNames()
+		if err != nil {
+			return 0, err
+		}
+		for _, column := range columns {
+			if _, ok := doc[column]; !ok {
+				doc[column] = nil
+			}
+		}
+		return http.StatusOK, t.Update(id, doc)
+	})
+}
+
+func (api *httpAPI) updateDoc(w http.ResponseWriter, r *http.Request) {
+	api.withDoc(w, r, func(t *table.Table, id string, doc map[string]interface{}) (int, error) {
+		return http.StatusOK, t.Update(id, doc)
+	})
+}
+
+func (api *httpAPI) deleteDoc(w http.ResponseWriter, r *http.Request) {
+	api.withTable(w, r, func(t *table.Table) (int, interface{}, error) {
+		return http.StatusNoContent, nil, t.Delete(r.PathValue("id"))
+	})
+}
+
+// withDoc reads the document of the body, typing its id as the column, and
+// answers with the document as stored
+func (api *httpAPI) withDoc(w http.ResponseWriter, r *http.Request, fn func(t *table.Table, id string, doc map[string]interface{}) (int, error)) {
+	var doc map[string]interface{}
+	err := decodeBody(r, &doc)
+	if err == nil && doc == nil {
+		err = &pgError{code: "22P02", message: "Expected a JSON object"}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	api.withTable(w, r, func(t *table.Table) (int, interface{}, error) {
+		id := r.PathValue("id")
+		idType, err := t.GetIdType()
+		if err != nil {
+			return 0, nil, err
+		}
+		var typedId interface{} = id
+		if idType == "integer" {
+			typedId, err = strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				return 0, nil, &pgError{code: "22P02", message: fmt.Sprintf("Id %s is not an integer", id)}
+			}
+		}
+		if bodyId, ok := doc["id"]; ok && fmt.Sprintf("%v", jsonArg(bodyId)) != id {
+			return 0, nil, &pgError{code: "22023", message: fmt.Sprintf("Document id %v does not match %s", bodyId, id)}
+		}
+		doc["id"] = typedId
+		status, err := fn(t, id, doc)
+		if err != nil {
+			return 0, nil, err
+		}
+		stored, err := t.GetById(id)
+		return status, stored, err
+	})
+}
+
+// withTable runs fn in a transaction on the table of the path, committed
+// when fn succeeds. It stops with the request or at the statement timeout
+func (api *httpAPI) withTable(w http.ResponseWriter, r *http.Request, fn func(t *table.Table) (int, interface{}, error)) {
+	name := r.PathValue("name")
+	if !tableNameRe.MatchString(name) {
+		writeError(w, &pgError{code: "42602", message: fmt.Sprintf("Invalid table name %s", name)})
+		return
+	}
+	db := table.DefaultDatabase()
+	if database := r.URL.Query().Get("database"); database != "" {
+		var err error
+		db, err = table.OpenDatabase(database)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx := r.Context()
+	if timeout := sql.StatementTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	tx.SetContext(ctx)
+	t, err := tx.Table(name)
+	if err != nil {
+		tx.Rollback()
+		writeError(w, err)
+		return
+	}
+	status, body, err := fn(t)
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, status, body)
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	err := decoder.Decode(v)
+	if err != nil {
+		return &pgError{code: "22P02", message: fmt.Sprintf("Invalid JSON body: %s", err)}
+	}
+	return nil
+}
+
+// jsonArg turns a decoded JSON value into an argument of a prepared
+// statement, objects and arrays are bound as their JSON text
+func jsonArg(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if integer, err := v.Int64(); err == nil {
+			return integer
+		}
+		float, _ := v.Float64()
+		return float
+	case map[string]interface{}, []interface{}:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	return value
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	var buffer bytes.Buffer
+	err := json.NewEncoder(&buffer).Encode(body)
+	if err != nil {
+		writeError(w, fmt.Errorf("Error encoding response: %s", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buffer.Bytes())
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	body := map[string]interface{}{
+		"ok":    false,
+		"error": &protocol.Error{Code: sqlState(err), Message: err.Error()},
+	}
+	data, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(err))
+	w.Write(append(data, '\n'))
+}
+
+// httpStatus picks the status of an error from its SQLSTATE code
+func httpStatus(err error) int {
+	state := sqlState(err)
+	switch {
+	case state == "28P01":
+		return http.StatusUnauthorized
+	case state == "42501":
+		return http.StatusForbidden
+	case state == "42P01", state == "3D000", state == "P0002":
+		return http.StatusNotFound
+	case strings.HasPrefix(state, "23"), state == "40001", state == "40P01", state == "55P03", state == "42P07", state == "42P04":
+		return http.StatusConflict
+	case state == "22023":
+		return http.StatusUnprocessableEntity
+	case state == "57014":
+		return http.StatusServiceUnavailable
+	case state == "XX000" && strings.HasPrefix(err.Error(), "Error "):
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
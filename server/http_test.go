@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/kimuraz/golang-json-db/sql"
+	"github.com/kimuraz/golang-json-db/table"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+	messages := make(chan string)
+	go func() {
+		for range messages {
+		}
+	}()
+	credentials, err := table.NewCredentialCache(credentialTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &httpAPI{messages: messages, processes: newRegistry(), running: &sync.WaitGroup{}, credentials: credentials}
+	server := httptest.NewServer(api.handler())
+	t.Cleanup(func() {
+		server.Close()
+		close(messages)
+	})
+	return server
+}
+
+func mustExec(t *testing.T, s *sql.Session, statements ...string) {
+	t.Helper()
+	for _, statement := range statements {
+		if _, err := s.Execute(statement); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+}
+
+// request sends a request and decodes the JSON answer
+func request(t *testing.T, method string, url string, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	var decoded map[string]interface{}
+	json.Unmarshal(data, &decoded)
+	return resp.StatusCode, decoded
+}
+
+func TestHTTPFilter(t *testing.T) {
+	server := newTestAPI(t)
+	mustExec(t, sql.NewSession(),
+		"CREATE TABLE filtered (id INT PRIMARY KEY, n INT)",
+		"INSERT INTO filtered (id, n) VALUES (1, 1)",
+		"INSERT INTO filtered (id, n) VALUES (2, 2)",
+		"INSERT INTO filtered (id, n) VALUES (3, 3)",
+		"CREATE TABLE hidden (id INT PRIMARY KEY, secret TEXT)",
+		"INSERT INTO hidden (id, secret) VALUES (1, 'password')",
+	)
+	tests := []struct {
+		filter string
+		status int
+		rows   int
+	}{
+		{"", http.StatusOK, 3},
+		{"n > 1", http.StatusOK, 2},
+		{"n > 1 AND (n = 2 OR id = 1)", http.StatusOK, 1},
+		{"n BETWEEN 1 AND 2", http.StatusOK, 2},
+		{"n > 1 UNION SELECT * FROM hidden", http.StatusBadRequest, 0},
+		{"n > 1 LIMIT 1", http.StatusBadRequest, 0},
+		{"n > 1 ORDER BY n", http.StatusBadRequest, 0},
+		{"n > 1 GROUP BY n", http.StatusBadRequest, 0},
+		{"n > 1 FOR UPDATE", http.StatusBadRequest, 0},
+		{"id IN (SELECT id FROM hidden)", http.StatusBadRequest, 0},
+		{"n > 1; DROP TABLE hidden", http.StatusBadRequest, 0},
+		{"n > 1 OR NOT (n = 1)", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			status, body := request(t, "GET", server.URL+"/tables/filtered?filter="+url.QueryEscape(tt.filter), "")
+			if status != tt.status {
+				t.Fatalf("status %d, want %d: %v", status, tt.status, body)
+			}
+			rows, _ := body["result"].([]interface{})
+			if len(rows) != tt.rows {
+				t.Errorf("got %d rows, want %d", len(rows), tt.rows)
+			}
+		})
+	}
+	if status, _ := request(t, "GET", server.URL+"/tables/hidden", ""); status != http.StatusOK {
+		t.Errorf("hidden is gone, status %d", status)
+	}
+}
+
+func TestHTTPDocumentTimeout(t *testing.T) {
+	server := newTestAPI(t)
+	owner := sql.NewSession()
+	mustExec(t, owner,
+		"CREATE TABLE doc_timeout (id INT PRIMARY KEY, n INT)",
+		"INSERT INTO doc_timeout (id, n) VALUES (1, 0)",
+		"BEGIN",
+		"UPDATE doc_timeout SET n = 1 WHERE id = 1",
+	)
+	defer owner.Close()
+	sql.SetStatementTimeout(100 * time.Millisecond)
+	defer sql.SetStatementTimeout(0)
+
+	start := time.Now()
+	status, body := request(t, "PATCH", server.URL+"/tables/doc_timeout/docs/1", `{"n": 2}`)
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d: %v", status, http.StatusServiceUnavailable, body)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %s, the statement timeout is 100ms", elapsed)
+	}
+}
+
+// TestHTTPReplaceDoc inserts a document with a new id and replaces it,
+// clearing the columns the new document leaves out
+func TestHTTPReplaceDoc(t *testing.T) {
+	server := newTestAPI(t)
+	mustExec(t, sql.NewSession(), "CREATE TABLE replaced (id INT PRIMARY KEY, n INT, s TEXT)")
+	tests := []struct {
+		body   string
+		status int
+		// want is the document read back
+		want map[string]interface{}
+	}{
+		{body: `{"n": 1, "s": "a"}`, status: http.StatusCreated, want: map[string]interface{}{"id": float64(1), "n": float64(1), "s": "a"}},
+		{body: `{"n": 2}`, status: http.StatusOK, want: map[string]interface{}{"id": float64(1), "n": float64(2)}},
+	}
+	for _, tt := range tests {
+		status, body := request(t, "PUT", server.URL+"/tables/replaced/docs/1", tt.body)
+		if status != tt.status {
+			t.Fatalf("PUT %s: status %d, want %d: %v", tt.body, status, tt.status, body)
+		}
+		_, body = request(t, "GET", server.URL+"/tables/replaced/docs/1", "")
+		if !reflect.DeepEqual(body, tt.want) {
+			t.Errorf("PUT %s: got %v, want %v", tt.body, body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package server
+
+import (
+	"github.com/kimuraz/golang-json-db/internal/testutil"
+	"github.com/kimuraz/golang-json-db/table"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	testutil.Main(m, table.SetDataDir)
+}
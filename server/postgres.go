@@ -0,0 +1,1028 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/protocol"
+	"github.com/kimuraz/golang-json-db/sql"
+	"github.com/kimuraz/golang-json-db/table"
+	"github.com/xwb1989/sqlparser"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The PostgreSQL v3 protocol, enough of it for psql and drivers like pgx:
+// startup with SCRAM-SHA-256 once the server has users, simple queries and the extended protocol
+// with parse, bind, describe and execute. Statements run on a sql.Session
+// like the ones of the framed protocol
+
+const (
+	pgProtocolVersion = 196608
+	pgCancelRequest   = 80877102
+	pgSSLRequest      = 80877103
+	pgGSSRequest      = 80877104
+)
+
+// errCancelRequest ends the startup of a connection that only carried a
+// cancel request
+var errCancelRequest = errors.New("Cancel request")
+
+type pgConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	session *sql.Session
+	// process is the registry entry of the connection, its id and secret
+	// are the key of cancel requests
+	process    *entry
+	registry   *registry
+	statements map[string]*pgStatement
+	portals    map[string]*pgPortal
+	// skip drops extended query messages after an error, until Sync
+	skip bool
+}
+
+// pgStatement is a statement prepared in the session, paramTypes has the
+// OID of each placeholder
+type pgStatement struct {
+	prepared   *sql.Prepared
+	paramTypes []uint32
+}
+
+// pgPortal is a statement with its parameters bound. A SELECT read by
+// Execute calls that ask for a limited number of rows keeps its scan in a
+// cursor of the session between them, other statements keep their rows
+type pgPortal struct {
+	name      string
+	statement *pgStatement
+	args      []interface{}
+	formats   []int16
+	result    *pgResult
+	sent      int
+	cursor    bool
+}
+
+// pgRowWriter sends the rows of a statement as DataRow messages as they are
+// read
+type pgRowWriter struct {
+	c       *pgConn
+	formats []int16
+	// columns are the ones described for a portal, the RowDescription of a
+	// simple query is sent with the rows
+	columns  []table.Column
+	describe bool
+	streamed bool
+	count    int
+}
+
+func (w *pgRowWriter) Columns(columns []table.Column) error {
+	w.streamed = true
+	if w.columns == nil {
+		w.columns = columns
+		if w.columns == nil {
+			w.columns = []table.Column{}
+		}
+	}
+	if w.describe {
+		w.c.rowDescription(w.columns, w.formats)
+		w.describe = false
+	}
+	return nil
+}
+
+func (w *pgRowWriter) Row(row map[string]interface{}) error {
+	// Numbers are encoded from their JSON text, as the rows of a result
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var decoded map[string]interface{}
+	if err = decoder.Decode(&decoded); err != nil {
+		return fmt.Errorf("Error decoding rows: %s", err)
+	}
+	w.count++
+	return w.c.dataRows(w.columns, w.formats, []map[string]interface{}{decoded})
+}
+
+type pgResult struct {
+	columns []table.Column
+	rows    []map[string]interface{}
+	tag     string
+}
+
+// pgError is an error with the SQLSTATE code sent to the client
+type pgError struct {
+	code    string
+	message string
+}
+
+func (e *pgError) Error() string {
+	return e.message
+}
+
+// StartPostgres accepts PostgreSQL clients on PostgresPort
+func (s *Server) StartPostgres() {
+	portStr := strconv.Itoa(s.PostgresPort)
+	ln, err := net.Listen("tcp", ":"+portStr)
+	if err != nil {
+		s.MessageChan <- fmt.Sprintf("Error starting the PostgreSQL listener: %s", err.Error())
+		return
+	}
+	if !s.listen(ln) {
+		return
+	}
+	s.MessageChan <- fmt.Sprintf("Starting PostgreSQL listener on port %s...", portStr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.stopped() {
+				return
+			}
+			s.MessageChan <- "Error accepting connection: " + err.Error()
+			continue
+		}
+		session := sql.NewSession()
+		e, ok := s.registry.add(conn, "postgres", session)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.registry.remove(e)
+			servePostgres(conn, e, s.registry, s.MessageChan)
+		}()
+	}
+}
+
+// servePostgres speaks to a PostgreSQL client until it disconnects, or
+// answers a cancel request for another connection
+func servePostgres(conn net.Conn, process *entry, registry *registry, messages chan string) {
+	c := &pgConn{
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		writer:     bufio.NewWriter(conn),
+		session:    process.session,
+		process:    process,
+		registry:   registry,
+		statements: make(map[string]*pgStatement),
+		portals:    make(map[string]*pgPortal),
+	}
+	defer conn.Close()
+	// An unfinished transaction is rolled back with the connection
+	defer c.session.Close()
+
+	messages <- "New PostgreSQL connection from: " + conn.RemoteAddr().String()
+	err := c.startup()
+	if err == errCancelRequest {
+		return
+	}
+	if err != nil {
+		messages <- fmt.Sprintf("PostgreSQL startup of %s failed: %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+	for {
+		kind, body, err := c.readMessage()
+		if err != nil {
+			if err == io.EOF {
+				messages <- fmt.Sprintf("Client %s disconnected", conn.RemoteAddr().String())
+				return
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				messages <- fmt.Sprintf("Closing connection of %s for shutdown", conn.RemoteAddr().String())
+				c.sendError(&pgError{code: "57P01", message: "The server is shutting down"}, "FATAL")
+				c.writer.Flush()
+				return
+			}
+			messages <- fmt.Sprintf("Error reading from client: %s", err.Error())
+			return
+		}
+		if kind == 'X' {
+			messages <- fmt.Sprintf("Client %s disconnected", conn.RemoteAddr().String())
+			return
+		}
+		if kind == 'Q' {
+			query := strings.TrimRight(string(body), "\x00")
+			messages <- fmt.Sprintf("[%s]: %s", conn.RemoteAddr(), sql.RedactPasswords(query))
+			c.simpleQuery(query)
+		} else {
+			c.extendedQuery(kind, body, messages)
+		}
+		if err = c.writer.Flush(); err != nil {
+			messages <- fmt.Sprintf("Error writing to client: %s", err.Error())
+			return
+		}
+	}
+}
+
+func (c *pgConn) startup() error {
+	for {
+		header := make([]byte, 4)
+		_, err := io.ReadFull(c.reader, header)
+		if err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(header)
+		if length < 8 || length > 10000 {
+			return fmt.Errorf("Invalid startup message length %d", length)
+		}
+		body := make([]byte, length-4)
+		_, err = io.ReadFull(c.reader, body)
+		if err != nil {
+			return err
+		}
+
+		code := binary.BigEndian.Uint32(body[:4])
+		switch code {
+		case pgSSLRequest, pgGSSRequest:
+			// Encryption is not supported, the client goes on in the clear
+			c.conn.Write([]byte{'N'})
+			continue
+		case pgCancelRequest:
+			// Sent on a connection of its own, which is closed without an
+			// answer
+			if len(body) == 12 {
+				id := int(binary.BigEndian.Uint32(body[4:8]))
+				secret := int32(binary.BigEndian.Uint32(body[8:12]))
+				c.registry.cancelRequest(id, secret)
+			}
+			return errCancelRequest
+		case pgProtocolVersion:
+		default:
+			err = fmt.Errorf("Unsupported frontend protocol %d.%d, the server speaks 3.0", code>>16, code&0xffff)
+			c.sendError(&pgError{code: "0A000", message: err.Error()}, "FATAL")
+			c.writer.Flush()
+			return err
+		}
+
+		r := &pgReader{data: body[4:]}
+		params := make(map[string]string)
+		for {
+			key := r.string()
+			if key == "" || r.err != nil {
+				break
+			}
+			params[key] = r.string()
+		}
+		if err = c.authenticate(params["user"]); err != nil {
+			return err
+		}
+		if database := params["database"]; database != "" && database != table.DefaultDatabaseName {
+			if err = c.session.Use(database); err != nil {
+				c.sendError(&pgError{code: "3D000", message: err.Error()}, "FATAL")
+				c.writer.Flush()
+				return err
+			}
+		}
+
+		auth := &pgBuffer{}
+		auth.int32(0)
+		c.send('R', auth)
+		for _, status := range [][2]string{
+			{"server_version", "14.0"},
+			{"server_encoding", "UTF8"},
+			{"client_encoding", "UTF8"},
+			{"DateStyle", "ISO, MDY"},
+			{"TimeZone", "UTC"},
+			{"integer_datetimes", "on"},
+			{"standard_conforming_strings", "on"},
+			{"application_name", params["application_name"]},
+		} {
+			b := &pgBuffer{}
+			b.string(status[0])
+			b.string(status[1])
+			c.send('S', b)
+		}
+		key := &pgBuffer{}
+		key.int32(c.process.id)
+		key.int32(int(c.process.secret))
+		c.send('K', key)
+		c.readyForQuery()
+		return c.writer.Flush()
+	}
+}
+
+// authenticate runs a SCRAM-SHA-256 exchange once the server has users, the
+// password never travels and the connection ends when it does not match
+func (c *pgConn) authenticate(user string) error {
+	keys, err := scramKeys(user)
+	if err != nil || keys == nil {
+		return err
+	}
+	scram, err := protocol.NewScramServer(keys)
+	if err != nil {
+		return err
+	}
+
+	// AuthenticationSASL lists the mechanisms, the client picks one and
+	// sends its first message along
+	request := &pgBuffer{}
+	request.int32(10)
+	request.string(protocol.ScramMechanism)
+	request.bytes([]byte{0})
+	body, err := c.saslMessage(request)
+	if err != nil {
+		return err
+	}
+	r := &pgReader{data: body}
+	mechanism := r.string()
+	clientFirst := r.next(int(r.int32()))
+	if r.err != nil || mechanism != protocol.ScramMechanism {
+		return c.authFailed(&pgError{code: "28000", message: fmt.Sprintf("Unsupported SASL mechanism %s", mechanism)})
+	}
+	serverFirst, err := scram.First(string(clientFirst))
+	if err != nil {
+		return c.authFailed(&pgError{code: "08P01", message: err.Error()})
+	}
+
+	request = &pgBuffer{}
+	request.int32(11)
+	request.bytes([]byte(serverFirst))
+	body, err = c.saslMessage(request)
+	if err != nil {
+		return err
+	}
+	serverFinal, err := scram.Final(string(body))
+	if err != nil {
+		return c.authFailed(&table.AuthError{User: user})
+	}
+
+	final := &pgBuffer{}
+	final.int32(12)
+	final.bytes([]byte(serverFinal))
+	c.send('R', final)
+	c.session.SetUser(user)
+	return nil
+}
+
+// saslMessage sends an authentication request and reads the SASL message
+// answering it
+func (c *pgConn) saslMessage(request *pgBuffer) ([]byte, error) {
+	c.send('R', request)
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	kind, body, err := c.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	if kind != 'p' {
+		return nil, c.authFailed(&pgError{code: "08P01", message: fmt.Sprintf("Expected a SASL message, got %q", kind)})
+	}
+	return body, nil
+}
+
+// authFailed ends the startup of a connection with err
+func (c *pgConn) authFailed(err error) error {
+	c.sendError(err, "FATAL")
+	c.writer.Flush()
+	return err
+}
+
+func (c *pgConn) readMessage() (byte, []byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(c.reader, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < 4 || length > protocol.MaxPayloadSize {
+		return 0, nil, fmt.Errorf("Invalid message length %d", length)
+	}
+	body := make([]byte, length-4)
+	_, err = io.ReadFull(c.reader, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// simpleQuery runs every statement of the query, stopping at the first
+// error
+func (c *pgConn) simpleQuery(query string) {
+	defer c.readyForQuery()
+	statements, err := sqlparser.SplitStatementToPieces(query)
+	if err != nil {
+		statements = []string{query}
+	}
+	empty := true
+	for _, statement := range statements {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+		empty = false
+		result, err := c.execute(statement, &pgRowWriter{c: c, describe: true})
+		if err != nil {
+			c.sendError(err, "ERROR")
+			return
+		}
+		if result.columns != nil {
+			c.rowDescription(result.columns, nil)
+		}
+		err = c.dataRows(result.columns, nil, result.rows)
+		if err != nil {
+			c.sendError(err, "ERROR")
+			return
+		}
+		c.commandComplete(result.tag)
+	}
+	// Only semicolons, lib/pq pings with one
+	if empty {
+		c.send('I', &pgBuffer{})
+	}
+}
+
+func (c *pgConn) extendedQuery(kind byte, body []byte, messages chan string) {
+	if kind == 'S' {
+		c.skip = false
+		// Portals end with the transaction they were bound in
+		if !c.session.InTransaction() {
+			for name := range c.portals {
+				c.closePortal(name)
+			}
+		}
+		c.readyForQuery()
+		return
+	}
+	if kind == 'H' {
+		return
+	}
+	if c.skip {
+		return
+	}
+	r := &pgReader{data: body}
+	var err error
+	switch kind {
+	case 'P':
+		err = c.parse(r, messages)
+	case 'B':
+		err = c.bind(r)
+	case 'D':
+		err = c.describe(r)
+	case 'E':
+		err = c.executePortal(r)
+	case 'C':
+		kind, name := r.byte(), r.string()
+		if kind == 'S' {
+			if _, ok := c.statements[name]; ok {
+				c.session.Deallocate(name)
+			}
+			delete(c.statements, name)
+		} else {
+			c.closePortal(name)
+		}
+		c.send('3', &pgBuffer{})
+	default:
+		err = &pgError{code: "08P01", message: fmt.Sprintf("Unsupported message type %q", kind)}
+	}
+	if err == nil && r.err != nil {
+		err = &pgError{code: "08P01", message: r.err.Error()}
+	}
+	if err != nil {
+		c.sendError(err, "ERROR")
+		c.skip = true
+	}
+}
+
+func (c *pgConn) parse(r *pgReader, messages chan string) error {
+	name, query := r.string(), r.string()
+	declared := make([]uint32, r.count())
+	for i := range declared {
+		declared[i] = uint32(r.int32())
+	}
+	if r.err != nil {
+		return nil
+	}
+	messages <- fmt.Sprintf("[%s]: %s", c.conn.RemoteAddr(), sql.RedactPasswords(query))
+
+	// The unnamed statement is replaced, named ones live until closed
+	prepared, err := c.session.Prepare(name, query)
+	if err != nil {
+		return err
+	}
+	description := prepared.Description
+	count := len(description.Parameters)
+	if len(declared) > count {
+		count = len(declared)
+	}
+	statement := &pgStatement{prepared: prepared, paramTypes: make([]uint32, count)}
+	for i := range statement.paramTypes {
+		switch {
+		case i < len(declared) && declared[i] != 0:
+			statement.paramTypes[i] = declared[i]
+		case i < len(description.Parameters):
+			statement.paramTypes[i] = typeOID(description.Parameters[i])
+		default:
+			statement.paramTypes[i] = oidText
+		}
+	}
+	c.statements[name] = statement
+	c.send('1', &pgBuffer{})
+	return nil
+}
+
+func (c *pgConn) bind(r *pgReader) error {
+	portalName, statementName := r.string(), r.string()
+	paramFormats := make([]int16, r.count())
+	for i := range paramFormats {
+		paramFormats[i] = r.int16()
+	}
+	values := make([][]byte, r.count())
+	for i := range values {
+		length := r.int32()
+		if length >= 0 {
+			values[i] = r.next(int(length))
+		}
+	}
+	resultFormats := make([]int16, r.count())
+	for i := range resultFormats {
+		resultFormats[i] = r.int16()
+	}
+	if r.err != nil {
+		return nil
+	}
+
+	statement, ok := c.statements[statementName]
+	if !ok {
+		return &pgError{code: "26000", message: fmt.Sprintf("Prepared statement %s does not exist", statementName)}
+	}
+	if len(values) != len(statement.paramTypes) {
+		return &pgError{code: "08P01", message: fmt.Sprintf("Statement has %d parameters, got %d", len(statement.paramTypes), len(values))}
+	}
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		var err error
+		args[i], err = decodeParameter(statement.paramTypes[i], format(paramFormats, i) == 1, value)
+		if err != nil {
+			return &pgError{code: "22P02", message: fmt.Sprintf("Invalid value for parameter $%d: %s", i+1, err)}
+		}
+	}
+	c.closePortal(portalName)
+	c.portals[portalName] = &pgPortal{name: portalName, statement: statement, args: args, formats: resultFormats}
+	c.send('2', &pgBuffer{})
+	return nil
+}
+
+func (c *pgConn) describe(r *pgReader) error {
+	kind, name := r.byte(), r.string()
+	if r.err != nil {
+		return nil
+	}
+	if kind == 'S' {
+		statement, ok := c.statements[name]
+		if !ok {
+			return &pgError{code: "26000", message: fmt.Sprintf("Prepared statement %s does not exist", name)}
+		}
+		params := &pgBuffer{}
+		params.int16(len(statement.paramTypes))
+		for _, oid := range statement.paramTypes {
+			params.int32(int(oid))
+		}
+		c.send('t', params)
+		c.rowDescription(statement.prepared.Description.Columns, nil)
+		return nil
+	}
+	portal, ok := c.portals[name]
+	if !ok {
+		return &pgError{code: "34000", message: fmt.Sprintf("Portal %s does not exist", name)}
+	}
+	c.rowDescription(portal.statement.prepared.Description.Columns, portal.formats)
+	return nil
+}
+
+// executePortal runs the statement of the portal on its first Execute and
+// sends up to maxRows of its rows as they are read, the rest wait for the
+// next Execute
+func (c *pgConn) executePortal(r *pgReader) error {
+	name, maxRows := r.string(), int(r.int32())
+	if r.err != nil {
+		return nil
+	}
+	portal, ok := c.portals[name]
+	if !ok {
+		return &pgError{code: "34000", message: fmt.Sprintf("Portal %s does not exist", name)}
+	}
+	prepared := portal.statement.prepared
+	if strings.TrimSpace(prepared.SQL) == "" {
+		c.send('I', &pgBuffer{})
+		return nil
+	}
+	// Rows go out as described
+	w := &pgRowWriter{c: c, formats: portal.formats, columns: prepared.Description.Columns}
+	if portal.result == nil && maxRows > 0 && prepared.IsSelect() {
+		err := c.session.DeclarePrepared(context.Background(), portalCursor(name), prepared, portal.args)
+		if err != nil {
+			return err
+		}
+		portal.cursor = true
+		portal.result = &pgResult{}
+	}
+	if portal.cursor {
+		n, err := c.session.FetchRows(context.Background(), portalCursor(name), maxRows, w)
+		if err != nil {
+			return err
+		}
+		portal.sent += n
+		if n == maxRows {
+			c.send('s', &pgBuffer{})
+			return nil
+		}
+		// The portal stays until it is closed, later Execute calls find no
+		// rows
+		portal.cursor = false
+		portal.result = &pgResult{tag: fmt.Sprintf("SELECT %d", portal.sent)}
+		portal.sent = 0
+		c.session.CloseCursor(portalCursor(name))
+		c.commandComplete(portal.result.tag)
+		return nil
+	}
+	if portal.result == nil {
+		response, err := c.session.ExecutePreparedRows(context.Background(), prepared, portal.args, w)
+		if err != nil {
+			return err
+		}
+		result, err := c.result(prepared.SQL, response)
+		if err != nil {
+			return err
+		}
+		if w.streamed {
+			// The rows were sent as they were read
+			result.tag = rowsTag(result.tag, w.count)
+			portal.result = result
+			c.commandComplete(result.tag)
+			return nil
+		}
+		portal.result = result
+	}
+	columns := w.columns
+	if columns == nil {
+		columns = portal.result.columns
+	}
+	rows := portal.result.rows[portal.sent:]
+	if maxRows > 0 && maxRows < len(rows) {
+		rows = rows[:maxRows]
+	}
+	err := c.dataRows(columns, portal.formats, rows)
+	if err != nil {
+		return err
+	}
+	portal.sent += len(rows)
+	if portal.sent < len(portal.result.rows) {
+		c.send('s', &pgBuffer{})
+		return nil
+	}
+	c.commandComplete(portal.result.tag)
+	return nil
+}
+
+// portalCursor names the cursor of a portal in the session, FETCH cannot
+// name it
+func portalCursor(name string) string {
+	return "portal " + name
+}
+
+// closePortal forgets a portal and closes its cursor
+func (c *pgConn) closePortal(name string) {
+	if portal, ok := c.portals[name]; ok && portal.cursor {
+		c.session.CloseCursor(portalCursor(name))
+	}
+	delete(c.portals, name)
+}
+
+// execute runs a statement, its rows go to w as they are read
+func (c *pgConn) execute(query string, w *pgRowWriter) (*pgResult, error) {
+	response, err := c.session.ExecuteRows(context.Background(), query, w)
+	if err != nil {
+		return nil, err
+	}
+	// EXECUTE is tagged as the statement it ran
+	if name, ok := response["statement"].(string); ok && strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "EXECUTE") {
+		if prepared, ok := c.session.Prepared(name); ok {
+			query = prepared.SQL
+		}
+	}
+	result, err := c.result(query, response)
+	if err != nil || !w.streamed {
+		return result, err
+	}
+	result.tag = rowsTag(result.tag, w.count)
+	return result, nil
+}
+
+// result reads the rows of a response
+func (c *pgConn) result(query string, response map[string]interface{}) (*pgResult, error) {
+	result := &pgResult{tag: commandTag(query, response)}
+	rows, ok := response["result"].(string)
+	if !ok {
+		return result, nil
+	}
+	result.columns, _ = response["columns"].([]table.Column)
+	if result.columns == nil {
+		result.columns = []table.Column{}
+	}
+	decoder := json.NewDecoder(strings.NewReader(rows))
+	decoder.UseNumber()
+	err := decoder.Decode(&result.rows)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding rows: %s", err)
+	}
+	result.tag = rowsTag(result.tag, len(result.rows))
+	return result, nil
+}
+
+// rowsTag is the tag of a statement that returned count rows
+func rowsTag(tag string, count int) string {
+	if strings.HasPrefix(tag, "FETCH") {
+		return fmt.Sprintf("FETCH %d", count)
+	}
+	return fmt.Sprintf("SELECT %d", count)
+}
+
+// commandTag names what a statement did the way PostgreSQL does
+func commandTag(query string, response map[string]interface{}) string {
+	words := strings.Fields(strings.ToUpper(query))
+	if len(words) == 0 {
+		return ""
+	}
+	affected, _ := response["rows_affected"].(int)
+	switch words[0] {
+	case "INSERT":
+		return fmt.Sprintf("INSERT 0 %d", affected)
+	case "UPDATE", "DELETE":
+		return fmt.Sprintf("%s %d", words[0], affected)
+	case "START":
+		return "BEGIN"
+	case "DECLARE":
+		return "DECLARE CURSOR"
+	case "CLOSE":
+		return "CLOSE CURSOR"
+	case "CREATE", "DROP", "ALTER":
+		if len(words) > 1 {
+			return words[0] + " " + words[1]
+		}
+	}
+	return words[0]
+}
+
+// rowDescription sends NoData for statements without rows
+func (c *pgConn) rowDescription(columns []table.Column, formats []int16) {
+	if columns == nil {
+		c.send('n', &pgBuffer{})
+		return
+	}
+	b := &pgBuffer{}
+	b.int16(len(columns))
+	for i, column := range columns {
+		oid := typeOID(column.Type)
+		b.string(column.Name)
+		b.int32(0)
+		b.int16(0)
+		b.int32(int(oid))
+		b.int16(typeSize(oid))
+		b.int32(-1)
+		b.int16(int(format(formats, i)))
+	}
+	c.send('T', b)
+}
+
+func (c *pgConn) dataRows(columns []table.Column, formats []int16, rows []map[string]interface{}) error {
+	for _, row := range rows {
+		b := &pgBuffer{}
+		b.int16(len(columns))
+		for i, column := range columns {
+			value, err := encodeValue(column.Type, row[column.Name], format(formats, i) == 1)
+			if err != nil {
+				return &pgError{code: "22000", message: fmt.Sprintf("Error encoding column %s: %s", column.Name, err)}
+			}
+			if value == nil {
+				b.int32(-1)
+				continue
+			}
+			b.int32(len(value))
+			b.bytes(value)
+		}
+		c.send('D', b)
+	}
+	return nil
+}
+
+func (c *pgConn) commandComplete(tag string) {
+	b := &pgBuffer{}
+	b.string(tag)
+	c.send('C', b)
+}
+
+func (c *pgConn) readyForQuery() {
+	status := byte('I')
+	if c.session.InTransaction() {
+		status = 'T'
+	}
+	c.send('Z', &pgBuffer{data: []byte{status}})
+}
+
+func (c *pgConn) sendError(err error, severity string) {
+	b := &pgBuffer{}
+	for _, field := range []struct {
+		kind  byte
+		value string
+	}{
+		{'S', severity},
+		{'V', severity},
+		{'C', sqlState(err)},
+		{'M', err.Error()},
+	} {
+		b.data = append(b.data, field.kind)
+		b.string(field.value)
+	}
+	b.data = append(b.data, 0)
+	c.send('E', b)
+}
+
+func (c *pgConn) send(kind byte, b *pgBuffer) {
+	header := make([]byte, 5)
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:], uint32(len(b.data)+4))
+	c.writer.Write(header)
+	c.writer.Write(b.data)
+}
+
+// sqlState picks the SQLSTATE code of an error
+func sqlState(err error) string {
+	switch e := err.(type) {
+	case *pgError:
+		return e.code
+	case *table.DeadlockError:
+		return "40P01"
+	case *table.LockTimeoutError:
+		return "55P03"
+	case *table.CanceledError:
+		return "57014"
+	case *table.AuthError:
+		return "28P01"
+	case *table.PermissionError:
+		return "42501"
+	case *table.ConflictError:
+		return "40001"
+	case *table.ValidationError:
+		return "22023"
+	case *table.ConstraintError:
+		switch e.Constraint {
+		case "NOT NULL":
+			return "23502"
+		case "FOREIGN KEY":
+			return "23503"
+		case "UNIQUE":
+			return "23505"
+		case "CHECK":
+			return "23514"
+		}
+		return "23000"
+	}
+	// Errors wrapped by the session only keep their message
+	message := err.Error()
+	switch {
+	case message == "Id not found":
+		return "P0002"
+	case message == "Id already exists":
+		return "23505"
+	case strings.HasPrefix(message, "syntax error"):
+		return "42601"
+	case strings.HasPrefix(message, "Invalid value for parameter"):
+		return "22P02"
+	case strings.HasPrefix(message, "Statement takes"):
+		return "08P01"
+	case strings.HasPrefix(message, "Prepared statement") && strings.HasSuffix(message, "does not exist"):
+		return "26000"
+	case strings.HasPrefix(message, "Prepared statement") && strings.HasSuffix(message, "already exists"):
+		return "42P05"
+	case strings.HasPrefix(message, "Deadlock detected"):
+		return "40P01"
+	case strings.HasPrefix(message, "Lock wait timeout"):
+		return "55P03"
+	case strings.HasPrefix(message, "Database") && strings.HasSuffix(message, "does not exist"):
+		return "3D000"
+	case strings.HasPrefix(message, "Table") && strings.HasSuffix(message, "does not exist"):
+		return "42P01"
+	case strings.HasPrefix(message, "Column") && strings.HasSuffix(message, "does not exist"):
+		return "42703"
+	case strings.HasPrefix(message, "Database") && strings.HasSuffix(message, "already exists"):
+		return "42P04"
+	case strings.HasSuffix(message, "already exists"):
+		return "42P07"
+	case strings.HasPrefix(message, "Unsupported"):
+		return "0A000"
+	case strings.Contains(message, "transaction"):
+		return "25000"
+	}
+	return "XX000"
+}
+
+func format(formats []int16, i int) int16 {
+	switch len(formats) {
+	case 0:
+		return 0
+	case 1:
+		return formats[0]
+	}
+	if i < len(formats) {
+		return formats[i]
+	}
+	return 0
+}
+
+// pgBuffer builds the body of a message
+type pgBuffer struct {
+	data []byte
+}
+
+func (b *pgBuffer) int16(v int) {
+	b.data = binary.BigEndian.AppendUint16(b.data, uint16(v))
+}
+
+func (b *pgBuffer) int32(v int) {
+	b.data = binary.BigEndian.AppendUint32(b.data, uint32(v))
+}
+
+func (b *pgBuffer) string(s string) {
+	b.data = append(b.data, s...)
+	b.data = append(b.data, 0)
+}
+
+func (b *pgBuffer) bytes(data []byte) {
+	b.data = append(b.data, data...)
+}
+
+// pgReader reads the body of a message, the first read past its end sets
+// err and the later ones return zero values
+type pgReader struct {
+	data []byte
+	err  error
+}
+
+func (r *pgReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = fmt.Errorf("Malformed message")
+		return nil
+	}
+	data := r.data[:n]
+	r.data = r.data[n:]
+	return data
+}
+
+func (r *pgReader) byte() byte {
+	data := r.next(1)
+	if data == nil {
+		return 0
+	}
+	return data[0]
+}
+
+func (r *pgReader) int16() int16 {
+	data := r.next(2)
+	if data == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(data))
+}
+
+func (r *pgReader) int32() int32 {
+	data := r.next(4)
+	if data == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(data))
+}
+
+// count reads the length of a list
+func (r *pgReader) count() int {
+	n := int(r.int16())
+	if n < 0 {
+		r.next(-1)
+		return 0
+	}
+	return n
+}
+
+func (r *pgReader) string() string {
+	end := bytes.IndexByte(r.data, 0)
+	if end < 0 {
+		r.next(-1)
+		return ""
+	}
+	s := string(r.next(end))
+	r.next(1)
+	return s
+}
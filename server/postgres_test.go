@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/kimuraz/golang-json-db/protocol"
+	"github.com/kimuraz/golang-json-db/sql"
+	"github.com/kimuraz/golang-json-db/table"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// pgMessage reads a message of the backend
+func pgMessage(t *testing.T, reader *bufio.Reader) (byte, *pgReader) {
+	t.Helper()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatalf("reading message: %s", err)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		t.Fatalf("reading message: %s", err)
+	}
+	return header[0], &pgReader{data: body}
+}
+
+// pgSend writes a message of the frontend, startup messages have no kind
+func pgSend(t *testing.T, conn net.Conn, kind byte, b *pgBuffer) {
+	t.Helper()
+	message := []byte{}
+	if kind != 0 {
+		message = append(message, kind)
+	}
+	message = binary.BigEndian.AppendUint32(message, uint32(len(b.data)+4))
+	if _, err := conn.Write(append(message, b.data...)); err != nil {
+		t.Fatalf("writing message: %s", err)
+	}
+}
+
+// pgErrorCode returns the SQLSTATE of an error response
+func pgErrorCode(r *pgReader) string {
+	for kind := r.byte(); kind != 0 && r.err == nil; kind = r.byte() {
+		value := r.string()
+		if kind == 'C' {
+			return value
+		}
+	}
+	return ""
+}
+
+func TestPostgresAuth(t *testing.T) {
+	if err := table.CreateUser("pgadmin", "secret", true); err != nil {
+		t.Fatal(err)
+	}
+	// The other tests run without users
+	t.Cleanup(func() {
+		table.CloseTables()
+		os.RemoveAll(filepath.Join(table.DataDir(), ".system"))
+	})
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		// wantCode is the SQLSTATE the startup fails with, empty when it
+		// succeeds
+		wantCode string
+	}{
+		{name: "right password", user: "pgadmin", password: "secret"},
+		{name: "wrong password", user: "pgadmin", password: "secrets", wantCode: "28P01"},
+		{name: "unknown user", user: "nobody", password: "secret", wantCode: "28P01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, peer := net.Pipe()
+			defer conn.Close()
+			r := newRegistry()
+			session := sql.NewSession()
+			e, _ := r.add(peer, "postgres", session)
+			messages := make(chan string, 100)
+			go servePostgres(peer, e, r, messages)
+			reader := bufio.NewReader(conn)
+
+			startup := &pgBuffer{}
+			startup.int32(pgProtocolVersion)
+			startup.string("user")
+			startup.string(tt.user)
+			startup.data = append(startup.data, 0)
+			pgSend(t, conn, 0, startup)
+
+			kind, m := pgMessage(t, reader)
+			if kind != 'R' || m.int32() != 10 || m.string() != protocol.ScramMechanism {
+				t.Fatalf("expected a SCRAM-SHA-256 request, got %q", kind)
+			}
+			scram, err := protocol.NewScramClient(tt.user, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first := &pgBuffer{}
+			first.string(protocol.ScramMechanism)
+			clientFirst := scram.First()
+			first.int32(len(clientFirst))
+			first.bytes([]byte(clientFirst))
+			pgSend(t, conn, 'p', first)
+
+			kind, m = pgMessage(t, reader)
+			if kind != 'R' || m.int32() != 11 {
+				t.Fatalf("expected a SASL continue, got %q", kind)
+			}
+			clientFinal, err := scram.Final(string(m.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pgSend(t, conn, 'p', &pgBuffer{data: []byte(clientFinal)})
+
+			kind, m = pgMessage(t, reader)
+			if tt.wantCode != "" {
+				if kind != 'E' {
+					t.Fatalf("expected an error, got %q", kind)
+				}
+				if code := pgErrorCode(m); code != tt.wantCode {
+					t.Errorf("got SQLSTATE %s, want %s", code, tt.wantCode)
+				}
+				return
+			}
+			if kind != 'R' || m.int32() != 12 {
+				t.Fatalf("expected a SASL final, got %q", kind)
+			}
+			if err = scram.Verify(string(m.data)); err != nil {
+				t.Fatal(err)
+			}
+			if kind, m = pgMessage(t, reader); kind != 'R' || m.int32() != 0 {
+				t.Fatalf("expected authentication ok, got %q", kind)
+			}
+			if session.User() != tt.user {
+				t.Errorf("session user is %q, want %q", session.User(), tt.user)
+			}
+		})
+	}
+}
+
+// TestPostgresPortalRows executes a portal two rows at a time, each Execute
+// goes on with the scan where the last one stopped
+func TestPostgresPortalRows(t *testing.T) {
+	mustExec(t, sql.NewSession(),
+		"CREATE TABLE portal_rows (id INT PRIMARY KEY, n INT)",
+		"INSERT INTO portal_rows (id, n) VALUES (1, 10), (2, 20), (3, 30), (4, 40), (5, 50)",
+	)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	r := newRegistry()
+	e, _ := r.add(peer, "postgres", sql.NewSession())
+	go servePostgres(peer, e, r, make(chan string, 100))
+	reader := bufio.NewReader(conn)
+
+	startup := &pgBuffer{}
+	startup.int32(pgProtocolVersion)
+	startup.string("user")
+	startup.string("postgres")
+	startup.data = append(startup.data, 0)
+	pgSend(t, conn, 0, startup)
+	for kind, _ := pgMessage(t, reader); kind != 'Z'; kind, _ = pgMessage(t, reader) {
+	}
+
+	// The server flushes after each message, the pipe has no buffer
+	parse := &pgBuffer{}
+	parse.string("")
+	parse.string("SELECT * FROM portal_rows WHERE n > 10")
+	parse.int16(0)
+	pgSend(t, conn, 'P', parse)
+	if kind, _ := pgMessage(t, reader); kind != '1' {
+		t.Fatalf("expected parse complete, got %q", kind)
+	}
+	bind := &pgBuffer{}
+	bind.string("")
+	bind.string("")
+	bind.int16(0)
+	bind.int16(0)
+	bind.int16(0)
+	pgSend(t, conn, 'B', bind)
+	if kind, _ := pgMessage(t, reader); kind != '2' {
+		t.Fatalf("expected bind complete, got %q", kind)
+	}
+
+	// Each Execute ends suspended, or complete once the rows ran out
+	var got []string
+	var ends []byte
+	for i := 0; i < 3; i++ {
+		execute := &pgBuffer{}
+		execute.string("")
+		execute.int32(2)
+		pgSend(t, conn, 'E', execute)
+		kind, m := pgMessage(t, reader)
+		for ; kind == 'D'; kind, m = pgMessage(t, reader) {
+			m.int16()
+			m.next(int(m.int32()))
+			got = append(got, string(m.next(int(m.int32()))))
+		}
+		ends = append(ends, kind)
+	}
+	if want := []string{"20", "30", "40", "50"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got rows %v, want %v", got, want)
+	}
+	if want := []byte{'s', 's', 'C'}; !reflect.DeepEqual(ends, want) {
+		t.Errorf("got ends %q, want %q", ends, want)
+	}
+}
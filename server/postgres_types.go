@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OIDs of the PostgreSQL types the columns map to, and of the ones clients
+// commonly send parameters as
+const (
+	oidBool        = 16
+	oidBytea       = 17
+	oidInt8        = 20
+	oidInt2        = 21
+	oidInt4        = 23
+	oidText        = 25
+	oidJSON        = 114
+	oidFloat4      = 700
+	oidFloat8      = 701
+	oidUnknown     = 705
+	oidVarchar     = 1043
+	oidDate        = 1082
+	oidTimestamp   = 1114
+	oidTimestamptz = 1184
+	oidNumeric     = 1700
+	oidJSONB       = 3802
+)
+
+// Binary dates and times count from 2000-01-01
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// typeOID maps the SQL type of a column, parameters of unknown type are
+// text
+func typeOID(sqlType string) uint32 {
+	switch sqlType {
+	case "BOOLEAN":
+		return oidBool
+	case "INTEGER":
+		return oidInt8
+	case "DOUBLE":
+		return oidFloat8
+	case "DATE":
+		return oidDate
+	case "TIMESTAMP":
+		return oidTimestamp
+	case "BLOB":
+		return oidBytea
+	case "JSON":
+		return oidJSON
+	}
+	return oidText
+}
+
+func typeSize(oid uint32) int {
+	switch oid {
+	case oidBool:
+		return 1
+	case oidDate:
+		return 4
+	case oidInt8, oidFloat8, oidTimestamp:
+		return 8
+	}
+	return -1
+}
+
+// encodeValue writes a value decoded from the rows in the text or binary
+// format of its column type, nil is NULL. Values that do not match their
+// column type go as text
+func encodeValue(sqlType string, value interface{}, binaryFormat bool) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch sqlType {
+	case "BOOLEAN":
+		if v, ok := value.(bool); ok {
+			if binaryFormat {
+				if v {
+					return []byte{1}, nil
+				}
+				return []byte{0}, nil
+			}
+			if v {
+				return []byte("t"), nil
+			}
+			return []byte("f"), nil
+		}
+	case "INTEGER", "DOUBLE":
+		if v, ok := value.(json.Number); ok {
+			if !binaryFormat {
+				return []byte(v.String()), nil
+			}
+			if sqlType == "INTEGER" {
+				i, err := v.Int64()
+				if err != nil {
+					return nil, err
+				}
+				return binary.BigEndian.AppendUint64(nil, uint64(i)), nil
+			}
+			f, err := v.Float64()
+			if err != nil {
+				return nil, err
+			}
+			return binary.BigEndian.AppendUint64(nil, math.Float64bits(f)), nil
+		}
+	case "DATE", "TIMESTAMP":
+		if v, ok := value.(string); ok {
+			t, err := table.ParseTime(v)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case sqlType == "DATE" && binaryFormat:
+				days := int32(t.Sub(pgEpoch).Hours() / 24)
+				return binary.BigEndian.AppendUint32(nil, uint32(days)), nil
+			case sqlType == "DATE":
+				return []byte(t.Format("2006-01-02")), nil
+			case binaryFormat:
+				return binary.BigEndian.AppendUint64(nil, uint64(t.Sub(pgEpoch).Microseconds())), nil
+			}
+			return []byte(t.Format("2006-01-02 15:04:05.999999")), nil
+		}
+	case "BLOB":
+		if v, ok := value.(string); ok {
+			data, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, err
+			}
+			if binaryFormat {
+				return data, nil
+			}
+			return []byte(`\x` + hex.EncodeToString(data)), nil
+		}
+	}
+	// Only text and json share the text format in binary
+	if binaryFormat && typeOID(sqlType) != oidText && typeOID(sqlType) != oidJSON {
+		return nil, fmt.Errorf("%v is not a %s", value, sqlType)
+	}
+	if v, ok := value.(string); ok && sqlType != "JSON" {
+		return []byte(v), nil
+	}
+	return json.Marshal(value)
+}
+
+// decodeParameter reads a bound parameter into an argument of the prepared
+// statement, nil data is NULL
+func decodeParameter(oid uint32, binaryFormat bool, data []byte) (interface{}, error) {
+	if data == nil {
+		return nil, nil
+	}
+	if binaryFormat {
+		size := map[uint32]int{oidBool: 1, oidInt2: 2, oidInt4: 4, oidInt8: 8, oidFloat4: 4, oidFloat8: 8, oidDate: 4, oidTimestamp: 8, oidTimestamptz: 8}
+		if n, ok := size[oid]; ok && len(data) != n {
+			return nil, fmt.Errorf("expected %d bytes, got %d", n, len(data))
+		}
+		switch oid {
+		case oidBool:
+			return data[0] != 0, nil
+		case oidInt2:
+			return int64(int16(binary.BigEndian.Uint16(data))), nil
+		case oidInt4:
+			return int64(int32(binary.BigEndian.Uint32(data))), nil
+		case oidInt8:
+			return int64(binary.BigEndian.Uint64(data)), nil
+		case oidFloat4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+		case oidFloat8:
+			return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+		case oidBytea:
+			return data, nil
+		case oidDate:
+			days := int32(binary.BigEndian.Uint32(data))
+			return pgEpoch.AddDate(0, 0, int(days)).Format("2006-01-02"), nil
+		case oidTimestamp, oidTimestamptz:
+			micros := int64(binary.BigEndian.Uint64(data))
+			return pgEpoch.Add(time.Duration(micros) * time.Microsecond), nil
+		case oidJSONB:
+			// Binary jsonb starts with its version
+			if len(data) == 0 {
+				return nil, fmt.Errorf("empty jsonb")
+			}
+			return string(data[1:]), nil
+		case oidText, oidVarchar, oidJSON, oidUnknown:
+			return string(data), nil
+		}
+		return nil, fmt.Errorf("binary format of type %d is not supported", oid)
+	}
+
+	text := string(data)
+	switch oid {
+	case oidBool:
+		switch strings.ToLower(strings.TrimSpace(text)) {
+		case "t", "true", "y", "yes", "on", "1":
+			return true, nil
+		case "f", "false", "n", "no", "off", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("%s is not a boolean", text)
+	case oidInt2, oidInt4, oidInt8:
+		value, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not an integer", text)
+		}
+		return value, nil
+	case oidFloat4, oidFloat8, oidNumeric:
+		value, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a number", text)
+		}
+		return value, nil
+	case oidBytea:
+		if !strings.HasPrefix(text, `\x`) {
+			return data, nil
+		}
+		return hex.DecodeString(text[2:])
+	}
+	return text, nil
+}
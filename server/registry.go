@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/sql"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// registry keeps the open connections of every listener. Connections add
+// themselves when they start and remove themselves when their goroutine
+// ends, so the list never holds closed ones. It is the process list of the
+// sessions
+type registry struct {
+	mu      sync.Mutex
+	nextID  int
+	entries map[int]*entry
+	// closed turns new connections away once the server shuts down
+	closed  bool
+	running sync.WaitGroup
+}
+
+// entry is a connection in the registry
+type entry struct {
+	id       int
+	conn     net.Conn
+	protocol string
+	session  *sql.Session
+	since    time.Time
+	// secret is the key PostgreSQL cancel requests send along with the id,
+	// random so other clients cannot guess it
+	secret int32
+}
+
+func newRegistry() *registry {
+	return &registry{entries: make(map[int]*entry)}
+}
+
+// add registers a connection and its session, false once the server is
+// shutting down or when no secret could be drawn for it
+func (r *registry) add(conn net.Conn, protocol string, session *sql.Session) (*entry, bool) {
+	var secret [4]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, false
+	}
+	r.nextID++
+	e := &entry{id: r.nextID, conn: conn, protocol: protocol, session: session, since: time.Now(), secret: int32(binary.BigEndian.Uint32(secret[:]))}
+	r.entries[e.id] = e
+	r.running.Add(1)
+	session.SetProcessList(r)
+	return e, true
+}
+
+// remove is called by the goroutine of a connection when it ends
+func (r *registry) remove(e *entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[e.id]; ok {
+		delete(r.entries, e.id)
+		r.running.Done()
+	}
+}
+
+// list returns the open connections in the order they came
+func (r *registry) list() []*entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := make([]*entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].id < entries[j].id
+	})
+	return entries
+}
+
+func (r *registry) Processes() []sql.Process {
+	entries := r.list()
+	processes := make([]sql.Process, len(entries))
+	for i, e := range entries {
+		processes[i] = sql.Process{
+			ID:        e.id,
+			Protocol:  e.protocol,
+			Address:   e.conn.RemoteAddr().String(),
+			Connected: e.since,
+			Activity:  e.session.Activity(),
+		}
+	}
+	return processes
+}
+
+// Kill closes the connection, a running statement ends before its session
+// rolls back
+func (r *registry) Kill(id int) error {
+	r.mu.Lock()
+	e, ok := r.entries[id]
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("Process %d does not exist", id)
+	}
+	return e.conn.Close()
+}
+
+// Cancel stops the running statement of a process, nothing happens when it
+// is idle
+func (r *registry) Cancel(id int) error {
+	r.mu.Lock()
+	e, ok := r.entries[id]
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("Process %d does not exist", id)
+	}
+	e.session.Cancel()
+	return nil
+}
+
+// cancelRequest cancels for a PostgreSQL client, which has to know the
+// secret of the process
+func (r *registry) cancelRequest(id int, secret int32) bool {
+	r.mu.Lock()
+	e, ok := r.entries[id]
+	r.mu.Unlock()
+	if !ok || e.secret != secret {
+		return false
+	}
+	return e.session.Cancel()
+}
+
+// drainGrace is how long drain waits for the connections closed at the
+// deadline to stop their statement and roll back
+const drainGrace = 5 * time.Second
+
+// drain turns new connections away and stops the open ones from reading
+// further requests, the ones running a statement end after answering it.
+// Connections still open at the deadline have their statement canceled and
+// are closed, then drain waits up to drainGrace for them to roll back. It
+// returns how many were closed and how many had not ended after that
+func (r *registry) drain(deadline time.Time) (int, int) {
+	r.mu.Lock()
+	r.closed = true
+	for _, e := range r.entries {
+		e.conn.SetReadDeadline(time.Now())
+	}
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0, 0
+	case <-time.After(time.Until(deadline)):
+	}
+
+	entries := r.list()
+	for _, e := range entries {
+		e.session.Cancel()
+		e.conn.Close()
+	}
+	select {
+	case <-done:
+		return len(entries), 0
+	case <-time.After(drainGrace):
+	}
+	return len(entries), len(r.list())
+}
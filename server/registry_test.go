@@ -0,0 +1,75 @@
+package server
+
+import (
+	"github.com/kimuraz/golang-json-db/sql"
+	"github.com/kimuraz/golang-json-db/table"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRegistrySecrets(t *testing.T) {
+	r := newRegistry()
+	secrets := make(map[int32]bool)
+	for i := 0; i < 100; i++ {
+		conn, peer := net.Pipe()
+		defer conn.Close()
+		defer peer.Close()
+		e, ok := r.add(conn, "postgres", sql.NewSession())
+		if !ok {
+			t.Fatal("add refused a connection")
+		}
+		if secrets[e.secret] {
+			t.Fatalf("secret %d handed out twice", e.secret)
+		}
+		secrets[e.secret] = true
+		if r.cancelRequest(e.id, e.secret+1) {
+			t.Errorf("cancel request with a wrong secret accepted")
+		}
+	}
+}
+
+func TestDrainCancelsRunningStatements(t *testing.T) {
+	owner := sql.NewSession()
+	for _, statement := range []string{
+		"CREATE TABLE drain (id INT PRIMARY KEY, n INT)",
+		"INSERT INTO drain (id, n) VALUES (1, 0)",
+		"BEGIN",
+		"UPDATE drain SET n = 1 WHERE id = 1",
+	} {
+		if _, err := owner.Execute(statement); err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+	}
+	defer owner.Close()
+
+	r := newRegistry()
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	session := sql.NewSession()
+	e, _ := r.add(conn, "gjdb", session)
+	result := make(chan error, 1)
+	go func() {
+		defer r.remove(e)
+		defer session.Close()
+		_, err := session.Execute("UPDATE drain SET n = 2 WHERE id = 1")
+		result <- err
+	}()
+	// Let the update wait for the row lock
+	for session.Activity().State != sql.StateActive {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	closed, left := r.drain(time.Now().Add(50 * time.Millisecond))
+	if closed != 1 || left != 0 {
+		t.Errorf("drain = %d closed, %d left, want 1 and 0", closed, left)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain took %s", elapsed)
+	}
+	if _, ok := (<-result).(*table.CanceledError); !ok {
+		t.Errorf("running statement was not canceled")
+	}
+}
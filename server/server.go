@@ -1,99 +1,401 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/kimuraz/golang-json-db/protocol"
 	"github.com/kimuraz/golang-json-db/sql"
 	"github.com/kimuraz/golang-json-db/table"
 	"github.com/kimuraz/golang-json-db/utils"
 	"github.com/rs/zerolog/log"
+	"io"
 	"net"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// rowBatchSize is how many rows go in a rows frame
+const rowBatchSize = 100
+
+// DefaultShutdownTimeout is how long Shutdown waits for running statements
+// when ShutdownTimeout is not set
+const DefaultShutdownTimeout = 10 * time.Second
+
 type Server struct {
-	Clients     []*ServerClient
-	Port        int
-	MessageChan chan string
+	Port int
+	// PostgresPort serves the PostgreSQL protocol when set
+	PostgresPort int
+	// HTTPPort serves the HTTP API when set
+	HTTPPort int
+	// ShutdownTimeout is how long Shutdown waits for running statements
+	// before closing their connections
+	ShutdownTimeout time.Duration
+	MessageChan     chan string
+
+	registry *registry
+	// mu guards the listeners, they are closed by Shutdown
+	mu         sync.Mutex
+	listeners  []net.Listener
+	httpServer *http.Server
+	// httpRequests are the HTTP requests being answered
+	httpRequests sync.WaitGroup
+	closing      bool
+	shutdown     sync.Once
+	done         chan struct{}
 }
 
+// pendingRequests is how many requests a connection reads ahead of the
+// running one, cancel frames are read past them
+const pendingRequests = 16
+
 type ServerClient struct {
-	Conn     net.Conn
-	Received []string
-	Sent     []string
+	Conn    *protocol.Conn
+	Session *sql.Session
+
+	// mu guards the running request and its cancel, the last one started
+	// and the ids canceled before they ran
+	mu       sync.Mutex
+	running  uint32
+	stop     context.CancelFunc
+	last     uint32
+	canceled map[uint32]bool
 }
 
 func (c *ServerClient) ReadLoop(messages chan string) {
 	defer c.Conn.Close()
+	// An unfinished transaction is rolled back with the connection
+	defer c.Session.Close()
+	var keys *protocol.ScramKeys
+	hello, err := c.Conn.Accept("gjdb", func(hello *protocol.Hello) (*protocol.ScramKeys, error) {
+		var err error
+		keys, err = scramKeys(hello.User)
+		return keys, err
+	})
+	if err != nil {
+		messages <- fmt.Sprintf("Handshake with %s failed: %s", c.Conn.RemoteAddr(), err.Error())
+		return
+	}
+	if keys != nil {
+		c.Session.SetUser(hello.User)
+	}
+	requests := make(chan *protocol.Frame, pendingRequests)
+	done := make(chan struct{})
+	defer close(done)
+	go c.readRequests(requests, done, messages)
+
+	for frame := range requests {
+		ctx, ok := c.start(frame.ID)
+		if !ok {
+			c.Conn.WriteFrame(protocol.ErrorFrame(frame.ID, protocol.CodeCanceled, (&table.CanceledError{}).Error()))
+			continue
+		}
+		var res map[string]interface{}
+		w := &frameWriter{conn: c.Conn, id: frame.ID, start: time.Now()}
+		switch frame.Type {
+		case protocol.TypeQuery:
+			message := strings.Trim(string(frame.Payload), " ")
+			messages <- fmt.Sprintf("[%s]: %s", c.Conn.RemoteAddr(), sql.RedactPasswords(message))
+			res, err = c.Session.ExecuteRows(ctx, message, w)
+		case protocol.TypePrepare, protocol.TypeExecute:
+			res, err = c.prepared(ctx, frame, messages, w)
+		default:
+			err = &protocol.Error{Code: protocol.CodeProtocol, Message: fmt.Sprintf("Unexpected %s frame", frame.Type)}
+		}
+		c.finish()
+		if err != nil {
+			log.Err(err)
+			code := protocol.CodeStatement
+			switch e := err.(type) {
+			case *protocol.Error:
+				code = e.Code
+			case *table.CanceledError:
+				code = protocol.CodeCanceled
+			}
+			c.Conn.WriteFrame(protocol.ErrorFrame(frame.ID, code, err.Error()))
+			continue
+		}
+		err = w.complete(res)
+		if err != nil {
+			messages <- fmt.Sprintf("Error writing to client: %s", err.Error())
+			break
+		}
+	}
+}
+
+// readRequests hands the frames of the client to ReadLoop until the
+// connection ends. Cancel frames are handled right away, the statement they
+// stop is running in ReadLoop or waiting in requests
+func (c *ServerClient) readRequests(requests chan<- *protocol.Frame, done <-chan struct{}, messages chan string) {
+	defer close(requests)
 	for {
-		buffer := make([]byte, 1024)
-		n, err := c.Conn.Read(buffer)
+		frame, err := c.Conn.ReadFrame()
 		if err != nil {
-			if err.Error() == "EOF" {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err == io.EOF {
 				messages <- fmt.Sprintf("Client %s disconnected", c.Conn.RemoteAddr().String())
-				c.Conn.Close()
-				c.Conn = nil
-				break
+				return
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				messages <- fmt.Sprintf("Closing connection of %s for shutdown", c.Conn.RemoteAddr().String())
+				return
 			}
 			messages <- fmt.Sprintf("Error reading from client: %s", err.Error())
-			break
+			return
+		}
+		if frame.Type == protocol.TypeCancel {
+			c.cancel(frame.ID)
+			continue
+		}
+		select {
+		case requests <- frame:
+		case <-done:
+			return
 		}
-		message := strings.Trim(string(buffer[:n]), " ")
-		messages <- fmt.Sprintf("[%s]: %s", c.Conn.RemoteAddr(), message)
-		c.Received = append(c.Received, message)
+	}
+}
+
+// start marks request id as the running one and returns the context it
+// runs in, false when it was canceled before it started
+func (c *ServerClient) start(id uint32) (context.Context, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = id
+	if c.canceled[id] {
+		delete(c.canceled, id)
+		return nil, false
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	c.running = id
+	c.stop = stop
+	return ctx, true
+}
+
+func (c *ServerClient) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stop()
+	c.running = 0
+	c.stop = nil
+}
 
-		res, err := sql.SQLToAction(message)
-		jsonRes, _ := json.Marshal(res)
+// cancel stops request id when it runs, or before it starts when it is
+// waiting. Requests already answered are left alone
+func (c *ServerClient) cancel(id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil && id == c.running {
+		c.stop()
+		return
+	}
+	if id > c.last {
+		if c.canceled == nil {
+			c.canceled = make(map[uint32]bool)
+		}
+		c.canceled[id] = true
+	}
+}
+
+// prepared runs prepare and execute frames, payloads that do not decode
+// are answered with a protocol error
+func (c *ServerClient) prepared(ctx context.Context, frame *protocol.Frame, messages chan string, w *frameWriter) (map[string]interface{}, error) {
+	if frame.Type == protocol.TypePrepare {
+		var prepare protocol.Prepare
+		if err := frame.Decode(&prepare); err != nil {
+			return nil, &protocol.Error{Code: protocol.CodeProtocol, Message: err.Error()}
+		}
+		messages <- fmt.Sprintf("[%s]: PREPARE %s AS %s", c.Conn.RemoteAddr(), prepare.Name, sql.RedactPasswords(prepare.SQL))
+		p, err := c.Session.Prepare(prepare.Name, prepare.SQL)
 		if err != nil {
-			log.Err(err)
-			c.Conn.Write([]byte(fmt.Sprintf("Error parsing command: %s\n", err.Error())))
+			return nil, err
+		}
+		return map[string]interface{}{
+			"ok":         true,
+			"statement":  p.Name,
+			"parameters": p.Description.Parameters,
+			"columns":    p.Description.Columns,
+		}, nil
+	}
+
+	// Numbers are kept apart from floats for integer columns
+	var execute protocol.Execute
+	decoder := json.NewDecoder(bytes.NewReader(frame.Payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&execute); err != nil {
+		return nil, &protocol.Error{Code: protocol.CodeProtocol, Message: fmt.Sprintf("Error decoding %s payload: %s", frame.Type, err)}
+	}
+	if execute.SQL != "" {
+		messages <- fmt.Sprintf("[%s]: %s", c.Conn.RemoteAddr(), sql.RedactPasswords(execute.SQL))
+		execute.Name = ""
+		if _, err := c.Session.Prepare(execute.Name, execute.SQL); err != nil {
+			return nil, err
+		}
+	}
+	p, ok := c.Session.Prepared(execute.Name)
+	if !ok {
+		return nil, fmt.Errorf("Prepared statement %s does not exist", execute.Name)
+	}
+	args := make([]interface{}, len(execute.Params))
+	for i, param := range execute.Params {
+		args[i] = jsonArg(param)
+	}
+	return c.Session.ExecutePreparedRows(ctx, p, args, w)
+}
+
+// frameWriter sends the rows of a statement as they are read, a columns
+// frame and then batches of rowBatchSize rows. The complete frame carries
+// the rest of the response
+type frameWriter struct {
+	conn    *protocol.Conn
+	id      uint32
+	start   time.Time
+	columns bool
+	batch   []json.RawMessage
+	count   int
+}
+
+func (w *frameWriter) Columns(columns []table.Column) error {
+	if columns == nil {
+		columns = []table.Column{}
+	}
+	w.columns = true
+	return w.write(protocol.TypeColumns, columns)
+}
+
+func (w *frameWriter) Row(row map[string]interface{}) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	return w.add(data)
+}
+
+// add queues a row already in JSON, a full batch is sent right away
+func (w *frameWriter) add(row json.RawMessage) error {
+	w.batch = append(w.batch, row)
+	w.count++
+	if len(w.batch) < rowBatchSize {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *frameWriter) flush() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	err := w.write(protocol.TypeRows, w.batch)
+	w.batch = w.batch[:0]
+	return err
+}
+
+func (w *frameWriter) write(messageType protocol.MessageType, payload interface{}) error {
+	frame, err := protocol.NewFrame(messageType, w.id, payload)
+	if err != nil {
+		return err
+	}
+	return w.conn.WriteFrame(frame)
+}
+
+// complete sends the rows left and the complete frame. Statements that
+// answer with a result of their own, like SHOW, have it sent as rows first
+func (w *frameWriter) complete(response map[string]interface{}) error {
+	complete := make(map[string]interface{}, len(response)+2)
+	for key, value := range response {
+		complete[key] = value
+	}
+	rowCount, _ := response["rows_affected"].(int)
+	if result, ok := response["result"].(string); ok && !w.columns {
+		delete(complete, "result")
+		delete(complete, "columns")
+		columns, _ := response["columns"].([]table.Column)
+		if err := w.Columns(columns); err != nil {
+			return err
 		}
+		var rows []json.RawMessage
+		if err := json.Unmarshal([]byte(result), &rows); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := w.add(row); err != nil {
+				return err
+			}
+		}
+	}
+	if w.columns {
+		rowCount = w.count
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	complete["row_count"] = rowCount
+	complete["elapsed_ms"] = float64(time.Since(w.start).Microseconds()) / 1000
+	return w.write(protocol.TypeComplete, complete)
+}
 
-		c.Conn.Write(jsonRes)
+// scramKeys returns what checking the password of a new connection needs
+// once the server has users. Without users it is nil and anyone may
+// connect, to create the first one
+func scramKeys(user string) (*protocol.ScramKeys, error) {
+	hasUsers, err := table.HasUsers()
+	if err != nil || !hasUsers {
+		return nil, err
 	}
+	salt, iterations, key, err := table.SaltedPassword(user)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.ScramKeys{Salt: salt, Iterations: iterations, SaltedPassword: key}, nil
 }
 
-func ConnectServerClient(conn net.Conn, messages chan string) *ServerClient {
+// ConnectServerClient serves a connection with its session from a goroutine
+// of its own, once its hello is authenticated. onClose is called once it
+// ends
+func ConnectServerClient(conn net.Conn, session *sql.Session, messages chan string, onClose func()) *ServerClient {
 	client := &ServerClient{
-		Conn: conn,
+		Conn:    protocol.NewConn(conn),
+		Session: session,
 	}
 
 	messages <- "New connection from: " + conn.RemoteAddr().String()
 
-	go client.ReadLoop(messages)
+	go func() {
+		defer onClose()
+		client.ReadLoop(messages)
+	}()
 	return client
 }
 
 func (s *Server) ListenCli() {
 	for {
 		var input string
-		fmt.Scanln(&input)
+		_, err := fmt.Scanln(&input)
+		if err == io.EOF {
+			return
+		}
 		if input == "exit" {
-			for _, client := range s.Clients {
-				client.Conn.Close()
-			}
-			os.Exit(0)
+			s.Shutdown()
+			return
 		}
 
 		if input == "list" {
-			if len(s.Clients) == 0 {
+			processes := s.registry.Processes()
+			if len(processes) == 0 {
 				s.MessageChan <- "No clients connected"
 			}
-			for _, client := range s.Clients {
-				s.MessageChan <- client.Conn.RemoteAddr().String()
-			}
-		}
-	}
-}
-
-func (s *Server) ListenDisconnect() {
-	for {
-		for i, c := range s.Clients {
-			if c.Conn == nil {
-				s.Clients = append(s.Clients[:i], s.Clients[i+1:]...)
+			for _, p := range processes {
+				s.MessageChan <- fmt.Sprintf("%d %s %s %s %s", p.ID, p.Protocol, p.Address, p.State, p.Query)
 			}
 		}
 	}
@@ -101,9 +403,11 @@ func (s *Server) ListenDisconnect() {
 
 func NewServer(port int) *Server {
 	return &Server{
-		Clients:     make([]*ServerClient, 0),
-		Port:        port,
-		MessageChan: make(chan string),
+		Port:            port,
+		ShutdownTimeout: DefaultShutdownTimeout,
+		MessageChan:     make(chan string),
+		registry:        newRegistry(),
+		done:            make(chan struct{}),
 	}
 }
 
@@ -115,18 +419,129 @@ func (s *Server) StartServer() {
 
 	portStr := strconv.Itoa(s.Port)
 	s.MessageChan <- fmt.Sprintf("Starting server on port %s...", portStr)
-	ln, _ := net.Listen("tcp", ":"+portStr)
-	defer ln.Close()
+	ln, err := net.Listen("tcp", ":"+portStr)
+	if err != nil {
+		s.MessageChan <- fmt.Sprintf("Error starting the server: %s", err.Error())
+		return
+	}
+	if !s.listen(ln) {
+		return
+	}
 
+	if s.PostgresPort > 0 {
+		go s.StartPostgres()
+	}
+	if s.HTTPPort > 0 {
+		go s.StartHTTP()
+	}
 	go s.ListenCli()
-	go s.ListenDisconnect()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if s.stopped() {
+				return
+			}
 			s.MessageChan <- "Error accepting connection: " + err.Error()
 			continue
 		}
-		s.Clients = append(s.Clients, ConnectServerClient(conn, s.MessageChan))
+		session := sql.NewSession()
+		e, ok := s.registry.add(conn, "gjdb", session)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		ConnectServerClient(conn, session, s.MessageChan, func() {
+			s.registry.remove(e)
+		})
+	}
+}
+
+// listen keeps a listener for Shutdown to close, false when the server is
+// already shutting down
+func (s *Server) listen(ln net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		ln.Close()
+		return false
+	}
+	s.listeners = append(s.listeners, ln)
+	return true
+}
+
+// stopped tells the accept loops that their listener was closed on purpose
+func (s *Server) stopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// Shutdown stops accepting connections, lets the running statements answer
+// until ShutdownTimeout, cancels the ones still running and syncs the tables
+// to disk once their sessions rolled back. Done is closed once it is over
+func (s *Server) Shutdown() {
+	s.shutdown.Do(func() {
+		s.MessageChan <- "Shutting down..."
+		deadline := time.Now().Add(s.ShutdownTimeout)
+		s.mu.Lock()
+		s.closing = true
+		for _, ln := range s.listeners {
+			ln.Close()
+		}
+		httpServer := s.httpServer
+		s.mu.Unlock()
+
+		var wg sync.WaitGroup
+		if httpServer != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithDeadline(context.Background(), deadline)
+				defer cancel()
+				if err := httpServer.Shutdown(ctx); err != nil {
+					// Closing the connections cancels the context of their
+					// statements
+					httpServer.Close()
+					if !waitTimeout(&s.httpRequests, drainGrace) {
+						s.MessageChan <- "HTTP requests still running after being closed, their changes may not be synced"
+					}
+				}
+			}()
+		}
+		closed, left := s.registry.drain(deadline)
+		if closed > 0 {
+			s.MessageChan <- fmt.Sprintf("Closed %d connections still running at the deadline", closed)
+		}
+		if left > 0 {
+			s.MessageChan <- fmt.Sprintf("%d connections still running after being closed, their changes may not be synced", left)
+		}
+		wg.Wait()
+
+		if err := table.FlushTables(); err != nil {
+			s.MessageChan <- fmt.Sprintf("Error flushing tables: %s", err.Error())
+		}
+		s.MessageChan <- "Server stopped"
+		close(s.done)
+	})
+}
+
+// waitTimeout waits for wg up to timeout, false if it was not done by then
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
 	}
 }
+
+// Done is closed once Shutdown is over
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
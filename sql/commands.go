@@ -0,0 +1,320 @@
+package sql
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"github.com/xwb1989/sqlparser"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Statements sqlparser cannot represent are matched here before parsing
+
+var createIndexRe = regexp.MustCompile(`(?is)^\s*create\s+index\s+(\w+)\s+on\s+(\w+)\s*\(([^)]*)\)\s*;?\s*$`)
+var createSequenceRe = regexp.MustCompile(`(?is)^\s*create\s+sequence\s+(\w+)(?:\s+start\s+(?:with\s+)?(-?\d+))?(?:\s+increment\s+(?:by\s+)?(-?\d+))?\s*;?\s*$`)
+var dropSequenceRe = regexp.MustCompile(`(?is)^\s*drop\s+sequence\s+(\w+)\s*;?\s*$`)
+var alterTableRe = regexp.MustCompile(`(?is)^\s*alter\s+table\s+(\w+)\s+(add|modify|drop|rename)\s+(?:column\s+)?(.+?)\s*;?\s*$`)
+var renameColumnRe = regexp.MustCompile(`(?is)^(\w+)\s+to\s+(\w+)$`)
+var usingRe = regexp.MustCompile(`(?i)\s+using\s+`)
+var alterCollectionRe = regexp.MustCompile(`(?is)^\s*alter\s+collection\s+(\w+)\s+schema\s+(?:'((?:[^']|'')*)'|(\{.*\}))(?:\s+using\s+(.+?))?\s*;?\s*$`)
+var createCollectionRe = regexp.MustCompile(`(?is)^\s*create\s+collection\s+(\w+)\s+schema\s+(?:'((?:[^']|'')*)'|(\{.*\}))\s*;?\s*$`)
+var vacuumRe = regexp.MustCompile(`(?is)^\s*vacuum(?:\s+(?:table\s+)?(\w+))?\s*;?\s*$`)
+
+func nativeCommand(sql string, db *table.Database) (map[string]interface{}, bool, error) {
+	if match := createIndexRe.FindStringSubmatch(sql); match != nil {
+		response, err := createIndex(db, match[1], match[2], splitColumns(match[3]))
+		return response, true, err
+	}
+	if match := createSequenceRe.FindStringSubmatch(sql); match != nil {
+		response, err := createSequence(db, match[1], match[2], match[3])
+		return response, true, err
+	}
+	if match := dropSequenceRe.FindStringSubmatch(sql); match != nil {
+		response := map[string]interface{}{"sequence": match[1], "ok": true}
+		err := db.DropSequence(match[1])
+		if err != nil {
+			response["ok"] = false
+		}
+		return response, true, err
+	}
+	if match := createCollectionRe.FindStringSubmatch(sql); match != nil {
+		response, err := createCollection(db, match[1], schemaLiteral(match[2], match[3]))
+		return response, true, err
+	}
+	if match := alterCollectionRe.FindStringSubmatch(sql); match != nil {
+		response, err := alterCollection(db, match[1], schemaLiteral(match[2], match[3]), match[4])
+		return response, true, err
+	}
+	if match := alterTableRe.FindStringSubmatch(sql); match != nil {
+		response, err := alterTable(db, match[1], strings.ToLower(match[2]), match[3])
+		return response, true, err
+	}
+	if match := vacuumRe.FindStringSubmatch(sql); match != nil {
+		response, err := vacuum(db, match[1])
+		return response, true, err
+	}
+	return nil, false, nil
+}
+
+func splitColumns(list string) []string {
+	var columns []string
+	for _, column := range strings.Split(list, ",") {
+		column = strings.Trim(strings.TrimSpace(column), "`")
+		if column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+func createIndex(db *table.Database, name string, tableName string, columns []string) (map[string]interface{}, error) {
+	response := make(map[string]interface{})
+	response["table"] = tableName
+	response["index"] = name
+	t, err := db.GetTable(tableName)
+	if err != nil {
+		response["ok"] = false
+		return response, err
+	}
+	if len(columns) == 1 {
+		column, path, asText, ok := parsePathExpr(columns[0])
+		if !ok {
+			response["ok"] = false
+			return response, fmt.Errorf("Single column indexes are created with the table, use at least two columns or a path")
+		}
+		err = t.CreatePathIndex(name, column, path, asText)
+	} else {
+		err = t.CreateCompositeIndex(name, columns)
+	}
+	if err != nil {
+		response["ok"] = false
+		return response, err
+	}
+	response["ok"] = true
+	return response, nil
+}
+
+func createSequence(db *table.Database, name string, start string, increment string) (map[string]interface{}, error) {
+	response := make(map[string]interface{})
+	response["sequence"] = name
+	startValue, incrementValue := int64(1), int64(1)
+	if start != "" {
+		startValue, _ = strconv.ParseInt(start, 10, 64)
+	}
+	if increment != "" {
+		incrementValue, _ = strconv.ParseInt(increment, 10, 64)
+	}
+	_, err := db.CreateSequence(name, startValue, incrementValue)
+	if err != nil {
+		response["ok"] = false
+		return response, err
+	}
+	response["ok"] = true
+	return response, nil
+}
+
+// schemaLiteral returns the JSON of a SCHEMA clause, given either quoted or
+// as is. Only quotes are unescaped, backslashes belong to the JSON
+func schemaLiteral(quoted string, bare string) string {
+	if bare != "" {
+		return bare
+	}
+	return strings.ReplaceAll(quoted, "''", "'")
+}
+
+// collectionSchema completes a collection JSON Schema. Documents need an id,
+// a string one generated as UUIDv4 is added when the schema has none
+func collectionSchema(schema string) (string, error) {
+	var jsonSchema map[string]interface{}
+	err := json.Unmarshal([]byte(schema), &jsonSchema)
+	if err != nil {
+		return "", fmt.Errorf("Error unmarshalling schema: %s", err)
+	}
+	if schemaType, ok := jsonSchema["type"]; ok && schemaType != "object" {
+		return "", fmt.Errorf("Collection schema must be of type object, found %v", schemaType)
+	}
+	jsonSchema["type"] = "object"
+	properties, ok := jsonSchema["properties"].(map[string]interface{})
+	if !ok {
+		properties = make(map[string]interface{})
+		jsonSchema["properties"] = properties
+	}
+	if id, ok := properties["id"].(map[string]interface{}); ok {
+		if id["type"] != "integer" && id["type"] != "string" {
+			return "", fmt.Errorf("Collection id must be an integer or a string")
+		}
+	} else {
+		properties["id"] = map[string]interface{}{"type": "string", "generator": table.UUIDv4Generator}
+	}
+
+	finalSchema, err := json.Marshal(jsonSchema)
+	if err != nil {
+		return "", fmt.Errorf("Error marshalling schema: %s", err)
+	}
+	return string(finalSchema), nil
+}
+
+// createCollection creates a table from a full JSON Schema
+func createCollection(db *table.Database, name string, schema string) (map[string]interface{}, error) {
+	response := make(map[string]interface{})
+	response["table"] = name
+
+	schema, err := collectionSchema(schema)
+	if err != nil {
+		response["ok"] = false
+		return response, err
+	}
+	response["schema"] = schema
+	_, err = db.NewTable(name, schema)
+	if err != nil {
+		response["ok"] = false
+		return response, err
+	}
+	response["ok"] = true
+	return response, nil
+}
+
+// alterCollection replaces the JSON Schema of a table, using holds the
+// assignments migrating the existing documents
+func alterCollection(db *table.Database, name string, schema string, using string) (map[string]interface{}, error) {
+	response := make(map[string]interface{})
+	response["table"] = name
+	t, err := db.GetTable(name)
+	if err != nil {
+		response["ok"] = false
+		return response, err
+	}
+	schema, err = collectionSchema(schema)
+	if err != nil {
+		response["ok"] = false
+		return response, err
+	}
+	var migrations []table.Migration
+	if using != "" {
+		migrations, err = parseAssignments(using)
+		if err != nil {
+			response["ok"] = false
+			return response, err
+		}
+	}
+	version, err := t.AlterSchema(schema, migrations)
+	if err != nil {
+		response["ok"] = false
+		return response, err
+	}
+	response["version"] = version
+	response["ok"] = true
+	return response, nil
+}
+
+// alterTable runs ADD, MODIFY, DROP and RENAME COLUMN. sqlparser accepts
+// ALTER TABLE but keeps none of its details
+func alterTable(db *table.Database, name string, action string, spec string) (map[string]interface{}, error) {
+	response := make(map[string]interface{})
+	response["table"] = name
+	t, err := db.GetTable(name)
+	if err != nil {
+		response["ok"] = false
+		return response, err
+	}
+
+	var version int
+	switch action {
+	case "add", "modify":
+		definition, using := spec, ""
+		if loc := findOutsideStrings(usingRe, spec); loc != nil {
+			definition, using = spec[:loc[0]], spec[loc[1]:]
+		}
+		var column string
+		var prop map[string]interface{}
+		var required bool
+		column, prop, required, err = parseColumnDefinition(definition)
+		if err != nil {
+			break
+		}
+		var expr *table.Expr
+		if using != "" {
+			expr, err = parseUsing(using)
+			if err != nil {
+				break
+			}
+		}
+		if action == "add" {
+			version, err = t.AddColumn(column, prop, required, expr)
+		} else {
+			version, err = t.ModifyColumn(column, prop, required, expr)
+		}
+	case "drop":
+		version, err = t.DropColumn(strings.Trim(spec, "`"))
+	case "rename":
+		match := renameColumnRe.FindStringSubmatch(spec)
+		if match == nil {
+			err = fmt.Errorf("Expected RENAME COLUMN old TO new")
+			break
+		}
+		version, err = t.RenameColumn(match[1], match[2])
+	}
+	if err != nil {
+		response["ok"] = false
+		return response, err
+	}
+	response["version"] = version
+	response["ok"] = true
+	return response, nil
+}
+
+// parseColumnDefinition maps a single column definition the same way
+// CREATE TABLE does
+func parseColumnDefinition(definition string) (string, map[string]interface{}, bool, error) {
+	stmt, err := sqlparser.Parse(rewriteTypes("create table t (" + definition + ")"))
+	if err != nil {
+		return "", nil, false, fmt.Errorf("Invalid column definition %s: %s", definition, err)
+	}
+	ddl, ok := stmt.(*sqlparser.DDL)
+	if !ok || ddl.TableSpec == nil || len(ddl.TableSpec.Columns) != 1 {
+		return "", nil, false, fmt.Errorf("Invalid column definition: %s", definition)
+	}
+	schema, err := columnsToSchemaMap(ddl.TableSpec.Columns)
+	if err != nil {
+		return "", nil, false, err
+	}
+	column := ddl.TableSpec.Columns[0].Name.String()
+	_, required := schema["required"]
+	return column, schema["properties"].(map[string]interface{})[column].(map[string]interface{}), required, nil
+}
+
+// vacuum removes the row versions no transaction needs from one table, or
+// from all of them without a name
+func vacuum(db *table.Database, name string) (map[string]interface{}, error) {
+	response := make(map[string]interface{})
+	names := []string{name}
+	if name == "" {
+		var err error
+		names, err = db.ListTables()
+		if err != nil {
+			response["ok"] = false
+			return response, err
+		}
+	} else {
+		response["table"] = name
+	}
+	removed := 0
+	for _, name := range names {
+		t, err := db.GetTable(name)
+		if err != nil {
+			response["ok"] = false
+			return response, err
+		}
+		count, err := t.Vacuum()
+		if err != nil {
+			response["ok"] = false
+			return response, fmt.Errorf("Error vacuuming %s: %s", name, err)
+		}
+		removed += count
+	}
+	response["removed"] = removed
+	response["ok"] = true
+	return response, nil
+}
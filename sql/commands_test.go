@@ -0,0 +1,87 @@
+package sql
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// TestAlterTable changes a table holding rows and reads them back, the rows
+// stay in their old version on disk and are migrated when read
+func TestAlterTable(t *testing.T) {
+	tests := []struct {
+		name   string
+		alter  []string
+		insert string
+		where  string
+		column string
+		want   []string
+	}{
+		{
+			name:   "widen INT to DOUBLE",
+			alter:  []string{"MODIFY COLUMN price DOUBLE"},
+			where:  "price = 10",
+			column: "id",
+			want:   []string{"1"},
+		},
+		{
+			name:   "widen INT to DOUBLE and insert a fraction",
+			alter:  []string{"MODIFY COLUMN price DOUBLE"},
+			insert: "(3, 10.5, 'd')",
+			where:  "price > 10.2",
+			column: "id",
+			want:   []string{"2", "3"},
+		},
+		{
+			name:   "add a column computed from another",
+			alter:  []string{"ADD COLUMN total INT USING price * 2"},
+			where:  "total = 40",
+			column: "id",
+			want:   []string{"2"},
+		},
+		{
+			name:   "rename a column",
+			alter:  []string{"RENAME COLUMN price TO cost"},
+			where:  "cost = 20",
+			column: "label",
+			want:   []string{"c"},
+		},
+		{
+			name:   "drop a column",
+			alter:  []string{"DROP COLUMN label"},
+			where:  "id = 1",
+			column: "label",
+			want:   []string{"<nil>"},
+		},
+		{
+			name:   "two versions",
+			alter:  []string{"ADD COLUMN total INT USING price + 1", "RENAME COLUMN total TO bumped"},
+			where:  "bumped = 11",
+			column: "id",
+			want:   []string{"1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSession()
+			name := testTableName(t)
+			mustExec(t, s, fmt.Sprintf("CREATE TABLE %s (id INT PRIMARY KEY, price INT, label VARCHAR(20))", name))
+			mustExec(t, s, fmt.Sprintf("INSERT INTO %s (id, price, label) VALUES (1, 10, 'a b')", name))
+			mustExec(t, s, fmt.Sprintf("INSERT INTO %s (id, price, label) VALUES (2, 20, 'c')", name))
+			for _, alter := range tt.alter {
+				mustExec(t, s, fmt.Sprintf("ALTER TABLE %s %s", name, alter))
+			}
+			if tt.insert != "" {
+				mustExec(t, s, fmt.Sprintf("INSERT INTO %s (id, price, label) VALUES %s", name, tt.insert))
+			}
+			response := mustExec(t, s, fmt.Sprintf("SELECT * FROM %s WHERE %s", name, tt.where))
+			got := resultColumn(t, response, tt.column)
+			if tt.column == "id" {
+				got = resultIds(t, response)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"github.com/xwb1989/sqlparser"
+	"regexp"
+	"strings"
+)
+
+// Mirrors sqlparser unexported column key options
+const (
+	colKeyPrimary   sqlparser.ColumnKeyOption = 1
+	colKeyUnique    sqlparser.ColumnKeyOption = 3
+	colKeyUniqueKey sqlparser.ColumnKeyOption = 4
+)
+
+var createTableRe = regexp.MustCompile(`(?is)^\s*create\s+table\s`)
+var checkRe = regexp.MustCompile(`(?i)(,\s*)?(constraint\s+\w+\s+)?\bcheck\s*\(`)
+var foreignKeyRe = regexp.MustCompile(`(?i),\s*(constraint\s+\w+\s+)?foreign\s+key\s*\(\s*` + "`?" + `(\w+)` + "`?" + `\s*\)\s*references\s+` + "`?" + `(\w+)` + "`?" + `\s*\(\s*` + "`?" + `(\w+)` + "`?" + `\s*\)((?:\s+on\s+(?:delete|update)\s+(?:restrict|cascade|set\s+null|no\s+action))*)`)
+var onDeleteRe = regexp.MustCompile(`(?i)on\s+delete\s+(restrict|cascade|set\s+null|no\s+action)`)
+
+// tableConstraints are the constraints sqlparser does not understand, they
+// are taken out of the CREATE TABLE statement before parsing it
+type tableConstraints struct {
+	checks      []table.Check
+	foreignKeys []table.ForeignKey
+}
+
+func extractConstraints(sql string) (string, tableConstraints, error) {
+	var constraints tableConstraints
+	if !createTableRe.MatchString(sql) {
+		return sql, constraints, nil
+	}
+
+	sql, checks, err := extractChecks(sql)
+	if err != nil {
+		return "", constraints, err
+	}
+	constraints.checks = checks
+
+	for {
+		loc := findOutsideStrings(foreignKeyRe, sql)
+		if loc == nil {
+			break
+		}
+		match := foreignKeyRe.FindStringSubmatch(sql[loc[0]:loc[1]])
+		if !strings.EqualFold(match[4], "id") {
+			return "", constraints, fmt.Errorf("Foreign keys can only reference id, found %s(%s)", match[3], match[4])
+		}
+		fk := table.ForeignKey{Column: match[2], References: match[3], OnDelete: table.Restrict}
+		// ids cannot be updated so ON UPDATE is accepted but has nothing to do
+		if action := onDeleteRe.FindStringSubmatch(match[5]); action != nil {
+			switch strings.Join(strings.Fields(strings.ToLower(action[1])), " ") {
+			case "cascade":
+				fk.OnDelete = table.Cascade
+			case "set null":
+				fk.OnDelete = table.SetNull
+			}
+		}
+		constraints.foreignKeys = append(constraints.foreignKeys, fk)
+		sql = sql[:loc[0]] + sql[loc[1]:]
+	}
+	return sql, constraints, nil
+}
+
+// extractChecks removes the CHECK constraints from a CREATE TABLE statement
+func extractChecks(sql string) (string, []table.Check, error) {
+	var checks []table.Check
+
+	for {
+		loc := findOutsideStrings(checkRe, sql)
+		if loc == nil {
+			break
+		}
+		end, err := closingParen(sql, loc[1]-1)
+		if err != nil {
+			return "", nil, err
+		}
+		expr := strings.TrimSpace(sql[loc[1]:end])
+		clause, err := parseCheckExpr(expr)
+		if err != nil {
+			return "", nil, err
+		}
+		checks = append(checks, table.Check{Expr: expr, Clause: *clause})
+		sql = sql[:loc[0]] + " " + sql[end+1:]
+	}
+	return sql, checks, nil
+}
+
+func parseCheckExpr(expr string) (*table.WhereClause, error) {
+	stmt, err := sqlparser.Parse("select * from t where " + expr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CHECK expression %s: %s", expr, err)
+	}
+	where := stmt.(*sqlparser.Select).Where.Expr
+	if err = checkOperands(where); err != nil {
+		return nil, fmt.Errorf("Unsupported CHECK expression %s: %s", expr, err)
+	}
+	clause, err := parseWhereExpr(where)
+	if err != nil {
+		return nil, fmt.Errorf("Unsupported CHECK expression: %s", expr)
+	}
+	return clause, nil
+}
+
+// checkOperands makes sure comparisons have a column on the left and
+// constants on the right, a CHECK cannot compare two columns
+func checkOperands(expr sqlparser.Expr) error {
+	return sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		var left sqlparser.Expr
+		var right []sqlparser.Expr
+		switch node := node.(type) {
+		case *sqlparser.ComparisonExpr:
+			// 'x' = ANY(tags) looks the constant up in the column
+			if fn, ok := node.Right.(*sqlparser.FuncExpr); ok && fn.Name.Lowered() == "any" {
+				return false, nil
+			}
+			left, right = node.Left, []sqlparser.Expr{node.Right}
+		case *sqlparser.RangeCond:
+			left, right = node.Left, []sqlparser.Expr{node.From, node.To}
+		default:
+			return true, nil
+		}
+		if _, _, _, ok := pathOperand(left); !ok {
+			return false, fmt.Errorf("the left side of %s is not a column", sqlparser.String(node))
+		}
+		for _, operand := range right {
+			err := sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+				if column, ok := node.(*sqlparser.ColName); ok {
+					return false, fmt.Errorf("comparing with column %s is not supported, compare with a constant", sqlparser.String(column))
+				}
+				return true, nil
+			}, operand)
+			if err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}, expr)
+}
+
+// findOutsideStrings is like FindStringIndex but skips matches that start
+// inside a quoted literal
+func findOutsideStrings(re *regexp.Regexp, sql string) []int {
+	for _, loc := range re.FindAllStringIndex(sql, -1) {
+		if !insideString(sql, loc[0]) {
+			return loc
+		}
+	}
+	return nil
+}
+
+func insideString(sql string, pos int) bool {
+	var quote byte
+	for i := 0; i < pos; i++ {
+		c := sql[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == '\'' || c == '"' || c == '`' {
+			quote = c
+		}
+	}
+	return quote != 0
+}
+
+// closingParen returns the position of the parenthesis closing the one at open
+func closingParen(sql string, open int) (int, error) {
+	depth := 0
+	var quote byte
+	for i := open; i < len(sql); i++ {
+		c := sql[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '\'', '"', '`':
+			quote = c
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("Unbalanced parenthesis near: %s", sql[open:])
+}
@@ -0,0 +1,88 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCheckConstraints(t *testing.T) {
+	tests := []struct {
+		name      string
+		check     string
+		createErr string
+		inserts   map[string]bool
+	}{
+		{name: "constant", check: "CHECK (a > 0)", inserts: map[string]bool{"(1, 1, 2)": true, "(2, 0, 2)": false}},
+		{name: "range", check: "CHECK (a BETWEEN 1 AND 10)", inserts: map[string]bool{"(1, 5, 0)": true, "(2, 11, 0)": false}},
+		{name: "and", check: "CHECK (a > 0 AND b < 100)", inserts: map[string]bool{"(1, 1, 2)": true, "(2, 1, 200)": false}},
+		{name: "two columns", check: "CHECK (a < b)", createErr: "comparing with column b is not supported"},
+		{name: "column on the right", check: "CHECK (0 < a)", createErr: "the left side of 0 < a is not a column"},
+		{name: "column in a range", check: "CHECK (a BETWEEN 0 AND b)", createErr: "comparing with column b is not supported"},
+	}
+	s := NewSession()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := testTableName(t)
+			_, err := s.Execute(fmt.Sprintf("CREATE TABLE %s (id INT PRIMARY KEY, a INT, b INT, %s)", name, tt.check))
+			if tt.createErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.createErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.createErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for values, ok := range tt.inserts {
+				_, err = s.Execute(fmt.Sprintf("INSERT INTO %s (id, a, b) VALUES %s", name, values))
+				if ok && err != nil {
+					t.Errorf("%s: %s", values, err)
+				}
+				if !ok && (err == nil || !strings.Contains(err.Error(), "CHECK constraint violated")) {
+					t.Errorf("%s: got %v, want a CHECK violation", values, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	s := NewSession()
+	name := testTableName(t)
+	mustExec(t, s, fmt.Sprintf("CREATE TABLE %s (id INT PRIMARY KEY, age INT DEFAULT 18, tier INT NOT NULL DEFAULT 1)", name))
+
+	tests := []struct {
+		name    string
+		insert  string
+		age     string
+		level   string
+		wantErr string
+	}{
+		{name: "left out", insert: "(id) VALUES (1)", age: "18", level: "1"},
+		{name: "given", insert: "(id, age, tier) VALUES (2, 30, 2)", age: "30", level: "2"},
+		{name: "explicit null", insert: "(id, age) VALUES (3, NULL)", age: "<nil>", level: "1"},
+		{name: "explicit null on not null", insert: "(id, tier) VALUES (4, NULL)", wantErr: "NOT NULL constraint violated on tier"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Execute(fmt.Sprintf("INSERT INTO %s %s", name, tt.insert))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			response := mustExec(t, s, fmt.Sprintf("SELECT * FROM %s WHERE id = %d", name, i+1))
+			if age := resultColumn(t, response, "age"); len(age) != 1 || age[0] != tt.age {
+				t.Errorf("age is %v, want %s", age, tt.age)
+			}
+			if level := resultColumn(t, response, "tier"); len(level) != 1 || level[0] != tt.level {
+				t.Errorf("tier is %v, want %s", level, tt.level)
+			}
+		})
+	}
+}
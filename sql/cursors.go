@@ -0,0 +1,209 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"github.com/xwb1989/sqlparser"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var declareRe = regexp.MustCompile(`(?is)^\s*declare\s+(\w+)\s+(?:(?:no\s+)?scroll\s+)?cursor\s+(?:with(?:out)?\s+hold\s+)?for\s+(.+?)\s*;?\s*$`)
+var fetchRe = regexp.MustCompile(`(?is)^\s*fetch\s+(?:(next|all|forward\s+all|forward\s+\d+|\d+)\s+)?(?:(?:from|in)\s+)?(\w+)\s*;?\s*$`)
+var closeRe = regexp.MustCompile(`(?is)^\s*close\s+(\w+)\s*;?\s*$`)
+
+// cursor keeps the scan of a SELECT for FETCH to go on reading a few rows
+// at a time. A cursor declared in a transaction reads in it and ends with
+// it, outside of one it reads in a transaction of its own until it is
+// closed
+type cursor struct {
+	columns []table.Column
+	rows    *table.Rows
+	lock    string
+	tx      *table.Tx
+	owned   bool
+}
+
+// cursorCommand runs DECLARE name CURSOR FOR SELECT ..., FETCH [n | ALL]
+// FROM name and CLOSE name. Fetched rows go to w, or in the response when
+// it is nil
+func (s *Session) cursorCommand(ctx context.Context, sql string, w RowWriter) (map[string]interface{}, bool, error) {
+	response := map[string]interface{}{"ok": true}
+	var err error
+	switch {
+	case declareRe.MatchString(sql):
+		match := declareRe.FindStringSubmatch(sql)
+		response["cursor"] = match[1]
+		err = s.declareCursor(ctx, match[1], match[2])
+	case fetchRe.MatchString(sql):
+		match := fetchRe.FindStringSubmatch(sql)
+		response["cursor"] = match[2]
+		c, ok := s.cursor(match[2])
+		if !ok {
+			err = fmt.Errorf("Cursor %s does not exist", match[2])
+			break
+		}
+		count := 1
+		switch how := strings.ToLower(strings.Join(strings.Fields(match[1]), " ")); {
+		case how == "all" || how == "forward all":
+			count = -1
+		case strings.HasPrefix(how, "forward "):
+			count, _ = strconv.Atoi(how[len("forward "):])
+		case how != "" && how != "next":
+			count, _ = strconv.Atoi(how)
+		}
+		var collected *collector
+		if w == nil {
+			collected = &collector{}
+			w = collected
+		}
+		_, err = s.fetch(ctx, c, count, w)
+		if err == nil && collected != nil {
+			err = collected.respond(response)
+		}
+	case closeRe.MatchString(sql):
+		name := closeRe.FindStringSubmatch(sql)[1]
+		response["cursor"] = name
+		err = s.CloseCursor(name)
+	default:
+		return nil, false, nil
+	}
+	if err != nil {
+		response["ok"] = false
+	}
+	return response, true, err
+}
+
+// declareCursor starts the scan of a SELECT, its rows are read by FETCH
+func (s *Session) declareCursor(ctx context.Context, name string, query string) error {
+	stmt, err := sqlparser.Parse(rewriteJSONOperators(rewriteTypes(query)))
+	if err != nil {
+		return err
+	}
+	selectStmt, ok := stmt.(*sqlparser.Select)
+	if !ok || isDual(selectStmt) {
+		return fmt.Errorf("Cursors can only be declared for a SELECT from a table")
+	}
+	return s.openCursor(ctx, name, selectStmt)
+}
+
+func (s *Session) openCursor(ctx context.Context, name string, stmt *sqlparser.Select) error {
+	if _, ok := s.cursors[name]; ok {
+		return fmt.Errorf("Cursor %s already exists", name)
+	}
+	c := &cursor{lock: stmt.Lock, tx: s.tx}
+	var err error
+	if c.tx == nil {
+		c.tx, err = s.db.Begin()
+		if err != nil {
+			return err
+		}
+		c.owned = true
+	}
+	c.tx.SetContext(ctx)
+	c.rows, c.columns, err = scanSelect(stmt, c.tx)
+	if c.rows != nil {
+		c.rows.Close()
+	}
+	c.tx.EndStatement()
+	if err != nil {
+		if c.owned {
+			c.tx.Rollback()
+		}
+		return err
+	}
+	if s.cursors == nil {
+		s.cursors = make(map[string]*cursor)
+	}
+	s.cursors[name] = c
+	return nil
+}
+
+// fetch sends the next count rows of a cursor to w, all of them when count
+// is negative, from where the last FETCH stopped
+func (s *Session) fetch(ctx context.Context, c *cursor, count int, w RowWriter) (int, error) {
+	c.tx.SetContext(ctx)
+	err := c.rows.Reopen(c.tx)
+	if err == nil {
+		err = w.Columns(c.columns)
+	}
+	n := 0
+	if err == nil {
+		n, err = copyRows(w, c.rows, count, c.lock)
+	}
+	c.rows.Close()
+	c.tx.EndStatement()
+	if _, ok := err.(*table.DeadlockError); ok && !c.owned {
+		// The others in the cycle wait for the locks of the whole transaction
+		if rollbackErr := s.rollback(); rollbackErr != nil {
+			return n, fmt.Errorf("%s (%s)", err, rollbackErr)
+		}
+		return n, fmt.Errorf("%s, the transaction was rolled back", err)
+	}
+	return n, err
+}
+
+// DeclarePrepared opens cursor name on a prepared SELECT with args bound to
+// its placeholders, FetchRows reads it. The PostgreSQL protocol reads
+// portals asking for a few rows at a time through one
+func (s *Session) DeclarePrepared(ctx context.Context, name string, p *Prepared, args []interface{}) error {
+	if !p.IsSelect() {
+		return fmt.Errorf("Cursors can only be declared for a SELECT from a table")
+	}
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	s.begin(p.SQL, cancel)
+	err := p.bind(args)
+	if err == nil {
+		err = s.openCursor(ctx, name, p.stmt.(*sqlparser.Select))
+	}
+	s.end(err)
+	return err
+}
+
+// FetchRows sends the next count rows of cursor name to w, all of them when
+// count is negative. It returns how many were sent
+func (s *Session) FetchRows(ctx context.Context, name string, count int, w RowWriter) (int, error) {
+	c, ok := s.cursor(name)
+	if !ok {
+		return 0, fmt.Errorf("Cursor %s does not exist", name)
+	}
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	s.begin(fmt.Sprintf("FETCH %d FROM %s", count, name), cancel)
+	n, err := s.fetch(ctx, c, count, w)
+	s.end(err)
+	return n, err
+}
+
+// CloseCursor forgets cursor name
+func (s *Session) CloseCursor(name string) error {
+	if _, ok := s.cursors[name]; !ok {
+		return fmt.Errorf("Cursor %s does not exist", name)
+	}
+	return s.closeCursor(name)
+}
+
+// cursor returns cursor name, a cursor declared in a transaction is gone
+// once the transaction is over
+func (s *Session) cursor(name string) (*cursor, bool) {
+	c, ok := s.cursors[name]
+	if ok && !c.owned && c.tx != s.tx {
+		s.closeCursor(name)
+		return nil, false
+	}
+	return c, ok
+}
+
+// closeCursor forgets a cursor, ending the transaction it owns
+func (s *Session) closeCursor(name string) error {
+	c := s.cursors[name]
+	delete(s.cursors, name)
+	c.rows.Close()
+	if c.owned {
+		return c.tx.Rollback()
+	}
+	return nil
+}
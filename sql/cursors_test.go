@@ -0,0 +1,74 @@
+package sql
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// TestCursorScan fetches a cursor declared outside of a transaction a few
+// rows at a time while another session changes and vacuums the table, the
+// scan goes on where it stopped and sees the rows as they were declared
+func TestCursorScan(t *testing.T) {
+	s := NewSession()
+	other := NewSession()
+	name := testTableName(t)
+	mustExec(t, s, fmt.Sprintf("CREATE TABLE %s (id INT PRIMARY KEY, n INT)", name))
+	mustExec(t, s, fmt.Sprintf("INSERT INTO %s (id, n) VALUES (1, 10), (2, 20), (3, 30), (4, 40), (5, 50)", name))
+	mustExec(t, s, fmt.Sprintf("DECLARE c CURSOR FOR SELECT * FROM %s WHERE n > 10", name))
+
+	steps := []struct {
+		sql string
+		// other runs in another session before the fetch
+		other  []string
+		wantNs []string
+	}{
+		{sql: "FETCH 2 FROM c", wantNs: []string{"20", "30"}},
+		{
+			sql: "FETCH NEXT FROM c",
+			other: []string{
+				fmt.Sprintf("UPDATE %s SET n = 41 WHERE id = 4", name),
+				fmt.Sprintf("DELETE FROM %s WHERE id = 5", name),
+				fmt.Sprintf("INSERT INTO %s (id, n) VALUES (6, 60)", name),
+				fmt.Sprintf("VACUUM %s", name),
+			},
+			wantNs: []string{"40"},
+		},
+		{sql: "FETCH ALL FROM c", wantNs: []string{"50"}},
+		{sql: "FETCH ALL FROM c", wantNs: []string{}},
+	}
+	for _, step := range steps {
+		for _, sql := range step.other {
+			mustExec(t, other, sql)
+		}
+		response := mustExec(t, s, step.sql)
+		if got := resultColumn(t, response, "n"); !reflect.DeepEqual(got, step.wantNs) {
+			t.Errorf("%s: got %v, want %v", step.sql, got, step.wantNs)
+		}
+	}
+
+	mustExec(t, s, "CLOSE c")
+	if _, err := s.Execute("FETCH NEXT FROM c"); err == nil {
+		t.Error("closed cursor was fetched")
+	}
+}
+
+// TestCursorTransaction reads in the transaction a cursor is declared in,
+// the cursor is gone once it ends
+func TestCursorTransaction(t *testing.T) {
+	s := NewSession()
+	name := testTableName(t)
+	mustExec(t, s, fmt.Sprintf("CREATE TABLE %s (id INT PRIMARY KEY, n INT)", name))
+	mustExec(t, s, fmt.Sprintf("INSERT INTO %s (id, n) VALUES (1, 10), (2, 20)", name))
+	mustExec(t, s, "BEGIN")
+	mustExec(t, s, fmt.Sprintf("UPDATE %s SET n = 11 WHERE id = 1", name))
+	mustExec(t, s, fmt.Sprintf("DECLARE c CURSOR FOR SELECT * FROM %s", name))
+	response := mustExec(t, s, "FETCH ALL FROM c")
+	if got, want := resultColumn(t, response, "n"), []string{"20", "11"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	mustExec(t, s, "COMMIT")
+	if _, err := s.Execute("FETCH ALL FROM c"); err == nil {
+		t.Error("cursor outlived its transaction")
+	}
+}
@@ -0,0 +1,278 @@
+package sql
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"github.com/xwb1989/sqlparser"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Description tells what a statement returns and takes without running it
+type Description struct {
+	// Columns of the rows, empty for statements without rows
+	Columns []table.Column
+	// Parameters has the SQL type of each placeholder, empty when the
+	// statement does not tell
+	Parameters []string
+}
+
+// Describe reads the rows and placeholders of a statement. Placeholders are
+// ? in order of appearance or $n by position
+func (s *Session) Describe(sql string) (*Description, error) {
+	count := 0
+	named, err := scanPlaceholders(sql, func(n int) (string, error) {
+		if n > count {
+			count = n
+		}
+		return fmt.Sprintf(":v%d", n), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	description := &Description{Parameters: make([]string, count)}
+	if match := fetchRe.FindStringSubmatch(sql); match != nil {
+		if c, ok := s.cursors[match[2]]; ok {
+			description.Columns = c.columns
+		}
+		return description, nil
+	}
+
+	// Commands sqlparser does not know return no rows
+	stmt, err := sqlparser.Parse(rewriteJSONOperators(rewriteTypes(named)))
+	if err != nil {
+		return description, nil
+	}
+	var tableName string
+	var where *sqlparser.Where
+	switch stmt := stmt.(type) {
+	case *sqlparser.Select:
+		if isDual(stmt) {
+			description.Columns = dualColumns(stmt)
+			return description, nil
+		}
+		tableName = stmt.From[0].(*sqlparser.AliasedTableExpr).Expr.(sqlparser.TableName).Name.CompliantName()
+		where = stmt.Where
+	case *sqlparser.Insert:
+		tableName = stmt.Table.Name.CompliantName()
+	case *sqlparser.Update:
+		tableName = sqlparser.String(stmt.TableExprs[0].(*sqlparser.AliasedTableExpr).Expr)
+		where = stmt.Where
+	case *sqlparser.Delete:
+		tableName = sqlparser.String(stmt.TableExprs[0].(*sqlparser.AliasedTableExpr).Expr)
+		where = stmt.Where
+	default:
+		return description, nil
+	}
+
+	t, err := s.db.GetTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := t.Columns()
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]string, len(columns))
+	for _, column := range columns {
+		types[column.Name] = column.Type
+	}
+	setType := func(column sqlparser.Expr, arg sqlparser.Expr) {
+		name, ok := column.(*sqlparser.ColName)
+		if n, isArg := placeholder(arg); ok && isArg && n <= count {
+			description.Parameters[n-1] = types[name.Name.CompliantName()]
+		}
+	}
+
+	switch stmt := stmt.(type) {
+	case *sqlparser.Select:
+		description.Columns = columns
+	case *sqlparser.Insert:
+		names, err := t.GetColumnNames()
+		if err != nil {
+			return nil, err
+		}
+		if len(stmt.Columns) > 0 {
+			names = make([]string, len(stmt.Columns))
+			for i, column := range stmt.Columns {
+				names[i] = column.CompliantName()
+			}
+		}
+		rows, _ := stmt.Rows.(sqlparser.Values)
+		for _, row := range rows {
+			for i, value := range row {
+				if n, ok := placeholder(value); ok && i < len(names) && n <= count {
+					description.Parameters[n-1] = types[names[i]]
+				}
+			}
+		}
+	case *sqlparser.Update:
+		for _, expr := range stmt.Exprs {
+			setType(expr.Name, expr.Expr)
+		}
+	}
+
+	if where != nil {
+		sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+			switch node := node.(type) {
+			case *sqlparser.ComparisonExpr:
+				setType(node.Left, node.Right)
+				setType(node.Right, node.Left)
+				if tuple, ok := node.Right.(sqlparser.ValTuple); ok {
+					for _, elem := range tuple {
+						setType(node.Left, elem)
+					}
+				}
+			case *sqlparser.RangeCond:
+				setType(node.Left, node.From)
+				setType(node.Left, node.To)
+			}
+			return true, nil
+		}, where.Expr)
+	}
+	return description, nil
+}
+
+// dualColumns types the columns of a SELECT without table, functions are
+// not run
+func dualColumns(stmt *sqlparser.Select) []table.Column {
+	var columns []table.Column
+	for _, expr := range stmt.SelectExprs {
+		aliased, ok := expr.(*sqlparser.AliasedExpr)
+		if !ok {
+			continue
+		}
+		name := sqlparser.String(aliased.Expr)
+		if !aliased.As.IsEmpty() {
+			name = aliased.As.String()
+		}
+		columnType := "TEXT"
+		if fn, ok := aliased.Expr.(*sqlparser.FuncExpr); ok {
+			switch fn.Name.Lowered() {
+			case "nextval", "currval":
+				columnType = "INTEGER"
+			}
+		} else {
+			columnType = valueType(extractValue(aliased.Expr))
+		}
+		columns = append(columns, table.Column{Name: name, Type: columnType})
+	}
+	return columns
+}
+
+// placeholder returns the number of a :vN bind variable
+func placeholder(expr sqlparser.Expr) (int, bool) {
+	val, ok := expr.(*sqlparser.SQLVal)
+	if !ok || val.Type != sqlparser.ValArg || !strings.HasPrefix(string(val.Val), ":v") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(val.Val[2:]))
+	return n, err == nil
+}
+
+// Bind writes the arguments into the placeholders of a statement as SQL
+// literals. Arguments are nil, integers, floats, bools, strings, bytes or
+// times
+func Bind(sql string, args []interface{}) (string, error) {
+	used := make([]bool, len(args))
+	bound, err := scanPlaceholders(sql, func(n int) (string, error) {
+		if n > len(args) {
+			return "", fmt.Errorf("Missing argument for placeholder $%d", n)
+		}
+		used[n-1] = true
+		return Literal(args[n-1])
+	})
+	if err != nil {
+		return "", err
+	}
+	for i, ok := range used {
+		if !ok {
+			return "", fmt.Errorf("Argument %d is not used by any placeholder", i+1)
+		}
+	}
+	return bound, nil
+}
+
+// Literal writes a value the way the parser reads it back
+func Literal(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "NULL", nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int32:
+		return strconv.FormatInt(int64(v), 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case string:
+		return quoteString(v), nil
+	case []byte:
+		return fmt.Sprintf("X'%s'", hex.EncodeToString(v)), nil
+	case time.Time:
+		return quoteString(v.UTC().Format(time.RFC3339Nano)), nil
+	}
+	return "", fmt.Errorf("Unsupported argument type %T", value)
+}
+
+// quoteString writes a string literal, the parser reads backslash escapes
+func quoteString(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// scanPlaceholders replaces every ? and $n outside of quotes with what fn
+// returns for its number, the ? are numbered in order
+func scanPlaceholders(sql string, fn func(n int) (string, error)) (string, error) {
+	var sb strings.Builder
+	next := 0
+	var quote byte
+	for i := 0; i < len(sql); i++ {
+		ch := sql[i]
+		if quote != 0 {
+			sb.WriteByte(ch)
+			if ch == '\\' && i+1 < len(sql) {
+				i++
+				sb.WriteByte(sql[i])
+			} else if ch == quote {
+				quote = 0
+			}
+			continue
+		}
+		n := 0
+		switch {
+		case ch == '\'' || ch == '"' || ch == '`':
+			quote = ch
+		case ch == '?':
+			next++
+			n = next
+		case ch == '$' && i+1 < len(sql) && sql[i+1] >= '0' && sql[i+1] <= '9':
+			end := i + 1
+			for end < len(sql) && sql[end] >= '0' && sql[end] <= '9' {
+				end++
+			}
+			n, _ = strconv.Atoi(sql[i+1 : end])
+			if n < 1 {
+				return "", fmt.Errorf("Invalid placeholder %s", sql[i:end])
+			}
+			i = end - 1
+		}
+		if n == 0 {
+			sb.WriteByte(ch)
+			continue
+		}
+		replacement, err := fn(n)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(replacement)
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,111 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"github.com/xwb1989/sqlparser"
+	"strings"
+)
+
+// parseValueExpr converts an expression computed from a row, like the USING
+// of a schema change, to its table representation
+func parseValueExpr(expr sqlparser.Expr) (*table.Expr, error) {
+	switch expr := expr.(type) {
+	case *sqlparser.ColName:
+		return &table.Expr{Column: expr.Name.String()}, nil
+	case *sqlparser.SQLVal, *sqlparser.NullVal, sqlparser.BoolVal:
+		return &table.Expr{Value: extractValue(expr)}, nil
+	case *sqlparser.ParenExpr:
+		return parseValueExpr(expr.Expr)
+	case *sqlparser.UnaryExpr:
+		if expr.Operator != sqlparser.UMinusStr {
+			break
+		}
+		operand, err := parseValueExpr(expr.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return &table.Expr{Operator: "-", Args: []table.Expr{*operand}}, nil
+	case *sqlparser.BinaryExpr:
+		switch expr.Operator {
+		case sqlparser.PlusStr, sqlparser.MinusStr, sqlparser.MultStr, sqlparser.DivStr:
+		default:
+			return nil, fmt.Errorf("Unsupported operator: %s", expr.Operator)
+		}
+		left, err := parseValueExpr(expr.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := parseValueExpr(expr.Right)
+		if err != nil {
+			return nil, err
+		}
+		return &table.Expr{Operator: expr.Operator, Args: []table.Expr{*left, *right}}, nil
+	case *sqlparser.ConvertExpr:
+		typeName := ""
+		switch strings.ToLower(expr.Type.Type) {
+		case "signed", "unsigned", "integer":
+			typeName = "integer"
+		case "decimal", "float", "double":
+			typeName = "number"
+		case "char", "nchar", "text":
+			typeName = "string"
+		default:
+			return nil, fmt.Errorf("Unsupported cast to %s", expr.Type.Type)
+		}
+		operand, err := parseValueExpr(expr.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return &table.Expr{Func: "cast", Value: typeName, Args: []table.Expr{*operand}}, nil
+	case *sqlparser.FuncExpr:
+		name := expr.Name.Lowered()
+		switch name {
+		case "ifnull":
+			name = "coalesce"
+		case "lower", "upper", "trim", "concat", "coalesce":
+		default:
+			return nil, fmt.Errorf("Unsupported function: %s", expr.Name.String())
+		}
+		fn := &table.Expr{Func: name}
+		for _, arg := range expr.Exprs {
+			aliased, ok := arg.(*sqlparser.AliasedExpr)
+			if !ok {
+				return nil, fmt.Errorf("Unsupported argument: %s", sqlparser.String(arg))
+			}
+			argExpr, err := parseValueExpr(aliased.Expr)
+			if err != nil {
+				return nil, err
+			}
+			fn.Args = append(fn.Args, *argExpr)
+		}
+		return fn, nil
+	}
+	return nil, fmt.Errorf("Unsupported expression: %s", sqlparser.String(expr))
+}
+
+// parseAssignments reads a list like a = expr, b = expr into set migrations
+func parseAssignments(assignments string) ([]table.Migration, error) {
+	stmt, err := sqlparser.Parse("update t set " + assignments)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid migration %s: %s", assignments, err)
+	}
+	var migrations []table.Migration
+	for _, assignment := range stmt.(*sqlparser.Update).Exprs {
+		expr, err := parseValueExpr(assignment.Expr)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, table.Migration{Op: table.SetColumn, Column: assignment.Name.Name.String(), Expr: expr})
+	}
+	return migrations, nil
+}
+
+// parseUsing reads the expression of a USING clause
+func parseUsing(using string) (*table.Expr, error) {
+	migrations, err := parseAssignments("x = " + using)
+	if err != nil {
+		return nil, err
+	}
+	return migrations[0].Expr, nil
+}
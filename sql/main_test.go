@@ -0,0 +1,52 @@
+package sql
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/internal/testutil"
+	"github.com/kimuraz/golang-json-db/table"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	testutil.Main(m, table.SetDataDir)
+}
+
+func testTableName(t *testing.T) string {
+	name := strings.NewReplacer("/", "_", " ", "_", "-", "_").Replace(t.Name())
+	return strings.ToLower(name)
+}
+
+func mustExec(t *testing.T, s *Session, sql string) map[string]interface{} {
+	t.Helper()
+	response, err := s.Execute(sql)
+	if err != nil {
+		t.Fatalf("%s: %s", sql, err)
+	}
+	return response
+}
+
+// resultIds returns the sorted ids of the rows of a SELECT response
+func resultIds(t *testing.T, response map[string]interface{}) []string {
+	t.Helper()
+	ids := resultColumn(t, response, "id")
+	sort.Strings(ids)
+	return ids
+}
+
+// resultColumn returns a column of the rows of a response in their order
+func resultColumn(t *testing.T, response map[string]interface{}, column string) []string {
+	t.Helper()
+	var rows []map[string]interface{}
+	result, _ := response["result"].(string)
+	if err := json.Unmarshal([]byte(result), &rows); err != nil {
+		t.Fatalf("Error reading rows %q: %s", result, err)
+	}
+	values := make([]string, len(rows))
+	for i, row := range rows {
+		values[i] = fmt.Sprintf("%v", row[column])
+	}
+	return values
+}
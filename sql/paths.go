@@ -0,0 +1,119 @@
+package sql
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"github.com/xwb1989/sqlparser"
+	"regexp"
+	"strings"
+)
+
+// sqlparser does not know the JSON operators, they are rewritten into
+// functions before parsing:
+//   data->'address'->>'city'  =>  json_path_text(data, 'address', 'city')
+//   tags @> '["x"]'            =>  json_contains(tags, '["x"]')
+
+const pathStep = `->>?\s*(?:'(?:[^'\\]|\\.)*'|\d+)`
+
+var pathExprRe = regexp.MustCompile(`\b([A-Za-z_]\w*)((?:\s*` + pathStep + `)+)`)
+var pathStepRe = regexp.MustCompile(`->(>?)\s*('(?:[^'\\]|\\.)*'|\d+)`)
+var containsRe = regexp.MustCompile(`(json_path(?:_text)?\([^()]*\)|\b[A-Za-z_]\w*)\s*@>\s*('(?:[^'\\]|\\.)*')`)
+
+// parsePathExpr splits data->'address'->>'city' into its column and path
+func parsePathExpr(expr string) (string, []string, bool, bool) {
+	match := pathExprRe.FindStringSubmatch(strings.TrimSpace(expr))
+	if match == nil || len(match[0]) != len(strings.TrimSpace(expr)) {
+		return "", nil, false, false
+	}
+	var path []string
+	asText := false
+	for _, step := range pathStepRe.FindAllStringSubmatch(match[2], -1) {
+		path = append(path, strings.Trim(step[2], "'"))
+		asText = step[1] == ">"
+	}
+	return match[1], path, asText, true
+}
+
+func rewriteJSONOperators(sql string) string {
+	for {
+		loc := findOutsideStrings(pathExprRe, sql)
+		if loc == nil {
+			break
+		}
+		column, path, asText, _ := parsePathExpr(sql[loc[0]:loc[1]])
+		fn := "json_path"
+		if asText {
+			fn = "json_path_text"
+		}
+		args := []string{column}
+		for _, key := range path {
+			args = append(args, "'"+key+"'")
+		}
+		sql = sql[:loc[0]] + fmt.Sprintf("%s(%s)", fn, strings.Join(args, ", ")) + sql[loc[1]:]
+	}
+	for {
+		loc := findOutsideStrings(containsRe, sql)
+		if loc == nil {
+			break
+		}
+		match := containsRe.FindStringSubmatch(sql[loc[0]:loc[1]])
+		sql = sql[:loc[0]] + fmt.Sprintf("json_contains(%s, %s)", match[1], match[2]) + sql[loc[1]:]
+	}
+	return sql
+}
+
+// pathOperand reads a column, or a json_path call, on the left side of a
+// comparison
+func pathOperand(expr sqlparser.Expr) (string, []string, bool, bool) {
+	switch expr := expr.(type) {
+	case *sqlparser.ColName:
+		return expr.Name.String(), nil, false, true
+	case *sqlparser.FuncExpr:
+		name := expr.Name.Lowered()
+		if (name != "json_path" && name != "json_path_text") || len(expr.Exprs) == 0 {
+			return "", nil, false, false
+		}
+		var args []string
+		for _, arg := range expr.Exprs {
+			aliased, ok := arg.(*sqlparser.AliasedExpr)
+			if !ok {
+				return "", nil, false, false
+			}
+			args = append(args, fmt.Sprintf("%v", extractValue(aliased.Expr)))
+		}
+		return args[0], args[1:], name == "json_path_text", true
+	}
+	return "", nil, false, false
+}
+
+// containsClause turns json_contains(column, '<json>') into a @> clause
+func containsClause(fn *sqlparser.FuncExpr) *table.WhereClause {
+	if len(fn.Exprs) != 2 {
+		return nil
+	}
+	left, ok := fn.Exprs[0].(*sqlparser.AliasedExpr)
+	if !ok {
+		return nil
+	}
+	column, path, asText, ok := pathOperand(left.Expr)
+	if !ok {
+		return nil
+	}
+	right, ok := fn.Exprs[1].(*sqlparser.AliasedExpr)
+	if !ok {
+		return nil
+	}
+	var value interface{}
+	err := json.Unmarshal([]byte(fmt.Sprintf("%v", extractValue(right.Expr))), &value)
+	if err != nil {
+		return nil
+	}
+	return &table.WhereClause{
+		Column:   column,
+		Path:     path,
+		AsText:   asText,
+		Operator: "@>",
+		Value:    value,
+	}
+}
@@ -0,0 +1,434 @@
+package sql
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"github.com/xwb1989/sqlparser"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var prepareRe = regexp.MustCompile(`(?is)^\s*prepare\s+(\w+)\s*(?:\(([^)]*)\))?\s+as\s+(.+?)\s*;?\s*$`)
+var executeRe = regexp.MustCompile(`(?is)^\s*execute\s+(\w+)\s*(?:\((.*)\))?\s*;?\s*$`)
+var deallocateRe = regexp.MustCompile(`(?is)^\s*deallocate\s+(?:prepare\s+)?(\w+)\s*;?\s*$`)
+
+// parameterTypes maps the types PREPARE may declare to the SQL types of the
+// columns
+var parameterTypes = map[string]string{
+	"int": "INTEGER", "integer": "INTEGER", "bigint": "INTEGER", "smallint": "INTEGER",
+	"int2": "INTEGER", "int4": "INTEGER", "int8": "INTEGER",
+	"double": "DOUBLE", "float": "DOUBLE", "float8": "DOUBLE", "real": "DOUBLE", "numeric": "DOUBLE", "decimal": "DOUBLE",
+	"bool": "BOOLEAN", "boolean": "BOOLEAN",
+	"text": "TEXT", "varchar": "TEXT", "char": "TEXT",
+	"date": "DATE", "timestamp": "TIMESTAMP", "timestamptz": "TIMESTAMP", "datetime": "TIMESTAMP",
+	"blob": "BLOB", "bytea": "BLOB",
+	"json": "JSON", "jsonb": "JSON",
+}
+
+// Prepared is a statement parsed once and run many times with different
+// arguments for its placeholders. SELECT, INSERT, UPDATE and DELETE keep
+// their syntax tree, other statements have the arguments written into their
+// text on every run
+type Prepared struct {
+	Name        string
+	SQL         string
+	Description *Description
+	stmt        sqlparser.Statement
+	// slots are the expressions of each placeholder in stmt, set to the
+	// arguments before it runs
+	slots [][]reflect.Value
+}
+
+// Prepare parses a statement with ? or $n placeholders and keeps it in the
+// session under name. The unnamed statement is replaced by every Prepare,
+// other names have to be deallocated first
+func (s *Session) Prepare(name string, sql string) (*Prepared, error) {
+	if _, ok := s.prepared[name]; ok && name != "" {
+		return nil, fmt.Errorf("Prepared statement %s already exists", name)
+	}
+	description, err := s.Describe(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &Prepared{Name: name, SQL: sql, Description: description}
+	named, err := scanPlaceholders(sql, func(n int) (string, error) {
+		return fmt.Sprintf(":v%d", n), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := sqlparser.Parse(rewriteJSONOperators(rewriteTypes(named)))
+	if err == nil {
+		switch stmt.(type) {
+		case *sqlparser.Select, *sqlparser.Insert, *sqlparser.Update, *sqlparser.Delete:
+			p.stmt = stmt
+			p.slots = make([][]reflect.Value, len(description.Parameters))
+			collectSlots(reflect.ValueOf(stmt), p.slots)
+		}
+	}
+	if s.prepared == nil {
+		s.prepared = make(map[string]*Prepared)
+	}
+	s.prepared[name] = p
+	return p, nil
+}
+
+// Prepared returns the statement kept under name
+func (s *Session) Prepared(name string) (*Prepared, bool) {
+	p, ok := s.prepared[name]
+	return p, ok
+}
+
+// Deallocate forgets the statement kept under name
+func (s *Session) Deallocate(name string) error {
+	if _, ok := s.prepared[name]; !ok {
+		return fmt.Errorf("Prepared statement %s does not exist", name)
+	}
+	delete(s.prepared, name)
+	return nil
+}
+
+// ExecutePrepared runs a prepared statement with an argument for each of its
+// placeholders. Arguments are checked against the type of the column their
+// placeholder is compared with or written to
+func (s *Session) ExecutePrepared(p *Prepared, args []interface{}) (map[string]interface{}, error) {
+	return s.ExecutePreparedContext(context.Background(), p, args)
+}
+
+// ExecutePreparedContext runs a prepared statement until ctx is done, like
+// ExecuteContext
+func (s *Session) ExecutePreparedContext(ctx context.Context, p *Prepared, args []interface{}) (map[string]interface{}, error) {
+	return s.ExecutePreparedRows(ctx, p, args, nil)
+}
+
+// ExecutePreparedRows runs a prepared statement sending its rows to w, like
+// ExecuteRows
+func (s *Session) ExecutePreparedRows(ctx context.Context, p *Prepared, args []interface{}, w RowWriter) (map[string]interface{}, error) {
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	s.begin(p.SQL, cancel)
+	response, err := s.executePrepared(ctx, p, args, w)
+	s.end(err)
+	return response, err
+}
+
+func (s *Session) executePrepared(ctx context.Context, p *Prepared, args []interface{}, w RowWriter) (map[string]interface{}, error) {
+	if p.stmt == nil {
+		args, err := p.checkArgs(args)
+		if err != nil {
+			return map[string]interface{}{"ok": false}, err
+		}
+		query, err := Bind(p.SQL, args)
+		if err != nil {
+			return map[string]interface{}{"ok": false}, err
+		}
+		return s.execute(ctx, query, w)
+	}
+	if err := p.bind(args); err != nil {
+		return map[string]interface{}{"ok": false}, err
+	}
+	return s.run(ctx, p.SQL, func(tx *table.Tx) (map[string]interface{}, error) {
+		return executeStatement(p.stmt, p.SQL, tableConstraints{}, tx, w)
+	})
+}
+
+// IsSelect tells if the statement is a SELECT from a table, cursors can be
+// declared on it
+func (p *Prepared) IsSelect() bool {
+	stmt, ok := p.stmt.(*sqlparser.Select)
+	return ok && !isDual(stmt)
+}
+
+// checkArgs checks there is an argument of the right type for each
+// placeholder
+func (p *Prepared) checkArgs(args []interface{}) ([]interface{}, error) {
+	if len(args) != len(p.Description.Parameters) {
+		return nil, fmt.Errorf("Statement takes %d parameters, got %d", len(p.Description.Parameters), len(args))
+	}
+	return checkArgs(p.Description.Parameters, args)
+}
+
+// bind writes the arguments into the placeholders of the syntax tree
+func (p *Prepared) bind(args []interface{}) error {
+	args, err := p.checkArgs(args)
+	if err != nil {
+		return err
+	}
+	for i, slots := range p.slots {
+		expr, err := literalExpr(args[i])
+		if err != nil {
+			return err
+		}
+		for _, slot := range slots {
+			slot.Set(reflect.ValueOf(expr))
+		}
+	}
+	return nil
+}
+
+// preparedCommand runs PREPARE name [(types)] AS statement, EXECUTE
+// name[(arguments)] and DEALLOCATE [PREPARE] name | ALL
+func (s *Session) preparedCommand(ctx context.Context, sql string, w RowWriter) (map[string]interface{}, bool, error) {
+	response := map[string]interface{}{"ok": true}
+	var err error
+	switch {
+	case prepareRe.MatchString(sql):
+		match := prepareRe.FindStringSubmatch(sql)
+		response["statement"] = match[1]
+		var p *Prepared
+		p, err = s.Prepare(match[1], match[3])
+		if err != nil {
+			break
+		}
+		err = declareTypes(p, match[2])
+		if err != nil {
+			delete(s.prepared, match[1])
+			break
+		}
+		response["parameters"] = p.Description.Parameters
+	case executeRe.MatchString(sql):
+		match := executeRe.FindStringSubmatch(sql)
+		p, ok := s.prepared[match[1]]
+		if !ok {
+			response["statement"] = match[1]
+			err = fmt.Errorf("Prepared statement %s does not exist", match[1])
+			break
+		}
+		var args []interface{}
+		args, err = parseArgs(match[2])
+		if err != nil {
+			break
+		}
+		response, err = s.executePrepared(ctx, p, args, w)
+		if response == nil {
+			response = map[string]interface{}{"ok": false}
+		}
+		response["statement"] = match[1]
+		return response, true, err
+	case deallocateRe.MatchString(sql):
+		name := deallocateRe.FindStringSubmatch(sql)[1]
+		response["statement"] = name
+		if strings.EqualFold(name, "all") {
+			s.prepared = nil
+			break
+		}
+		err = s.Deallocate(name)
+	default:
+		return nil, false, nil
+	}
+	if err != nil {
+		response["ok"] = false
+	}
+	return response, true, err
+}
+
+// declareTypes sets the parameter types listed by PREPARE, they take the
+// place of the ones read from the columns
+func declareTypes(p *Prepared, list string) error {
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+	names := splitColumns(list)
+	if len(names) < len(p.Description.Parameters) {
+		return fmt.Errorf("PREPARE declares %d parameter types, the statement has %d parameters", len(names), len(p.Description.Parameters))
+	}
+	types := make([]string, len(names))
+	for i, name := range names {
+		words := strings.Fields(strings.ToLower(name))
+		if len(words) == 0 {
+			return fmt.Errorf("Missing parameter type %d", i+1)
+		}
+		sqlType, ok := parameterTypes[words[0]]
+		if !ok {
+			return fmt.Errorf("Unsupported parameter type %s", name)
+		}
+		types[i] = sqlType
+	}
+	p.Description.Parameters = types
+	for len(p.slots) < len(types) {
+		p.slots = append(p.slots, nil)
+	}
+	return nil
+}
+
+// parseArgs reads the literals given to EXECUTE
+func parseArgs(list string) ([]interface{}, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	stmt, err := sqlparser.Parse("SELECT " + list)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing arguments: %s", err)
+	}
+	selectExprs := stmt.(*sqlparser.Select).SelectExprs
+	args := make([]interface{}, len(selectExprs))
+	for i, expr := range selectExprs {
+		aliased, ok := expr.(*sqlparser.AliasedExpr)
+		if !ok {
+			return nil, fmt.Errorf("Invalid argument %s", sqlparser.String(expr))
+		}
+		args[i] = extractValue(aliased.Expr)
+	}
+	return args, nil
+}
+
+// collectSlots finds the :vN placeholders of a syntax tree, slots[n-1]
+// gets the settable expressions holding the n-th one
+func collectSlots(v reflect.Value, slots [][]reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			collectSlots(v.Elem(), slots)
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		if expr, ok := v.Interface().(sqlparser.Expr); ok && v.CanSet() {
+			if n, ok := placeholder(expr); ok && n <= len(slots) {
+				slots[n-1] = append(slots[n-1], v)
+				return
+			}
+		}
+		collectSlots(v.Elem(), slots)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				collectSlots(v.Field(i), slots)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			collectSlots(v.Index(i), slots)
+		}
+	}
+}
+
+// literalExpr is the expression the parser reads for a literal of the value
+func literalExpr(value interface{}) (sqlparser.Expr, error) {
+	switch v := value.(type) {
+	case nil:
+		return &sqlparser.NullVal{}, nil
+	case bool:
+		return sqlparser.BoolVal(v), nil
+	case int:
+		return sqlparser.NewIntVal([]byte(strconv.Itoa(v))), nil
+	case int32:
+		return sqlparser.NewIntVal([]byte(strconv.FormatInt(int64(v), 10))), nil
+	case int64:
+		return sqlparser.NewIntVal([]byte(strconv.FormatInt(v, 10))), nil
+	case float32:
+		return sqlparser.NewFloatVal([]byte(strconv.FormatFloat(float64(v), 'f', -1, 32))), nil
+	case float64:
+		return sqlparser.NewFloatVal([]byte(strconv.FormatFloat(v, 'f', -1, 64))), nil
+	case string:
+		return sqlparser.NewStrVal([]byte(v)), nil
+	case []byte:
+		return sqlparser.NewHexVal([]byte(hex.EncodeToString(v))), nil
+	case time.Time:
+		return sqlparser.NewStrVal([]byte(v.UTC().Format(time.RFC3339Nano))), nil
+	}
+	return nil, fmt.Errorf("Unsupported argument type %T", value)
+}
+
+// checkArgs converts the arguments to the SQL type of their placeholder,
+// arguments of placeholders without a type are taken as they are
+func checkArgs(types []string, args []interface{}) ([]interface{}, error) {
+	checked := make([]interface{}, len(args))
+	for i, arg := range args {
+		value, err := convertArg(types[i], arg)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for parameter $%d: %s", i+1, err)
+		}
+		checked[i] = value
+	}
+	return checked, nil
+}
+
+func convertArg(sqlType string, arg interface{}) (interface{}, error) {
+	if arg == nil {
+		return nil, nil
+	}
+	switch sqlType {
+	case "INTEGER":
+		switch v := arg.(type) {
+		case int, int32, int64:
+			return v, nil
+		case float64:
+			if v == math.Trunc(v) {
+				return int64(v), nil
+			}
+		case string:
+			if integer, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				return integer, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not an integer", arg)
+	case "DOUBLE":
+		switch v := arg.(type) {
+		case int:
+			return float64(v), nil
+		case int32:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case float32, float64:
+			return v, nil
+		case string:
+			if float, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return float, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not a number", arg)
+	case "BOOLEAN":
+		switch v := arg.(type) {
+		case bool:
+			return v, nil
+		case int, int64:
+			if v == 0 || v == 1 {
+				return v == 1, nil
+			}
+		case string:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "t", "true", "1":
+				return true, nil
+			case "f", "false", "0":
+				return false, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not a boolean", arg)
+	case "TEXT":
+		if _, ok := arg.(string); !ok {
+			return nil, fmt.Errorf("%v is not a string", arg)
+		}
+	case "DATE", "TIMESTAMP":
+		switch v := arg.(type) {
+		case time.Time:
+			return v, nil
+		case string:
+			if _, err := table.ParseTime(v); err == nil {
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not a date", arg)
+	case "BLOB":
+		switch v := arg.(type) {
+		case []byte:
+			return v, nil
+		case string:
+			// Bytes are sent as base64 in JSON
+			if data, err := base64.StdEncoding.DecodeString(v); err == nil {
+				return data, nil
+			}
+		}
+		return nil, fmt.Errorf("%v is not base64", arg)
+	}
+	return arg, nil
+}
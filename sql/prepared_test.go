@@ -0,0 +1,84 @@
+package sql
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// TestPreparedStatements runs PREPARE, EXECUTE and DEALLOCATE in order on a
+// single session, every step either returns the listed ids or fails
+func TestPreparedStatements(t *testing.T) {
+	s := NewSession()
+	name := testTableName(t)
+	mustExec(t, s, fmt.Sprintf("CREATE TABLE %s (id INT PRIMARY KEY, label VARCHAR(20), price DOUBLE)", name))
+
+	steps := []struct {
+		sql     string
+		want    []string
+		wantErr bool
+	}{
+		{sql: fmt.Sprintf("PREPARE ins AS INSERT INTO %s (id, label, price) VALUES (?, ?, ?)", name)},
+		{sql: "EXECUTE ins(1, 'a', 1.5)"},
+		{sql: "EXECUTE ins(2, 'it''s', 2)"},
+		{sql: "EXECUTE ins('x', 'c', 3)", wantErr: true},
+		{sql: "EXECUTE ins(3, 'c')", wantErr: true},
+		{sql: fmt.Sprintf("PREPARE ins AS SELECT * FROM %s", name), wantErr: true},
+		{sql: fmt.Sprintf("PREPARE cheap AS SELECT * FROM %s WHERE price < $1", name)},
+		{sql: "EXECUTE cheap(2)", want: []string{"1"}},
+		{sql: "EXECUTE cheap(10)", want: []string{"1", "2"}},
+		{sql: fmt.Sprintf("PREPARE named AS SELECT * FROM %s WHERE label = $1", name)},
+		{sql: "EXECUTE named('it''s')", want: []string{"2"}},
+		{sql: "EXECUTE named('a'' OR ''1''=''1')", want: []string{}},
+		{sql: fmt.Sprintf("PREPARE typed (bigint) AS SELECT * FROM %s WHERE id = $1", name)},
+		{sql: "EXECUTE typed(1)", want: []string{"1"}},
+		{sql: "EXECUTE typed('one')", wantErr: true},
+		{sql: "DEALLOCATE PREPARE cheap"},
+		{sql: "EXECUTE cheap(2)", wantErr: true},
+		{sql: "DEALLOCATE ALL"},
+		{sql: "EXECUTE named('a')", wantErr: true},
+	}
+	for _, step := range steps {
+		response, err := s.Execute(step.sql)
+		if step.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", step.sql)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", step.sql, err)
+		}
+		if step.want != nil {
+			if got := resultIds(t, response); !reflect.DeepEqual(got, step.want) {
+				t.Errorf("%s: got %v, want %v", step.sql, got, step.want)
+			}
+		}
+	}
+}
+
+func TestPreparedParameters(t *testing.T) {
+	s := NewSession()
+	name := testTableName(t)
+	mustExec(t, s, fmt.Sprintf("CREATE TABLE %s (id INT PRIMARY KEY, label VARCHAR(20), price DOUBLE, added DATE)", name))
+
+	tests := []struct {
+		sql  string
+		want []string
+	}{
+		{sql: fmt.Sprintf("INSERT INTO %s (id, label, price) VALUES (?, ?, ?)", name), want: []string{"INTEGER", "TEXT", "DOUBLE"}},
+		{sql: fmt.Sprintf("SELECT * FROM %s WHERE added > $1 AND id = $2", name), want: []string{"DATE", "INTEGER"}},
+		{sql: fmt.Sprintf("UPDATE %s SET price = ? WHERE label = ?", name), want: []string{"DOUBLE", "TEXT"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			p, err := s.Prepare("", tt.sql)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(p.Description.Parameters, tt.want) {
+				t.Errorf("got %v, want %v", p.Description.Parameters, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var showProcesslistRe = regexp.MustCompile(`(?is)^\s*show\s+(?:full\s+)?processlist\s*;?\s*$`)
+var killRe = regexp.MustCompile(`(?is)^\s*kill\s+(connection\s+|query\s+)?(\d+)\s*;?\s*$`)
+
+// historySize is how many statements a session remembers
+const historySize = 100
+
+// States of a session
+const (
+	StateIdle          = "idle"
+	StateActive        = "active"
+	StateInTransaction = "idle in transaction"
+)
+
+// Activity is what a session is doing, Query is the running statement or
+// the last one and Since when the state began. User is who the connection
+// authenticated as
+type Activity struct {
+	User     string
+	Database string
+	State    string
+	Query    string
+	Since    time.Time
+}
+
+// HistoryEntry is a statement a session ran
+type HistoryEntry struct {
+	Query   string
+	Started time.Time
+	Elapsed time.Duration
+	Error   string
+}
+
+// Process is a connection of the server as SHOW PROCESSLIST lists it
+type Process struct {
+	ID        int
+	Protocol  string
+	Address   string
+	Connected time.Time
+	Activity
+}
+
+// ProcessList lets SHOW PROCESSLIST and KILL reach the connections of the
+// server the session belongs to
+type ProcessList interface {
+	Processes() []Process
+	// Kill closes the connection of a process, its open transaction is
+	// rolled back
+	Kill(id int) error
+	// Cancel stops the statement a process is running, its connection and
+	// transaction stay open
+	Cancel(id int) error
+}
+
+var processColumns = []table.Column{
+	{Name: "id", Type: "INTEGER"},
+	{Name: "protocol", Type: "TEXT"},
+	{Name: "address", Type: "TEXT"},
+	{Name: "user", Type: "TEXT"},
+	{Name: "database", Type: "TEXT"},
+	{Name: "state", Type: "TEXT"},
+	{Name: "seconds", Type: "DOUBLE"},
+	{Name: "query", Type: "TEXT"},
+}
+
+// SetProcessList gives the session the connections of its server
+func (s *Session) SetProcessList(processes ProcessList) {
+	s.processes = processes
+}
+
+// Activity returns what the session is doing, safe to call from other
+// goroutines
+func (s *Session) Activity() Activity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.activity
+}
+
+// History returns the last statements of the session, the oldest first
+func (s *Session) History() []HistoryEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]HistoryEntry(nil), s.history...)
+}
+
+// Cancel stops the running statement, false when the session is idle
+func (s *Session) Cancel() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel == nil {
+		return false
+	}
+	s.cancel()
+	return true
+}
+
+func (s *Session) begin(sql string, cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancel = cancel
+	s.activity.State = StateActive
+	s.activity.Query = RedactPasswords(sql)
+	s.activity.Since = time.Now()
+}
+
+// end moves the running statement to the history
+func (s *Session) end(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	entry := HistoryEntry{Query: s.activity.Query, Started: s.activity.Since, Elapsed: now.Sub(s.activity.Since)}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if len(s.history) == historySize {
+		s.history = append(s.history[:0], s.history[1:]...)
+	}
+	s.history = append(s.history, entry)
+
+	s.cancel = nil
+	s.activity.Database = s.db.Name
+	s.activity.State = StateIdle
+	if s.tx != nil {
+		s.activity.State = StateInTransaction
+	}
+	s.activity.Since = now
+}
+
+// showProcesslist lists the connections of the server, only the ones of
+// the user itself unless it is an admin
+func (s *Session) showProcesslist() (map[string]interface{}, error) {
+	if s.processes == nil {
+		return nil, fmt.Errorf("SHOW PROCESSLIST needs a connection to a server")
+	}
+	admin, err := s.isAdmin()
+	if err != nil {
+		return nil, err
+	}
+	processes := s.processes.Processes()
+	rows := make([]map[string]interface{}, 0, len(processes))
+	for _, p := range processes {
+		if !admin && p.User != s.User() {
+			continue
+		}
+		rows = append(rows, map[string]interface{}{
+			"id":       p.ID,
+			"protocol": p.Protocol,
+			"address":  p.Address,
+			"user":     p.User,
+			"database": p.Database,
+			"state":    p.State,
+			"seconds":  float64(time.Since(p.Since).Milliseconds()) / 1000,
+			"query":    p.Query,
+		})
+	}
+	return rowsResponse(processColumns, rows)
+}
+
+// authorizeProcess lets users kill their own connections, admins may kill
+// any. A process that does not exist is left for Kill to report
+func (s *Session) authorizeProcess(id int) error {
+	for _, p := range s.processes.Processes() {
+		if p.ID == id {
+			return s.authorize(p.User, fmt.Sprintf("kill process %d", id))
+		}
+	}
+	return nil
+}
+
+// kill closes the connection of a process, KILL QUERY only stops its
+// running statement. Users may only kill their own connections unless they
+// are admins
+func (s *Session) kill(how string, id string) (map[string]interface{}, error) {
+	response := map[string]interface{}{"ok": true, "process": id}
+	if s.processes == nil {
+		response["ok"] = false
+		return response, fmt.Errorf("KILL needs a connection to a server")
+	}
+	n, err := strconv.Atoi(id)
+	if err == nil {
+		err = s.authorizeProcess(n)
+	}
+	if err == nil {
+		if strings.EqualFold(strings.TrimSpace(how), "query") {
+			err = s.processes.Cancel(n)
+		} else {
+			err = s.processes.Kill(n)
+		}
+	}
+	if err != nil {
+		response["ok"] = false
+	}
+	return response, err
+}
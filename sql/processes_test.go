@@ -0,0 +1,28 @@
+package sql
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShowProcesslistPermissions(t *testing.T) {
+	setupUsers(t)
+	processes := &fakeProcesses{users: map[int]string{1: "alice", 2: "bob", 3: "", 4: "alice"}}
+	tests := []struct {
+		user string
+		want []string
+	}{
+		{user: "alice", want: []string{"1", "4"}},
+		{user: "bob", want: []string{"2"}},
+		{user: "root", want: []string{"1", "2", "3", "4"}},
+		{user: "", want: []string{"1", "2", "3", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			response := mustExec(t, userSession(tt.user, processes), "SHOW PROCESSLIST")
+			if got := resultIds(t, response); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
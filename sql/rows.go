@@ -0,0 +1,101 @@
+package sql
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"github.com/xwb1989/sqlparser"
+	"io"
+)
+
+// RowWriter receives the rows of a SELECT or FETCH as they are read, after
+// their columns. A statement run with one has no result in its response
+type RowWriter interface {
+	Columns(columns []table.Column) error
+	Row(row map[string]interface{}) error
+}
+
+// collector keeps the rows of a statement run without a RowWriter, they go
+// in the result of its response
+type collector struct {
+	columns []table.Column
+	rows    []map[string]interface{}
+}
+
+func (c *collector) Columns(columns []table.Column) error {
+	c.columns = columns
+	return nil
+}
+
+func (c *collector) Row(row map[string]interface{}) error {
+	c.rows = append(c.rows, row)
+	return nil
+}
+
+// respond writes the rows as the JSON result of the response
+func (c *collector) respond(response map[string]interface{}) error {
+	resToJson, err := json.Marshal(c.rows)
+	if err != nil {
+		return err
+	}
+	response["result"] = string(resToJson)
+	response["columns"] = c.columns
+	return nil
+}
+
+// selectTable names the table a SELECT reads
+func selectTable(stmt *sqlparser.Select) string {
+	return stmt.From[0].(*sqlparser.AliasedTableExpr).Expr.(sqlparser.TableName).Name.CompliantName()
+}
+
+// scanSelect opens the table of a SELECT and starts reading the rows its
+// WHERE matches
+func scanSelect(stmt *sqlparser.Select, tx *table.Tx) (*table.Rows, []table.Column, error) {
+	t, err := tx.Table(selectTable(stmt))
+	if err != nil {
+		return nil, nil, err
+	}
+	var where *table.WhereClause
+	if stmt.Where != nil {
+		where, err = parseWhereExpr(stmt.Where.Expr)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	columns, err := t.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := t.Scan(where)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rows, columns, nil
+}
+
+// copyRows sends up to count rows of the scan to w, all the rows left when
+// count is negative. FOR UPDATE and LOCK IN SHARE MODE lock each row as it
+// is read, until the transaction ends
+func copyRows(w RowWriter, rows *table.Rows, count int, lock string) (int, error) {
+	n := 0
+	for count < 0 || n < count {
+		row, err := rows.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if lock != "" {
+			err = rows.Table().LockRows([]string{fmt.Sprintf("%v", row["id"])}, lock == sqlparser.ForUpdateStr)
+			if err != nil {
+				return n, err
+			}
+		}
+		if err = w.Row(row); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,79 @@
+package sql
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// TestSequenceFunctions takes values from a sequence in INSERT values and
+// SELECT without table, other statements refuse nextval and currval
+func TestSequenceFunctions(t *testing.T) {
+	s := NewSession()
+	name := testTableName(t)
+	seq := name + "_seq"
+	mustExec(t, s, fmt.Sprintf("CREATE TABLE %s (id INT PRIMARY KEY, n INT)", name))
+	mustExec(t, s, fmt.Sprintf("CREATE SEQUENCE %s START WITH 10", seq))
+
+	steps := []struct {
+		sql     string
+		wantErr bool
+	}{
+		{sql: fmt.Sprintf("INSERT INTO %s (id, n) VALUES (1, nextval('%s'))", name, seq)},
+		{sql: fmt.Sprintf("INSERT INTO %s (id, n) VALUES (2, nextval('%s')), (3, currval('%s'))", name, seq, seq)},
+		{sql: fmt.Sprintf("SELECT * FROM %s WHERE n = nextval('%s')", name, seq), wantErr: true},
+		{sql: fmt.Sprintf("SELECT * FROM %s WHERE n BETWEEN 1 AND currval('%s')", name, seq), wantErr: true},
+		{sql: fmt.Sprintf("DELETE FROM %s WHERE n IN (nextval('%s'))", name, seq), wantErr: true},
+		{sql: fmt.Sprintf("UPDATE %s SET n = nextval('%s') WHERE id = 1", name, seq), wantErr: true},
+	}
+	for _, step := range steps {
+		_, err := s.Execute(step.sql)
+		if step.wantErr != (err != nil) {
+			t.Errorf("%s: unexpected error %v", step.sql, err)
+		}
+	}
+	if _, err := FilterQuery(name, fmt.Sprintf("n = nextval('%s')", seq)); err == nil {
+		t.Error("filter calling nextval was accepted")
+	}
+
+	response := mustExec(t, s, fmt.Sprintf("SELECT * FROM %s", name))
+	if got, want := resultColumn(t, response, "n"), []string{"10", "11", "11"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	response = mustExec(t, s, fmt.Sprintf("SELECT nextval('%s') AS v", seq))
+	if got, want := resultColumn(t, response, "v"), []string{"12"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("refused statements used the sequence, got %v, want %v", got, want)
+	}
+}
+
+// TestSequencePerDatabase creates sequences of the same name in two
+// databases, each one counts on its own
+func TestSequencePerDatabase(t *testing.T) {
+	s := NewSession()
+	name := testTableName(t)
+	seq := name + "_seq"
+	mustExec(t, s, fmt.Sprintf("CREATE SEQUENCE %s", seq))
+	mustExec(t, s, fmt.Sprintf("CREATE DATABASE %s", name))
+	mustExec(t, s, fmt.Sprintf("USE %s", name))
+	if _, err := s.Execute(fmt.Sprintf("SELECT nextval('%s') AS v", seq)); err == nil {
+		t.Fatal("sequence of the default database found in another one")
+	}
+	mustExec(t, s, fmt.Sprintf("CREATE SEQUENCE %s START WITH 100", seq))
+
+	tests := []struct {
+		database string
+		want     string
+	}{
+		{database: name, want: "100"},
+		{database: "default", want: "1"},
+		{database: name, want: "101"},
+		{database: "default", want: "2"},
+	}
+	for _, tt := range tests {
+		mustExec(t, s, fmt.Sprintf("USE %s", tt.database))
+		response := mustExec(t, s, fmt.Sprintf("SELECT nextval('%s') AS v", seq))
+		if got := resultColumn(t, response, "v"); !reflect.DeepEqual(got, []string{tt.want}) {
+			t.Errorf("%s: got %v, want %s", tt.database, got, tt.want)
+		}
+	}
+}
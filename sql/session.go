@@ -0,0 +1,322 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BEGIN takes the modes snapshot isolation satisfies, PostgreSQL clients
+// send them
+var beginRe = regexp.MustCompile(`(?is)^\s*(?:begin|start\s+transaction)(?:\s+work|\s+transaction)?(?:\s*,?\s*(?:read\s+write|isolation\s+level\s+(?:read\s+uncommitted|read\s+committed|repeatable\s+read)))*\s*;?\s*$`)
+var commitRe = regexp.MustCompile(`(?is)^\s*commit(?:\s+work)?\s*;?\s*$`)
+var rollbackRe = regexp.MustCompile(`(?is)^\s*rollback(?:\s+work)?\s*;?\s*$`)
+var savepointRe = regexp.MustCompile(`(?is)^\s*savepoint\s+(\w+)\s*;?\s*$`)
+var rollbackToRe = regexp.MustCompile(`(?is)^\s*rollback(?:\s+work)?\s+to\s+(?:savepoint\s+)?(\w+)\s*;?\s*$`)
+var releaseRe = regexp.MustCompile(`(?is)^\s*release\s+(?:savepoint\s+)?(\w+)\s*;?\s*$`)
+var lockTableRe = regexp.MustCompile(`(?is)^\s*lock\s+(?:tables?\s+)?(\w+(?:\s*,\s*\w+)*)(?:\s+in\s+(share|exclusive|access\s+exclusive)\s+mode)?(\s+nowait)?\s*;?\s*$`)
+var useRe = regexp.MustCompile(`(?is)^\s*use\s+(\w+)\s*;?\s*$`)
+var ddlRe = regexp.MustCompile(`(?is)^\s*(?:create|alter|drop|vacuum)\b`)
+
+// Session runs the statements of a single connection and keeps its open
+// transaction between them. Outside of BEGIN every statement runs in a
+// transaction of its own, so a failing statement never leaves half its
+// changes behind. Tables are opened from the current database, the default
+// one until USE changes it. Besides the transaction a session keeps its
+// cursors, prepared statements, settings and the last statements it ran
+type Session struct {
+	db         *table.Database
+	tx         *table.Tx
+	savepoints []savepoint
+	cursors    map[string]*cursor
+	prepared   map[string]*Prepared
+	timeout    time.Duration
+	settings   map[string]string
+	processes  ProcessList
+
+	// mu guards what other connections read for SHOW PROCESSLIST and the
+	// cancel of the running statement they call for KILL QUERY
+	mu       sync.Mutex
+	activity Activity
+	history  []HistoryEntry
+	cancel   context.CancelFunc
+}
+
+type savepoint struct {
+	name string
+	mark int
+}
+
+func NewSession() *Session {
+	db := table.DefaultDatabase()
+	return &Session{
+		db:       db,
+		settings: map[string]string{"output_format": "table"},
+		activity: Activity{Database: db.Name, State: StateIdle, Since: time.Now()},
+	}
+}
+
+// Database is the current database of the session
+func (s *Session) Database() *table.Database {
+	return s.db
+}
+
+// InTransaction tells if BEGIN was run and not yet committed or rolled back
+func (s *Session) InTransaction() bool {
+	return s.tx != nil
+}
+
+// Execute runs a statement and keeps it in the history of the session
+func (s *Session) Execute(sql string) (map[string]interface{}, error) {
+	return s.ExecuteContext(context.Background(), sql)
+}
+
+// ExecuteContext runs a statement until ctx is done, the statement timeout
+// of the session or the global one and Cancel stop it as well
+func (s *Session) ExecuteContext(ctx context.Context, sql string) (map[string]interface{}, error) {
+	return s.ExecuteRows(ctx, sql, nil)
+}
+
+// ExecuteRows runs a statement like ExecuteContext, the rows of a SELECT or
+// FETCH go to w as they are read instead of the result of the response
+func (s *Session) ExecuteRows(ctx context.Context, sql string, w RowWriter) (map[string]interface{}, error) {
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	s.begin(sql, cancel)
+	response, err := s.execute(ctx, sql, w)
+	s.end(err)
+	return response, err
+}
+
+func (s *Session) execute(ctx context.Context, sql string, w RowWriter) (map[string]interface{}, error) {
+	if response, ok, err := s.transactionCommand(ctx, sql); ok {
+		return response, err
+	}
+	if response, ok, err := s.cursorCommand(ctx, sql, w); ok {
+		return response, err
+	}
+	if response, ok, err := s.preparedCommand(ctx, sql, w); ok {
+		return response, err
+	}
+	if response, ok, err := s.sessionCommand(sql); ok {
+		return response, err
+	}
+	if response, ok, err := s.userCommand(sql); ok {
+		return response, err
+	}
+	return s.run(ctx, sql, func(tx *table.Tx) (map[string]interface{}, error) {
+		return execute(sql, tx, w)
+	})
+}
+
+// statementContext applies the statement timeout to ctx
+func (s *Session) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := s.timeout
+	if timeout == 0 {
+		timeout = StatementTimeout()
+	}
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// run calls fn in the open transaction, or in one of its own outside of
+// BEGIN. The tables fn opens stop their scans and lock waits once ctx is
+// done
+func (s *Session) run(ctx context.Context, sql string, fn func(tx *table.Tx) (map[string]interface{}, error)) (map[string]interface{}, error) {
+	if s.db.Name != table.DefaultDatabaseName {
+		if _, err := table.OpenDatabase(s.db.Name); err != nil {
+			return map[string]interface{}{"ok": false}, err
+		}
+	}
+
+	if s.tx == nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return map[string]interface{}{"ok": false}, err
+		}
+		tx.SetContext(ctx)
+		response, err := fn(tx)
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				return response, fmt.Errorf("%s (%s)", err, rollbackErr)
+			}
+			return response, err
+		}
+		// The current database may have been dropped
+		if ddlRe.MatchString(sql) {
+			if _, err := table.OpenDatabase(s.db.Name); err != nil {
+				s.db = table.DefaultDatabase()
+			}
+		}
+		return response, tx.Commit()
+	}
+
+	// Schema changes cannot be undone, VACUUM would wait for the transaction
+	if ddlRe.MatchString(sql) {
+		return map[string]interface{}{"ok": false}, fmt.Errorf("CREATE, ALTER, DROP and VACUUM cannot run inside a transaction")
+	}
+	mark := s.tx.Mark()
+	s.tx.SetContext(ctx)
+	response, err := fn(s.tx)
+	s.tx.EndStatement()
+	if _, ok := err.(*table.DeadlockError); ok {
+		// The others in the cycle wait for the locks of the whole transaction
+		if rollbackErr := s.rollback(); rollbackErr != nil {
+			return response, fmt.Errorf("%s (%s)", err, rollbackErr)
+		}
+		return response, fmt.Errorf("%s, the transaction was rolled back", err)
+	}
+	if err != nil {
+		if rollbackErr := s.tx.RollbackTo(mark); rollbackErr != nil {
+			return response, fmt.Errorf("%s (%s)", err, rollbackErr)
+		}
+	}
+	return response, err
+}
+
+// Use makes the database with the given name the current one
+func (s *Session) Use(name string) error {
+	if s.tx != nil {
+		return fmt.Errorf("USE cannot run inside a transaction")
+	}
+	db, err := table.OpenDatabase(name)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	s.mu.Lock()
+	s.activity.Database = db.Name
+	s.mu.Unlock()
+	return nil
+}
+
+// Close rolls back the open transaction and closes the cursors, connections
+// call it when they end
+func (s *Session) Close() error {
+	err := s.rollback()
+	for name := range s.cursors {
+		if closeErr := s.closeCursor(name); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// rollback rolls back the open transaction
+func (s *Session) rollback() error {
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Rollback()
+	s.tx = nil
+	s.savepoints = nil
+	return err
+}
+
+func (s *Session) transactionCommand(ctx context.Context, sql string) (map[string]interface{}, bool, error) {
+	response := map[string]interface{}{"ok": true}
+	var err error
+	switch {
+	case beginRe.MatchString(sql):
+		response["transaction"] = "begin"
+		if s.tx != nil {
+			err = fmt.Errorf("A transaction is already in progress")
+			break
+		}
+		s.tx, err = s.db.Begin()
+	case commitRe.MatchString(sql):
+		response["transaction"] = "commit"
+		if s.tx == nil {
+			err = fmt.Errorf("No transaction in progress")
+			break
+		}
+		err = s.tx.Commit()
+		s.tx = nil
+		s.savepoints = nil
+	case rollbackRe.MatchString(sql):
+		response["transaction"] = "rollback"
+		if s.tx == nil {
+			err = fmt.Errorf("No transaction in progress")
+			break
+		}
+		err = s.rollback()
+	case savepointRe.MatchString(sql):
+		name := savepointRe.FindStringSubmatch(sql)[1]
+		response["savepoint"] = name
+		if s.tx == nil {
+			err = fmt.Errorf("SAVEPOINT can only be used in a transaction")
+			break
+		}
+		// A savepoint with the same name replaces the previous one
+		if i := s.findSavepoint(name); i >= 0 {
+			s.savepoints = append(s.savepoints[:i], s.savepoints[i+1:]...)
+		}
+		s.savepoints = append(s.savepoints, savepoint{name: name, mark: s.tx.Mark()})
+	case rollbackToRe.MatchString(sql):
+		name := rollbackToRe.FindStringSubmatch(sql)[1]
+		response["savepoint"] = name
+		i := s.findSavepoint(name)
+		if s.tx == nil || i < 0 {
+			err = fmt.Errorf("Savepoint %s does not exist", name)
+			break
+		}
+		// The savepoint itself stays, later ones are gone
+		err = s.tx.RollbackTo(s.savepoints[i].mark)
+		s.savepoints = s.savepoints[:i+1]
+	case releaseRe.MatchString(sql):
+		name := releaseRe.FindStringSubmatch(sql)[1]
+		response["savepoint"] = name
+		i := s.findSavepoint(name)
+		if s.tx == nil || i < 0 {
+			err = fmt.Errorf("Savepoint %s does not exist", name)
+			break
+		}
+		s.savepoints = s.savepoints[:i]
+	case useRe.MatchString(sql):
+		name := useRe.FindStringSubmatch(sql)[1]
+		response["database"] = name
+		err = s.Use(name)
+	case lockTableRe.MatchString(sql):
+		match := lockTableRe.FindStringSubmatch(sql)
+		names := splitColumns(match[1])
+		mode := strings.ToLower(match[2])
+		response["tables"] = names
+		if s.tx == nil {
+			err = fmt.Errorf("LOCK TABLE can only be used in a transaction")
+			break
+		}
+		s.tx.SetContext(ctx)
+		for _, name := range names {
+			err = s.tx.LockTable(name, mode != "share", match[3] != "")
+			if err != nil {
+				break
+			}
+		}
+		s.tx.EndStatement()
+		if _, ok := err.(*table.DeadlockError); ok {
+			s.rollback()
+			err = fmt.Errorf("%s, the transaction was rolled back", err)
+		}
+	default:
+		return nil, false, nil
+	}
+	if err != nil {
+		response["ok"] = false
+	}
+	return response, true, err
+}
+
+func (s *Session) findSavepoint(name string) int {
+	for i := len(s.savepoints) - 1; i >= 0; i-- {
+		if s.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
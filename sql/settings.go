@@ -0,0 +1,235 @@
+package sql
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var setRe = regexp.MustCompile(`(?is)^\s*set\s+(?:session\s+)?(\w+)\s*(?:=|\s+to\s+)\s*(.+?)\s*;?\s*$`)
+var resetRe = regexp.MustCompile(`(?is)^\s*reset\s+(\w+)\s*;?\s*$`)
+var showSessionRe = regexp.MustCompile(`(?is)^\s*show\s+session\s*;?\s*$`)
+var showHistoryRe = regexp.MustCompile(`(?is)^\s*show\s+history\s*;?\s*$`)
+
+// OutputFormats are the values output_format takes, clients render rows
+// with it
+var OutputFormats = []string{"table", "json", "csv"}
+
+var settingColumns = []table.Column{{Name: "name", Type: "TEXT"}, {Name: "value", Type: "TEXT"}}
+
+var historyColumns = []table.Column{
+	{Name: "started", Type: "TIMESTAMP"},
+	{Name: "elapsed_ms", Type: "DOUBLE"},
+	{Name: "query", Type: "TEXT"},
+	{Name: "error", Type: "TEXT"},
+}
+
+// statementTimeout applies to the sessions without SET timeout, 0 leaves
+// their statements without one
+var statementTimeout atomic.Int64
+
+// SetStatementTimeout changes how long statements of every session may run
+// before failing with a *table.CanceledError, SET timeout overrides it
+func SetStatementTimeout(timeout time.Duration) {
+	statementTimeout.Store(int64(timeout))
+}
+
+// StatementTimeout is the timeout set by SetStatementTimeout
+func StatementTimeout() time.Duration {
+	return time.Duration(statementTimeout.Load())
+}
+
+// Timeout is the statement timeout set with SET timeout, 0 when unset
+func (s *Session) Timeout() time.Duration {
+	return s.timeout
+}
+
+// Setting returns the value of a session setting, empty when unset
+func (s *Session) Setting(name string) string {
+	if name == "timeout" {
+		return formatTimeout(s.timeout)
+	}
+	return s.settings[strings.ToLower(name)]
+}
+
+// sessionCommand runs SET name = value, RESET name | ALL, SHOW SESSION,
+// SHOW HISTORY, SHOW PROCESSLIST and KILL [QUERY] id
+func (s *Session) sessionCommand(sql string) (map[string]interface{}, bool, error) {
+	var response map[string]interface{}
+	var err error
+	switch {
+	case setRe.MatchString(sql):
+		match := setRe.FindStringSubmatch(sql)
+		response, err = s.set(strings.ToLower(match[1]), match[2])
+	case resetRe.MatchString(sql):
+		name := strings.ToLower(resetRe.FindStringSubmatch(sql)[1])
+		if name == "all" {
+			s.timeout = 0
+			s.settings = map[string]string{"output_format": "table"}
+			response = map[string]interface{}{"ok": true, "setting": name}
+			break
+		}
+		response, err = s.set(name, "DEFAULT")
+	case showSessionRe.MatchString(sql):
+		response, err = rowsResponse(settingColumns, s.sessionRows())
+	case showHistoryRe.MatchString(sql):
+		s.mu.Lock()
+		rows := make([]map[string]interface{}, len(s.history))
+		for i, entry := range s.history {
+			rows[i] = map[string]interface{}{
+				"started":    entry.Started.UTC().Format(time.RFC3339Nano),
+				"elapsed_ms": float64(entry.Elapsed.Microseconds()) / 1000,
+				"query":      entry.Query,
+			}
+			if entry.Error != "" {
+				rows[i]["error"] = entry.Error
+			}
+		}
+		s.mu.Unlock()
+		response, err = rowsResponse(historyColumns, rows)
+	case showProcesslistRe.MatchString(sql):
+		response, err = s.showProcesslist()
+	case killRe.MatchString(sql):
+		match := killRe.FindStringSubmatch(sql)
+		response, err = s.kill(match[1], match[2])
+	default:
+		return nil, false, nil
+	}
+	if err != nil {
+		if response == nil {
+			response = map[string]interface{}{}
+		}
+		response["ok"] = false
+	}
+	return response, true, err
+}
+
+// set changes a setting, DEFAULT puts it back. Settings the session does
+// not use are kept as they are, PostgreSQL clients send their own
+func (s *Session) set(name string, value string) (map[string]interface{}, error) {
+	response := map[string]interface{}{"ok": true, "setting": name}
+	if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	isDefault := strings.EqualFold(value, "default")
+	switch name {
+	case "timeout":
+		timeout := time.Duration(0)
+		if !isDefault {
+			var err error
+			timeout, err = parseTimeout(value)
+			if err != nil {
+				response["ok"] = false
+				return response, err
+			}
+		}
+		s.timeout = timeout
+		value = formatTimeout(timeout)
+	case "output_format":
+		value = strings.ToLower(value)
+		if isDefault {
+			value = "table"
+		}
+		if !contains(OutputFormats, value) {
+			response["ok"] = false
+			return response, fmt.Errorf("Invalid output_format %s, expected one of %s", value, strings.Join(OutputFormats, ", "))
+		}
+		s.settings[name] = value
+	default:
+		if isDefault {
+			delete(s.settings, name)
+			value = ""
+		} else {
+			s.settings[name] = value
+		}
+	}
+	response["value"] = value
+	return response, nil
+}
+
+// sessionRows lists the state and settings of the session for SHOW SESSION
+func (s *Session) sessionRows() []map[string]interface{} {
+	transaction := "none"
+	if s.tx != nil {
+		transaction = "in progress"
+	}
+	values := map[string]string{
+		"database":    s.db.Name,
+		"transaction": transaction,
+		"prepared":    strings.Join(sortedKeys(s.prepared), ", "),
+		"cursors":     strings.Join(sortedKeys(s.cursors), ", "),
+		"timeout":     formatTimeout(s.timeout),
+	}
+	s.mu.Lock()
+	values["user"] = s.activity.User
+	values["history"] = strconv.Itoa(len(s.history))
+	s.mu.Unlock()
+	for name, value := range s.settings {
+		if _, ok := values[name]; !ok {
+			values[name] = value
+		}
+	}
+	names := sortedKeys(values)
+	rows := make([]map[string]interface{}, len(names))
+	for i, name := range names {
+		rows[i] = map[string]interface{}{"name": name, "value": values[name]}
+	}
+	return rows
+}
+
+// parseTimeout reads a duration like 1.5s or 200ms, plain numbers are
+// milliseconds
+func parseTimeout(value string) (time.Duration, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil && ms >= 0 {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return 0, fmt.Errorf("Invalid timeout %s, expected milliseconds or a duration like 5s", value)
+	}
+	return timeout, nil
+}
+
+func formatTimeout(timeout time.Duration) string {
+	if timeout == 0 {
+		return "0"
+	}
+	return timeout.String()
+}
+
+// rowsResponse answers with rows like a SELECT
+func rowsResponse(columns []table.Column, rows []map[string]interface{}) (map[string]interface{}, error) {
+	response := map[string]interface{}{"ok": true}
+	result, err := json.Marshal(rows)
+	if err != nil {
+		response["ok"] = false
+		return response, fmt.Errorf("Error encoding rows: %s", err)
+	}
+	response["result"] = string(result)
+	response["columns"] = columns
+	return response, nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
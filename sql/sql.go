@@ -5,18 +5,45 @@ import (
 	"fmt"
 	"github.com/kimuraz/golang-json-db/table"
 	"github.com/xwb1989/sqlparser"
-	"github.com/xwb1989/sqlparser/dependency/sqltypes"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
+var dbIfExistsRe = regexp.MustCompile(`(?is)^\s*(?:create|drop)\s+(?:database|schema)\s+if\s+(?:not\s+)?exists\b`)
+
+// SQLToAction runs a single statement in a session of its own
 func SQLToAction(sql string) (map[string]interface{}, error) {
-	response := make(map[string]interface{})
+	return NewSession().Execute(sql)
+}
+
+// execute runs a statement, every table change goes through tx
+func execute(sql string, tx *table.Tx, w RowWriter) (map[string]interface{}, error) {
+	if response, ok, err := nativeCommand(sql, tx.Database()); ok {
+		return response, err
+	}
+
+	sql, constraints, err := extractConstraints(sql)
+	if err != nil {
+		return nil, err
+	}
+	sql = rewriteTypes(sql)
+	sql = rewriteJSONOperators(sql)
+
 	stmt, err := sqlparser.Parse(sql)
 
 	if err != nil {
 		return nil, err
 	}
+	return executeStatement(stmt, sql, constraints, tx, w)
+}
 
+// executeStatement runs a parsed statement, sql is its text after the
+// rewrites. The rows of a SELECT go to w, or in the response when it is nil
+func executeStatement(stmt sqlparser.Statement, sql string, constraints tableConstraints, tx *table.Tx, w RowWriter) (map[string]interface{}, error) {
+	response := make(map[string]interface{})
+	var err error
 	switch stmt := stmt.(type) {
 	case *sqlparser.DDL:
 		_ = stmt
@@ -27,25 +54,67 @@ func SQLToAction(sql string) (map[string]interface{}, error) {
 			if stmt.TableSpec == nil {
 				return nil, fmt.Errorf("Cannot parse table specification")
 			}
-			schema, err := ColumnsToSchema(stmt.TableSpec.Columns)
+			schema, err := tableSpecToSchema(tx.Database(), stmt.TableSpec, constraints)
 			if err != nil {
 				return nil, err
 			}
 			response["schema"] = schema
-			_, err = table.NewTable(stmt.NewName.Name.CompliantName(), schema)
+			t, err := tx.Database().NewTable(stmt.NewName.Name.CompliantName(), schema)
 
 			if err != nil {
 				response["ok"] = false
 				return response, err
 			}
+
+			// Single column keys are covered by the per column indexes
+			for _, index := range stmt.TableSpec.Indexes {
+				if len(index.Columns) < 2 {
+					continue
+				}
+				columns := make([]string, 0, len(index.Columns))
+				for _, column := range index.Columns {
+					columns = append(columns, column.Column.String())
+				}
+				err = t.CreateCompositeIndex(index.Info.Name.String(), columns)
+				if err != nil {
+					response["ok"] = false
+					return response, err
+				}
+			}
 		default:
 			return nil, fmt.Errorf("Unsupported action: %s", stmt.Action)
 		}
 
+	case *sqlparser.DBDDL:
+		// sqlparser drops IF [NOT] EXISTS of databases
+		ifExists := dbIfExistsRe.MatchString(sql)
+		response["database"] = stmt.DBName
+		switch stmt.Action {
+		case sqlparser.CreateStr:
+			_, err = table.OpenDatabase(stmt.DBName)
+			if err == nil && ifExists {
+				break
+			}
+			_, err = table.CreateDatabase(stmt.DBName)
+		case sqlparser.DropStr:
+			_, err = table.OpenDatabase(stmt.DBName)
+			if err != nil && ifExists {
+				err = nil
+				break
+			}
+			err = table.DropDatabase(stmt.DBName)
+		default:
+			return nil, fmt.Errorf("Unsupported action: %s", stmt.Action)
+		}
+		if err != nil {
+			response["ok"] = false
+			return response, err
+		}
+
 	case *sqlparser.Insert:
 		_ = stmt
 		response["table"] = stmt.Table.Name.CompliantName()
-		table, err := table.GetTable(stmt.Table.Name.CompliantName())
+		table, err := tx.Table(stmt.Table.Name.CompliantName())
 		if err != nil {
 			response["ok"] = false
 			return response, err
@@ -55,8 +124,16 @@ func SQLToAction(sql string) (map[string]interface{}, error) {
 			response["ok"] = false
 			return response, err
 		}
-		insertJson := InsertSqlToJSON(stmt, defaultColumnNames)
+		insertJson, err := InsertSqlToJSON(stmt, defaultColumnNames, tx.Database())
+		if err != nil {
+			response["ok"] = false
+			return response, err
+		}
 		for _, row := range insertJson.([]map[string]interface{}) {
+			if err := tx.Err(); err != nil {
+				response["ok"] = false
+				return response, err
+			}
 			jsonStr, err := json.Marshal(row)
 			if err != nil {
 				response["ok"] = false
@@ -68,84 +145,321 @@ func SQLToAction(sql string) (map[string]interface{}, error) {
 				return response, err
 			}
 		}
+		response["rows_affected"] = len(insertJson.([]map[string]interface{}))
 		response["ok"] = true
 		return response, nil
 
-	case *sqlparser.Select:
-		_ = stmt
-		response["table"] = stmt.From[0].(*sqlparser.AliasedTableExpr).Expr.(sqlparser.TableName).Name.CompliantName()
-		t, err := table.GetTable(stmt.From[0].(*sqlparser.AliasedTableExpr).Expr.(sqlparser.TableName).Name.CompliantName())
+	case *sqlparser.Update:
+		tableName := sqlparser.String(stmt.TableExprs[0].(*sqlparser.AliasedTableExpr).Expr)
+		response["table"] = tableName
+		t, err := tx.Table(tableName)
+		if err != nil {
+			response["ok"] = false
+			return response, err
+		}
+		changes := make(map[string]interface{})
+		for _, expr := range stmt.Exprs {
+			if err = noSequences(expr.Expr); err != nil {
+				response["ok"] = false
+				return response, err
+			}
+			changes[expr.Name.Name.CompliantName()] = extractValue(expr.Expr)
+		}
+		ids, err := selectIds(t, stmt.Where)
 		if err != nil {
 			response["ok"] = false
 			return response, err
 		}
-		if stmt.Where == nil {
-			result, err := t.SelectAll()
+		for _, id := range ids {
+			if err = tx.Err(); err != nil {
+				response["ok"] = false
+				return response, err
+			}
+			err = t.Update(id, changes)
 			if err != nil {
 				response["ok"] = false
 				return response, err
 			}
-			resToJson, err := json.Marshal(result)
+		}
+		response["rows_affected"] = len(ids)
+
+	case *sqlparser.Delete:
+		tableName := sqlparser.String(stmt.TableExprs[0].(*sqlparser.AliasedTableExpr).Expr)
+		response["table"] = tableName
+		t, err := tx.Table(tableName)
+		if err != nil {
+			response["ok"] = false
+			return response, err
+		}
+		ids, err := selectIds(t, stmt.Where)
+		if err != nil {
+			response["ok"] = false
+			return response, err
+		}
+		for _, id := range ids {
+			if err = tx.Err(); err != nil {
+				response["ok"] = false
+				return response, err
+			}
+			err = t.Delete(id)
 			if err != nil {
 				response["ok"] = false
 				return response, err
 			}
-			response["result"] = string(resToJson)
-		} else {
-			whereClauses := parseWhereExpr(stmt.Where.Expr)
-			result, err := t.SelectWhere(*whereClauses)
+		}
+		response["rows_affected"] = len(ids)
+
+	case *sqlparser.Select:
+		_ = stmt
+		// Without a RowWriter the rows go in the result of the response
+		var collected *collector
+		if w == nil {
+			collected = &collector{}
+			w = collected
+		}
+		if isDual(stmt) {
+			result, columns, err := selectFunctions(stmt, tx.Database())
 			if err != nil {
 				response["ok"] = false
 				return response, err
 			}
-			resToJson, err := json.Marshal(result)
+			if err = w.Columns(columns); err != nil {
+				response["ok"] = false
+				return response, err
+			}
+			if err = w.Row(result[0]); err != nil {
+				response["ok"] = false
+				return response, err
+			}
+		} else {
+			response["table"] = selectTable(stmt)
+			rows, columns, err := scanSelect(stmt, tx)
 			if err != nil {
 				response["ok"] = false
 				return response, err
 			}
-			response["result"] = string(resToJson)
+			defer rows.Close()
+			if err = w.Columns(columns); err != nil {
+				response["ok"] = false
+				return response, err
+			}
+			// FOR UPDATE and LOCK IN SHARE MODE keep the rows locked until
+			// the transaction ends
+			if _, err = copyRows(w, rows, -1, stmt.Lock); err != nil {
+				response["ok"] = false
+				return response, err
+			}
+		}
+		if collected != nil {
+			if err = collected.respond(response); err != nil {
+				response["ok"] = false
+				return response, err
+			}
 		}
 	}
 	response["ok"] = true
 	return response, nil
 }
 
-func parseWhereExpr(expr sqlparser.Expr) *table.WhereClause {
+// selectIds returns the ids matched by a WHERE, or every id without one
+func selectIds(t *table.Table, where *sqlparser.Where) ([]string, error) {
+	if where == nil {
+		rows, err := t.SelectAll()
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]string, 0, len(rows))
+		for _, row := range rows {
+			ids = append(ids, fmt.Sprintf("%v", row["id"]))
+		}
+		return ids, nil
+	}
+	whereClauses, err := parseWhereExpr(where.Expr)
+	if err != nil {
+		return nil, err
+	}
+	return t.SelectWhereIds(*whereClauses)
+}
+
+// FilterQuery builds SELECT * FROM name WHERE filter, as the HTTP API reads
+// rows. The filter has to be a condition and nothing else: clauses parsed
+// after it, a UNION or subqueries are rejected, and the query is rebuilt
+// from the parsed condition
+func FilterQuery(name string, filter string) (string, error) {
+	query := fmt.Sprintf("SELECT * FROM %s", name)
+	if filter == "" {
+		return query, nil
+	}
+	stmt, err := sqlparser.Parse(rewriteJSONOperators(query + " WHERE " + filter))
+	if err != nil {
+		return "", fmt.Errorf("Invalid filter %s: %s", filter, err)
+	}
+	sel, ok := stmt.(*sqlparser.Select)
+	if ok && sel.Where != nil {
+		bare := &sqlparser.Select{SelectExprs: sel.SelectExprs, From: sel.From, Where: sel.Where}
+		ok = sqlparser.String(bare) == sqlparser.String(sel)
+	}
+	if !ok {
+		return "", fmt.Errorf("Invalid filter %s: only a condition is allowed", filter)
+	}
+	err = sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if _, ok := node.(*sqlparser.Subquery); ok {
+			return false, fmt.Errorf("Invalid filter %s: subqueries are not allowed", filter)
+		}
+		return true, nil
+	}, sel.Where.Expr)
+	if err != nil {
+		return "", err
+	}
+	if _, err = parseWhereExpr(sel.Where.Expr); err != nil {
+		return "", err
+	}
+	return query + " WHERE " + sqlparser.String(sel.Where.Expr), nil
+}
+
+// parseWhereExpr turns a WHERE expression into a clause chain. Any part it
+// cannot handle fails the whole expression, a filter missing one of its
+// conditions would match more rows than asked for
+func parseWhereExpr(expr sqlparser.Expr) (*table.WhereClause, error) {
+	var clause *table.WhereClause
 	switch expr := expr.(type) {
 	case *sqlparser.ComparisonExpr:
-		return &table.WhereClause{
-			Column:   sqlparser.String(expr.Left),
+		if err := noSequences(expr); err != nil {
+			return nil, err
+		}
+		if anyFn, ok := expr.Right.(*sqlparser.FuncExpr); ok && anyFn.Name.Lowered() == "any" {
+			clause = anyClause(expr.Left, expr.Operator, anyFn)
+			break
+		}
+		column, path, asText, ok := pathOperand(expr.Left)
+		if !ok {
+			column = sqlparser.String(expr.Left)
+		}
+		clause = &table.WhereClause{
+			Column:   column,
+			Path:     path,
+			AsText:   asText,
 			Operator: expr.Operator,
 			Value:    extractValue(expr.Right),
 		}
-	case *sqlparser.AndExpr:
-		left := parseWhereExpr(expr.Left)
-		right := parseWhereExpr(expr.Right)
-		if left != nil && right != nil {
-			andClause := left
-			for andClause.And != nil {
-				andClause = andClause.And
-			}
-			andClause.And = right
+	case *sqlparser.RangeCond:
+		if err := noSequences(expr); err != nil {
+			return nil, err
 		}
-		return left
-	case *sqlparser.OrExpr:
-		left := parseWhereExpr(expr.Left)
-		right := parseWhereExpr(expr.Right)
-		if left != nil && right != nil {
-			orClause := left
-			for orClause.Or != nil {
-				orClause = orClause.Or
+		column, path, asText, ok := pathOperand(expr.Left)
+		if !ok {
+			break
+		}
+		from := &table.WhereClause{Column: column, Path: path, AsText: asText, Value: extractValue(expr.From)}
+		to := &table.WhereClause{Column: column, Path: path, AsText: asText, Value: extractValue(expr.To)}
+		if expr.Operator == sqlparser.BetweenStr {
+			from.Operator, to.Operator = ">=", "<="
+			from.And = to
+		} else {
+			from.Operator, to.Operator = "<", ">"
+			from.Or = to
+		}
+		clause = from
+	case *sqlparser.FuncExpr:
+		if expr.Name.Lowered() == "json_contains" {
+			clause = containsClause(expr)
+		}
+	case *sqlparser.ColName:
+		// A bare boolean column, WHERE active
+		clause = &table.WhereClause{Column: sqlparser.String(expr), Operator: "=", Value: true}
+	case *sqlparser.NotExpr:
+		if column, ok := expr.Expr.(*sqlparser.ColName); ok {
+			clause = &table.WhereClause{Column: sqlparser.String(column), Operator: "=", Value: false}
+		}
+	case *sqlparser.IsExpr:
+		column, ok := expr.Expr.(*sqlparser.ColName)
+		if ok && (expr.Operator == sqlparser.IsTrueStr || expr.Operator == sqlparser.IsFalseStr) {
+			clause = &table.WhereClause{Column: sqlparser.String(column), Operator: "=", Value: expr.Operator == sqlparser.IsTrueStr}
+		}
+	case *sqlparser.ParenExpr:
+		return parseWhereExpr(expr.Expr)
+	case *sqlparser.AndExpr, *sqlparser.OrExpr:
+		var leftExpr, rightExpr sqlparser.Expr
+		if and, ok := expr.(*sqlparser.AndExpr); ok {
+			leftExpr, rightExpr = and.Left, and.Right
+		} else {
+			or := expr.(*sqlparser.OrExpr)
+			leftExpr, rightExpr = or.Left, or.Right
+		}
+		left, err := parseWhereExpr(leftExpr)
+		if err != nil {
+			return nil, err
+		}
+		right, err := parseWhereExpr(rightExpr)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := expr.(*sqlparser.AndExpr); ok {
+			return andClauses(left, right), nil
+		}
+		return orClauses(left, right), nil
+	}
+	if clause == nil {
+		return nil, fmt.Errorf("Unsupported WHERE expression: %s", sqlparser.String(expr))
+	}
+	return clause, nil
+}
+
+// noSequences refuses nextval and currval, they hand out a value every time
+// they run and only belong where a row is written once
+func noSequences(expr sqlparser.SQLNode) error {
+	return sqlparser.Walk(func(node sqlparser.SQLNode) (bool, error) {
+		if fn, ok := node.(*sqlparser.FuncExpr); ok {
+			switch fn.Name.Lowered() {
+			case "nextval", "currval":
+				return false, fmt.Errorf("%s can only be used in INSERT values", fn.Name.String())
 			}
-			orClause.Or = right
 		}
-		return left
-	default:
+		return true, nil
+	}, expr)
+}
+
+// andClauses chains right after left. A chain reads as (clause AND and) OR
+// or, so right joins every branch of the ORs of left
+func andClauses(left *table.WhereClause, right *table.WhereClause) *table.WhereClause {
+	clause := *left
+	if clause.And == nil {
+		clause.And = copyClause(right)
+	} else {
+		clause.And = andClauses(clause.And, right)
+	}
+	if clause.Or != nil {
+		clause.Or = andClauses(clause.Or, right)
+	}
+	return &clause
+}
+
+// orClauses adds right as the last branch of left
+func orClauses(left *table.WhereClause, right *table.WhereClause) *table.WhereClause {
+	clause := *left
+	if clause.Or == nil {
+		clause.Or = right
+	} else {
+		clause.Or = orClauses(clause.Or, right)
+	}
+	return &clause
+}
+
+// copyClause copies a chain so it can be linked in more than one place, the
+// values are coerced in place once the table reads them
+func copyClause(clause *table.WhereClause) *table.WhereClause {
+	if clause == nil {
 		return nil
 	}
+	copied := *clause
+	copied.And = copyClause(clause.And)
+	copied.Or = copyClause(clause.Or)
+	return &copied
 }
 
-func InsertSqlToJSON(stmt *sqlparser.Insert, defaultColumnNames []string) interface{} {
+// InsertSqlToJSON reads the rows of an INSERT, nextval and currval take
+// their sequence from db
+func InsertSqlToJSON(stmt *sqlparser.Insert, defaultColumnNames []string, db *table.Database) (interface{}, error) {
 	values := make([]map[string]interface{}, 0)
 	columnsNames := make([]string, 0)
 	if len(stmt.Columns) == 0 {
@@ -159,15 +473,163 @@ func InsertSqlToJSON(stmt *sqlparser.Insert, defaultColumnNames []string) interf
 		jsonObject := make(map[string]interface{})
 		for i, val := range row {
 			columnName := columnsNames[i]
-			jsonObject[columnName] = extractValue(val)
+			value, err := evalFunction(val, db)
+			if err != nil {
+				return nil, err
+			}
+			jsonObject[columnName] = value
 		}
 		values = append(values, jsonObject)
 	}
-	return values
+	return values, nil
+}
+
+func isDual(stmt *sqlparser.Select) bool {
+	if len(stmt.From) != 1 {
+		return false
+	}
+	aliased, ok := stmt.From[0].(*sqlparser.AliasedTableExpr)
+	if !ok {
+		return false
+	}
+	name, ok := aliased.Expr.(sqlparser.TableName)
+	return ok && name.Name.String() == "dual"
+}
+
+// selectFunctions answers a SELECT without table, like SELECT nextval('s')
+func selectFunctions(stmt *sqlparser.Select, db *table.Database) ([]map[string]interface{}, []table.Column, error) {
+	row := make(map[string]interface{})
+	var columns []table.Column
+	for _, expr := range stmt.SelectExprs {
+		aliased, ok := expr.(*sqlparser.AliasedExpr)
+		if !ok {
+			return nil, nil, fmt.Errorf("Unsupported expression: %s", sqlparser.String(expr))
+		}
+		value, err := evalFunction(aliased.Expr, db)
+		if err != nil {
+			return nil, nil, err
+		}
+		name := sqlparser.String(aliased.Expr)
+		if !aliased.As.IsEmpty() {
+			name = aliased.As.String()
+		}
+		row[name] = value
+		columns = append(columns, table.Column{Name: name, Type: valueType(value)})
+	}
+	return []map[string]interface{}{row}, columns, nil
+}
+
+// valueType names the SQL type of a computed value
+func valueType(value interface{}) string {
+	switch value.(type) {
+	case bool:
+		return "BOOLEAN"
+	case int, int64:
+		return "INTEGER"
+	case float64:
+		return "DOUBLE"
+	case string:
+		return "TEXT"
+	}
+	return "JSON"
+}
+
+// evalFunction computes the value of a function. Sequences are read from
+// db, a nil db leaves them out as they only run in INSERT values and
+// SELECT without table
+func evalFunction(expr sqlparser.Expr, db *table.Database) (interface{}, error) {
+	fn, ok := expr.(*sqlparser.FuncExpr)
+	if !ok {
+		return extractValue(expr), nil
+	}
+	switch fn.Name.Lowered() {
+	case "nextval", "currval":
+		if db == nil {
+			return nil, fmt.Errorf("%s can only be used in INSERT values", fn.Name.String())
+		}
+		if len(fn.Exprs) != 1 {
+			return nil, fmt.Errorf("%s expects the sequence name", fn.Name.String())
+		}
+		seqName, ok := fn.Exprs[0].(*sqlparser.AliasedExpr)
+		if !ok {
+			return nil, fmt.Errorf("%s expects the sequence name", fn.Name.String())
+		}
+		seq, err := db.GetSequence(fmt.Sprintf("%v", extractValue(seqName.Expr)))
+		if err != nil {
+			return nil, err
+		}
+		if fn.Name.Lowered() == "currval" {
+			return seq.Value, nil
+		}
+		return seq.Next()
+	case "now", "current_timestamp", "utc_timestamp", "localtimestamp":
+		return time.Now().UTC().Format(time.RFC3339), nil
+	case "current_date", "curdate", "utc_date":
+		return time.Now().UTC().Format("2006-01-02"), nil
+	}
+	return nil, fmt.Errorf("Unsupported function: %s", fn.Name.String())
+}
+
+// anyClause handles both sides ANY can be used on:
+//
+//	'x' = ANY(tags)      rows whose tags array has 'x'
+//	tag = ANY('x', 'y')  same as tag IN ('x', 'y')
+func anyClause(left sqlparser.Expr, operator string, anyFn *sqlparser.FuncExpr) *table.WhereClause {
+	if operator != "=" {
+		return nil
+	}
+	var args []sqlparser.Expr
+	for _, arg := range anyFn.Exprs {
+		aliased, ok := arg.(*sqlparser.AliasedExpr)
+		if !ok {
+			return nil
+		}
+		args = append(args, aliased.Expr)
+	}
+
+	if len(args) == 1 {
+		if column, path, asText, ok := pathOperand(args[0]); ok {
+			return &table.WhereClause{
+				Column:   column,
+				Path:     path,
+				AsText:   asText,
+				Operator: "@>",
+				Value:    []interface{}{extractValue(left)},
+			}
+		}
+	}
+
+	column, path, asText, ok := pathOperand(left)
+	if !ok {
+		return nil
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = extractValue(arg)
+	}
+	return &table.WhereClause{
+		Column:   column,
+		Path:     path,
+		AsText:   asText,
+		Operator: "in",
+		Value:    values,
+	}
 }
 
 func extractValue(val sqlparser.Expr) interface{} {
 	switch v := val.(type) {
+	case sqlparser.ValTuple:
+		values := make([]interface{}, len(v))
+		for i, elem := range v {
+			values[i] = extractValue(elem)
+		}
+		return values
+	case *sqlparser.FuncExpr:
+		value, err := evalFunction(v, nil)
+		if err != nil {
+			return sqlparser.String(val)
+		}
+		return value
 	case *sqlparser.SQLVal:
 		switch v.Type {
 		case sqlparser.StrVal:
@@ -184,9 +646,18 @@ func extractValue(val sqlparser.Expr) interface{} {
 				return string(v.Val)
 			}
 			return floatVal
+		case sqlparser.HexVal:
+			// Bytes are marshalled as base64, the BLOB representation
+			bytes, err := v.HexDecode()
+			if err != nil {
+				return string(v.Val)
+			}
+			return bytes
 		default:
 			return string(v.Val)
 		}
+	case sqlparser.BoolVal:
+		return bool(v)
 	case *sqlparser.NullVal:
 		return nil
 	default:
@@ -195,39 +666,113 @@ func extractValue(val sqlparser.Expr) interface{} {
 }
 
 func ColumnsToSchema(columns []*sqlparser.ColumnDefinition) (string, error) {
+	schema, err := columnsToSchemaMap(columns)
+	if err != nil {
+		return "", err
+	}
+	json, err := json.Marshal(schema)
+
+	return string(json), err
+}
+
+// tableSpecToSchema builds the table schema including its constraints
+func tableSpecToSchema(db *table.Database, spec *sqlparser.TableSpec, constraints tableConstraints) (string, error) {
+	schema, err := columnsToSchemaMap(spec.Columns)
+	if err != nil {
+		return "", err
+	}
+
+	var uniqueKeys [][]string
+	for _, index := range spec.Indexes {
+		if !index.Info.Unique && !index.Info.Primary {
+			continue
+		}
+		columns := make([]string, 0, len(index.Columns))
+		for _, column := range index.Columns {
+			columns = append(columns, column.Column.String())
+		}
+		if len(columns) == 1 {
+			prop, ok := schema["properties"].(map[string]interface{})[columns[0]].(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("Unknown column in unique key: %s", columns[0])
+			}
+			prop["unique"] = true
+			continue
+		}
+		uniqueKeys = append(uniqueKeys, columns)
+	}
+	if len(uniqueKeys) > 0 {
+		schema["uniqueKeys"] = uniqueKeys
+	}
+	if len(constraints.checks) > 0 {
+		schema["checks"] = constraints.checks
+	}
+	for _, fk := range constraints.foreignKeys {
+		if _, ok := schema["properties"].(map[string]interface{})[fk.Column]; !ok {
+			return "", fmt.Errorf("Unknown column in foreign key: %s", fk.Column)
+		}
+		if _, err := db.GetTable(fk.References); err != nil {
+			return "", fmt.Errorf("Foreign key references unknown table %s", fk.References)
+		}
+	}
+	if len(constraints.foreignKeys) > 0 {
+		schema["foreignKeys"] = constraints.foreignKeys
+	}
+
+	json, err := json.Marshal(schema)
+	return string(json), err
+}
+
+func columnsToSchemaMap(columns []*sqlparser.ColumnDefinition) (map[string]interface{}, error) {
 	schema := make(map[string]interface{})
 	schema["type"] = "object"
 	schema["properties"] = make(map[string]interface{})
+	required := make([]string, 0)
 
 	for _, column := range columns {
-		switch column.Type.SQLType() {
-		case sqltypes.Int8:
-			fallthrough
-		case sqltypes.Int16:
-			fallthrough
-		case sqltypes.Int24:
-			fallthrough
-		case sqltypes.Int32:
-			fallthrough
-		case sqltypes.Int64:
-			schema["properties"].(map[string]interface{})[column.Name.String()] = map[string]interface{}{"type": "integer"}
-		case sqltypes.Text:
-			fallthrough
-		case sqltypes.VarChar:
-			fallthrough
-		case sqltypes.Char:
-			schema["properties"].(map[string]interface{})[column.Name.String()] = map[string]interface{}{"type": "string"}
-		case sqltypes.Decimal:
-			fallthrough
-		case sqltypes.Float32:
-			fallthrough
-		case sqltypes.Float64:
-			schema["properties"].(map[string]interface{})[column.Name.String()] = map[string]interface{}{"type": "number"}
-		default:
-			return "", fmt.Errorf("Unsupported type: %s", column.Type.SQLType())
+		prop, err := columnProperty(column)
+		if err != nil {
+			return nil, err
+		}
+		schema["properties"].(map[string]interface{})[column.Name.String()] = prop
+
+		if column.Type.NotNull || column.Type.KeyOpt == colKeyPrimary {
+			required = append(required, column.Name.String())
+		}
+		if column.Type.KeyOpt == colKeyPrimary || column.Type.KeyOpt == colKeyUnique || column.Type.KeyOpt == colKeyUniqueKey {
+			prop["unique"] = true
+		}
+		if column.Type.Autoincrement {
+			if prop["type"] != "integer" {
+				return nil, fmt.Errorf("AUTO_INCREMENT is only supported on integer columns: %s", column.Name.String())
+			}
+			prop["generator"] = table.SequenceGenerator
+		}
+		// String ids pick their generator through the column comment
+		if column.Type.Comment != nil {
+			generator := strings.ToLower(string(column.Type.Comment.Val))
+			if table.IsGenerator(generator) {
+				prop["generator"] = generator
+			}
+		}
+		if isCurrentTimestamp(column.Type.Default) {
+			if prop["format"] != table.DateFormat && prop["format"] != table.DateTimeFormat {
+				return nil, fmt.Errorf("CURRENT_TIMESTAMP is only supported on date columns: %s", column.Name.String())
+			}
+			prop["generator"] = table.NowGenerator
+		} else if column.Type.Default != nil {
+			defaultValue := extractValue(column.Type.Default)
+			if number, ok := defaultValue.(int64); ok && prop["type"] == "boolean" {
+				defaultValue = number != 0
+			}
+			if column.Type.Default.Type != sqlparser.ValArg || !strings.EqualFold(string(column.Type.Default.Val), "null") {
+				prop["default"] = defaultValue
+			}
 		}
 	}
-	json, err := json.Marshal(schema)
+	if len(required) > 0 {
+		schema["required"] = required
+	}
 
-	return string(json), err
+	return schema, nil
 }
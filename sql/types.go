@@ -0,0 +1,104 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"github.com/xwb1989/sqlparser"
+	"github.com/xwb1989/sqlparser/dependency/sqltypes"
+	"regexp"
+	"strings"
+)
+
+var booleanTypeRe = regexp.MustCompile("(?i)(\\w`?\\s+)(?:boolean|bool)\\b")
+var defaultBooleanRe = regexp.MustCompile(`(?i)\bdefault\s+(true|false)\b`)
+var typedLiteralRe = regexp.MustCompile(`(?i)\b(?:date|datetime|timestamp)\s+('(?:[^'\\]|\\.|'')*')`)
+var defaultNowRe = regexp.MustCompile(`(?i)\bdefault\s+(?:now\s*\(\s*\)|current_date(?:\s*\(\s*\))?|current_timestamp\s*\(\s*\d*\s*\))`)
+
+// rewriteTypes turns the column types, defaults and literals sqlparser does
+// not understand into ones it does: BOOLEAN becomes TINYINT(1), DEFAULT TRUE
+// becomes DEFAULT 1, NOW() or CURRENT_DATE become CURRENT_TIMESTAMP and
+// typed literals like DATE '2020-01-02' lose their type, the column they are
+// compared with or stored in gives it back
+func rewriteTypes(sql string) string {
+	for {
+		loc := findOutsideStrings(typedLiteralRe, sql)
+		if loc == nil {
+			break
+		}
+		literal := typedLiteralRe.FindStringSubmatch(sql[loc[0]:loc[1]])[1]
+		sql = sql[:loc[0]] + literal + sql[loc[1]:]
+	}
+	if !createTableRe.MatchString(sql) {
+		return sql
+	}
+	for {
+		loc := findOutsideStrings(booleanTypeRe, sql)
+		if loc == nil {
+			break
+		}
+		match := booleanTypeRe.FindStringSubmatch(sql[loc[0]:loc[1]])
+		sql = sql[:loc[0]] + match[1] + "tinyint(1)" + sql[loc[1]:]
+	}
+	for {
+		loc := findOutsideStrings(defaultBooleanRe, sql)
+		if loc == nil {
+			break
+		}
+		value := "0"
+		if strings.EqualFold(defaultBooleanRe.FindStringSubmatch(sql[loc[0]:loc[1]])[1], "true") {
+			value = "1"
+		}
+		sql = sql[:loc[0]] + "default " + value + sql[loc[1]:]
+	}
+	for {
+		loc := findOutsideStrings(defaultNowRe, sql)
+		if loc == nil {
+			break
+		}
+		sql = sql[:loc[0]] + "default current_timestamp" + sql[loc[1]:]
+	}
+	return sql
+}
+
+// columnProperty maps a column type to its JSON Schema property
+func columnProperty(column *sqlparser.ColumnDefinition) (map[string]interface{}, error) {
+	switch column.Type.SQLType() {
+	case sqltypes.Int8, sqltypes.Bit:
+		// TINYINT(1) and BIT(1) are how MySQL spells BOOLEAN
+		if column.Type.Length != nil && string(column.Type.Length.Val) == "1" {
+			return map[string]interface{}{"type": "boolean"}, nil
+		}
+		if column.Type.SQLType() == sqltypes.Bit {
+			return nil, fmt.Errorf("Unsupported type: %s", sqlparser.String(&column.Type))
+		}
+		return map[string]interface{}{"type": "integer"}, nil
+	case sqltypes.Uint8, sqltypes.Int16, sqltypes.Uint16, sqltypes.Int24, sqltypes.Uint24,
+		sqltypes.Int32, sqltypes.Uint32, sqltypes.Int64, sqltypes.Uint64:
+		return map[string]interface{}{"type": "integer"}, nil
+	case sqltypes.Text, sqltypes.VarChar, sqltypes.Char:
+		return map[string]interface{}{"type": "string"}, nil
+	case sqltypes.Decimal, sqltypes.Float32, sqltypes.Float64:
+		return map[string]interface{}{"type": "number"}, nil
+	case sqltypes.Date:
+		return map[string]interface{}{"type": "string", "format": table.DateFormat}, nil
+	case sqltypes.Datetime, sqltypes.Timestamp:
+		return map[string]interface{}{"type": "string", "format": table.DateTimeFormat}, nil
+	case sqltypes.TypeJSON:
+		return map[string]interface{}{"type": "object"}, nil
+	case sqltypes.Enum:
+		values := make([]interface{}, 0, len(column.Type.EnumValues))
+		for _, value := range column.Type.EnumValues {
+			values = append(values, strings.TrimSuffix(strings.TrimPrefix(value, "'"), "'"))
+		}
+		return map[string]interface{}{"type": "string", "enum": values}, nil
+	case sqltypes.Blob, sqltypes.Binary, sqltypes.VarBinary:
+		return map[string]interface{}{"type": "string", "contentEncoding": table.Base64Encoding}, nil
+	}
+	return nil, fmt.Errorf("Unsupported type: %s", column.Type.SQLType())
+}
+
+// isCurrentTimestamp tells if a DEFAULT is CURRENT_TIMESTAMP, which maps to
+// the now generator instead of a fixed value
+func isCurrentTimestamp(def *sqlparser.SQLVal) bool {
+	return def != nil && def.Type == sqlparser.ValArg && strings.EqualFold(string(def.Val), "current_timestamp")
+}
@@ -0,0 +1,41 @@
+package sql
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestTypedComparisons(t *testing.T) {
+	s := NewSession()
+	name := testTableName(t)
+	mustExec(t, s, fmt.Sprintf("CREATE TABLE %s (id INT PRIMARY KEY, price DOUBLE, stock INT, added DATE, seen TIMESTAMP)", name))
+	mustExec(t, s, fmt.Sprintf("INSERT INTO %s (id, price, stock, added, seen) VALUES (1, 10, 3, '2020-01-02', '2020-01-02 10:00:00')", name))
+	mustExec(t, s, fmt.Sprintf("INSERT INTO %s (id, price, stock, added, seen) VALUES (2, 10.5, 4, '2021-05-06', '2021-05-06 10:00:00')", name))
+
+	tests := []struct {
+		where string
+		want  []string
+	}{
+		{where: "price = 10", want: []string{"1"}},
+		{where: "price = 10.0", want: []string{"1"}},
+		{where: "price = 10.5", want: []string{"2"}},
+		{where: "stock = 3", want: []string{"1"}},
+		{where: "stock = 3.0", want: []string{"1"}},
+		{where: "stock = 3.5", want: []string{}},
+		{where: "stock IN (3.0, 4)", want: []string{"1", "2"}},
+		{where: "price = 10 AND stock = 3", want: []string{"1"}},
+		{where: "added = DATE '2020-01-02'", want: []string{"1"}},
+		{where: "added > DATE '2020-06-01'", want: []string{"2"}},
+		{where: "seen = TIMESTAMP '2021-05-06 10:00:00'", want: []string{"2"}},
+		{where: "added = 'DATE ''2020-01-02'''", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.where, func(t *testing.T) {
+			response := mustExec(t, s, fmt.Sprintf("SELECT * FROM %s WHERE %s", name, tt.where))
+			if got := resultIds(t, response); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
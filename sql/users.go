@@ -0,0 +1,133 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"regexp"
+	"strings"
+)
+
+var createUserRe = regexp.MustCompile(`(?is)^\s*create\s+user\s+(\w+)\s+(?:with\s+)?(?:password|identified\s+by)\s+'((?:[^']|'')*)'(\s+admin)?\s*;?\s*$`)
+var alterUserRe = regexp.MustCompile(`(?is)^\s*alter\s+user\s+(\w+)\s+(?:with\s+)?(?:password|identified\s+by)\s+'((?:[^']|'')*)'\s*;?\s*$`)
+var alterUserAdminRe = regexp.MustCompile(`(?is)^\s*alter\s+user\s+(\w+)\s+(?:with\s+)?(admin|noadmin)\s*;?\s*$`)
+var dropUserRe = regexp.MustCompile(`(?is)^\s*drop\s+user\s+(if\s+exists\s+)?(\w+)\s*;?\s*$`)
+var showUsersRe = regexp.MustCompile(`(?is)^\s*show\s+users\s*;?\s*$`)
+
+// passwordRe finds the passwords of user statements, they are kept out of
+// the history, the process list and the logs
+var passwordRe = regexp.MustCompile(`(?i)(\b(?:password|identified\s+by)\s+)'(?:[^']|'')*'`)
+
+var userColumns = []table.Column{{Name: "name", Type: "TEXT"}, {Name: "admin", Type: "BOOLEAN"}}
+
+// RedactPasswords hides the passwords of CREATE and ALTER USER
+func RedactPasswords(sql string) string {
+	return passwordRe.ReplaceAllString(sql, "$1'***'")
+}
+
+// SetUser records the user the connection authenticated as
+func (s *Session) SetUser(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activity.User = name
+}
+
+// User is the user the connection authenticated as, empty when the server
+// has no users
+func (s *Session) User() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.activity.User
+}
+
+// isAdmin tells if the session may manage users and other connections. A
+// session without a user was opened in process or before the server had
+// users, it may do anything like every connection could then
+func (s *Session) isAdmin() (bool, error) {
+	user := s.User()
+	if user == "" {
+		return true, nil
+	}
+	return table.IsAdmin(user)
+}
+
+// authorize fails with a *table.PermissionError unless the session is an
+// admin or belongs to user
+func (s *Session) authorize(user string, action string) error {
+	if current := s.User(); current != "" && current == user {
+		return nil
+	}
+	admin, err := s.isAdmin()
+	if err != nil || admin {
+		return err
+	}
+	return &table.PermissionError{User: s.User(), Action: action}
+}
+
+// userCommand runs CREATE USER name [WITH] PASSWORD 'secret' [ADMIN], ALTER
+// USER name [WITH] PASSWORD 'secret', ALTER USER name ADMIN | NOADMIN, DROP
+// USER [IF EXISTS] name and SHOW USERS. Users belong to the server, not to
+// a database, and are not rolled back. Users change their own password,
+// the rest is for admins, and SHOW USERS only lists the user itself to the
+// others
+func (s *Session) userCommand(sql string) (map[string]interface{}, bool, error) {
+	response := map[string]interface{}{"ok": true}
+	var err error
+	// Like other schema changes they are refused inside a transaction, they
+	// could not be undone
+	changes := createUserRe.MatchString(sql) || alterUserRe.MatchString(sql) || alterUserAdminRe.MatchString(sql) || dropUserRe.MatchString(sql)
+	if changes && s.tx != nil {
+		return map[string]interface{}{"ok": false}, true, fmt.Errorf("CREATE, ALTER, DROP and VACUUM cannot run inside a transaction")
+	}
+	switch {
+	case createUserRe.MatchString(sql):
+		match := createUserRe.FindStringSubmatch(sql)
+		response["user"] = match[1]
+		if err = s.authorize("", "create users"); err != nil {
+			break
+		}
+		err = table.CreateUser(match[1], strings.ReplaceAll(match[2], "''", "'"), match[3] != "")
+	case alterUserRe.MatchString(sql):
+		match := alterUserRe.FindStringSubmatch(sql)
+		response["user"] = match[1]
+		if err = s.authorize(match[1], fmt.Sprintf("alter user %s", match[1])); err != nil {
+			break
+		}
+		err = table.AlterUser(match[1], strings.ReplaceAll(match[2], "''", "'"))
+	case alterUserAdminRe.MatchString(sql):
+		match := alterUserAdminRe.FindStringSubmatch(sql)
+		response["user"] = match[1]
+		if err = s.authorize("", fmt.Sprintf("alter user %s", match[1])); err != nil {
+			break
+		}
+		err = table.SetAdmin(match[1], strings.EqualFold(match[2], "admin"))
+	case dropUserRe.MatchString(sql):
+		match := dropUserRe.FindStringSubmatch(sql)
+		response["user"] = match[2]
+		if err = s.authorize("", fmt.Sprintf("drop user %s", match[2])); err != nil {
+			break
+		}
+		err = table.DropUser(match[2])
+		if err != nil && match[1] != "" && err.Error() == fmt.Sprintf("User %s does not exist", match[2]) {
+			err = nil
+		}
+	case showUsersRe.MatchString(sql):
+		var list []table.User
+		list, err = table.ListUsers()
+		if err != nil {
+			break
+		}
+		rows := make([]map[string]interface{}, 0, len(list))
+		for _, user := range list {
+			if s.authorize(user.Name, "") == nil {
+				rows = append(rows, map[string]interface{}{"name": user.Name, "admin": user.Admin})
+			}
+		}
+		response, err = rowsResponse(userColumns, rows)
+	default:
+		return nil, false, nil
+	}
+	if err != nil {
+		response["ok"] = false
+	}
+	return response, true, err
+}
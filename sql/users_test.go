@@ -0,0 +1,169 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/kimuraz/golang-json-db/table"
+	"sync"
+	"testing"
+)
+
+// fakeProcesses is a process list of connections by user, it remembers the
+// processes killed or canceled
+type fakeProcesses struct {
+	users  map[int]string
+	killed []string
+}
+
+func (f *fakeProcesses) Processes() []Process {
+	var processes []Process
+	for id := 1; id <= len(f.users); id++ {
+		processes = append(processes, Process{ID: id, Activity: Activity{User: f.users[id]}})
+	}
+	return processes
+}
+
+func (f *fakeProcesses) Kill(id int) error {
+	if _, ok := f.users[id]; !ok {
+		return fmt.Errorf("Process %d does not exist", id)
+	}
+	f.killed = append(f.killed, fmt.Sprintf("kill %d", id))
+	return nil
+}
+
+func (f *fakeProcesses) Cancel(id int) error {
+	if _, ok := f.users[id]; !ok {
+		return fmt.Errorf("Process %d does not exist", id)
+	}
+	f.killed = append(f.killed, fmt.Sprintf("cancel %d", id))
+	return nil
+}
+
+func userSession(user string, processes ProcessList) *Session {
+	s := NewSession()
+	s.SetUser(user)
+	s.SetProcessList(processes)
+	return s
+}
+
+var usersOnce sync.Once
+
+// setupUsers creates root, the first user and so an admin, and two users
+// that are not
+func setupUsers(t *testing.T) {
+	t.Helper()
+	usersOnce.Do(func() {
+		s := NewSession()
+		mustExec(t, s, "CREATE USER root PASSWORD 'root'")
+		mustExec(t, s, "CREATE USER alice PASSWORD 'alice'")
+		mustExec(t, s, "CREATE USER bob PASSWORD 'bob'")
+	})
+}
+
+func isPermissionError(err error) bool {
+	_, ok := err.(*table.PermissionError)
+	return ok
+}
+
+func TestUserPermissions(t *testing.T) {
+	setupUsers(t)
+	tests := []struct {
+		user string
+		sql  string
+		// denied is a *table.PermissionError, fails any other error
+		denied bool
+		fails  bool
+	}{
+		{user: "alice", sql: "ALTER USER alice PASSWORD 'alice'"},
+		{user: "alice", sql: "ALTER USER bob PASSWORD 'mine now'", denied: true},
+		{user: "alice", sql: "ALTER USER alice ADMIN", denied: true},
+		{user: "alice", sql: "CREATE USER mallory PASSWORD 'x' ADMIN", denied: true},
+		{user: "alice", sql: "DROP USER bob", denied: true},
+		{user: "alice", sql: "DROP USER IF EXISTS nobody", denied: true},
+		{user: "root", sql: "ALTER USER bob PASSWORD 'bob'"},
+		{user: "root", sql: "CREATE USER carol PASSWORD 'carol'"},
+		{user: "root", sql: "DROP USER carol"},
+		{user: "root", sql: "ALTER USER root NOADMIN", fails: true},
+		{user: "root", sql: "DROP USER root", fails: true},
+		{user: "root", sql: "CREATE USER dave PASSWORD 'dave' ADMIN"},
+		{user: "dave", sql: "ALTER USER root NOADMIN"},
+		{user: "root", sql: "DROP USER bob", denied: true},
+		{user: "dave", sql: "ALTER USER root ADMIN"},
+		{user: "root", sql: "DROP USER dave"},
+		// Sessions without a user were opened before the server had users
+		{user: "", sql: "CREATE USER erin PASSWORD 'erin'"},
+		{user: "", sql: "DROP USER erin"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.user, tt.sql), func(t *testing.T) {
+			_, err := userSession(tt.user, nil).Execute(tt.sql)
+			switch {
+			case tt.denied && !isPermissionError(err):
+				t.Errorf("want a *table.PermissionError, got %v", err)
+			case tt.fails && (err == nil || isPermissionError(err)):
+				t.Errorf("want an error other than a permission one, got %v", err)
+			case !tt.denied && !tt.fails && err != nil:
+				t.Errorf("unexpected error %s", err)
+			}
+		})
+	}
+}
+
+func TestShowUsers(t *testing.T) {
+	setupUsers(t)
+	tests := []struct {
+		user string
+		want []string
+	}{
+		{user: "alice", want: []string{"alice"}},
+		{user: "root", want: []string{"alice", "bob", "root"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			response := mustExec(t, userSession(tt.user, nil), "SHOW USERS")
+			got := resultColumn(t, response, "name")
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKillPermissions(t *testing.T) {
+	setupUsers(t)
+	tests := []struct {
+		user   string
+		sql    string
+		denied bool
+		want   string
+	}{
+		{user: "alice", sql: "KILL 1", want: "kill 1"},
+		{user: "alice", sql: "KILL QUERY 1", want: "cancel 1"},
+		{user: "alice", sql: "KILL 2", denied: true},
+		{user: "alice", sql: "KILL QUERY 2", denied: true},
+		{user: "alice", sql: "KILL 3", denied: true},
+		{user: "root", sql: "KILL 2", want: "kill 2"},
+		{user: "root", sql: "KILL QUERY 3", want: "cancel 3"},
+		{user: "", sql: "KILL 2", want: "kill 2"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %s", tt.user, tt.sql), func(t *testing.T) {
+			processes := &fakeProcesses{users: map[int]string{1: "alice", 2: "bob", 3: ""}}
+			_, err := userSession(tt.user, processes).Execute(tt.sql)
+			if tt.denied {
+				if !isPermissionError(err) {
+					t.Errorf("want a *table.PermissionError, got %v", err)
+				}
+				if len(processes.killed) > 0 {
+					t.Errorf("killed %v anyway", processes.killed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %s", err)
+			}
+			if fmt.Sprint(processes.killed) != fmt.Sprint([]string{tt.want}) {
+				t.Errorf("got %v, want %s", processes.killed, tt.want)
+			}
+		})
+	}
+}
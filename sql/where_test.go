@@ -0,0 +1,129 @@
+package sql
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// whereTests pair a WHERE with the rows of gridTable it has to match, rows
+// hold a and b from 1 to 3 and their id is a*10 + b
+var whereTests = []struct {
+	where string
+	match func(a, b int) bool
+}{
+	{"a = 1 AND (b = 1 OR b = 2)", func(a, b int) bool { return a == 1 && (b == 1 || b == 2) }},
+	{"(a = 1 OR a = 2) AND b = 1", func(a, b int) bool { return (a == 1 || a == 2) && b == 1 }},
+	{"(a = 1 OR a = 2) AND (b = 1 OR b = 3)", func(a, b int) bool { return (a == 1 || a == 2) && (b == 1 || b == 3) }},
+	{"a = 1 OR a = 2 AND b = 1", func(a, b int) bool { return a == 1 || (a == 2 && b == 1) }},
+	{"(a = 1 AND b = 1) OR (a = 3 AND b = 3)", func(a, b int) bool { return (a == 1 && b == 1) || (a == 3 && b == 3) }},
+	{"((a = 2))", func(a, b int) bool { return a == 2 }},
+	{"a BETWEEN 2 AND 3", func(a, b int) bool { return a >= 2 && a <= 3 }},
+	{"a NOT BETWEEN 2 AND 3", func(a, b int) bool { return a < 2 || a > 3 }},
+	{"b = 2 AND a BETWEEN 1 AND 2", func(a, b int) bool { return b == 2 && a >= 1 && a <= 2 }},
+	{"a BETWEEN 1 AND 2 AND (b = 1 OR b = 3) OR a = 3 AND b = 2", func(a, b int) bool { return a <= 2 && (b == 1 || b == 3) || a == 3 && b == 2 }},
+}
+
+var unsupportedWheres = []string{
+	"a = 1 AND NOT (b = 1)",
+	"a = 1 OR EXISTS (SELECT 1 FROM dual)",
+	"a = 1 AND b IS NULL",
+}
+
+func gridTable(t *testing.T, s *Session, name string) {
+	t.Helper()
+	mustExec(t, s, fmt.Sprintf("CREATE TABLE %s (id INT PRIMARY KEY, a INT, b INT)", name))
+	for a := 1; a <= 3; a++ {
+		for b := 1; b <= 3; b++ {
+			mustExec(t, s, fmt.Sprintf("INSERT INTO %s (id, a, b) VALUES (%d, %d, %d)", name, a*10+b, a, b))
+		}
+	}
+}
+
+// gridIds lists the ids of gridTable for which keep is true
+func gridIds(keep func(a, b int) bool) []string {
+	ids := []string{}
+	for a := 1; a <= 3; a++ {
+		for b := 1; b <= 3; b++ {
+			if keep(a, b) {
+				ids = append(ids, fmt.Sprintf("%d", a*10+b))
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestSelectWhere(t *testing.T) {
+	s := NewSession()
+	name := testTableName(t)
+	gridTable(t, s, name)
+	for _, tt := range whereTests {
+		t.Run(tt.where, func(t *testing.T) {
+			response := mustExec(t, s, fmt.Sprintf("SELECT * FROM %s WHERE %s", name, tt.where))
+			if got, want := resultIds(t, response), gridIds(tt.match); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDeleteWhere(t *testing.T) {
+	s := NewSession()
+	base := testTableName(t)
+	for i, tt := range whereTests {
+		t.Run(tt.where, func(t *testing.T) {
+			name := fmt.Sprintf("%s_%d", base, i)
+			gridTable(t, s, name)
+			response := mustExec(t, s, fmt.Sprintf("DELETE FROM %s WHERE %s", name, tt.where))
+			want := gridIds(tt.match)
+			if response["rows_affected"] != len(want) {
+				t.Errorf("rows_affected = %v, want %d", response["rows_affected"], len(want))
+			}
+			left := gridIds(func(a, b int) bool { return !tt.match(a, b) })
+			if got := resultIds(t, mustExec(t, s, "SELECT * FROM "+name)); !reflect.DeepEqual(got, left) {
+				t.Errorf("rows left %v, want %v", got, left)
+			}
+		})
+	}
+}
+
+func TestUnsupportedWhere(t *testing.T) {
+	s := NewSession()
+	name := testTableName(t)
+	gridTable(t, s, name)
+	for _, where := range unsupportedWheres {
+		for _, statement := range []string{"SELECT * FROM %s WHERE %s", "DELETE FROM %s WHERE %s", "UPDATE %s SET b = 0 WHERE %s"} {
+			sql := fmt.Sprintf(statement, name, where)
+			if _, err := s.Execute(sql); err == nil {
+				t.Errorf("%s: expected an error", sql)
+			}
+		}
+	}
+	if got := resultIds(t, mustExec(t, s, fmt.Sprintf("SELECT * FROM %s WHERE b = 0", name))); len(got) != 0 {
+		t.Errorf("rows changed by failed statements: %v", got)
+	}
+	if got := resultIds(t, mustExec(t, s, "SELECT * FROM "+name)); len(got) != 9 {
+		t.Errorf("got %d rows, want 9", len(got))
+	}
+}
+
+func TestUpdateWhere(t *testing.T) {
+	s := NewSession()
+	base := testTableName(t)
+	for i, tt := range whereTests {
+		t.Run(tt.where, func(t *testing.T) {
+			name := fmt.Sprintf("%s_%d", base, i)
+			gridTable(t, s, name)
+			response := mustExec(t, s, fmt.Sprintf("UPDATE %s SET b = 0 WHERE %s", name, tt.where))
+			want := gridIds(tt.match)
+			if response["rows_affected"] != len(want) {
+				t.Errorf("rows_affected = %v, want %d", response["rows_affected"], len(want))
+			}
+			if got := resultIds(t, mustExec(t, s, fmt.Sprintf("SELECT * FROM %s WHERE b = 0", name))); !reflect.DeepEqual(got, want) {
+				t.Errorf("updated %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package table
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// tableHandle is the state of a table every session shares. Changes to the
+// id index and the column indexes are made by the holder of the table write
+// lock under mu, readers take mu shared for each lookup
+type tableHandle struct {
+	mu   sync.RWMutex
+	db   *Database
+	name string
+	// key names the table across databases
+	key              string
+	path             string
+	schema           string
+	ids              map[string][2]uint64
+	boolIndexes      map[string]*HashIndex[bool]
+	intIndexes       map[string]*HashIndex[int64]
+	floatIndexes     map[string]*HashIndex[float64]
+	stringIndexes    map[string]*BTreeStringIndex
+	compositeIndexes map[string]*CompositeIndex
+	pathIndexes      map[string]*PathIndex
+	multikeyIndexes  map[string]*MultikeyIndex
+	dateIndexes      map[string]*CompositeIndex
+	versions         []SchemaVersion
+	// stale is set once the catalog dropped the handle after a schema change
+	stale atomic.Bool
+}
+
+func newTableHandle(db *Database, name string, schema string) *tableHandle {
+	return &tableHandle{
+		db:               db,
+		name:             name,
+		key:              db.qualify(name),
+		path:             db.tablePath(name),
+		schema:           schema,
+		ids:              make(map[string][2]uint64),
+		boolIndexes:      make(map[string]*HashIndex[bool]),
+		intIndexes:       make(map[string]*HashIndex[int64]),
+		floatIndexes:     make(map[string]*HashIndex[float64]),
+		stringIndexes:    make(map[string]*BTreeStringIndex),
+		compositeIndexes: make(map[string]*CompositeIndex),
+		pathIndexes:      make(map[string]*PathIndex),
+		multikeyIndexes:  make(map[string]*MultikeyIndex),
+		dateIndexes:      make(map[string]*CompositeIndex),
+	}
+}
+
+// loadHandle reads a table from disk
+func loadHandle(db *Database, name string) (*tableHandle, error) {
+	path := db.tablePath(name)
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("Table with name %s does not exist", name)
+	}
+
+	schema, err := os.ReadFile(fmt.Sprintf("%s/schema.json", path))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading schema file: %s", err)
+	}
+
+	table := &Table{tableHandle: newTableHandle(db, name, string(schema))}
+	err = table.loadVersions()
+	if err != nil {
+		return nil, err
+	}
+	table.LoadIndexes()
+	return table.tableHandle, nil
+}
+
+// position returns where the newest version of a row is stored
+func (h *tableHandle) position(id string) ([2]uint64, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	position, ok := h.ids[id]
+	return position, ok
+}
+
+// sortedIds lists the ids in the order their newest versions are stored
+func (h *tableHandle) sortedIds() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ids := make([]string, 0, len(h.ids))
+	for id := range h.ids {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return h.ids[ids[i]][0] < h.ids[ids[j]][0]
+	})
+	return ids
+}
+
+// tableCatalog keeps every table the process opened by their key. Schema
+// changes drop their table, it is read from disk again the next time it is
+// opened
+type tableCatalog struct {
+	mu      sync.Mutex
+	handles map[string]*tableHandle
+}
+
+var catalog = &tableCatalog{handles: make(map[string]*tableHandle)}
+
+func (c *tableCatalog) get(db *Database, name string) (*tableHandle, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := db.qualify(name)
+	if handle, ok := c.handles[key]; ok {
+		return handle, nil
+	}
+	handle, err := loadHandle(db, name)
+	if err != nil {
+		return nil, err
+	}
+	c.handles[key] = handle
+	return handle, nil
+}
+
+func (c *tableCatalog) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if handle, ok := c.handles[key]; ok {
+		handle.stale.Store(true)
+		delete(c.handles, key)
+	}
+}
+
+// detach moves the table to a handle of its own read from disk, so a schema
+// change does not touch the state other sessions are reading. The shared
+// handle goes away once the change is done. Callers hold the write lock
+func (t *Table) detach() error {
+	handle, err := loadHandle(t.db, t.name)
+	if err != nil {
+		return err
+	}
+	t.tableHandle = handle
+	return nil
+}
+
+// CloseTables forgets every table the process opened, they are read from
+// disk again the next time they are opened
+func CloseTables() {
+	catalog.mu.Lock()
+	defer catalog.mu.Unlock()
+	for key, handle := range catalog.handles {
+		handle.stale.Store(true)
+		delete(catalog.handles, key)
+	}
+}
+
+// FlushTables syncs the files of every database to disk and forgets the
+// tables the process opened. Changes are written when their statement ends,
+// this makes sure they reached the disk before the process exits
+func FlushTables() error {
+	CloseTables()
+	if _, err := os.Stat(DataDir()); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.WalkDir(DataDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("Error reading %s: %s", path, err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Error opening %s: %s", path, err)
+		}
+		defer file.Close()
+		if err = file.Sync(); err != nil {
+			return fmt.Errorf("Error syncing %s: %s", path, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,72 @@
+package table
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestSharedTable writes through one opened table and reads through another
+// one, both use the ids and indexes of the catalog. Tables see the rows
+// committed when they were opened
+func TestSharedTable(t *testing.T) {
+	table := newTestTable(t, "", `{"properties": {"id": {"type": "integer"}, "s": {"type": "string"}}}`)
+	mustInsert(t, table, `{"id": 1, "s": "a"}`)
+	other, err := GetTable(table.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.tableHandle != table.tableHandle {
+		t.Fatal("tables opened twice do not share their state")
+	}
+	ids, err := other.SelectWhereIds(WhereClause{Column: "s", Operator: "=", Value: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"1"}) {
+		t.Errorf("got %v, want [1]", ids)
+	}
+
+	CloseTables()
+	reopened, err := GetTable(table.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.tableHandle == table.tableHandle {
+		t.Error("closed tables are still shared")
+	}
+	if _, err = reopened.GetById(1); err != nil {
+		t.Errorf("row missing after reading the table again: %s", err)
+	}
+}
+
+// TestSchemaChangeShared changes the schema of a table another session has
+// open, its next write follows the new schema
+func TestSchemaChangeShared(t *testing.T) {
+	table := newTestTable(t, "", `{"properties": {"id": {"type": "integer"}}}`)
+	other, err := GetTable(table.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = table.AlterSchema(`{"properties": {"id": {"type": "integer"}, "n": {"type": "integer"}}}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !other.stale.Load() {
+		t.Fatal("the handle of the other session was not dropped")
+	}
+	if err = other.Insert(`{"id": 1, "n": "x"}`); err == nil {
+		t.Error("insert followed the old schema")
+	}
+	mustInsert(t, other, `{"id": 1, "n": 1}`)
+	reader, err := GetTable(table.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := reader.SelectWhereIds(WhereClause{Column: "n", Operator: "=", Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"1"}) {
+		t.Errorf("got %v, want [1]", ids)
+	}
+}
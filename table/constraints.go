@@ -0,0 +1,421 @@
+package table
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Check is a CHECK constraint, Expr keeps the original text for messages
+type Check struct {
+	Expr   string      `json:"expr"`
+	Clause WhereClause `json:"clause"`
+}
+
+// Referential actions for ON DELETE, an empty action behaves as RESTRICT
+const (
+	Restrict = "restrict"
+	Cascade  = "cascade"
+	SetNull  = "set null"
+)
+
+// ForeignKey links Column to the id of the References table
+type ForeignKey struct {
+	Column     string `json:"column"`
+	References string `json:"references"`
+	OnDelete   string `json:"onDelete"`
+}
+
+// ConstraintError describes which constraint a row violated
+type ConstraintError struct {
+	Constraint string
+	Columns    []string
+	Message    string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("%s constraint violated on %s: %s", e.Constraint, strings.Join(e.Columns, ", "), e.Message)
+}
+
+// FieldError is a schema violation on a single field, nested fields are
+// joined by dots as in address.zip
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a row that does not match the schema
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = fmt.Sprintf("%s: %s", field.Field, field.Message)
+	}
+	return fmt.Sprintf("Data is not valid according to schema: %s", strings.Join(messages, "; "))
+}
+
+func (t *Table) getSchema() (JSONSchemaForValidation, error) {
+	var jsonSchema JSONSchemaForValidation
+	err := json.Unmarshal([]byte(t.schema), &jsonSchema)
+	if err != nil {
+		return jsonSchema, fmt.Errorf("Error unmarshalling schema: %s", err)
+	}
+	return jsonSchema, nil
+}
+
+// removeNulls drops null values, a missing key is how a NULL column is stored
+func removeNulls(jsonData map[string]interface{}) {
+	for key, value := range jsonData {
+		if value == nil {
+			delete(jsonData, key)
+		}
+	}
+}
+
+// applyDefaults fills the columns missing from a new row, keys holding nil
+// were given as NULL and are left alone
+func applyDefaults(jsonSchema JSONSchemaForValidation, jsonData map[string]interface{}) {
+	for column, prop := range jsonSchema.Properties {
+		if _, ok := jsonData[column]; !ok && prop.Default != nil {
+			jsonData[column] = prop.Default
+		}
+	}
+}
+
+// checkConstraints validates a row about to be written, id is the row own id
+// so it is not reported as its own duplicate on updates
+func (t *Table) checkConstraints(jsonSchema JSONSchemaForValidation, jsonData map[string]interface{}, id string) error {
+	for _, column := range jsonSchema.Required {
+		if _, ok := jsonData[column]; !ok {
+			return &ConstraintError{Constraint: "NOT NULL", Columns: []string{column}, Message: "value cannot be null"}
+		}
+	}
+
+	data, err := json.Marshal(jsonData)
+	if err != nil {
+		return fmt.Errorf("Error marshalling data: %s", err)
+	}
+	err = t.ValidateDocument(string(data))
+	if err != nil {
+		return err
+	}
+
+	for _, check := range jsonSchema.Checks {
+		coerceClause(jsonSchema, &check.Clause)
+		if !hasColumns(jsonData, check.Clause) {
+			// NULL makes a CHECK unknown, which SQL does not treat as a failure
+			continue
+		}
+		if !matchesWhere(jsonData, check.Clause) {
+			return &ConstraintError{Constraint: "CHECK", Columns: clauseColumns(check.Clause), Message: fmt.Sprintf("row does not satisfy %s", check.Expr)}
+		}
+	}
+
+	for _, fk := range jsonSchema.ForeignKeys {
+		value, ok := jsonData[fk.Column]
+		if !ok {
+			continue
+		}
+		parent, err := t.relatedTable(fk.References)
+		if err != nil {
+			return err
+		}
+		if _, err := parent.GetById(value); err != nil {
+			return &ConstraintError{Constraint: "FOREIGN KEY", Columns: []string{fk.Column}, Message: fmt.Sprintf("%v does not exist in %s", value, fk.References)}
+		}
+	}
+
+	for _, columns := range jsonSchema.uniqueSets() {
+		err = t.checkUnique(columns, jsonData, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s JSONSchemaForValidation) uniqueSets() [][]string {
+	var sets [][]string
+	for column, prop := range s.Properties {
+		if prop.Unique && column != "id" {
+			sets = append(sets, []string{column})
+		}
+	}
+	return append(sets, s.UniqueKeys...)
+}
+
+// checkUnique compares the values with the newest version of every
+// candidate row, not the ones the snapshot sees, so transactions running
+// side by side cannot both write them. A row changed by a transaction
+// still running may get its values back, so its older versions count too
+// and a match there is a conflict. Writes hold the table write lock,
+// checks and writes of a table never interleave
+func (t *Table) checkUnique(columns []string, jsonData map[string]interface{}, id string) error {
+	for _, column := range columns {
+		if _, ok := jsonData[column]; !ok {
+			// NULLs never collide
+			return nil
+		}
+	}
+
+	candidates, err := t.uniqueCandidates(columns, jsonData)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fmt.Sprintf("%s/data.bin", t.path))
+	if err != nil {
+		return fmt.Errorf("Error opening data file: %s", err)
+	}
+	defer f.Close()
+	for _, other := range candidates {
+		if other == id {
+			continue
+		}
+		// Versions past the newest one are only reached when a running
+		// transaction wrote over them, a match there is a conflict too
+		var found, conflict, older bool
+		err = t.unsettledVersions(f, other, func(version *rowVersion, unsettled bool) bool {
+			newest := !older
+			older = true
+			if version.deleted {
+				return false
+			}
+			for _, column := range columns {
+				if c, ok := compareValues(version.row[column], jsonData[column]); !ok || c != 0 {
+					return false
+				}
+			}
+			found, conflict = true, unsettled || !newest
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if conflict {
+			return &ConflictError{Table: t.name, Id: other}
+		}
+		if found {
+			values := make([]string, len(columns))
+			for i, column := range columns {
+				values[i] = fmt.Sprintf("%v", jsonData[column])
+			}
+			return &ConstraintError{Constraint: "UNIQUE", Columns: columns, Message: fmt.Sprintf("value (%s) already exists", strings.Join(values, ", "))}
+		}
+	}
+	return nil
+}
+
+// uniqueCandidates returns the rows that may hold the values, sorted. Indexes
+// keep the values of every version until a vacuum, so the rows found there
+// cover the older versions too. Without an index every row is a candidate
+func (t *Table) uniqueCandidates(columns []string, jsonData map[string]interface{}) ([]string, error) {
+	clauses := make([]WhereClause, len(columns))
+	for i, column := range columns {
+		clauses[i] = WhereClause{Column: column, Operator: "=", Value: jsonData[column]}
+	}
+	if ids, _, ok := t.lookupComposite(clauses); ok {
+		sort.Strings(ids)
+		return ids, nil
+	}
+
+	jsonSchema, err := t.getSchema()
+	if err != nil {
+		return nil, err
+	}
+	for _, clause := range clauses {
+		if jsonSchema.Properties[clause.Column].ContentEncoding == Base64Encoding {
+			// Blobs are not indexed
+			continue
+		}
+		ids, ok, err := t.indexedIds(clause)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			sort.Strings(ids)
+			return ids, nil
+		}
+	}
+	return t.sortedIds(), nil
+}
+
+// lockParents takes a shared lock on every row the foreign keys of the row
+// point to, so they cannot be deleted before the transaction ends. Parents
+// are locked before the table write lock, a delete holding one may need it
+func (t *Table) lockParents(jsonSchema JSONSchemaForValidation, jsonData map[string]interface{}) error {
+	for _, fk := range jsonSchema.ForeignKeys {
+		value, ok := jsonData[fk.Column]
+		if !ok || value == nil {
+			continue
+		}
+		parent, err := t.relatedTable(fk.References)
+		if err != nil {
+			return err
+		}
+		err = parent.LockRows([]string{fmt.Sprintf("%v", value)}, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUnseenChildren fails with a *ConflictError when the newest version of
+// a row the snapshot did not see points to id. Its transaction committed
+// after the snapshot was taken, deleting the row would leave it dangling
+func (t *Table) checkUnseenChildren(column string, id interface{}, seen []string) error {
+	seenIds := make(map[string]bool, len(seen))
+	for _, childId := range seen {
+		seenIds[childId] = true
+	}
+	f, err := os.Open(fmt.Sprintf("%s/data.bin", t.path))
+	if err != nil {
+		return fmt.Errorf("Error opening data file: %s", err)
+	}
+	defer f.Close()
+	clause := WhereClause{Column: column, Operator: "=", Value: id}
+	for _, childId := range t.sortedIds() {
+		if seenIds[childId] {
+			continue
+		}
+		var dangling bool
+		err = t.unsettledVersions(f, childId, func(version *rowVersion, unsettled bool) bool {
+			dangling = !version.deleted && matchesClause(version.row, clause)
+			return dangling
+		})
+		if err != nil {
+			return err
+		}
+		if dangling {
+			return &ConflictError{Table: t.name, Id: childId}
+		}
+	}
+	return nil
+}
+
+// matchesWhere evaluates a clause chain against a row with the same
+// semantics SelectWhereIds uses on ids
+func matchesWhere(row map[string]interface{}, clause WhereClause) bool {
+	matched := matchesClause(row, clause)
+	if matched && clause.And != nil {
+		matched = matchesWhere(row, *clause.And)
+	}
+	if !matched && clause.Or != nil {
+		matched = matchesWhere(row, *clause.Or)
+	}
+	return matched
+}
+
+func clauseColumns(clause WhereClause) []string {
+	columns := []string{clause.Column}
+	if clause.And != nil {
+		columns = append(columns, clauseColumns(*clause.And)...)
+	}
+	if clause.Or != nil {
+		columns = append(columns, clauseColumns(*clause.Or)...)
+	}
+	return columns
+}
+
+func hasColumns(row map[string]interface{}, clause WhereClause) bool {
+	for _, column := range clauseColumns(clause) {
+		if _, ok := row[column]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// relatedTable opens another table taking part in a constraint, the table
+// itself is returned for self references so both share the same ids. The
+// other table joins the same transaction
+func (t *Table) relatedTable(name string) (*Table, error) {
+	if name == t.name {
+		return t, nil
+	}
+	if t.tx != nil {
+		return t.tx.Table(name)
+	}
+	return t.db.GetTable(name)
+}
+
+// childReference is a foreign key of another table pointing to this one
+type childReference struct {
+	table *Table
+	fk    ForeignKey
+}
+
+func (t *Table) childReferences() ([]childReference, error) {
+	names, err := t.db.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	var children []childReference
+	for _, name := range names {
+		child, err := t.relatedTable(name)
+		if err != nil {
+			return nil, err
+		}
+		jsonSchema, err := child.getSchema()
+		if err != nil {
+			return nil, err
+		}
+		for _, fk := range jsonSchema.ForeignKeys {
+			if fk.References == t.name {
+				children = append(children, childReference{table: child, fk: fk})
+			}
+		}
+	}
+	return children, nil
+}
+
+// applyOnDelete runs the referential actions of every child row pointing to
+// the row being deleted, RESTRICT is checked for all of them before any
+// change is made
+func (t *Table) applyOnDelete(id interface{}) error {
+	children, err := t.childReferences()
+	if err != nil {
+		return err
+	}
+
+	childIds := make([][]string, len(children))
+	for i, child := range children {
+		ids, err := child.table.scanIds(WhereClause{Column: child.fk.Column, Operator: "=", Value: id})
+		if err != nil {
+			return err
+		}
+		err = child.table.checkUnseenChildren(child.fk.Column, id, ids)
+		if err != nil {
+			return err
+		}
+		// A row pointing to itself goes away with the delete
+		for _, childId := range ids {
+			if child.table != t || childId != fmt.Sprintf("%v", id) {
+				childIds[i] = append(childIds[i], childId)
+			}
+		}
+		if len(childIds[i]) > 0 && child.fk.OnDelete != Cascade && child.fk.OnDelete != SetNull {
+			return &ConstraintError{Constraint: "FOREIGN KEY", Columns: []string{child.fk.Column}, Message: fmt.Sprintf("%v is still referenced by %s", id, child.table.name)}
+		}
+	}
+
+	for i, child := range children {
+		for _, childId := range childIds[i] {
+			if child.fk.OnDelete == Cascade {
+				err = child.table.Delete(childId)
+			} else {
+				err = child.table.Update(childId, map[string]interface{}{child.fk.Column: nil})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
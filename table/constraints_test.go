@@ -0,0 +1,340 @@
+package table
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func isConflict(err error) bool {
+	_, ok := err.(*ConflictError)
+	return ok
+}
+
+func isUniqueViolation(err error) bool {
+	e, ok := err.(*ConstraintError)
+	return ok && e.Constraint == "UNIQUE"
+}
+
+func isNil(err error) bool {
+	return err == nil
+}
+
+// TestUniqueConcurrent inserts a value from a transaction while another one
+// changes the rows holding it. The other transaction begins after the
+// inserting one, so its changes are never in the snapshot of the insert
+func TestUniqueConcurrent(t *testing.T) {
+	const schema = `{"properties": {"id": {"type": "integer"}, "u": {"type": "string", "unique": true}}}`
+	tests := []struct {
+		name  string
+		setup []string
+		// other runs in the other transaction, ended by commit or rollback
+		// or left running when end is empty
+		other func(table *Table) error
+		end   string
+		want  func(error) bool
+	}{
+		{
+			name:  "uncommitted insert",
+			other: func(table *Table) error { return table.Insert(`{"id": 1, "u": "a"}`) },
+			want:  isConflict,
+		},
+		{
+			name:  "insert committed after the snapshot",
+			other: func(table *Table) error { return table.Insert(`{"id": 1, "u": "a"}`) },
+			end:   "commit",
+			want:  isUniqueViolation,
+		},
+		{
+			name:  "rolled back insert",
+			other: func(table *Table) error { return table.Insert(`{"id": 1, "u": "a"}`) },
+			end:   "rollback",
+			want:  isNil,
+		},
+		{
+			name:  "other value",
+			other: func(table *Table) error { return table.Insert(`{"id": 1, "u": "b"}`) },
+			want:  isNil,
+		},
+		{
+			name:  "uncommitted update away from the value",
+			setup: []string{`{"id": 1, "u": "a"}`},
+			other: func(table *Table) error { return table.Update("1", map[string]interface{}{"u": "b"}) },
+			want:  isConflict,
+		},
+		{
+			name:  "committed update away from the value",
+			setup: []string{`{"id": 1, "u": "a"}`},
+			other: func(table *Table) error { return table.Update("1", map[string]interface{}{"u": "b"}) },
+			end:   "commit",
+			want:  isNil,
+		},
+		{
+			name:  "uncommitted delete",
+			setup: []string{`{"id": 1, "u": "a"}`},
+			other: func(table *Table) error { return table.Delete("1") },
+			want:  isConflict,
+		},
+		{
+			name:  "committed row",
+			setup: []string{`{"id": 1, "u": "a"}`},
+			other: func(table *Table) error { return nil },
+			want:  isUniqueViolation,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := newTestTable(t, "", schema)
+			mustInsert(t, table, tt.setup...)
+
+			inserting, err := NewTx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer inserting.Rollback()
+			other, err := NewTx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer other.Rollback()
+			otherTable, err := other.Table(table.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = tt.other(otherTable); err != nil {
+				t.Fatalf("other transaction: %s", err)
+			}
+			switch tt.end {
+			case "commit":
+				other.Commit()
+			case "rollback":
+				other.Rollback()
+			}
+
+			insertTable, err := inserting.Table(table.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = insertTable.Insert(`{"id": 2, "u": "a"}`)
+			if !tt.want(err) {
+				t.Errorf("unexpected error %v (%T)", err, err)
+			}
+		})
+	}
+}
+
+// TestUniqueIndexed finds duplicates through the index of each column type,
+// a composite index and the scan left for unindexed blobs
+func TestUniqueIndexed(t *testing.T) {
+	tests := []struct {
+		name      string
+		schema    string
+		composite []string
+		setup     []string
+		update    map[string]interface{}
+		row       string
+		want      func(error) bool
+	}{
+		{
+			name:   "integer",
+			schema: `{"properties": {"id": {"type": "integer"}, "u": {"type": "integer", "unique": true}}}`,
+			setup:  []string{`{"id": 1, "u": 7}`},
+			row:    `{"id": 2, "u": 7}`,
+			want:   isUniqueViolation,
+		},
+		{
+			name:   "number",
+			schema: `{"properties": {"id": {"type": "integer"}, "u": {"type": "number", "unique": true}}}`,
+			setup:  []string{`{"id": 1, "u": 1.5}`},
+			row:    `{"id": 2, "u": 1.5}`,
+			want:   isUniqueViolation,
+		},
+		{
+			name:   "date",
+			schema: `{"properties": {"id": {"type": "integer"}, "u": {"type": "string", "format": "date", "unique": true}}}`,
+			setup:  []string{`{"id": 1, "u": "2020-01-02"}`},
+			row:    `{"id": 2, "u": "2020-01-02"}`,
+			want:   isUniqueViolation,
+		},
+		{
+			name:   "string sharing the first word",
+			schema: `{"properties": {"id": {"type": "integer"}, "u": {"type": "string", "unique": true}}}`,
+			setup:  []string{`{"id": 1, "u": "big red"}`},
+			row:    `{"id": 2, "u": "big blue"}`,
+			want:   isNil,
+		},
+		{
+			name:   "blob",
+			schema: `{"properties": {"id": {"type": "integer"}, "u": {"type": "string", "contentEncoding": "base64", "unique": true}}}`,
+			setup:  []string{`{"id": 1, "u": "YQ=="}`},
+			row:    `{"id": 2, "u": "YQ=="}`,
+			want:   isUniqueViolation,
+		},
+		{
+			name:      "composite key",
+			schema:    `{"properties": {"id": {"type": "integer"}, "a": {"type": "integer"}, "b": {"type": "string"}}, "uniqueKeys": [["a", "b"]]}`,
+			composite: []string{"a", "b"},
+			setup:     []string{`{"id": 1, "a": 1, "b": "x"}`, `{"id": 2, "a": 1, "b": "y"}`},
+			row:       `{"id": 3, "a": 1, "b": "y"}`,
+			want:      isUniqueViolation,
+		},
+		{
+			name:      "composite key with another value",
+			schema:    `{"properties": {"id": {"type": "integer"}, "a": {"type": "integer"}, "b": {"type": "string"}}, "uniqueKeys": [["a", "b"]]}`,
+			composite: []string{"a", "b"},
+			setup:     []string{`{"id": 1, "a": 1, "b": "x"}`},
+			row:       `{"id": 2, "a": 2, "b": "x"}`,
+			want:      isNil,
+		},
+		{
+			name:   "value updated away",
+			schema: `{"properties": {"id": {"type": "integer"}, "u": {"type": "integer", "unique": true}}}`,
+			setup:  []string{`{"id": 1, "u": 7}`},
+			update: map[string]interface{}{"u": 8},
+			row:    `{"id": 2, "u": 7}`,
+			want:   isNil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := newTestTable(t, "", tt.schema)
+			if tt.composite != nil {
+				if err := table.CreateCompositeIndex("unique_key", tt.composite); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mustInsert(t, table, tt.setup...)
+			if tt.update != nil {
+				if err := table.Update("1", tt.update); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := table.Insert(tt.row)
+			if !tt.want(err) {
+				t.Errorf("unexpected error %v (%T)", err, err)
+			}
+		})
+	}
+}
+
+// TestForeignKeyConcurrent inserts a child while another transaction
+// deletes its parent, and the other way around. Whichever comes second has
+// to wait for the first and fail if it committed
+func TestForeignKeyConcurrent(t *testing.T) {
+	tests := []struct {
+		name string
+		// first holds its change open while second runs
+		first, second func(parent *Table, child *Table) error
+		end           string
+		want          func(error) bool
+	}{
+		{
+			name:   "insert child after a committed delete of its parent",
+			first:  func(parent *Table, child *Table) error { return parent.Delete("1") },
+			second: func(parent *Table, child *Table) error { return child.Insert(`{"id": 1, "pid": 1}`) },
+			end:    "commit",
+			want:   isConflict,
+		},
+		{
+			name:   "insert child after a rolled back delete of its parent",
+			first:  func(parent *Table, child *Table) error { return parent.Delete("1") },
+			second: func(parent *Table, child *Table) error { return child.Insert(`{"id": 1, "pid": 1}`) },
+			end:    "rollback",
+			want:   isNil,
+		},
+		{
+			name:   "delete parent after a committed child insert",
+			first:  func(parent *Table, child *Table) error { return child.Insert(`{"id": 1, "pid": 1}`) },
+			second: func(parent *Table, child *Table) error { return parent.Delete("1") },
+			end:    "commit",
+			want:   isConflict,
+		},
+		{
+			name:   "delete parent after a rolled back child insert",
+			first:  func(parent *Table, child *Table) error { return child.Insert(`{"id": 1, "pid": 1}`) },
+			second: func(parent *Table, child *Table) error { return parent.Delete("1") },
+			end:    "rollback",
+			want:   isNil,
+		},
+		{
+			name:   "update child to a parent deleted by a committed transaction",
+			first:  func(parent *Table, child *Table) error { return parent.Delete("1") },
+			second: func(parent *Table, child *Table) error { return child.Update("2", map[string]interface{}{"pid": 1}) },
+			end:    "commit",
+			want:   isConflict,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := newTestTable(t, fmt.Sprintf("_%d_parent", i), `{"properties": {"id": {"type": "integer"}}}`)
+			parentName := parent.name
+			child := newTestTable(t, fmt.Sprintf("_%d_child", i), fmt.Sprintf(`{"properties": {"id": {"type": "integer"}, "pid": {"type": "integer"}}, "foreignKeys": [{"column": "pid", "references": %q}]}`, parentName))
+			mustInsert(t, parent, `{"id": 1}`, `{"id": 2}`)
+			mustInsert(t, child, `{"id": 2, "pid": 2}`)
+
+			second, err := NewTx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Rollback()
+			first, err := NewTx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Rollback()
+			if err = tt.first(mustTxTable(t, first, parentName), mustTxTable(t, first, child.name)); err != nil {
+				t.Fatalf("first transaction: %s", err)
+			}
+			first.EndStatement()
+
+			// The second transaction waits for the locks of the first one
+			ended := make(chan struct{})
+			go func() {
+				defer close(ended)
+				time.Sleep(50 * time.Millisecond)
+				if tt.end == "commit" {
+					first.Commit()
+				} else {
+					first.Rollback()
+				}
+			}()
+			err = tt.second(mustTxTable(t, second, parentName), mustTxTable(t, second, child.name))
+			<-ended
+			if !tt.want(err) {
+				t.Fatalf("unexpected error %v (%T)", err, err)
+			}
+			if err == nil {
+				second.Commit()
+			}
+			checkNoDanglingChildren(t, parent, child)
+		})
+	}
+}
+
+func mustTxTable(t *testing.T, tx *Tx, name string) *Table {
+	t.Helper()
+	table, err := tx.Table(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func checkNoDanglingChildren(t *testing.T, parent *Table, child *Table) {
+	t.Helper()
+	tx, err := NewTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	rows, err := mustTxTable(t, tx, child.name).SelectAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parents := mustTxTable(t, tx, parent.name)
+	for _, row := range rows {
+		if _, err := parents.GetById(row["pid"]); err != nil {
+			t.Errorf("child %v points to missing parent %v", row["id"], row["pid"])
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package table
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DefaultDatabaseName is the database living at the root of the data
+// directory, connections start in it
+const DefaultDatabaseName = "default"
+
+// databaseFile marks the directories of the data directory that are
+// databases, tables have a schema.json instead
+const databaseFile = "database.json"
+
+var dataDir = "./data"
+
+// SetDataDir changes the directory every database is stored in, it has to
+// be called before any table is opened
+func SetDataDir(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating data directory: %s", err)
+	}
+	dataDir = dir
+	return nil
+}
+
+// DataDir returns the directory every database is stored in
+func DataDir() string {
+	return dataDir
+}
+
+// Database is a directory of tables and sequences. The default one is the
+// data directory itself, the others are directories inside of it
+type Database struct {
+	Name string
+	Dir  string
+}
+
+func DefaultDatabase() *Database {
+	return &Database{Name: DefaultDatabaseName, Dir: dataDir}
+}
+
+// OpenDatabase returns the database with the given name if it exists
+func OpenDatabase(name string) (*Database, error) {
+	if name == DefaultDatabaseName {
+		return DefaultDatabase(), nil
+	}
+	db := &Database{Name: name, Dir: filepath.Join(dataDir, name)}
+	if _, err := os.Stat(filepath.Join(db.Dir, databaseFile)); err != nil {
+		return nil, fmt.Errorf("Database %s does not exist", name)
+	}
+	return db, nil
+}
+
+func CreateDatabase(name string) (*Database, error) {
+	db := &Database{Name: name, Dir: filepath.Join(dataDir, name)}
+	if name == DefaultDatabaseName {
+		return nil, fmt.Errorf("Database with name %s already exists", name)
+	}
+	// A table of the default database may use the directory
+	if _, err := os.Stat(db.Dir); err == nil {
+		return nil, fmt.Errorf("Database with name %s already exists", name)
+	}
+	err := os.MkdirAll(db.Dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating database directory: %s", err)
+	}
+	data, _ := json.Marshal(map[string]string{"name": name})
+	err = os.WriteFile(filepath.Join(db.Dir, databaseFile), data, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error writing database file: %s", err)
+	}
+	return db, nil
+}
+
+// DropDatabase removes a database with its tables once the statements using
+// them are done
+func DropDatabase(name string) error {
+	if name == DefaultDatabaseName {
+		return fmt.Errorf("The default database cannot be dropped")
+	}
+	db, err := OpenDatabase(name)
+	if err != nil {
+		return err
+	}
+	names, err := db.ListTables()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		lock := lockFor(db.qualify(name))
+		lock.statement.Lock()
+		lock.write.Lock()
+		defer lock.statement.Unlock()
+		defer lock.write.Unlock()
+		catalog.invalidate(db.qualify(name))
+	}
+	err = os.RemoveAll(db.Dir)
+	if err != nil {
+		return fmt.Errorf("Error removing database directory: %s", err)
+	}
+	return nil
+}
+
+// ListDatabases returns the names of every database, the default one first
+func ListDatabases() ([]string, error) {
+	names := []string{DefaultDatabaseName}
+	entries, err := os.ReadDir(dataDir)
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading data directory: %s", err)
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(dataDir, entry.Name(), databaseFile)); err == nil && entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// qualify names a table across databases, the tables of the default one
+// keep their own name
+func (db *Database) qualify(name string) string {
+	if db.Name == DefaultDatabaseName {
+		return name
+	}
+	return fmt.Sprintf("%s.%s", db.Name, name)
+}
+
+func (db *Database) tablePath(name string) string {
+	return filepath.Join(db.Dir, name)
+}
@@ -0,0 +1,178 @@
+package table
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Expr is a value computed from a row, migrations use it to fill columns.
+// Exactly one of Column, Func or Operator is set, otherwise it is the literal
+// Value. Casts keep their target JSON type in Value
+type Expr struct {
+	Column   string      `json:"column,omitempty"`
+	Func     string      `json:"func,omitempty"`
+	Operator string      `json:"operator,omitempty"`
+	Args     []Expr      `json:"args,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+}
+
+// Eval computes the expression for a row, NULL propagates like in SQL
+func (e Expr) Eval(row map[string]interface{}) (interface{}, error) {
+	switch {
+	case e.Column != "":
+		return row[e.Column], nil
+	case e.Operator != "":
+		return e.evalOperator(row)
+	case e.Func != "":
+		return e.evalFunc(row)
+	}
+	return e.Value, nil
+}
+
+func (e Expr) evalArgs(row map[string]interface{}) ([]interface{}, error) {
+	values := make([]interface{}, len(e.Args))
+	for i, arg := range e.Args {
+		value, err := arg.Eval(row)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func (e Expr) evalOperator(row map[string]interface{}) (interface{}, error) {
+	values, err := e.evalArgs(row)
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]float64, len(values))
+	for i, value := range values {
+		if value == nil {
+			return nil, nil
+		}
+		number, ok := toNumber(value)
+		if !ok {
+			return nil, fmt.Errorf("Operator %s expects numbers, found %v", e.Operator, value)
+		}
+		numbers[i] = number
+	}
+	if len(numbers) == 1 && e.Operator == "-" {
+		return -numbers[0], nil
+	}
+	if len(numbers) != 2 {
+		return nil, fmt.Errorf("Operator %s expects two operands", e.Operator)
+	}
+	switch e.Operator {
+	case "+":
+		return numbers[0] + numbers[1], nil
+	case "-":
+		return numbers[0] - numbers[1], nil
+	case "*":
+		return numbers[0] * numbers[1], nil
+	case "/":
+		if numbers[1] == 0 {
+			return nil, nil
+		}
+		return numbers[0] / numbers[1], nil
+	}
+	return nil, fmt.Errorf("Unsupported operator: %s", e.Operator)
+}
+
+func (e Expr) evalFunc(row map[string]interface{}) (interface{}, error) {
+	values, err := e.evalArgs(row)
+	if err != nil {
+		return nil, err
+	}
+	switch e.Func {
+	case "coalesce":
+		for _, value := range values {
+			if value != nil {
+				return value, nil
+			}
+		}
+		return nil, nil
+	case "concat":
+		var builder strings.Builder
+		for _, value := range values {
+			if value == nil {
+				return nil, nil
+			}
+			builder.WriteString(toText(value))
+		}
+		return builder.String(), nil
+	}
+
+	if len(values) != 1 {
+		return nil, fmt.Errorf("%s expects one argument", e.Func)
+	}
+	if values[0] == nil {
+		return nil, nil
+	}
+	switch e.Func {
+	case "lower":
+		return strings.ToLower(toText(values[0])), nil
+	case "upper":
+		return strings.ToUpper(toText(values[0])), nil
+	case "trim":
+		return strings.TrimSpace(toText(values[0])), nil
+	case "cast":
+		return castValue(values[0], fmt.Sprintf("%v", e.Value))
+	}
+	return nil, fmt.Errorf("Unsupported function: %s", e.Func)
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+func toText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// castValue converts a value to a JSON type, like CAST(x AS type) does
+func castValue(value interface{}, typeName string) (interface{}, error) {
+	switch typeName {
+	case "string":
+		return toText(value), nil
+	case "number", "integer":
+		number, ok := toNumber(value)
+		if !ok {
+			return nil, fmt.Errorf("Cannot cast %v to %s", value, typeName)
+		}
+		if typeName == "integer" {
+			return float64(int64(number)), nil
+		}
+		return number, nil
+	case "boolean":
+		coerced, ok := JSONProperty{Type: "boolean"}.coerceValue(value)
+		if !ok {
+			return nil, fmt.Errorf("Cannot cast %v to boolean", value)
+		}
+		return coerced, nil
+	}
+	return nil, fmt.Errorf("Unsupported cast to %s", typeName)
+}
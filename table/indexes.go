@@ -3,9 +3,12 @@ package table
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"github.com/kimuraz/golang-json-db/utils"
 	"os"
+	"sort"
+	"strings"
 )
 
 type GobIndex struct{}
@@ -57,6 +60,23 @@ func (hashIdx *HashIndex[T]) Remove(key T, id string) {
 	}
 }
 
+// SaveToFile overwrites the file with the current state, the embedded
+// GobIndex cannot see the unexported map
+func (hashIdx *HashIndex[T]) SaveToFile(fileName string) error {
+	return saveGob(fileName, hashIdx.hashIndex)
+}
+
+func (hashIdx *HashIndex[T]) LoadFromFile(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := gob.NewDecoder(file)
+	return decoder.Decode(&hashIdx.hashIndex)
+}
+
 func (hashIdx *HashIndex[T]) Print() {
 	for k, v := range hashIdx.hashIndex {
 		fmt.Println(fmt.Sprintf("key: %v, value: %v", k, v))
@@ -86,23 +106,298 @@ func (gobIndex *GobIndex) LoadFromFile(fileName string) error {
 }
 
 func (bTreeIdx *BTreeStringIndex) SaveToFile(fileName string) error {
-	var buf bytes.Buffer
-	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	return saveGob(fileName, bTreeIdx)
+}
+
+func (bTreeIdx *BTreeStringIndex) LoadFromFile(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	encoder := gob.NewEncoder(&buf)
-	err = encoder.Encode(bTreeIdx)
+	decoder := gob.NewDecoder(file)
+	return decoder.Decode(bTreeIdx)
+}
+
+// Kinds of values stored in composite index keys, in sort order
+const (
+	nullValue uint8 = iota
+	boolValue
+	numberValue
+	stringValue
+)
+
+// IndexValue is a single typed component of a composite index key
+type IndexValue struct {
+	Kind uint8
+	Num  float64
+	Str  string
+	Bool bool
+}
+
+// CompositeEntry holds the ids of every row sharing the same key tuple
+type CompositeEntry struct {
+	Key []IndexValue
+	Ids []string
+}
+
+// CompositeIndex indexes an ordered tuple of columns, entries are kept sorted
+// by key so it can answer leftmost-prefix equality plus a trailing range
+type CompositeIndex struct {
+	Name    string
+	Columns []string
+	Entries []CompositeEntry
+}
+
+// RangeBound is one side of a range lookup on a composite index
+type RangeBound struct {
+	Value     interface{}
+	Inclusive bool
+}
+
+func NewIndexValue(value interface{}) IndexValue {
+	switch v := value.(type) {
+	case bool:
+		return IndexValue{Kind: boolValue, Bool: v}
+	case int:
+		return IndexValue{Kind: numberValue, Num: float64(v)}
+	case int64:
+		return IndexValue{Kind: numberValue, Num: float64(v)}
+	case float64:
+		return IndexValue{Kind: numberValue, Num: v}
+	case string:
+		return IndexValue{Kind: stringValue, Str: v}
+	case nil:
+		return IndexValue{Kind: nullValue}
+	default:
+		return IndexValue{Kind: stringValue, Str: fmt.Sprintf("%v", v)}
+	}
+}
+
+func (v IndexValue) Compare(other IndexValue) int {
+	if v.Kind != other.Kind {
+		if v.Kind < other.Kind {
+			return -1
+		}
+		return 1
+	}
+	switch v.Kind {
+	case boolValue:
+		if v.Bool == other.Bool {
+			return 0
+		}
+		if !v.Bool {
+			return -1
+		}
+		return 1
+	case numberValue:
+		if v.Num < other.Num {
+			return -1
+		}
+		if v.Num > other.Num {
+			return 1
+		}
+		return 0
+	case stringValue:
+		return strings.Compare(v.Str, other.Str)
+	}
+	return 0
+}
+
+func NewCompositeIndex(name string, columns []string) *CompositeIndex {
+	return &CompositeIndex{
+		Name:    name,
+		Columns: columns,
+		Entries: make([]CompositeEntry, 0),
+	}
+}
+
+// compareKeys compares only the first len(b) components of a, so a full key
+// can be matched against a prefix
+func compareKeys(a []IndexValue, b []IndexValue) int {
+	for i := range b {
+		if i >= len(a) {
+			return -1
+		}
+		if c := a[i].Compare(b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func toKey(values []interface{}) []IndexValue {
+	key := make([]IndexValue, len(values))
+	for i, value := range values {
+		key[i] = NewIndexValue(value)
+	}
+	return key
+}
+
+func (cIdx *CompositeIndex) search(key []IndexValue) (int, bool) {
+	pos := sort.Search(len(cIdx.Entries), func(i int) bool {
+		return compareKeys(cIdx.Entries[i].Key, key) >= 0
+	})
+	return pos, pos < len(cIdx.Entries) && compareKeys(cIdx.Entries[pos].Key, key) == 0
+}
+
+func (cIdx *CompositeIndex) Insert(values []interface{}, id string) {
+	key := toKey(values)
+	pos, found := cIdx.search(key)
+	if found {
+		cIdx.Entries[pos].Ids = append(cIdx.Entries[pos].Ids, id)
+		return
+	}
+	cIdx.Entries = append(cIdx.Entries, CompositeEntry{})
+	copy(cIdx.Entries[pos+1:], cIdx.Entries[pos:])
+	cIdx.Entries[pos] = CompositeEntry{Key: key, Ids: []string{id}}
+}
+
+func (cIdx *CompositeIndex) Remove(values []interface{}, id string) {
+	pos, found := cIdx.search(toKey(values))
+	if !found {
+		return
+	}
+	entry := &cIdx.Entries[pos]
+	for i, v := range entry.Ids {
+		if v == id {
+			entry.Ids = append(entry.Ids[:i], entry.Ids[i+1:]...)
+			break
+		}
+	}
+	if len(entry.Ids) == 0 {
+		cIdx.Entries = append(cIdx.Entries[:pos], cIdx.Entries[pos+1:]...)
+	}
+}
+
+// Lookup returns the ids matching every value of prefix on the leading
+// columns and, when given, the bounds on the column right after the prefix
+func (cIdx *CompositeIndex) Lookup(prefix []interface{}, lower *RangeBound, upper *RangeBound) []string {
+	prefixKey := toKey(prefix)
+	startKey := prefixKey
+	if lower != nil {
+		startKey = append(toKey(prefix), NewIndexValue(lower.Value))
+	}
+	pos, _ := cIdx.search(startKey)
+
+	var ids []string
+	for ; pos < len(cIdx.Entries); pos++ {
+		key := cIdx.Entries[pos].Key
+		if compareKeys(key, prefixKey) != 0 {
+			break
+		}
+		if lower != nil && !lower.Inclusive && key[len(prefixKey)].Compare(NewIndexValue(lower.Value)) == 0 {
+			continue
+		}
+		if upper != nil {
+			c := key[len(prefixKey)].Compare(NewIndexValue(upper.Value))
+			if c > 0 || (c == 0 && !upper.Inclusive) {
+				break
+			}
+		}
+		ids = append(ids, cIdx.Entries[pos].Ids...)
+	}
+	return ids
+}
+
+// lookupOperator answers a single comparison on the first column, ok is false
+// for operators the index cannot serve
+func (cIdx *CompositeIndex) lookupOperator(operator string, value interface{}) ([]string, bool) {
+	switch operator {
+	case "=":
+		return cIdx.Lookup([]interface{}{value}, nil, nil), true
+	case ">", ">=":
+		return cIdx.Lookup(nil, &RangeBound{Value: value, Inclusive: operator == ">="}, nil), true
+	case "<", "<=":
+		return cIdx.Lookup(nil, nil, &RangeBound{Value: value, Inclusive: operator == "<="}), true
+	}
+	return nil, false
+}
+
+func (cIdx *CompositeIndex) SaveToFile(fileName string) error {
+	return saveGob(fileName, cIdx)
+}
+
+func (cIdx *CompositeIndex) LoadFromFile(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
 	if err != nil {
 		return err
 	}
-	_, err = buf.WriteTo(file)
-	return err
+	defer file.Close()
+
+	decoder := gob.NewDecoder(file)
+	return decoder.Decode(cIdx)
 }
 
-func (bTreeIdx *BTreeStringIndex) LoadFromFile(fileName string) error {
+// PathIndex indexes the value found at Path inside a document column, keys
+// are the JSON encoding of that value
+type PathIndex struct {
+	Name   string
+	Column string
+	Path   []string
+	AsText bool
+	Keys   map[string][]string
+}
+
+func NewPathIndex(name string, column string, path []string, asText bool) *PathIndex {
+	return &PathIndex{
+		Name:   name,
+		Column: column,
+		Path:   path,
+		AsText: asText,
+		Keys:   make(map[string][]string),
+	}
+}
+
+func pathKey(value interface{}) string {
+	key, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(key)
+}
+
+// valueOf returns the indexed value of a row, ok is false if the path does
+// not exist in it
+func (pIdx *PathIndex) valueOf(row map[string]interface{}) (interface{}, bool) {
+	value, ok := resolvePath(row[pIdx.Column], pIdx.Path)
+	if _, present := row[pIdx.Column]; !present || !ok {
+		return nil, false
+	}
+	if pIdx.AsText {
+		value = textValue(value)
+	}
+	return value, true
+}
+
+func (pIdx *PathIndex) Insert(value interface{}, id string) {
+	key := pathKey(value)
+	pIdx.Keys[key] = append(pIdx.Keys[key], id)
+}
+
+func (pIdx *PathIndex) Get(value interface{}) []string {
+	return pIdx.Keys[pathKey(value)]
+}
+
+func (pIdx *PathIndex) Remove(value interface{}, id string) {
+	key := pathKey(value)
+	for i, v := range pIdx.Keys[key] {
+		if v == id {
+			pIdx.Keys[key] = append(pIdx.Keys[key][:i], pIdx.Keys[key][i+1:]...)
+			break
+		}
+	}
+	if len(pIdx.Keys[key]) == 0 {
+		delete(pIdx.Keys, key)
+	}
+}
+
+func (pIdx *PathIndex) SaveToFile(fileName string) error {
+	return saveGob(fileName, pIdx)
+}
+
+func (pIdx *PathIndex) LoadFromFile(fileName string) error {
 	file, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
 	if err != nil {
 		return err
@@ -110,5 +405,136 @@ func (bTreeIdx *BTreeStringIndex) LoadFromFile(fileName string) error {
 	defer file.Close()
 
 	decoder := gob.NewDecoder(file)
-	return decoder.Decode(bTreeIdx)
+	return decoder.Decode(pIdx)
+}
+
+// MultikeyIndex indexes every scalar element of an array column under the
+// row id, keys are the JSON encoding of the element
+type MultikeyIndex struct {
+	Column string
+	Keys   map[string][]string
+}
+
+func NewMultikeyIndex(column string) *MultikeyIndex {
+	return &MultikeyIndex{
+		Column: column,
+		Keys:   make(map[string][]string),
+	}
+}
+
+// elementKeys returns the distinct keys of the indexable elements of an array
+func elementKeys(value interface{}) []string {
+	elements, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var keys []string
+	for _, element := range elements {
+		switch element.(type) {
+		case string, float64, int64:
+			key := pathKey(element)
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+func (mIdx *MultikeyIndex) Insert(value interface{}, id string) {
+	for _, key := range elementKeys(value) {
+		mIdx.Keys[key] = append(mIdx.Keys[key], id)
+	}
+}
+
+func (mIdx *MultikeyIndex) Remove(value interface{}, id string) {
+	for _, key := range elementKeys(value) {
+		for i, v := range mIdx.Keys[key] {
+			if v == id {
+				mIdx.Keys[key] = append(mIdx.Keys[key][:i], mIdx.Keys[key][i+1:]...)
+				break
+			}
+		}
+		if len(mIdx.Keys[key]) == 0 {
+			delete(mIdx.Keys, key)
+		}
+	}
+}
+
+// GetAny returns the ids of the rows having at least one of the elements
+func (mIdx *MultikeyIndex) GetAny(elements []interface{}) []string {
+	var ids []string
+	for _, element := range elements {
+		ids = union(ids, mIdx.Keys[pathKey(element)])
+	}
+	return ids
+}
+
+// GetAll returns the ids of the rows having every one of the elements, ok is
+// false when an element cannot be looked up in the index
+func (mIdx *MultikeyIndex) GetAll(elements []interface{}) ([]string, bool) {
+	var ids []string
+	for i, element := range elements {
+		switch element.(type) {
+		case string, float64, int64:
+		default:
+			return nil, false
+		}
+		if i == 0 {
+			ids = append(ids, mIdx.Keys[pathKey(element)]...)
+			continue
+		}
+		ids = intersect(ids, mIdx.Keys[pathKey(element)])
+	}
+	return ids, len(elements) > 0
+}
+
+func (mIdx *MultikeyIndex) SaveToFile(fileName string) error {
+	return saveGob(fileName, mIdx)
+}
+
+func (mIdx *MultikeyIndex) LoadFromFile(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := gob.NewDecoder(file)
+	return decoder.Decode(mIdx)
+}
+
+// saveGob encodes value to fileName through writeFileAtomic
+func saveGob(fileName string, value interface{}) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(value)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fileName, buf.Bytes())
+}
+
+// writeFileAtomic replaces a file through a rename, so readers in other
+// sessions see either the previous content or the new one and never half of
+// it. The content is synced first, a crash cannot leave an empty file behind
+func writeFileAtomic(fileName string, data []byte) error {
+	tmp := fileName + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fileName)
 }
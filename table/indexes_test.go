@@ -0,0 +1,125 @@
+package table
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func sortIds(ids []string) []string {
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func TestCompositeIndexLookup(t *testing.T) {
+	idx := NewCompositeIndex("city_age", []string{"city", "age"})
+	for i, row := range []struct {
+		city string
+		age  int
+	}{{"Lima", 20}, {"Lima", 30}, {"Lima", 40}, {"Lima", 30}, {"Oslo", 25}, {"Rome", 30}} {
+		idx.Insert([]interface{}{row.city, row.age}, fmt.Sprint(i+1))
+	}
+
+	tests := []struct {
+		name   string
+		prefix []interface{}
+		lower  *RangeBound
+		upper  *RangeBound
+		want   []string
+	}{
+		{name: "full key", prefix: []interface{}{"Lima", 30}, want: []string{"2", "4"}},
+		{name: "leftmost prefix", prefix: []interface{}{"Lima"}, want: []string{"1", "2", "3", "4"}},
+		{name: "missing prefix", prefix: []interface{}{"Paris"}},
+		{name: "lower inclusive", prefix: []interface{}{"Lima"}, lower: &RangeBound{Value: 30, Inclusive: true}, want: []string{"2", "3", "4"}},
+		{name: "lower exclusive", prefix: []interface{}{"Lima"}, lower: &RangeBound{Value: 30}, want: []string{"3"}},
+		{name: "upper inclusive", prefix: []interface{}{"Lima"}, upper: &RangeBound{Value: 30, Inclusive: true}, want: []string{"1", "2", "4"}},
+		{name: "upper exclusive", prefix: []interface{}{"Lima"}, upper: &RangeBound{Value: 30}, want: []string{"1"}},
+		{name: "between", prefix: []interface{}{"Lima"}, lower: &RangeBound{Value: 21}, upper: &RangeBound{Value: 39}, want: []string{"2", "4"}},
+		{name: "range on the first column", lower: &RangeBound{Value: "M"}, want: []string{"5", "6"}},
+		{name: "float matches integer", prefix: []interface{}{"Oslo", 25.0}, want: []string{"5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sortIds(idx.Lookup(tt.prefix, tt.lower, tt.upper))
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	idx.Remove([]interface{}{"Lima", 30}, "2")
+	idx.Remove([]interface{}{"Oslo", 25}, "5")
+	if got := idx.Lookup([]interface{}{"Lima", 30}, nil, nil); !reflect.DeepEqual(got, []string{"4"}) {
+		t.Errorf("after Remove got %v, want [4]", got)
+	}
+	if got := idx.Lookup([]interface{}{"Oslo"}, nil, nil); len(got) != 0 {
+		t.Errorf("after removing the last id got %v", got)
+	}
+}
+
+func TestLookupComposite(t *testing.T) {
+	table := newTestTable(t, "", `{"type": "object", "properties": {"id": {"type": "string"}, "city": {"type": "string"}, "age": {"type": "integer"}, "name": {"type": "string"}}, "required": ["id"]}`)
+	mustInsert(t, table,
+		`{"id": "1", "city": "Lima", "age": 20, "name": "a"}`,
+		`{"id": "2", "city": "Lima", "age": 30, "name": "b"}`,
+		`{"id": "3", "city": "Lima", "age": 40, "name": "c"}`,
+		`{"id": "4", "city": "Oslo", "age": 30, "name": "d"}`,
+	)
+	if err := table.CreateCompositeIndex("city_age", []string{"city", "age"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		clauses []WhereClause
+		found   bool
+		want    []string
+		rest    int
+	}{
+		{
+			name:    "equality on both columns",
+			clauses: []WhereClause{{Column: "age", Operator: "=", Value: 30}, {Column: "city", Operator: "=", Value: "Lima"}},
+			found:   true, want: []string{"2"},
+		},
+		{
+			name:    "prefix and range",
+			clauses: []WhereClause{{Column: "city", Operator: "=", Value: "Lima"}, {Column: "age", Operator: ">", Value: 20}, {Column: "age", Operator: "<=", Value: 40}},
+			found:   true, want: []string{"2", "3"},
+		},
+		{
+			name:    "other clauses are left over",
+			clauses: []WhereClause{{Column: "city", Operator: "=", Value: "Lima"}, {Column: "age", Operator: "=", Value: 20}, {Column: "name", Operator: "=", Value: "a"}},
+			found:   true, want: []string{"1"}, rest: 1,
+		},
+		{
+			name:    "single equality is left to the column index",
+			clauses: []WhereClause{{Column: "city", Operator: "=", Value: "Lima"}},
+		},
+		{
+			name:    "no leftmost column",
+			clauses: []WhereClause{{Column: "age", Operator: "=", Value: 30}, {Column: "name", Operator: "=", Value: "b"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, rest, found := table.lookupComposite(tt.clauses)
+			if found != tt.found {
+				t.Fatalf("found is %v, want %v", found, tt.found)
+			}
+			if !found {
+				return
+			}
+			if got := sortIds(ids); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if len(rest) != tt.rest {
+				t.Errorf("got %d clauses left over, want %d", len(rest), tt.rest)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package table
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lock modes, tables get the intention modes before their rows are locked
+type lockMode int
+
+const (
+	intentionShared lockMode = iota
+	intentionExclusive
+	sharedLock
+	exclusiveLock
+)
+
+var lockCompatible = [4][4]bool{
+	intentionShared:    {true, true, true, false},
+	intentionExclusive: {true, true, false, false},
+	sharedLock:         {true, false, true, false},
+	exclusiveLock:      {false, false, false, false},
+}
+
+// DefaultLockTimeout is how long a lock is waited for unless SetLockTimeout
+// was called
+const DefaultLockTimeout = 5 * time.Second
+
+var lockTimeout atomic.Int64
+
+func init() {
+	lockTimeout.Store(int64(DefaultLockTimeout))
+}
+
+// SetLockTimeout changes how long transactions wait for a lock before
+// failing with a *LockTimeoutError
+func SetLockTimeout(timeout time.Duration) {
+	lockTimeout.Store(int64(timeout))
+}
+
+// LockTimeoutError is returned when a lock was not granted in time
+type LockTimeoutError struct {
+	Resource string
+}
+
+func (e *LockTimeoutError) Error() string {
+	return fmt.Sprintf("Lock wait timeout exceeded on %s", e.Resource)
+}
+
+// DeadlockError is returned to the transaction whose wait would close a
+// cycle, it has to be rolled back so the others go on
+type DeadlockError struct {
+	Resource string
+}
+
+func (e *DeadlockError) Error() string {
+	return fmt.Sprintf("Deadlock detected waiting for %s", e.Resource)
+}
+
+// lockKey is a whole table when id is empty, a row otherwise
+type lockKey struct {
+	table string
+	id    string
+}
+
+func (k lockKey) String() string {
+	if k.id == "" {
+		return fmt.Sprintf("table %s", k.table)
+	}
+	return fmt.Sprintf("row %s of %s", k.id, k.table)
+}
+
+type lockEntry struct {
+	holders map[uint64]map[lockMode]bool
+	// released is closed and replaced every time a holder lets go
+	released chan struct{}
+}
+
+type lockWait struct {
+	key  lockKey
+	mode lockMode
+}
+
+// lockManager grants table and row locks to transactions until they end.
+// Waits form a graph from each waiting transaction to the holders blocking
+// it, a wait closing a cycle is a deadlock
+type lockManager struct {
+	mu      sync.Mutex
+	locks   map[lockKey]*lockEntry
+	held    map[uint64][]lockKey
+	waiting map[uint64]lockWait
+}
+
+var locks = &lockManager{
+	locks:   make(map[lockKey]*lockEntry),
+	held:    make(map[uint64][]lockKey),
+	waiting: make(map[uint64]lockWait),
+}
+
+func (m *lockManager) entry(key lockKey) *lockEntry {
+	entry, ok := m.locks[key]
+	if !ok {
+		entry = &lockEntry{holders: make(map[uint64]map[lockMode]bool), released: make(chan struct{})}
+		m.locks[key] = entry
+	}
+	return entry
+}
+
+// blockers lists the other transactions holding key in a mode that
+// conflicts with mode
+func (m *lockManager) blockers(tx uint64, key lockKey, mode lockMode) []uint64 {
+	entry, ok := m.locks[key]
+	if !ok {
+		return nil
+	}
+	var blockers []uint64
+	for holder, modes := range entry.holders {
+		if holder == tx {
+			continue
+		}
+		for held := range modes {
+			if !lockCompatible[held][mode] {
+				blockers = append(blockers, holder)
+				break
+			}
+		}
+	}
+	return blockers
+}
+
+// deadlocked follows the waits starting at the blockers of tx looking for tx
+func (m *lockManager) deadlocked(tx uint64) bool {
+	visited := make(map[uint64]bool)
+	var reaches func(from uint64) bool
+	reaches = func(from uint64) bool {
+		wait, ok := m.waiting[from]
+		if !ok {
+			return false
+		}
+		for _, blocker := range m.blockers(from, wait.key, wait.mode) {
+			if blocker == tx {
+				return true
+			}
+			if !visited[blocker] {
+				visited[blocker] = true
+				if reaches(blocker) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return reaches(tx)
+}
+
+// acquire waits up to timeout for key in mode, a zero timeout fails right
+// away when the lock is taken. The wait ends early when the statement of the
+// transaction is canceled
+func (m *lockManager) acquire(tx *Tx, key lockKey, mode lockMode, timeout time.Duration) error {
+	id := tx.id
+	deadline := time.Now().Add(timeout)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		if len(m.blockers(id, key, mode)) == 0 {
+			delete(m.waiting, id)
+			entry := m.entry(key)
+			if entry.holders[id] == nil {
+				entry.holders[id] = make(map[lockMode]bool)
+				m.held[id] = append(m.held[id], key)
+			}
+			entry.holders[id][mode] = true
+			return nil
+		}
+
+		m.waiting[id] = lockWait{key: key, mode: mode}
+		if m.deadlocked(id) {
+			delete(m.waiting, id)
+			return &DeadlockError{Resource: key.String()}
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			delete(m.waiting, id)
+			return &LockTimeoutError{Resource: key.String()}
+		}
+
+		released := m.entry(key).released
+		timer := time.NewTimer(remaining)
+		m.mu.Unlock()
+		select {
+		case <-released:
+		case <-timer.C:
+		case <-tx.canceled():
+		}
+		timer.Stop()
+		m.mu.Lock()
+		if err := tx.Err(); err != nil {
+			delete(m.waiting, id)
+			return err
+		}
+	}
+}
+
+// releaseAll lets go of every lock of tx, waiters check again
+func (m *lockManager) releaseAll(tx uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range m.held[tx] {
+		entry, ok := m.locks[key]
+		if !ok {
+			continue
+		}
+		delete(entry.holders, tx)
+		close(entry.released)
+		entry.released = make(chan struct{})
+		if len(entry.holders) == 0 {
+			delete(m.locks, key)
+		}
+	}
+	delete(m.held, tx)
+	delete(m.waiting, tx)
+}
+
+// lockRow locks a row for the transaction of the table, after the intention
+// lock on the table. An empty id only takes the table lock
+func (t *Table) lockRow(id string, mode lockMode) error {
+	if t.tx == nil {
+		return nil
+	}
+	intention := intentionExclusive
+	if mode == sharedLock {
+		intention = intentionShared
+	}
+	timeout := time.Duration(lockTimeout.Load())
+	err := locks.acquire(t.tx, lockKey{table: t.key}, intention, timeout)
+	if err != nil || id == "" {
+		return err
+	}
+	return locks.acquire(t.tx, lockKey{table: t.key, id: id}, mode, timeout)
+}
+
+// LockRows locks rows read by SELECT ... FOR UPDATE, or LOCK IN SHARE MODE
+// when not exclusive, until the transaction ends. Rows changed by another
+// transaction since the snapshot was taken cannot be locked
+func (t *Table) LockRows(ids []string, exclusive bool) error {
+	mode := sharedLock
+	if exclusive {
+		mode = exclusiveLock
+	}
+	for _, id := range ids {
+		err := t.lockRow(id, mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	unlock, err := t.lockWrites()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, id := range ids {
+		err = t.checkWritable(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LockTable locks a whole table until the transaction ends, as LOCK TABLE
+// does. Exclusive locks keep other transactions from changing or locking
+// any row, shared ones only from changing them. Reads are never blocked
+func (tx *Tx) LockTable(name string, exclusive bool, nowait bool) error {
+	t, err := tx.db.GetTable(name)
+	if err != nil {
+		return err
+	}
+	mode := sharedLock
+	if exclusive {
+		mode = exclusiveLock
+	}
+	timeout := time.Duration(lockTimeout.Load())
+	if nowait {
+		timeout = 0
+	}
+	return locks.acquire(tx, lockKey{table: t.key}, mode, timeout)
+}
@@ -0,0 +1,159 @@
+package table
+
+import (
+	"testing"
+	"time"
+)
+
+func isLockTimeout(err error) bool {
+	_, ok := err.(*LockTimeoutError)
+	return ok
+}
+
+func isDeadlock(err error) bool {
+	_, ok := err.(*DeadlockError)
+	return ok
+}
+
+// TestLockTable locks a table from one transaction and then the table or
+// one of its rows from another, without waiting
+func TestLockTable(t *testing.T) {
+	tests := []struct {
+		name  string
+		first bool
+		// second locks the table, or row 1 when row is set
+		second bool
+		row    bool
+		want   func(error) bool
+	}{
+		{name: "shared then shared", want: isNil},
+		{name: "shared then exclusive", second: true, want: isLockTimeout},
+		{name: "exclusive then shared", first: true, want: isLockTimeout},
+		{name: "shared then shared row", row: true, want: isNil},
+		{name: "shared then exclusive row", second: true, row: true, want: isLockTimeout},
+		{name: "exclusive then shared row", first: true, row: true, want: isLockTimeout},
+	}
+	SetLockTimeout(0)
+	defer SetLockTimeout(DefaultLockTimeout)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := newTestTable(t, "", `{"properties": {"id": {"type": "integer"}}}`)
+			mustInsert(t, table, `{"id": 1}`)
+
+			first, err := NewTx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Rollback()
+			if err = first.LockTable(table.name, tt.first, true); err != nil {
+				t.Fatal(err)
+			}
+
+			second, err := NewTx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Rollback()
+			if tt.row {
+				var secondTable *Table
+				secondTable, err = second.Table(table.name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = secondTable.LockRows([]string{"1"}, tt.second)
+			} else {
+				err = second.LockTable(table.name, tt.second, true)
+			}
+			if !tt.want(err) {
+				t.Errorf("unexpected error %v (%T)", err, err)
+			}
+		})
+	}
+}
+
+// TestRowLockWait waits for a row locked by another transaction, which
+// gets it once the holder ends
+func TestRowLockWait(t *testing.T) {
+	table := newTestTable(t, "", `{"properties": {"id": {"type": "integer"}}}`)
+	mustInsert(t, table, `{"id": 1}`)
+	first, firstTable := beginOn(t, table)
+	defer first.Rollback()
+	second, secondTable := beginOn(t, table)
+	defer second.Rollback()
+
+	if err := firstTable.LockRows([]string{"1"}, true); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- secondTable.LockRows([]string{"1"}, true)
+	}()
+	waitForLock(t, second)
+	first.Commit()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("lock after commit: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lock not granted after the holder committed")
+	}
+}
+
+// TestDeadlock locks two rows in opposite orders, the transaction closing
+// the cycle fails and the other one gets its lock once it rolls back
+func TestDeadlock(t *testing.T) {
+	table := newTestTable(t, "", `{"properties": {"id": {"type": "integer"}}}`)
+	mustInsert(t, table, `{"id": 1}`, `{"id": 2}`)
+	first, firstTable := beginOn(t, table)
+	defer first.Rollback()
+	second, secondTable := beginOn(t, table)
+	defer second.Rollback()
+
+	if err := firstTable.LockRows([]string{"1"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondTable.LockRows([]string{"2"}, true); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- secondTable.LockRows([]string{"1"}, true)
+	}()
+	waitForLock(t, second)
+	err := firstTable.LockRows([]string{"2"}, true)
+	if !isDeadlock(err) {
+		t.Fatalf("unexpected error %v (%T)", err, err)
+	}
+	first.Rollback()
+	if err = <-done; err != nil {
+		t.Errorf("lock after the deadlock: %s", err)
+	}
+}
+
+func beginOn(t *testing.T, table *Table) (*Tx, *Table) {
+	t.Helper()
+	tx, err := NewTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txTable, err := tx.Table(table.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx, txTable
+}
+
+// waitForLock returns once tx waits for a lock
+func waitForLock(t *testing.T, tx *Tx) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		locks.mu.Lock()
+		_, waiting := locks.waiting[tx.id]
+		locks.mu.Unlock()
+		if waiting {
+			return
+		}
+	}
+	t.Fatal("transaction never waited for the lock")
+}
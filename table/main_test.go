@@ -0,0 +1,34 @@
+package table
+
+import (
+	"github.com/kimuraz/golang-json-db/internal/testutil"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	testutil.Main(m, SetDataDir)
+}
+
+func testTableName(t *testing.T, suffix string) string {
+	name := strings.NewReplacer("/", "_", " ", "_", "-", "_").Replace(t.Name())
+	return strings.ToLower(name + suffix)
+}
+
+func newTestTable(t *testing.T, suffix string, schema string) *Table {
+	t.Helper()
+	table, err := NewTable(testTableName(t, suffix), schema)
+	if err != nil {
+		t.Fatalf("NewTable: %s", err)
+	}
+	return table
+}
+
+func mustInsert(t *testing.T, table *Table, rows ...string) {
+	t.Helper()
+	for _, row := range rows {
+		if err := table.Insert(row); err != nil {
+			t.Fatalf("Insert %s: %s", row, err)
+		}
+	}
+}
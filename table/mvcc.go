@@ -0,0 +1,685 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Every stored version of a row carries the transaction that wrote it and
+// the position of the version it replaced, deletes write a version of their
+// own. Rows written before versions existed belong to transaction 0, which
+// everyone sees
+const (
+	txKey      = "_tx"
+	prevKey    = "_prev"
+	deletedKey = "_deleted"
+)
+
+// Transaction ids are reserved on disk by blocks, so they stay unique across
+// restarts without a write per transaction
+const txIdBlock = 100
+
+// ConflictError is returned when a row was changed by a transaction the
+// current one does not see, the current one has to be retried
+type ConflictError struct {
+	Table string
+	Id    string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("Could not serialize access to %s %s due to a concurrent update", e.Table, e.Id)
+}
+
+// txManager hands out transaction ids and knows which transactions run
+type txManager struct {
+	mu       sync.Mutex
+	next     uint64
+	reserved uint64
+	// active maps every running transaction to the oldest transaction its
+	// snapshot may not see
+	active map[uint64]uint64
+}
+
+var transactions = &txManager{active: make(map[uint64]uint64)}
+
+func txIdsPath() string {
+	return filepath.Join(dataDir, "transactions.bin")
+}
+
+// commitsPath is the commit log, it holds the first transaction id it
+// covers followed by the ids of the transactions that committed a change
+// since then. Anything else a transaction from that range wrote was left
+// running when the process stopped
+func commitsPath() string {
+	return filepath.Join(dataDir, "commits.bin")
+}
+
+// snapshot tells which row versions a transaction sees: its own and the
+// ones of transactions committed before it began
+type snapshot struct {
+	tx     uint64
+	xmax   uint64
+	active map[uint64]bool
+}
+
+func (s *snapshot) visible(creator uint64) bool {
+	if s.tx != 0 && creator == s.tx {
+		return true
+	}
+	return creator < s.xmax && !s.active[creator]
+}
+
+// xmin is the oldest transaction the snapshot may not see
+func (s *snapshot) xmin() uint64 {
+	xmin := s.xmax
+	for id := range s.active {
+		if id < xmin {
+			xmin = id
+		}
+	}
+	return xmin
+}
+
+func (m *txManager) load() error {
+	if m.next != 0 {
+		return nil
+	}
+	data, err := os.ReadFile(txIdsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error reading transaction ids: %s", err)
+	}
+	next := uint64(1)
+	if len(data) == 8 {
+		next = binary.LittleEndian.Uint64(data)
+	}
+	err = recoverCommits(next)
+	if err != nil {
+		return err
+	}
+	m.next = next
+	m.reserved = next
+	return nil
+}
+
+// recoverCommits undoes the changes of the transactions the commit log does
+// not know, then starts the log over at next. A data directory without a
+// log is from before it existed, all of its rows are kept
+func recoverCommits(next uint64) error {
+	data, err := os.ReadFile(commitsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error reading commit log: %s", err)
+	}
+	if len(data) >= 8 {
+		since := binary.LittleEndian.Uint64(data)
+		committed := make(map[uint64]bool)
+		// A commit cut short by the stop leaves part of an id behind
+		for i := 8; i+8 <= len(data); i += 8 {
+			committed[binary.LittleEndian.Uint64(data[i:])] = true
+		}
+		err = undoUncommitted(func(tx uint64) bool {
+			return tx >= since && !committed[tx]
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	data = make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, next)
+	err = os.MkdirAll(dataDir, 0755)
+	if err == nil {
+		err = writeFileAtomic(commitsPath(), data)
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing commit log: %s", err)
+	}
+	return nil
+}
+
+// undoUncommitted moves the rows of every table back to the newest version
+// not written by an uncommitted transaction
+func undoUncommitted(uncommitted func(tx uint64) bool) error {
+	names, err := ListDatabases()
+	if err != nil {
+		return err
+	}
+	dbs := []*Database{systemDatabase()}
+	for _, name := range names {
+		db, err := OpenDatabase(name)
+		if err != nil {
+			return err
+		}
+		dbs = append(dbs, db)
+	}
+	for _, db := range dbs {
+		if _, err := os.Stat(db.Dir); os.IsNotExist(err) {
+			continue
+		}
+		tables, err := db.ListTables()
+		if err != nil {
+			return err
+		}
+		for _, name := range tables {
+			handle, err := catalog.get(db, name)
+			if err != nil {
+				return err
+			}
+			t := &Table{tableHandle: handle}
+			if err = t.undoUncommitted(uncommitted); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Table) undoUncommitted(uncommitted func(tx uint64) bool) error {
+	f, err := os.Open(fmt.Sprintf("%s/data.bin", t.path))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error opening data file: %s", err)
+	}
+	defer f.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	changed := false
+	for id, position := range t.ids {
+		for {
+			version, err := readVersion(f, position)
+			if err != nil {
+				return err
+			}
+			if !uncommitted(version.tx) {
+				break
+			}
+			changed = true
+			if version.prev == nil {
+				delete(t.ids, id)
+				break
+			}
+			position = *version.prev
+			t.ids[id] = position
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return t.updateIds()
+}
+
+// commit adds a transaction to the commit log, it is on disk once commit
+// returns
+func (m *txManager) commit(id uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(commitsPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening commit log: %s", err)
+	}
+	defer f.Close()
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, id)
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing commit log: %s", err)
+	}
+	return nil
+}
+
+func (m *txManager) begin() (uint64, *snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.load()
+	if err != nil {
+		return 0, nil, err
+	}
+	if m.next >= m.reserved {
+		data := make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, m.next+txIdBlock)
+		err = os.MkdirAll(dataDir, 0755)
+		if err == nil {
+			err = writeFileAtomic(txIdsPath(), data)
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("Error reserving transaction ids: %s", err)
+		}
+		m.reserved = m.next + txIdBlock
+	}
+
+	id := m.next
+	m.next++
+	snap := m.snapshot(id, id)
+	m.active[id] = snap.xmin()
+	return id, snap, nil
+}
+
+// readSnapshot sees what is committed now, tables opened outside of a
+// transaction use it
+func (m *txManager) readSnapshot() (*snapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	return m.snapshot(0, m.next), nil
+}
+
+func (m *txManager) snapshot(id uint64, xmax uint64) *snapshot {
+	snap := &snapshot{tx: id, xmax: xmax, active: make(map[uint64]bool, len(m.active))}
+	for active := range m.active {
+		snap.active[active] = true
+	}
+	return snap
+}
+
+// isActive tells if a transaction began and has not ended yet
+func (m *txManager) isActive(id uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.active[id]
+	return ok
+}
+
+func (m *txManager) end(id uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.active, id)
+}
+
+// horizon is the oldest transaction a running one may not see, versions
+// written before it are seen by all of them
+func (m *txManager) horizon() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	horizon := m.next
+	for _, xmin := range m.active {
+		if xmin < horizon {
+			horizon = xmin
+		}
+	}
+	return horizon
+}
+
+// tableLock serializes the changes made to a table across sessions, readers
+// never take it. Statements hold statement shared so VACUUM, which moves the
+// rows around, runs alone
+type tableLock struct {
+	write     sync.Mutex
+	statement sync.RWMutex
+}
+
+var tableLocksMu sync.Mutex
+var tableLocks = make(map[string]*tableLock)
+
+// lockFor returns the locks of the table with the given key
+func lockFor(key string) *tableLock {
+	tableLocksMu.Lock()
+	defer tableLocksMu.Unlock()
+	lock, ok := tableLocks[key]
+	if !ok {
+		lock = &tableLock{}
+		tableLocks[key] = lock
+	}
+	return lock
+}
+
+// lockWrites takes the write lock of the table. A table whose schema changed
+// since it was opened moves to the new state first
+func (t *Table) lockWrites() (func(), error) {
+	if t.writing > 0 {
+		t.writing++
+		return func() { t.writing-- }, nil
+	}
+	lock := lockFor(t.key)
+	lock.write.Lock()
+	t.writing = 1
+	unlock := func() {
+		t.writing--
+		if t.writing == 0 {
+			lock.write.Unlock()
+		}
+	}
+
+	if t.stale.Load() {
+		handle, err := catalog.get(t.db, t.name)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		t.tableHandle = handle
+	}
+	return unlock, nil
+}
+
+// autoTx gives a change made outside of a transaction one of its own, finish
+// commits it or rolls it back when the change failed and returns the error
+// of the change or of the commit
+func (t *Table) autoTx() (func(error) error, error) {
+	if t.tx != nil {
+		return func(err error) error { return err }, nil
+	}
+	tx, err := NewTx()
+	if err != nil {
+		return nil, err
+	}
+	t.tx, t.snap = tx, tx.snap
+	return func(err error) error {
+		t.tx = nil
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}, nil
+}
+
+// rowVersion is a version of a row as stored in the data file
+type rowVersion struct {
+	row     map[string]interface{}
+	tx      uint64
+	prev    *[2]uint64
+	deleted bool
+}
+
+func readVersion(f *os.File, position [2]uint64) (*rowVersion, error) {
+	buf := make([]byte, position[1])
+	_, err := f.ReadAt(buf, int64(position[0]))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading data file: %s", err)
+	}
+	var row map[string]interface{}
+	err = json.Unmarshal(bytes.Trim(buf, "\x00"), &row)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling data: %s", err)
+	}
+
+	version := &rowVersion{row: row}
+	if tx, ok := row[txKey].(float64); ok {
+		version.tx = uint64(tx)
+	}
+	if prev, ok := row[prevKey].([]interface{}); ok && len(prev) == 2 {
+		pos, _ := prev[0].(float64)
+		length, _ := prev[1].(float64)
+		version.prev = &[2]uint64{uint64(pos), uint64(length)}
+	}
+	version.deleted, _ = row[deletedKey].(bool)
+	delete(row, txKey)
+	delete(row, prevKey)
+	delete(row, deletedKey)
+	return version, nil
+}
+
+// visibleVersion follows the versions of a row from the newest to the first
+// one the snapshot sees, upgraded to the current schema. It is nil when
+// there is none or the row is deleted
+func (t *Table) visibleVersion(f *os.File, id string) (*rowVersion, error) {
+	position, ok := t.position(id)
+	for ok {
+		version, err := readVersion(f, position)
+		if err != nil {
+			return nil, err
+		}
+		if t.snap.visible(version.tx) {
+			if version.deleted {
+				return nil, nil
+			}
+			return version, t.upgradeRow(version.row)
+		}
+		if version.prev == nil {
+			break
+		}
+		position = *version.prev
+	}
+	return nil, nil
+}
+
+// latestVersion reads the newest version of a row whoever wrote it, nil if
+// the row never existed
+func (t *Table) latestVersion(id string) (*rowVersion, error) {
+	position, ok := t.position(id)
+	if !ok {
+		return nil, nil
+	}
+	f, err := os.Open(fmt.Sprintf("%s/data.bin", t.path))
+	if err != nil {
+		return nil, fmt.Errorf("Error opening data file: %s", err)
+	}
+	defer f.Close()
+	return readVersion(f, position)
+}
+
+// unsettledVersions walks the versions of a row from the newest one through
+// the ones written by other transactions still running, down to the newest
+// version that stays whatever they do. fn is called on each version until
+// it returns true, with unsettled set while the version may be undone
+func (t *Table) unsettledVersions(f *os.File, id string, fn func(version *rowVersion, unsettled bool) bool) error {
+	position, ok := t.position(id)
+	for ok {
+		version, err := readVersion(f, position)
+		if err != nil {
+			return err
+		}
+		if err = t.upgradeRow(version.row); err != nil {
+			return err
+		}
+		unsettled := version.tx != t.snap.tx && transactions.isActive(version.tx)
+		if fn(version, unsettled) || !unsettled || version.prev == nil {
+			return nil
+		}
+		position = *version.prev
+	}
+	return nil
+}
+
+// everyVersion reads the stored versions of every row whoever wrote them,
+// deletes left out. New indexes are built from them as they serve every
+// snapshot, the rows of running transactions included
+func (t *Table) everyVersion() ([]map[string]interface{}, error) {
+	f, err := os.Open(fmt.Sprintf("%s/data.bin", t.path))
+	if err != nil {
+		return nil, fmt.Errorf("Error opening data file: %s", err)
+	}
+	defer f.Close()
+	var rows []map[string]interface{}
+	for _, id := range t.sortedIds() {
+		position, ok := t.position(id)
+		for ok {
+			version, err := readVersion(f, position)
+			if err != nil {
+				return nil, err
+			}
+			if !version.deleted {
+				err = t.upgradeRow(version.row)
+				if err != nil {
+					return nil, err
+				}
+				rows = append(rows, version.row)
+			}
+			if version.prev == nil {
+				break
+			}
+			position = *version.prev
+		}
+	}
+	return rows, nil
+}
+
+// checkWritable fails when the newest version of a row is one the
+// transaction does not see: another transaction changed the row and did not
+// commit yet, or committed after this one began
+func (t *Table) checkWritable(id string) error {
+	latest, err := t.latestVersion(id)
+	if err != nil {
+		return err
+	}
+	if latest != nil && !t.snap.visible(latest.tx) {
+		return &ConflictError{Table: t.name, Id: id}
+	}
+	return nil
+}
+
+// checkNewId makes sure an inserted id is free, a deleted row leaves its id
+// free
+func (t *Table) checkNewId(id string) error {
+	latest, err := t.latestVersion(id)
+	if err != nil || latest == nil {
+		return err
+	}
+	if !t.snap.visible(latest.tx) {
+		return &ConflictError{Table: t.name, Id: id}
+	}
+	if !latest.deleted {
+		return fmt.Errorf("Id already exists")
+	}
+	return nil
+}
+
+// revertVersion moves a row back to the version before the one tx wrote.
+// The undone version stays in the data file until VACUUM
+func (t *Table) revertVersion(tx *Tx, id string) error {
+	unlock, err := t.lockWrites()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	latest, err := t.latestVersion(id)
+	if err != nil || latest == nil || latest.tx != tx.id {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if latest.prev == nil {
+		delete(t.ids, id)
+	} else {
+		t.ids[id] = *latest.prev
+	}
+	return t.updateIds()
+}
+
+// Vacuum drops the row versions no running transaction can see anymore. The
+// data file is rewritten with the versions left and the indexes are rebuilt
+// from them, so it waits for the statements using the table. It returns the
+// number of versions removed
+func (t *Table) Vacuum() (int, error) {
+	lock := lockFor(t.key)
+	lock.statement.Lock()
+	defer lock.statement.Unlock()
+	unlock, err := t.lockWrites()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	horizon := transactions.horizon()
+
+	src, err := os.Open(fmt.Sprintf("%s/data.bin", t.path))
+	if err != nil {
+		return 0, fmt.Errorf("Error opening data file: %s", err)
+	}
+	defer src.Close()
+	tmpPath := fmt.Sprintf("%s/data.bin.tmp", t.path)
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, fmt.Errorf("Error creating data file: %s", err)
+	}
+	defer dst.Close()
+
+	ids := t.sortedIds()
+	removed := 0
+	var offset uint64
+	newIds := make(map[string][2]uint64, len(ids))
+	var rows []map[string]interface{}
+	for _, id := range ids {
+		var chain []*rowVersion
+		position, ok := t.position(id)
+		for ok {
+			version, err := readVersion(src, position)
+			if err != nil {
+				return 0, err
+			}
+			chain = append(chain, version)
+			ok = version.prev != nil
+			if ok {
+				position = *version.prev
+			}
+		}
+
+		// Versions older than the newest one everybody sees are not needed,
+		// and a delete everybody sees takes the row with it
+		kept := len(chain)
+		for i, version := range chain {
+			if version.tx < horizon {
+				kept = i + 1
+				if version.deleted {
+					kept = i
+				}
+				break
+			}
+		}
+		removed += len(chain) - kept
+
+		var prev *[2]uint64
+		for i := kept - 1; i >= 0; i-- {
+			version := chain[i]
+			version.row[txKey] = version.tx
+			if prev != nil {
+				version.row[prevKey] = *prev
+			}
+			if version.deleted {
+				version.row[deletedKey] = true
+			}
+			data, err := json.Marshal(version.row)
+			if err != nil {
+				return 0, fmt.Errorf("Error marshalling data: %s", err)
+			}
+			_, err = dst.Write(data)
+			if err != nil {
+				return 0, fmt.Errorf("Error writing data to file: %s", err)
+			}
+			prev = &[2]uint64{offset, uint64(len(data))}
+			offset += uint64(len(data))
+
+			delete(version.row, txKey)
+			delete(version.row, prevKey)
+			delete(version.row, deletedKey)
+			if !version.deleted {
+				err = t.upgradeRow(version.row)
+				if err != nil {
+					return 0, err
+				}
+				rows = append(rows, version.row)
+			}
+		}
+		if prev != nil {
+			newIds[id] = *prev
+		}
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return 0, fmt.Errorf("Error writing data to file: %s", err)
+	}
+	err = os.Rename(tmpPath, fmt.Sprintf("%s/data.bin", t.path))
+	if err != nil {
+		return 0, fmt.Errorf("Error replacing data file: %s", err)
+	}
+	t.mu.Lock()
+	t.ids = newIds
+	err = t.updateIds()
+	t.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	// Positions are looked up in the new id index, so every version of a row
+	// is indexed under its newest one
+	return removed, t.rebuildIndexes(rows, nil)
+}
@@ -0,0 +1,131 @@
+package table
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// restart makes the package forget what the process knew, as if it stopped
+// while transactions were running
+func restart() {
+	transactions = &txManager{active: make(map[uint64]uint64)}
+	locks = &lockManager{
+		locks:   make(map[lockKey]*lockEntry),
+		held:    make(map[uint64][]lockKey),
+		waiting: make(map[uint64]lockWait),
+	}
+	CloseTables()
+}
+
+func TestRecoverCommits(t *testing.T) {
+	const schema = `{"properties": {"id": {"type": "integer"}, "v": {"type": "integer"}}}`
+	tests := []struct {
+		name  string
+		setup []string
+		// change runs in a transaction, ended by commit or left running
+		change func(table *Table) error
+		commit bool
+		want   map[string]float64
+	}{
+		{
+			name:   "committed insert",
+			change: func(table *Table) error { return table.Insert(`{"id": 1, "v": 1}`) },
+			commit: true,
+			want:   map[string]float64{"1": 1},
+		},
+		{
+			name:   "running insert",
+			change: func(table *Table) error { return table.Insert(`{"id": 1, "v": 1}`) },
+			want:   map[string]float64{},
+		},
+		{
+			name:  "running update",
+			setup: []string{`{"id": 1, "v": 1}`},
+			change: func(table *Table) error {
+				return table.Update("1", map[string]interface{}{"v": 2})
+			},
+			want: map[string]float64{"1": 1},
+		},
+		{
+			name:  "committed update",
+			setup: []string{`{"id": 1, "v": 1}`},
+			change: func(table *Table) error {
+				return table.Update("1", map[string]interface{}{"v": 2})
+			},
+			commit: true,
+			want:   map[string]float64{"1": 2},
+		},
+		{
+			name:   "running delete",
+			setup:  []string{`{"id": 1, "v": 1}`, `{"id": 2, "v": 2}`},
+			change: func(table *Table) error { return table.Delete("1") },
+			want:   map[string]float64{"1": 1, "2": 2},
+		},
+		{
+			name:  "running insert and update of the same row",
+			setup: []string{`{"id": 1, "v": 1}`},
+			change: func(table *Table) error {
+				if err := table.Insert(`{"id": 2, "v": 2}`); err != nil {
+					return err
+				}
+				if err := table.Update("2", map[string]interface{}{"v": 3}); err != nil {
+					return err
+				}
+				return table.Update("1", map[string]interface{}{"v": 4})
+			},
+			want: map[string]float64{"1": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := newTestTable(t, "", schema)
+			mustInsert(t, table, tt.setup...)
+
+			tx, err := NewTx()
+			if err != nil {
+				t.Fatal(err)
+			}
+			txTable, err := tx.Table(table.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = tt.change(txTable); err != nil {
+				t.Fatal(err)
+			}
+			tx.EndStatement()
+			if tt.commit {
+				if err = tx.Commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			restart()
+
+			table, err = GetTable(table.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := table.SelectAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]float64)
+			for _, row := range rows {
+				got[fmt.Sprintf("%v", row["id"])] = row["v"].(float64)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+
+			// The rows are free to change again
+			for id := range tt.want {
+				if err = table.Update(id, map[string]interface{}{"v": 5}); err != nil {
+					t.Errorf("Update %s: %s", id, err)
+				}
+			}
+			if err = table.Insert(`{"id": 9, "v": 9}`); err != nil {
+				t.Errorf("Insert: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package table
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// resolvePath walks into nested objects and arrays, array elements are
+// addressed by their position
+func resolvePath(value interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// textValue is what ->> returns, strings as they are and any other value in
+// its JSON form
+func textValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string, nil:
+		return v
+	}
+	text, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(text)
+}
+
+// contains implements @>, every element or key of b must be found in a
+func contains(a interface{}, b interface{}) bool {
+	switch bv := b.(type) {
+	case []interface{}:
+		av, ok := a.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, bElem := range bv {
+			found := false
+			for _, aElem := range av {
+				if contains(aElem, bElem) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		av, ok := a.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, bElem := range bv {
+			aElem, ok := av[key]
+			if !ok || !contains(aElem, bElem) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// An array contains the scalars it has as elements
+	if av, ok := a.([]interface{}); ok {
+		for _, aElem := range av {
+			if contains(aElem, b) {
+				return true
+			}
+		}
+		return false
+	}
+	c, ok := compareValues(a, b)
+	return ok && c == 0
+}
+
+// decodeNested parses the values of object and array columns given as JSON
+// text, which is how they arrive from SQL literals
+func decodeNested(jsonSchema JSONSchemaForValidation, jsonData map[string]interface{}) error {
+	for column, prop := range jsonSchema.Properties {
+		if prop.Type != "object" && prop.Type != "array" {
+			continue
+		}
+		text, ok := jsonData[column].(string)
+		if !ok {
+			continue
+		}
+		var value interface{}
+		err := json.Unmarshal([]byte(text), &value)
+		if err != nil {
+			return fmt.Errorf("Column %s expects JSON: %s", column, err)
+		}
+		jsonData[column] = value
+	}
+	return nil
+}
+
+// findPathIndex returns the index serving clause, callers hold mu
+func (t *Table) findPathIndex(clause WhereClause) *PathIndex {
+	for _, idx := range t.pathIndexes {
+		if idx.Column == clause.Column && idx.AsText == clause.AsText && reflect.DeepEqual(idx.Path, clause.Path) {
+			return idx
+		}
+	}
+	return nil
+}
+
+// CreatePathIndex indexes the value at path inside a column, existing rows
+// are indexed right away
+func (t *Table) CreatePathIndex(name string, column string, path []string, asText bool) error {
+	unlock, err := t.lockWrites()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, ok := t.pathIndexes[name]; ok {
+		return fmt.Errorf("Index %s already exists", name)
+	}
+	jsonSchema, err := t.getSchema()
+	if err != nil {
+		return err
+	}
+	if _, ok := jsonSchema.Properties[column]; !ok {
+		return fmt.Errorf("Column %s does not exist", column)
+	}
+
+	idx := NewPathIndex(name, column, path, asText)
+	rows, err := t.everyVersion()
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if value, ok := idx.valueOf(row); ok {
+			idx.Insert(value, fmt.Sprintf("%v", row["id"]))
+		}
+	}
+
+	err = idx.SaveToFile(fmt.Sprintf("%s/indexes/p_%s_idx.bin", t.path, name))
+	if err != nil {
+		return fmt.Errorf("Error saving path index: %s", err)
+	}
+	t.mu.Lock()
+	t.pathIndexes[name] = idx
+	t.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,114 @@
+package table
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Rows reads the rows of a select one at a time. The candidate ids are
+// looked up when the scan starts, each row is read from the data file once
+// Next reaches it
+type Rows struct {
+	t     *Table
+	f     *os.File
+	ids   []string
+	where *WhereClause
+	seen  map[string]bool
+	pos   int
+}
+
+// Scan starts reading the rows matching where, every row when it is nil
+func (t *Table) Scan(where *WhereClause) (*Rows, error) {
+	if where == nil {
+		return &Rows{t: t, ids: t.sortedIds()}, nil
+	}
+	jsonSchema, err := t.getSchema()
+	if err != nil {
+		return nil, err
+	}
+	clause := *where
+	coerceClause(jsonSchema, &clause)
+	ids, err := t.selectWhereIds(clause)
+	if err != nil {
+		return nil, err
+	}
+	return &Rows{t: t, ids: ids, where: &clause, seen: make(map[string]bool, len(ids))}, nil
+}
+
+// Next returns the next row the snapshot sees, io.EOF once there is none
+// left. Indexes hold the values of every version of a row, so rows are
+// matched again against the visible version
+func (r *Rows) Next() (map[string]interface{}, error) {
+	for r.pos < len(r.ids) {
+		if err := r.t.tx.Err(); err != nil {
+			return nil, err
+		}
+		if r.f == nil {
+			f, err := os.Open(fmt.Sprintf("%s/data.bin", r.t.path))
+			if err != nil {
+				return nil, fmt.Errorf("Error opening data file: %s", err)
+			}
+			r.f = f
+		}
+		id := r.ids[r.pos]
+		r.pos++
+		if r.where != nil {
+			if r.seen[id] {
+				continue
+			}
+			r.seen[id] = true
+		}
+		version, err := r.t.visibleVersion(r.f, id)
+		if err != nil {
+			return nil, err
+		}
+		if version != nil && (r.where == nil || matchesWhere(version.row, *r.where)) {
+			return version.row, nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// Table is the table the rows are read from
+func (r *Rows) Table() *Table {
+	return r.t
+}
+
+// Close lets go of the data file, Next opens it again
+func (r *Rows) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// Reopen carries the scan over to a later statement of tx, the table is
+// opened again for it since VACUUM may have moved the rows in between
+func (r *Rows) Reopen(tx *Tx) error {
+	r.Close()
+	t, err := tx.Table(r.t.name)
+	if err != nil {
+		return err
+	}
+	r.t = t
+	return nil
+}
+
+// readAll reads the rows left and closes the scan
+func (r *Rows) readAll() ([]map[string]interface{}, error) {
+	defer r.Close()
+	var data []map[string]interface{}
+	for {
+		row, err := r.Next()
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, row)
+	}
+}
@@ -0,0 +1,169 @@
+package table
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Sequence hands out increasing integers and is persisted after every call,
+// Value is the last value handed out
+type Sequence struct {
+	Name      string
+	Value     int64
+	Increment int64
+	path      string
+}
+
+// Id generators available for the "generator" keyword of a property
+const (
+	SequenceGenerator = "sequence"
+	UUIDv4Generator   = "uuidv4"
+	UUIDv7Generator   = "uuidv7"
+	ULIDGenerator     = "ulid"
+	// NowGenerator fills date columns with the current date or time, it is
+	// what DEFAULT CURRENT_TIMESTAMP maps to
+	NowGenerator = "now"
+)
+
+// sequencesMu makes the read, increment and save of a sequence atomic across
+// sessions, each one loads its own copy
+var sequencesMu sync.Mutex
+
+func IsGenerator(name string) bool {
+	switch name {
+	case SequenceGenerator, UUIDv4Generator, UUIDv7Generator, ULIDGenerator, NowGenerator:
+		return true
+	}
+	return false
+}
+
+func newSequence(path string, name string, start int64, increment int64) (*Sequence, error) {
+	if increment == 0 {
+		return nil, fmt.Errorf("Sequence %s increment cannot be zero", name)
+	}
+	seq := &Sequence{
+		Name:      name,
+		Value:     start - increment,
+		Increment: increment,
+		path:      path,
+	}
+	return seq, seq.save()
+}
+
+func loadSequence(path string) (*Sequence, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	seq := &Sequence{path: path}
+	err = gob.NewDecoder(file).Decode(seq)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding sequence: %s", err)
+	}
+	return seq, nil
+}
+
+// Standalone sequences live next to the tables of their database
+func (db *Database) sequencePath(name string) string {
+	return filepath.Join(db.Dir, fmt.Sprintf("%s.seq", name))
+}
+
+// CreateSequence creates a standalone sequence in the default database
+func CreateSequence(name string, start int64, increment int64) (*Sequence, error) {
+	return DefaultDatabase().CreateSequence(name, start, increment)
+}
+
+// CreateSequence creates a standalone sequence, as in CREATE SEQUENCE
+func (db *Database) CreateSequence(name string, start int64, increment int64) (*Sequence, error) {
+	if _, err := os.Stat(db.sequencePath(name)); err == nil {
+		return nil, fmt.Errorf("Sequence with name %s already exists", name)
+	}
+	return newSequence(db.sequencePath(name), name, start, increment)
+}
+
+func GetSequence(name string) (*Sequence, error) {
+	return DefaultDatabase().GetSequence(name)
+}
+
+func (db *Database) GetSequence(name string) (*Sequence, error) {
+	seq, err := loadSequence(db.sequencePath(name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Sequence with name %s does not exist", name)
+	}
+	return seq, err
+}
+
+func DropSequence(name string) error {
+	return DefaultDatabase().DropSequence(name)
+}
+
+func (db *Database) DropSequence(name string) error {
+	err := os.Remove(db.sequencePath(name))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("Sequence with name %s does not exist", name)
+	}
+	return err
+}
+
+func (seq *Sequence) save() error {
+	err := saveGob(seq.path, seq)
+	if err != nil {
+		return fmt.Errorf("Error writing sequence file: %s", err)
+	}
+	return nil
+}
+
+// reload picks up the values handed out by other sessions
+func (seq *Sequence) reload() {
+	if current, err := loadSequence(seq.path); err == nil {
+		seq.Value = current.Value
+	}
+}
+
+func (seq *Sequence) Next() (int64, error) {
+	sequencesMu.Lock()
+	defer sequencesMu.Unlock()
+	seq.reload()
+	seq.Value += seq.Increment
+	return seq.Value, seq.save()
+}
+
+// Advance moves the sequence past a value that was set explicitly so it is
+// never handed out
+func (seq *Sequence) Advance(value int64) error {
+	sequencesMu.Lock()
+	defer sequencesMu.Unlock()
+	seq.reload()
+	if (seq.Increment > 0 && value <= seq.Value) || (seq.Increment < 0 && value >= seq.Value) {
+		return nil
+	}
+	seq.Value = value
+	return seq.save()
+}
+
+// columnSequence opens the sequence backing a table column, a missing one
+// starts right after the highest value already stored
+func (t *Table) columnSequence(column string) (*Sequence, error) {
+	path := fmt.Sprintf("%s/%s_seq.bin", t.path, column)
+	seq, err := loadSequence(path)
+	if err == nil || !os.IsNotExist(err) {
+		return seq, err
+	}
+
+	rows, err := t.SelectAll()
+	if err != nil {
+		return nil, err
+	}
+	var highest int64
+	for _, row := range rows {
+		if value, ok := row[column].(float64); ok && int64(value) > highest {
+			highest = int64(value)
+		}
+	}
+	return newSequence(path, fmt.Sprintf("%s.%s", t.name, column), highest+1, 1)
+}
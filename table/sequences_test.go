@@ -0,0 +1,60 @@
+package table
+
+import (
+	"testing"
+)
+
+func TestSequenceGenerator(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		rows   []string
+		column string
+		want   []float64
+	}{
+		{
+			name:   "id",
+			schema: `{"properties": {"id": {"type": "integer"}, "name": {"type": "string"}}}`,
+			rows:   []string{`{"name": "a"}`, `{"name": "b"}`, `{"id": 7, "name": "c"}`, `{"name": "d"}`},
+			column: "id",
+			want:   []float64{1, 2, 7, 8},
+		},
+		{
+			name:   "other column",
+			schema: `{"properties": {"id": {"type": "integer"}, "n": {"type": "integer", "generator": "sequence"}}}`,
+			rows:   []string{`{"id": 1}`, `{"id": 2, "n": 10}`, `{"id": 3}`},
+			column: "n",
+			want:   []float64{1, 10, 11},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := newTestTable(t, "", tt.schema)
+			mustInsert(t, table, tt.rows...)
+			rows, err := table.SelectAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != len(tt.want) {
+				t.Fatalf("got %d rows, want %d", len(rows), len(tt.want))
+			}
+			seen := make(map[float64]bool)
+			for _, row := range rows {
+				value, ok := row[tt.column].(float64)
+				if !ok {
+					t.Fatalf("%s is %T, want float64", tt.column, row[tt.column])
+				}
+				seen[value] = true
+			}
+			for _, want := range tt.want {
+				if !seen[want] {
+					t.Errorf("no row with %s = %v", tt.column, want)
+				}
+				ids, err := table.FilterIndexByValue(tt.column, int64(want))
+				if err != nil || len(ids) != 1 {
+					t.Errorf("index lookup of %s = %v: %v %v", tt.column, want, ids, err)
+				}
+			}
+		})
+	}
+}
@@ -1,86 +1,212 @@
 package table
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"github.com/rs/zerolog/log"
+	"github.com/kimuraz/golang-json-db/utils"
 	"github.com/xeipuuv/gojsonschema"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
+// ErrNotFound is returned for a row the snapshot does not see
+var ErrNotFound = errors.New("Id not found")
+
+// Table is a table as seen by one statement, its state is shared with the
+// other sessions through the catalog
 type Table struct {
-	name          string
-	path          string
-	schema        string
-	ids           map[string][2]uint64
-	boolIndexes   map[string]*HashIndex[bool]
-	intIndexes    map[string]*HashIndex[int64]
-	floatIndexes  map[string]*HashIndex[float64]
-	stringIndexes map[string]*BTreeStringIndex
+	*tableHandle
+	tx      *Tx
+	snap    *snapshot
+	writing int
 }
 
 type JSONProperty struct {
-	Type string `json:"type"`
-	Ref  string `json:"$ref"`
+	Type            string          `json:"type"`
+	Ref             string          `json:"$ref"`
+	Format          string          `json:"format"`
+	ContentEncoding string          `json:"contentEncoding"`
+	Default         interface{}     `json:"default"`
+	Unique          bool            `json:"unique"`
+	Generator       string          `json:"generator"`
+	Items           json.RawMessage `json:"items"`
+}
+
+// UnmarshalJSON also accepts a list of types, as in ["string", "null"], the
+// first one that is not null is kept since nulls are never stored
+func (p *JSONProperty) UnmarshalJSON(data []byte) error {
+	type plainProperty JSONProperty
+	var raw struct {
+		plainProperty
+		Type json.RawMessage `json:"type"`
+	}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	*p = JSONProperty(raw.plainProperty)
+	if len(raw.Type) == 0 || json.Unmarshal(raw.Type, &p.Type) == nil {
+		return nil
+	}
+	var types []string
+	err = json.Unmarshal(raw.Type, &types)
+	if err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	for _, typeName := range types {
+		if typeName != "null" {
+			p.Type = typeName
+			break
+		}
+	}
+	return nil
+}
+
+// ItemsType is the type of the elements of an array property, empty when
+// they are not all of the same type
+func (p JSONProperty) ItemsType() string {
+	var items struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(p.Items, &items) != nil {
+		return ""
+	}
+	return items.Type
+}
+
+func hasMultikeyIndex(prop JSONProperty) bool {
+	if prop.Type != "array" {
+		return false
+	}
+	switch prop.ItemsType() {
+	case "string", "integer", "number":
+		return true
+	}
+	return false
 }
 
 type JSONSchemaForValidation struct {
-	Properties map[string]JSONProperty `json:"properties"`
+	Properties  map[string]JSONProperty `json:"properties"`
+	Required    []string                `json:"required"`
+	UniqueKeys  [][]string              `json:"uniqueKeys"`
+	Checks      []Check                 `json:"checks"`
+	ForeignKeys []ForeignKey            `json:"foreignKeys"`
 }
 
+// WhereClause compares Column, or the value found at Path inside of it, to
+// Value. AsText compares the path value as text, like ->> does
 type WhereClause struct {
-	Column   string
-	Operator string
-	Value    interface{}
-	And      *WhereClause
-	Or       *WhereClause
+	Column   string       `json:"column"`
+	Path     []string     `json:"path,omitempty"`
+	AsText   bool         `json:"asText,omitempty"`
+	Operator string       `json:"operator"`
+	Value    interface{}  `json:"value"`
+	And      *WhereClause `json:"and,omitempty"`
+	Or       *WhereClause `json:"or,omitempty"`
 }
 
-// For now I'll use a fixed size (Bytes) for the json objects data
-// but soon I'll implement a dynamic size
-var MAX_SIZE = 128
-
+// NewTable creates a table in the default database
 func NewTable(name string, schema string) (*Table, error) {
+	return DefaultDatabase().NewTable(name, schema)
+}
+
+func (db *Database) NewTable(name string, schema string) (*Table, error) {
+	path := db.tablePath(name)
 	// Check if name is valid new directory name
-	_, err := os.Stat(fmt.Sprintf("./data/%s", name))
+	_, err := os.Stat(path)
 	if err == nil {
 		return nil, fmt.Errorf("Table with name %s already exists", name)
 	}
 
+	// Check the schema compiles before anything is written
+	_, err = gojsonschema.NewSchema(gojsonschema.NewStringLoader(schema))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid schema: %s", err)
+	}
+
+	// The default database is created with its first table
+	if db.Name == DefaultDatabaseName {
+		err = os.MkdirAll(db.Dir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating data directory: %s", err)
+		}
+	}
+
 	// Create table directory
-	err = os.Mkdir(fmt.Sprintf("./data/%s", name), 0755)
+	err = os.Mkdir(path, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating table directory: %s", err)
 	}
 
 	// Create indexes directory
-	err = os.Mkdir(fmt.Sprintf("./data/%s/indexes", name), 0755)
+	err = os.Mkdir(fmt.Sprintf("%s/indexes", path), 0755)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating indexes directory: %s", err)
 	}
 
 	// Create data file
-	_, err = os.Create(fmt.Sprintf("./data/%s/data.bin", name))
+	_, err = os.Create(fmt.Sprintf("%s/data.bin", path))
 	if err != nil {
 		return nil, fmt.Errorf("Error creating data file: %s", err)
 	}
 
 	// Check if schema string is valid json
 	var jsonSchema JSONSchemaForValidation
-	var indexFiles []string = []string{"id_idx.bin"}
 	err = json.Unmarshal([]byte(schema), &jsonSchema)
 	if err != nil {
 		return nil, fmt.Errorf("Error unmarshalling schema: %s", err)
 	}
+	indexFiles := append([]string{"id_idx.bin"}, columnIndexFiles(jsonSchema)...)
+
+	// Write json schema to file
+	err = os.WriteFile(fmt.Sprintf("%s/schema.json", path), []byte(schema), 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error writing schema to file: %s", err)
+	}
+
+	// Create index files
+	for _, file := range indexFiles {
+		_, err = os.Create(fmt.Sprintf("%s/indexes/%s", path, file))
+		if err != nil {
+			return nil, fmt.Errorf("Error creating index file: %s", err)
+		}
+	}
+
+	table := &Table{tableHandle: newTableHandle(db, name, schema)}
+	table.versions = []SchemaVersion{{Version: 1, Schema: json.RawMessage(schema)}}
+	err = table.saveVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	// A table of the same name may have been cached before
+	catalog.invalidate(db.qualify(name))
+	return db.GetTable(name)
+}
+
+// columnIndexFiles lists the index file of every indexed column
+func columnIndexFiles(jsonSchema JSONSchemaForValidation) []string {
+	var indexFiles []string
 	for propName, prop := range jsonSchema.Properties {
-		if prop.Type == "array" || prop.Type == "object" || prop.Ref != "" {
-			return nil, fmt.Errorf("Invalid schema, it cannot contain arrays or object references: %s", schema)
+		if hasMultikeyIndex(prop) {
+			indexFiles = append(indexFiles, fmt.Sprintf("m_%s_idx.bin", propName))
+			continue
+		}
+		// Nested objects and arrays are not indexed, CREATE INDEX on a path does it
+		if prop.Type == "array" || prop.Type == "object" || prop.Type == "" || prop.Ref != "" {
+			continue
+		}
+		// Binary data is never looked up by value
+		if prop.ContentEncoding == Base64Encoding {
+			continue
 		}
 		if propName != "id" {
 			idxPrefix := ""
@@ -96,63 +222,56 @@ func NewTable(name string, schema string) (*Table, error) {
 			if prop.Type == "string" && propName != "id" {
 				idxPrefix = "s"
 			}
+			if prop.IsTime() {
+				idxPrefix = "d"
+			}
 			indexFiles = append(indexFiles, fmt.Sprintf("%s_%s_idx.bin", idxPrefix, propName))
 		}
 	}
+	return indexFiles
+}
 
-	// Write json schema to file
-	err = os.WriteFile(fmt.Sprintf("./data/%s/schema.json", name), []byte(schema), 0644)
-	if err != nil {
-		return nil, fmt.Errorf("Error writing schema to file: %s", err)
-	}
+// GetTable opens a table of the default database
+func GetTable(name string) (*Table, error) {
+	return DefaultDatabase().GetTable(name)
+}
 
-	// Create index files
-	for _, file := range indexFiles {
-		_, err = os.Create(fmt.Sprintf("./data/%s/indexes/%s", name, file))
-		if err != nil {
-			return nil, fmt.Errorf("Error creating index file: %s", err)
-		}
+// GetTable opens a table from the catalog, it is only read from disk the
+// first time
+func (db *Database) GetTable(name string) (*Table, error) {
+	snap, err := transactions.readSnapshot()
+	if err != nil {
+		return nil, err
 	}
-
-	table := &Table{
-		name:          name,
-		path:          fmt.Sprintf("./data/%s", name),
-		schema:        schema,
-		ids:           make(map[string][2]uint64),
-		boolIndexes:   make(map[string]*HashIndex[bool]),
-		intIndexes:    make(map[string]*HashIndex[int64]),
-		floatIndexes:  make(map[string]*HashIndex[float64]),
-		stringIndexes: make(map[string]*BTreeStringIndex),
+	handle, err := catalog.get(db, name)
+	if err != nil {
+		return nil, err
 	}
+	return &Table{tableHandle: handle, snap: snap}, nil
+}
 
-	return table, nil
+// ListTables returns the names of every table of the default database
+func ListTables() ([]string, error) {
+	return DefaultDatabase().ListTables()
 }
 
-func GetTable(name string) (*Table, error) {
-	_, err := os.Stat(fmt.Sprintf("./data/%s", name))
-	if err != nil {
-		return nil, fmt.Errorf("Table with name %s does not exist", name)
+// ListTables returns the names of every table of the database
+func (db *Database) ListTables() ([]string, error) {
+	entries, err := os.ReadDir(db.Dir)
+	if os.IsNotExist(err) && db.Name == DefaultDatabaseName {
+		return nil, nil
 	}
-
-	schema, err := os.ReadFile(fmt.Sprintf("./data/%s/schema.json", name))
 	if err != nil {
-		return nil, fmt.Errorf("Error reading schema file: %s", err)
+		return nil, fmt.Errorf("Error reading database directory: %s", err)
 	}
-
-	table := &Table{
-		name:          name,
-		path:          fmt.Sprintf("./data/%s", name),
-		schema:        string(schema),
-		ids:           make(map[string][2]uint64),
-		boolIndexes:   make(map[string]*HashIndex[bool]),
-		intIndexes:    make(map[string]*HashIndex[int64]),
-		floatIndexes:  make(map[string]*HashIndex[float64]),
-		stringIndexes: make(map[string]*BTreeStringIndex),
+	var names []string
+	for _, entry := range entries {
+		// Other databases live inside the default one
+		if _, err := os.Stat(filepath.Join(db.Dir, entry.Name(), "schema.json")); err == nil && entry.IsDir() {
+			names = append(names, entry.Name())
+		}
 	}
-
-	table.LoadIndexes()
-
-	return table, nil
+	return names, nil
 }
 
 func (t *Table) GetIdType() (string, error) {
@@ -164,6 +283,35 @@ func (t *Table) GetIdType() (string, error) {
 	return jsonSchema.Properties["id"].Type, nil
 }
 
+// Column describes a column of the rows a table returns
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Columns lists the columns of the table, id first and the others by name
+func (t *Table) Columns() ([]Column, error) {
+	jsonSchema, err := t.getSchema()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(jsonSchema.Properties))
+	for name := range jsonSchema.Properties {
+		if name != "id" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := jsonSchema.Properties["id"]; ok {
+		names = append([]string{"id"}, names...)
+	}
+	columns := make([]Column, len(names))
+	for i, name := range names {
+		columns[i] = Column{Name: name, Type: jsonSchema.Properties[name].SQLType()}
+	}
+	return columns, nil
+}
+
 func (t *Table) GetColumnNames() ([]string, error) {
 	var jsonSchema JSONSchemaForValidation
 	err := json.Unmarshal([]byte(t.schema), &jsonSchema)
@@ -177,26 +325,21 @@ func (t *Table) GetColumnNames() ([]string, error) {
 	return columns, nil
 }
 
+// updateIds saves the id index, callers hold mu
 func (t *Table) updateIds() error {
-	f, err := os.OpenFile(fmt.Sprintf("./data/%s/indexes/id_idx.bin", t.name), os.O_WRONLY, 0644)
-	defer f.Close()
-	if err != nil {
-		return fmt.Errorf("Error opening id index file: %s", err)
-	}
-	enc := gob.NewEncoder(f)
-	err = enc.Encode(t.ids)
+	err := saveGob(fmt.Sprintf("%s/indexes/id_idx.bin", t.path), t.ids)
 	if err != nil {
-		return fmt.Errorf("Error encoding id index: %s", err)
+		return fmt.Errorf("Error writing id index: %s", err)
 	}
-
 	return nil
 }
 
 func (t *Table) loadIds() error {
-	file, err := os.OpenFile(fmt.Sprintf("./data/%s/indexes/id_idx.bin", t.name), os.O_RDONLY, 0644)
+	file, err := os.OpenFile(fmt.Sprintf("%s/indexes/id_idx.bin", t.path), os.O_RDONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("Error reading id index file: %s", err)
 	}
+	defer file.Close()
 	decoder := gob.NewDecoder(file)
 	err = decoder.Decode(&t.ids)
 	if err != nil {
@@ -216,6 +359,35 @@ func (t *Table) ValidateInsertToSchema(data string) (bool, error) {
 	return result.Valid(), nil
 }
 
+// ValidateDocument validates data against the table schema, every invalid
+// field is reported in a *ValidationError
+func (t *Table) ValidateDocument(data string) error {
+	schemaLoader := gojsonschema.NewStringLoader(t.schema)
+	dataLoader := gojsonschema.NewStringLoader(data)
+
+	result, err := gojsonschema.Validate(schemaLoader, dataLoader)
+	if err != nil {
+		return fmt.Errorf("Error validating data: %s", err)
+	}
+	if result.Valid() {
+		return nil
+	}
+	validationErr := &ValidationError{}
+	for _, resultErr := range result.Errors() {
+		field := resultErr.Field()
+		// Missing fields are reported on their parent, name them instead
+		if property, ok := resultErr.Details()["property"].(string); ok && resultErr.Type() == "required" {
+			if field == "(root)" {
+				field = property
+			} else {
+				field = field + "." + property
+			}
+		}
+		validationErr.Fields = append(validationErr.Fields, FieldError{Field: field, Message: resultErr.Description()})
+	}
+	return validationErr
+}
+
 // Table dir should be something like:
 // tableName/data.bin
 // tableName/indexes/id_idx.bin
@@ -223,117 +395,415 @@ func (t *Table) ValidateInsertToSchema(data string) (bool, error) {
 // tableName/indexes/i_[attr]_idx.bin
 // tableName/indexes/f_[attr]_idx.bin
 // tableName/indexes/s_[attr]_idx.bin
+// tableName/indexes/c_[name]_idx.bin
+// tableName/indexes/p_[name]_idx.bin
+// tableName/indexes/m_[attr]_idx.bin
+// tableName/indexes/d_[attr]_idx.bin
 
 func (t *Table) LoadIndexes() error {
-	files, err := os.ReadDir(fmt.Sprintf("./data/%s/indexes", t.name))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	files, err := os.ReadDir(fmt.Sprintf("%s/indexes", t.path))
 	if err != nil {
 		return fmt.Errorf("Error reading indexes directory: %s", err)
 	}
 	for _, file := range files {
+		// Freshly created index files are empty until the first insert
+		if info, err := file.Info(); err == nil && info.Size() == 0 {
+			continue
+		}
+		// Files being written by another session
+		if !strings.HasSuffix(file.Name(), "_idx.bin") {
+			continue
+		}
 		idxName := strings.TrimSuffix(file.Name(), "_idx.bin")
-		if strings.Contains(file.Name(), "id_idx.bin") {
+		if file.Name() == "id_idx.bin" {
 			err = t.loadIds()
 			if err != nil {
 				return fmt.Errorf("Error loading id index: %s", err)
 			}
 		}
-		if strings.Contains(file.Name(), "b_") {
+		if strings.HasPrefix(file.Name(), "b_") {
 			idx := NewHashIndex[bool]()
-			err = idx.LoadFromFile(fmt.Sprintf("./data/%s/indexes/%s", t.name, file.Name()))
+			err = idx.LoadFromFile(fmt.Sprintf("%s/indexes/%s", t.path, file.Name()))
 			if err != nil {
 				return fmt.Errorf("Error loading bool index: %s", err)
 			}
 			idxName = strings.TrimPrefix(idxName, "b_")
 			t.boolIndexes[idxName] = idx
 		}
-		if strings.Contains(file.Name(), "i_") {
+		if strings.HasPrefix(file.Name(), "i_") {
 			idx := NewHashIndex[int64]()
-			err = idx.LoadFromFile(fmt.Sprintf("./data/%s/indexes/%s", t.name, file.Name()))
+			err = idx.LoadFromFile(fmt.Sprintf("%s/indexes/%s", t.path, file.Name()))
 			if err != nil {
 				return fmt.Errorf("Error loading int index: %s", err)
 			}
 			idxName = strings.TrimPrefix(idxName, "i_")
 			t.intIndexes[idxName] = idx
 		}
-		if strings.Contains(file.Name(), "f_") {
+		if strings.HasPrefix(file.Name(), "f_") {
 			idx := NewHashIndex[float64]()
-			err = idx.LoadFromFile(fmt.Sprintf("./data/%s/indexes/%s", t.name, file.Name()))
+			err = idx.LoadFromFile(fmt.Sprintf("%s/indexes/%s", t.path, file.Name()))
 			if err != nil {
 				return fmt.Errorf("Error loading float index: %s", err)
 			}
 			idxName = strings.TrimPrefix(idxName, "f_")
 			t.floatIndexes[idxName] = idx
 		}
-		if strings.Contains(file.Name(), "s_") {
+		if strings.HasPrefix(file.Name(), "s_") {
 			idx := NewBTreeStringIndex()
-			err = idx.LoadFromFile(fmt.Sprintf("./data/%s/indexes/%s", t.name, file.Name()))
+			err = idx.LoadFromFile(fmt.Sprintf("%s/indexes/%s", t.path, file.Name()))
 			if err != nil {
 				return fmt.Errorf("Error loading string index: %s", err)
 			}
 			idxName = strings.TrimPrefix(idxName, "s_")
 			t.stringIndexes[idxName] = idx
 		}
+		if strings.HasPrefix(file.Name(), "c_") {
+			idx := &CompositeIndex{}
+			err = idx.LoadFromFile(fmt.Sprintf("%s/indexes/%s", t.path, file.Name()))
+			if err != nil {
+				return fmt.Errorf("Error loading composite index: %s", err)
+			}
+			t.compositeIndexes[idx.Name] = idx
+		}
+		if strings.HasPrefix(file.Name(), "p_") {
+			idx := &PathIndex{}
+			err = idx.LoadFromFile(fmt.Sprintf("%s/indexes/%s", t.path, file.Name()))
+			if err != nil {
+				return fmt.Errorf("Error loading path index: %s", err)
+			}
+			t.pathIndexes[idx.Name] = idx
+		}
+		if strings.HasPrefix(file.Name(), "m_") {
+			idx := &MultikeyIndex{}
+			err = idx.LoadFromFile(fmt.Sprintf("%s/indexes/%s", t.path, file.Name()))
+			if err != nil {
+				return fmt.Errorf("Error loading multikey index: %s", err)
+			}
+			t.multikeyIndexes[idx.Column] = idx
+		}
+		if strings.HasPrefix(file.Name(), "d_") {
+			idx := &CompositeIndex{}
+			err = idx.LoadFromFile(fmt.Sprintf("%s/indexes/%s", t.path, file.Name()))
+			if err != nil {
+				return fmt.Errorf("Error loading date index: %s", err)
+			}
+			t.dateIndexes[idx.Name] = idx
+		}
 	}
 	return nil
 }
 
-func (t *Table) Insert(data string) error {
-	// Validate data
-	valid, err := t.ValidateInsertToSchema(data)
+func (t *Table) Insert(data string) (err error) {
+	finish, err := t.autoTx()
 	if err != nil {
-		return fmt.Errorf("Error validating data: %s", err)
-	}
-	if !valid {
-		return fmt.Errorf("Data is not valid according to schema")
+		return err
 	}
+	defer func() { err = finish(err) }()
 
-	// Verify if id is unique
 	var jsonData map[string]interface{}
 	err = json.Unmarshal([]byte(data), &jsonData)
-
 	if err != nil {
 		return fmt.Errorf("Error unmarshalling data: %s", err)
 	}
-	if _, ok := jsonData["id"]; !ok {
-		idType, err := t.GetIdType()
+
+	// Generated ids are new, no one else can be holding them
+	lockId := ""
+	if id, ok := jsonData["id"]; ok && id != nil {
+		lockId = fmt.Sprintf("%v", id)
+	}
+	err = t.lockRow(lockId, exclusiveLock)
+	if err != nil {
+		return err
+	}
+	jsonSchema, err := t.getSchema()
+	if err != nil {
+		return err
+	}
+	err = t.lockParents(jsonSchema, jsonData)
+	if err != nil {
+		return err
+	}
+	unlock, err := t.lockWrites()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The schema is read again once the table is locked, a change made in
+	// the meantime applies to the row
+	jsonSchema, err = t.getSchema()
+	if err != nil {
+		return err
+	}
+	// Defaults fill the columns left out, an explicit NULL stays NULL
+	applyDefaults(jsonSchema, jsonData)
+	removeNulls(jsonData)
+	err = decodeNested(jsonSchema, jsonData)
+	if err != nil {
+		return err
+	}
+	err = coerceValues(jsonSchema, jsonData)
+	if err != nil {
+		return err
+	}
+
+	// Verify if id is unique
+	if _, ok := jsonData["id"]; ok {
+		err = t.checkNewId(fmt.Sprintf("%v", jsonData["id"]))
 		if err != nil {
 			return err
 		}
-		if idType == "string" {
-			newId, err := uuid.NewUUID()
+	}
+	err = t.generateValues(jsonSchema, jsonData)
+	if err != nil {
+		return err
+	}
+	if _, ok := jsonData["id"]; !ok {
+		return fmt.Errorf("Id not found in data")
+	}
+
+	id := fmt.Sprintf("%v", jsonData["id"])
+	err = t.checkConstraints(jsonSchema, jsonData, id)
+	if err != nil {
+		return err
+	}
+
+	err = t.writeVersion(jsonData, false)
+	if err != nil {
+		return err
+	}
+	t.tx.record(t, id)
+	return nil
+}
+
+// generateValues fills the columns that have a generator and no value. id
+// always has one, by default a sequence for integers and a UUIDv4 for strings
+func (t *Table) generateValues(jsonSchema JSONSchemaForValidation, jsonData map[string]interface{}) error {
+	for column, prop := range jsonSchema.Properties {
+		generator := prop.Generator
+		if generator == "" && column == "id" {
+			if prop.Type == "integer" {
+				generator = SequenceGenerator
+			}
+			if prop.Type == "string" {
+				generator = UUIDv4Generator
+			}
+		}
+
+		switch generator {
+		case "":
+			continue
+		case SequenceGenerator:
+			seq, err := t.columnSequence(column)
 			if err != nil {
-				return fmt.Errorf("Error generating uuid: %s", err)
+				return fmt.Errorf("Error opening sequence: %s", err)
 			}
-			jsonData["id"] = newId
-		} else if idType == "integer" {
-			newId := len(t.ids) + 1
-			jsonData["id"] = newId
-		} else {
-			return fmt.Errorf("Id not found in data")
+			if value, ok := jsonData[column]; ok {
+				if number, ok := value.(float64); ok {
+					err = seq.Advance(int64(number))
+				}
+			} else {
+				// Stored as float64 like every number read back from JSON
+				var next int64
+				next, err = seq.Next()
+				jsonData[column] = float64(next)
+			}
+			if err != nil {
+				return fmt.Errorf("Error updating sequence: %s", err)
+			}
+			continue
+		}
+
+		if _, ok := jsonData[column]; ok {
+			continue
+		}
+		var value string
+		var err error
+		switch generator {
+		case NowGenerator:
+			value = prop.formatTime(time.Now())
+		case UUIDv4Generator:
+			var newId uuid.UUID
+			newId, err = uuid.NewRandom()
+			value = newId.String()
+		case UUIDv7Generator:
+			var newId uuid.UUID
+			newId, err = uuid.NewV7()
+			value = newId.String()
+		case ULIDGenerator:
+			value, err = utils.NewULID()
+		default:
+			return fmt.Errorf("Unknown generator %s for column %s", generator, column)
 		}
-	} else {
-		if _, ok := t.ids[fmt.Sprintf("%v", jsonData["id"])]; ok {
-			return fmt.Errorf("Id already exists")
+		if err != nil {
+			return fmt.Errorf("Error generating %s: %s", generator, err)
 		}
+		jsonData[column] = value
+	}
+	return nil
+}
+
+// Update merges changes into the row with the given id, a nil value clears
+// the column. The new version is appended to the data file and the id index
+// is moved to it
+func (t *Table) Update(id string, changes map[string]interface{}) (err error) {
+	finish, err := t.autoTx()
+	if err != nil {
+		return err
+	}
+	defer func() { err = finish(err) }()
+	err = t.lockRow(id, exclusiveLock)
+	if err != nil {
+		return err
+	}
+	jsonSchema, err := t.getSchema()
+	if err != nil {
+		return err
+	}
+	err = t.lockParents(jsonSchema, changes)
+	if err != nil {
+		return err
+	}
+	unlock, err := t.lockWrites()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	jsonSchema, err = t.getSchema()
+	if err != nil {
+		return err
+	}
+	err = t.checkWritable(id)
+	if err != nil {
+		return err
+	}
+	oldData, err := t.GetById(id)
+	if err != nil {
+		return err
+	}
+	if newId, ok := changes["id"]; ok && fmt.Sprintf("%v", newId) != id {
+		return fmt.Errorf("Updating id is not supported")
 	}
 
+	// Round trip through JSON so values have the same types as on insert
+	changesJson, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("Error marshalling data: %s", err)
+	}
+	newData := make(map[string]interface{}, len(oldData))
+	for key, value := range oldData {
+		newData[key] = value
+	}
+	err = json.Unmarshal(changesJson, &newData)
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling data: %s", err)
+	}
+	removeNulls(newData)
+	err = decodeNested(jsonSchema, newData)
+	if err != nil {
+		return err
+	}
+	err = coerceValues(jsonSchema, newData)
+	if err != nil {
+		return err
+	}
+
+	err = t.checkConstraints(jsonSchema, newData, id)
+	if err != nil {
+		return err
+	}
+
+	// The previous version keeps its index entries for older snapshots
+	err = t.writeVersion(newData, false)
+	if err != nil {
+		return err
+	}
+	t.tx.record(t, id)
+	return nil
+}
+
+// Delete removes the row with the given id after applying the ON DELETE
+// action of every foreign key referencing it. A deleted version is written
+// so transactions that still see the row keep doing so
+func (t *Table) Delete(id string) (err error) {
+	finish, err := t.autoTx()
+	if err != nil {
+		return err
+	}
+	defer func() { err = finish(err) }()
+	err = t.lockRow(id, exclusiveLock)
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := t.GetById(id)
+	if err != nil {
+		return err
+	}
+
+	// Children are changed first, each table is locked on its own
+	err = t.applyOnDelete(jsonData["id"])
+	if err != nil {
+		return err
+	}
+
+	unlock, err := t.lockWrites()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = t.checkWritable(id)
+	if err != nil {
+		return err
+	}
+	_, err = t.GetById(id)
+	if err != nil {
+		return err
+	}
+	err = t.writeVersion(map[string]interface{}{"id": jsonData["id"]}, true)
+	if err != nil {
+		return err
+	}
+	t.tx.record(t, id)
+	return nil
+}
+
+// writeVersion appends a new version of a row to the data file, linked to
+// the version it replaces, and indexes it
+func (t *Table) writeVersion(jsonData map[string]interface{}, deleted bool) error {
+	id := fmt.Sprintf("%v", jsonData["id"])
+	jsonData[versionKey] = t.Version()
+	jsonData[txKey] = t.tx.id
+	if position, ok := t.position(id); ok {
+		jsonData[prevKey] = position
+	}
+	if deleted {
+		jsonData[deletedKey] = true
+	}
 	finalData, err := json.Marshal(jsonData)
+	for _, key := range []string{versionKey, txKey, prevKey, deletedKey} {
+		delete(jsonData, key)
+	}
 	if err != nil {
 		return fmt.Errorf("Error marshalling data: %s", err)
 	}
 
 	finalStrData := string(finalData)
 
-	f, err := os.OpenFile(fmt.Sprintf("./data/%s/data.bin", t.name), os.O_WRONLY|os.O_APPEND, 0644)
+	f, err := os.OpenFile(fmt.Sprintf("%s/data.bin", t.path), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening data file: %s", err)
+	}
 	defer f.Close()
 	filePointerPosition, err := f.Seek(0, io.SeekEnd)
 	if err != nil {
 		return fmt.Errorf("Error opening data file: %s", err)
 	}
-	if len(finalStrData) > MAX_SIZE {
-		return fmt.Errorf("string exceeds fixed size: %s", finalStrData)
-	}
-	strBytes := []byte(padString(finalStrData, MAX_SIZE))
+	// Rows have their own size, the id index keeps position and length
+	strBytes := []byte(finalStrData)
 	err = binary.Write(f, binary.LittleEndian, strBytes)
 	if err != nil {
 		return fmt.Errorf("Error writing data to file: %s", err)
@@ -342,82 +812,94 @@ func (t *Table) Insert(data string) error {
 	return t.IndexData(jsonData, filePointerPosition, len(strBytes))
 }
 
-func padString(str string, size int) string {
-	if len(str) >= size {
-		return str
-	}
-	padding := make([]byte, size-len(str))
-	return str + string(padding)
-}
-
+// SelectAll reads every row the snapshot sees
 func (t *Table) SelectAll() ([]map[string]interface{}, error) {
-	// Open data file
-	f, err := os.Open(fmt.Sprintf("./data/%s/data.bin", t.name))
-	defer f.Close()
+	rows, err := t.Scan(nil)
 	if err != nil {
-		return nil, fmt.Errorf("Error opening data file: %s", err)
+		return nil, err
 	}
+	return rows.readAll()
+}
 
-	// Read data file
-	var data []map[string]interface{}
-	buf := make([]byte, MAX_SIZE)
-	for {
-		err := binary.Read(f, binary.LittleEndian, &buf)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Error().Err(err).Msg(fmt.Sprintf("Error reading data file: %s", f.Name()))
-			return nil, fmt.Errorf("Error reading data file: %s", err)
-		}
-		dataBytes := bytes.Trim(buf, "\x00")
-		var jsonData map[string]interface{}
-		err = json.Unmarshal(dataBytes, &jsonData)
-		if err != nil {
-			return nil, fmt.Errorf("Error unmarshalling data: %s", err)
-		}
-		data = append(data, jsonData)
+func (t *Table) FilterIndexByValue(columnName string, value interface{}) ([]string, error) {
+	t.mu.RLock()
+	ids, found, err := t.filterIndexByValue(columnName, value)
+	t.mu.RUnlock()
+	if err != nil || found {
+		return ids, err
 	}
-
-	return data, nil
+	return t.scanIds(WhereClause{Column: columnName, Operator: "=", Value: value})
 }
 
-func (t *Table) FilterIndexByValue(columnName string, value interface{}) ([]string, error) {
+// filterIndexByValue looks an equality up in the column index, found is
+// false when the index cannot answer it. Callers hold mu
+func (t *Table) filterIndexByValue(columnName string, value interface{}) ([]string, bool, error) {
 	var jsonSchema JSONSchemaForValidation
 	err := json.Unmarshal([]byte(t.schema), &jsonSchema)
 	if err != nil {
-		return nil, fmt.Errorf("Error unmarshalling schema: %s", err)
+		return nil, false, fmt.Errorf("Error unmarshalling schema: %s", err)
 	}
 
 	if columnName == "id" {
 		id := fmt.Sprintf("%v", value)
 		if _, ok := t.ids[id]; !ok {
-			return []string{}, nil
+			return []string{}, true, nil
 		}
-		return []string{id}, nil
+		return []string{id}, true, nil
 	}
 
+	// Indexes hold the type of their column, 10 finds 10.0 in a DOUBLE
+	value, _ = jsonSchema.Properties[columnName].coerceValue(value)
 	if jsonSchema.Properties[columnName].Type == "boolean" {
-		idx := t.boolIndexes[columnName]
-		ids := idx.Get(value.(bool))
-		return ids, nil
+		idx, ok := t.boolIndexes[columnName]
+		if !ok {
+			return []string{}, true, nil
+		}
+		b, ok := value.(bool)
+		if !ok {
+			// Only a scan can compare values of another type
+			return nil, false, nil
+		}
+		return idx.Get(b), true, nil
 	}
 	if jsonSchema.Properties[columnName].Type == "integer" {
-		idx := t.intIndexes[columnName]
-		ids := idx.Get(value.(int64))
-		return ids, nil
+		idx, ok := t.intIndexes[columnName]
+		if !ok {
+			return []string{}, true, nil
+		}
+		number, ok := value.(int64)
+		if !ok {
+			// Only a scan can compare values of another type
+			return nil, false, nil
+		}
+		return idx.Get(number), true, nil
 	}
 	if jsonSchema.Properties[columnName].Type == "number" {
-		idx := t.floatIndexes[columnName]
-		ids := idx.Get(value.(float64))
-		return ids, nil
+		idx, ok := t.floatIndexes[columnName]
+		if !ok {
+			return []string{}, true, nil
+		}
+		number, ok := value.(float64)
+		if !ok {
+			// Only a scan can compare values of another type
+			return nil, false, nil
+		}
+		return idx.Get(number), true, nil
 	}
 	if jsonSchema.Properties[columnName].Type == "string" {
-		idx := t.stringIndexes[columnName]
-		idx.BTree.PrintTree()
-		idMap, found := idx.BTree.Search(value.(string))
+		idx, ok := t.stringIndexes[columnName]
+		if !ok {
+			return []string{}, true, nil
+		}
+		// Values are indexed word by word, rows having the first word are
+		// the candidates
+		words := strings.Fields(fmt.Sprintf("%v", value))
+		if len(words) == 0 {
+			return nil, false, nil
+		}
+		idMap, found := idx.BTree.Search(words[0])
 		if !found {
-			return nil, fmt.Errorf("Value not found in index")
+			return []string{}, true, nil
 		}
 		var ids []string
 		for id, hasStr := range idMap {
@@ -425,28 +907,66 @@ func (t *Table) FilterIndexByValue(columnName string, value interface{}) ([]stri
 				ids = append(ids, id)
 			}
 		}
-		return ids, nil
+		return ids, true, nil
 	}
 
-	return nil, fmt.Errorf("Column type not supported %s, %s", columnName, jsonSchema.Properties[columnName].Type)
+	return nil, false, fmt.Errorf("Column type not supported %s, %s", columnName, jsonSchema.Properties[columnName].Type)
 }
 
 func (t *Table) SelectWhereIds(clauseChain WhereClause) ([]string, error) {
-	compositeIds, err := t.FilterIndexByValue(clauseChain.Column, clauseChain.Value)
+	rows, err := t.selectWhereRows(clauseChain)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = fmt.Sprintf("%v", row["id"])
+	}
+	return ids, nil
+}
+
+// selectWhereRows reads the rows matching the clauses
+func (t *Table) selectWhereRows(clauseChain WhereClause) ([]map[string]interface{}, error) {
+	rows, err := t.Scan(&clauseChain)
 	if err != nil {
-		return nil, fmt.Errorf("Error selecting data: %s", err)
+		return nil, err
+	}
+	return rows.readAll()
+}
+
+func (t *Table) selectWhereIds(clauseChain WhereClause) ([]string, error) {
+	if err := t.tx.Err(); err != nil {
+		return nil, err
+	}
+	if clauses, ok := clauseChain.conjunction(); ok {
+		ids, rest, found := t.lookupComposite(clauses)
+		if found {
+			for _, clause := range rest {
+				clauseIds, err := t.clauseIds(clause)
+				if err != nil {
+					return nil, selectError(err)
+				}
+				ids = intersect(ids, clauseIds)
+			}
+			return ids, nil
+		}
+	}
+
+	compositeIds, err := t.clauseIds(clauseChain)
+	if err != nil {
+		return nil, selectError(err)
 	}
 	if clauseChain.And != nil {
-		ids, err := t.SelectWhereIds(*clauseChain.And)
+		ids, err := t.selectWhereIds(*clauseChain.And)
 		if err != nil {
-			return nil, fmt.Errorf("Error selecting data: %s", err)
+			return nil, selectError(err)
 		}
 		compositeIds = intersect(compositeIds, ids)
 	}
 	if clauseChain.Or != nil {
-		ids, err := t.SelectWhereIds(*clauseChain.Or)
+		ids, err := t.selectWhereIds(*clauseChain.Or)
 		if err != nil {
-			return nil, fmt.Errorf("Error selecting data: %s", err)
+			return nil, selectError(err)
 		}
 		compositeIds = append(compositeIds, ids...)
 	}
@@ -455,24 +975,297 @@ func (t *Table) SelectWhereIds(clauseChain WhereClause) ([]string, error) {
 }
 
 func (t *Table) SelectWhere(clauseChain WhereClause) ([]map[string]interface{}, error) {
-	ids, err := t.SelectWhereIds(clauseChain)
+	data, err := t.selectWhereRows(clauseChain)
 	if err != nil {
-		return nil, fmt.Errorf("Error selecting data: %s", err)
+		return nil, selectError(err)
+	}
+	return data, nil
+}
+
+// selectError wraps an error of a select, a canceled statement keeps its
+// *CanceledError
+func selectError(err error) error {
+	if _, ok := err.(*CanceledError); ok {
+		return err
+	}
+	return fmt.Errorf("Error selecting data: %s", err)
+}
+
+// clauseIds resolves a single clause, ignoring its And/Or links. Equality
+// goes through the column index, other operators fall back to a scan
+func (t *Table) clauseIds(clause WhereClause) ([]string, error) {
+	ids, found, err := t.indexedIds(clause)
+	if err != nil || found {
+		return ids, err
+	}
+	if clause.Operator == "in" {
+		values, _ := clause.Value.([]interface{})
+		var ids []string
+		for _, value := range values {
+			if err := t.tx.Err(); err != nil {
+				return nil, err
+			}
+			valueIds, err := t.clauseIds(WhereClause{Column: clause.Column, Path: clause.Path, AsText: clause.AsText, Operator: "=", Value: value})
+			if err != nil {
+				return nil, err
+			}
+			ids = union(ids, valueIds)
+		}
+		return ids, nil
 	}
-	data, err := t.selectByIds(ids)
+	return t.scanIds(clause)
+}
+
+// indexedIds answers a clause from the indexes, found is false when none of
+// them can
+func (t *Table) indexedIds(clause WhereClause) ([]string, bool, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	mIdx, hasMultikey := t.multikeyIndexes[clause.Column]
+	hasMultikey = hasMultikey && len(clause.Path) == 0
+	switch clause.Operator {
+	case "in":
+		if hasMultikey {
+			values, _ := clause.Value.([]interface{})
+			return mIdx.GetAny(values), true, nil
+		}
+		return nil, false, nil
+	case "@>":
+		if hasMultikey {
+			elements, isArray := clause.Value.([]interface{})
+			if !isArray {
+				elements = []interface{}{clause.Value}
+			}
+			if ids, ok := mIdx.GetAll(elements); ok {
+				return ids, true, nil
+			}
+		}
+		return nil, false, nil
+	}
+	if idx, ok := t.dateIndexes[clause.Column]; ok && len(clause.Path) == 0 {
+		if ids, ok := idx.lookupOperator(clause.Operator, clause.Value); ok {
+			return ids, true, nil
+		}
+	}
+	if clause.Operator != "=" {
+		return nil, false, nil
+	}
+	if len(clause.Path) > 0 {
+		if idx := t.findPathIndex(clause); idx != nil {
+			return idx.Get(clause.Value), true, nil
+		}
+		return nil, false, nil
+	}
+	jsonSchema, err := t.getSchema()
 	if err != nil {
-		return nil, fmt.Errorf("Error selecting data: %s", err)
+		return nil, false, err
 	}
-	return data, nil
+	switch jsonSchema.Properties[clause.Column].Type {
+	case "boolean", "integer", "number", "string":
+		return t.filterIndexByValue(clause.Column, clause.Value)
+	}
+	if clause.Column == "id" {
+		return t.filterIndexByValue(clause.Column, clause.Value)
+	}
+	return nil, false, nil
+}
+
+// scanIds reads every row to find the ones matching a clause no index can
+// answer
+func (t *Table) scanIds(clause WhereClause) ([]string, error) {
+	rows, err := t.Scan(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for {
+		row, err := rows.Next()
+		if err == io.EOF {
+			return ids, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if matchesClause(row, clause) {
+			ids = append(ids, fmt.Sprintf("%v", row["id"]))
+		}
+	}
+}
+
+func matchesClause(row map[string]interface{}, clause WhereClause) bool {
+	value, ok := resolvePath(row[clause.Column], clause.Path)
+	if _, present := row[clause.Column]; !present || !ok {
+		return false
+	}
+	if clause.AsText {
+		value = textValue(value)
+	}
+	if clause.Operator == "@>" {
+		return contains(value, clause.Value)
+	}
+	if clause.Operator == "in" || clause.Operator == "not in" {
+		found := false
+		values, _ := clause.Value.([]interface{})
+		for _, v := range values {
+			if contains(value, v) {
+				found = true
+				break
+			}
+		}
+		return found == (clause.Operator == "in")
+	}
+	c, ok := compareValues(value, clause.Value)
+	if !ok {
+		return clause.Operator == "!=" || clause.Operator == "<>"
+	}
+	switch clause.Operator {
+	case "=":
+		return c == 0
+	case "!=", "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// compareValues orders two scalar values, ok is false when they are of
+// different kinds and cannot be compared
+func compareValues(a interface{}, b interface{}) (int, bool) {
+	aVal := NewIndexValue(a)
+	bVal := NewIndexValue(b)
+	if aVal.Kind != bVal.Kind {
+		return 0, false
+	}
+	return aVal.Compare(bVal), true
+}
+
+// conjunction flattens a chain made only of ANDs, ok is false if any OR is
+// involved
+func (clause WhereClause) conjunction() ([]WhereClause, bool) {
+	var clauses []WhereClause
+	for current := &clause; current != nil; current = current.And {
+		if current.Or != nil {
+			return nil, false
+		}
+		single := *current
+		single.And = nil
+		clauses = append(clauses, single)
+	}
+	return clauses, true
+}
+
+// lookupComposite picks the composite index covering the longest equality
+// prefix (plus a trailing range) of the given clauses, returning the matched
+// ids and the clauses the index did not cover
+func (t *Table) lookupComposite(clauses []WhereClause) ([]string, []WhereClause, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var best *CompositeIndex
+	var bestPrefix []interface{}
+	var bestLower, bestUpper *RangeBound
+	var bestUsed map[int]bool
+	bestScore := 0
+
+	names := make([]string, 0, len(t.compositeIndexes))
+	for name := range t.compositeIndexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		idx := t.compositeIndexes[name]
+		used := make(map[int]bool)
+		var prefix []interface{}
+		for _, column := range idx.Columns {
+			found := false
+			for i, clause := range clauses {
+				if !used[i] && clause.Column == column && clause.Operator == "=" {
+					prefix = append(prefix, clause.Value)
+					used[i] = true
+					found = true
+					break
+				}
+			}
+			if !found {
+				break
+			}
+		}
+
+		var lower, upper *RangeBound
+		if len(prefix) < len(idx.Columns) {
+			column := idx.Columns[len(prefix)]
+			for i, clause := range clauses {
+				if used[i] || clause.Column != column {
+					continue
+				}
+				switch clause.Operator {
+				case ">", ">=":
+					if lower == nil {
+						lower = &RangeBound{Value: clause.Value, Inclusive: clause.Operator == ">="}
+						used[i] = true
+					}
+				case "<", "<=":
+					if upper == nil {
+						upper = &RangeBound{Value: clause.Value, Inclusive: clause.Operator == "<="}
+						used[i] = true
+					}
+				}
+			}
+		}
+
+		score := len(prefix) * 2
+		if lower != nil || upper != nil {
+			score++
+		}
+		// A single equality is already served by the column index
+		if score > bestScore && score >= 3 {
+			best, bestPrefix, bestLower, bestUpper, bestUsed, bestScore = idx, prefix, lower, upper, used, score
+		}
+	}
+
+	if best == nil {
+		return nil, nil, false
+	}
+	var rest []WhereClause
+	for i, clause := range clauses {
+		if !bestUsed[i] {
+			rest = append(rest, clause)
+		}
+	}
+	return best.Lookup(bestPrefix, bestLower, bestUpper), rest, true
+}
+
+func union(ids []string, ids2 []string) []string {
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	for _, id := range ids2 {
+		if !set[id] {
+			set[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
 }
 
 func intersect(ids []string, ids2 []string) []string {
+	set := make(map[string]bool, len(ids2))
+	for _, id := range ids2 {
+		set[id] = true
+	}
 	var intersectedIds []string
 	for _, id := range ids {
-		for _, id2 := range ids2 {
-			if id == id2 {
-				intersectedIds = append(intersectedIds, id)
-			}
+		if set[id] {
+			intersectedIds = append(intersectedIds, id)
 		}
 	}
 	return intersectedIds
@@ -481,6 +1274,9 @@ func intersect(ids []string, ids2 []string) []string {
 func (t *Table) selectByIds(ids []string) ([]map[string]interface{}, error) {
 	var data []map[string]interface{}
 	for _, id := range ids {
+		if err := t.tx.Err(); err != nil {
+			return nil, err
+		}
 		jsonData, err := t.GetById(id)
 		if err != nil {
 			return nil, fmt.Errorf("Error getting data by id: %s", err)
@@ -490,37 +1286,21 @@ func (t *Table) selectByIds(ids []string) ([]map[string]interface{}, error) {
 	return data, nil
 }
 
+// GetById returns the version of the row the table snapshot sees
 func (t *Table) GetById(id interface{}) (map[string]interface{}, error) {
-	err := t.loadIds()
-	if err != nil {
-		return nil, fmt.Errorf("Error loading id index: %s", err)
-	}
-	if _, ok := t.ids[fmt.Sprintf("%v", id)]; !ok {
-		return nil, fmt.Errorf("Id not found")
-	}
-	filePointerPosition := t.ids[fmt.Sprintf("%v", id)][0]
-	dataLen := MAX_SIZE
-	f, err := os.Open(fmt.Sprintf("./data/%s/data.bin", t.name))
-	defer f.Close()
+	f, err := os.Open(fmt.Sprintf("%s/data.bin", t.path))
 	if err != nil {
 		return nil, fmt.Errorf("Error opening data file: %s", err)
 	}
-	_, err = f.Seek(int64(filePointerPosition), io.SeekStart)
-	if err != nil {
-		return nil, fmt.Errorf("Error seeking data file: %s", err)
-	}
-	buf := make([]byte, dataLen)
-	err = binary.Read(f, binary.LittleEndian, &buf)
+	defer f.Close()
+	version, err := t.visibleVersion(f, fmt.Sprintf("%v", id))
 	if err != nil {
-		return nil, fmt.Errorf("Error reading data file: %s", err)
+		return nil, err
 	}
-	dataBytes := bytes.Trim(buf, "\x00")
-	var jsonData map[string]interface{}
-	err = json.Unmarshal(dataBytes, &jsonData)
-	if err != nil {
-		return nil, fmt.Errorf("Error unmarshalling data: %s", err)
+	if version == nil {
+		return nil, ErrNotFound
 	}
-	return jsonData, nil
+	return version.row, nil
 }
 
 func (t *Table) IndexData(jsonData map[string]interface{}, filePointerPosition int64, dataLen int) error {
@@ -533,6 +1313,9 @@ func (t *Table) IndexData(jsonData map[string]interface{}, filePointerPosition i
 	// Hacky, but should work
 	id := fmt.Sprintf("%v", jsonData["id"])
 
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	for key, value := range jsonData {
 		if key == "id" {
 			t.ids[id] = [2]uint64{uint64(filePointerPosition), uint64(dataLen)}
@@ -544,7 +1327,7 @@ func (t *Table) IndexData(jsonData map[string]interface{}, filePointerPosition i
 				}
 				idx := t.boolIndexes[key]
 				idx.Insert(value.(bool), id)
-				idx.SaveToFile(fmt.Sprintf("./data/%s/indexes/b_%s_idx.bin", t.name, key))
+				idx.SaveToFile(fmt.Sprintf("%s/indexes/b_%s_idx.bin", t.path, key))
 				continue
 			}
 			if jsonSchema.Properties[key].Type == "integer" {
@@ -553,7 +1336,7 @@ func (t *Table) IndexData(jsonData map[string]interface{}, filePointerPosition i
 				}
 				idx := t.intIndexes[key]
 				idx.Insert(int64(value.(float64)), id)
-				idx.SaveToFile(fmt.Sprintf("./data/%s/indexes/i_%s_idx.bin", t.name, key))
+				idx.SaveToFile(fmt.Sprintf("%s/indexes/i_%s_idx.bin", t.path, key))
 				continue
 			}
 			if jsonSchema.Properties[key].Type == "number" {
@@ -562,7 +1345,19 @@ func (t *Table) IndexData(jsonData map[string]interface{}, filePointerPosition i
 				}
 				idx := t.floatIndexes[key]
 				idx.Insert(value.(float64), id)
-				idx.SaveToFile(fmt.Sprintf("./data/%s/indexes/f_%s_idx.bin", t.name, key))
+				idx.SaveToFile(fmt.Sprintf("%s/indexes/f_%s_idx.bin", t.path, key))
+				continue
+			}
+			if jsonSchema.Properties[key].IsTime() {
+				if _, ok := t.dateIndexes[key]; !ok {
+					t.dateIndexes[key] = NewCompositeIndex(key, []string{key})
+				}
+				idx := t.dateIndexes[key]
+				idx.Insert([]interface{}{value}, id)
+				idx.SaveToFile(fmt.Sprintf("%s/indexes/d_%s_idx.bin", t.path, key))
+				continue
+			}
+			if jsonSchema.Properties[key].ContentEncoding == Base64Encoding {
 				continue
 			}
 			if jsonSchema.Properties[key].Type == "string" {
@@ -573,18 +1368,101 @@ func (t *Table) IndexData(jsonData map[string]interface{}, filePointerPosition i
 				for _, str := range strings.Fields(value.(string)) {
 					idx.BTree.Insert(str, id)
 				}
-				idx.BTree.PrintTree()
-				idx.SaveToFile(fmt.Sprintf("./data/%s/indexes/s_%s_idx.bin", t.name, key))
+				idx.SaveToFile(fmt.Sprintf("%s/indexes/s_%s_idx.bin", t.path, key))
+				continue
+			}
+			if hasMultikeyIndex(jsonSchema.Properties[key]) {
+				if _, ok := t.multikeyIndexes[key]; !ok {
+					t.multikeyIndexes[key] = NewMultikeyIndex(key)
+				}
+				idx := t.multikeyIndexes[key]
+				idx.Insert(value, id)
+				idx.SaveToFile(fmt.Sprintf("%s/indexes/m_%s_idx.bin", t.path, key))
 			}
 		}
 	}
 
+	for name, idx := range t.compositeIndexes {
+		idx.Insert(compositeValues(idx, jsonData), id)
+		err = idx.SaveToFile(fmt.Sprintf("%s/indexes/c_%s_idx.bin", t.path, name))
+		if err != nil {
+			return fmt.Errorf("Error saving composite index: %s", err)
+		}
+	}
+
+	for name, idx := range t.pathIndexes {
+		if value, ok := idx.valueOf(jsonData); ok {
+			idx.Insert(value, id)
+			err = idx.SaveToFile(fmt.Sprintf("%s/indexes/p_%s_idx.bin", t.path, name))
+			if err != nil {
+				return fmt.Errorf("Error saving path index: %s", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func compositeValues(idx *CompositeIndex, jsonData map[string]interface{}) []interface{} {
+	values := make([]interface{}, len(idx.Columns))
+	for i, column := range idx.Columns {
+		values[i] = jsonData[column]
+	}
+	return values
+}
+
+// CreateCompositeIndex indexes the given ordered columns together, existing
+// rows are indexed right away
+func (t *Table) CreateCompositeIndex(name string, columns []string) error {
+	unlock, err := t.lockWrites()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, ok := t.compositeIndexes[name]; ok {
+		return fmt.Errorf("Index %s already exists", name)
+	}
+	if len(columns) < 2 {
+		return fmt.Errorf("Composite index %s needs at least two columns", name)
+	}
+
+	var jsonSchema JSONSchemaForValidation
+	err = json.Unmarshal([]byte(t.schema), &jsonSchema)
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling schema: %s", err)
+	}
+	for _, column := range columns {
+		prop, ok := jsonSchema.Properties[column]
+		if !ok {
+			return fmt.Errorf("Column %s does not exist", column)
+		}
+		if prop.Type == "array" || prop.Type == "object" {
+			return fmt.Errorf("Column %s cannot be part of a composite index", column)
+		}
+	}
+
+	idx := NewCompositeIndex(name, columns)
+	rows, err := t.everyVersion()
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		idx.Insert(compositeValues(idx, row), fmt.Sprintf("%v", row["id"]))
+	}
+
+	err = idx.SaveToFile(fmt.Sprintf("%s/indexes/c_%s_idx.bin", t.path, name))
+	if err != nil {
+		return fmt.Errorf("Error saving composite index: %s", err)
+	}
+	t.mu.Lock()
+	t.compositeIndexes[name] = idx
+	t.mu.Unlock()
 	return nil
 }
 
 func (t *Table) loadIdIndexFromFile(path string) (map[string]uint64, error) {
 	index := make(map[string]uint64)
-	_, err := os.ReadFile(fmt.Sprintf("./data/%s/indexes/id_idx.bin", t.name, path))
+	_, err := os.ReadFile(fmt.Sprintf("%s/indexes/%s", t.path, path))
 	if err != nil {
 		return index, fmt.Errorf("Error reading id index file: %s", err)
 	}
@@ -0,0 +1,179 @@
+package table
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// undoEntry is a row version written by the transaction, undoing it moves
+// the row back to the version before
+type undoEntry struct {
+	db    *Database
+	table string
+	id    string
+}
+
+// Tx groups changes to any number of tables so they can be undone together.
+// It sees the rows committed when it began plus its own changes, which
+// other transactions only see once it commits. The rows it changes stay
+// locked until then. Sequences are not rolled back, like in most databases
+type Tx struct {
+	id   uint64
+	db   *Database
+	snap *snapshot
+	undo []undoEntry
+	// Tables used by the running statement, VACUUM waits for them
+	held map[string]bool
+	// ctx of the running statement, scans and lock waits stop once it is
+	// done
+	ctx  context.Context
+	done bool
+}
+
+// CanceledError ends a statement whose context is done, either canceled or
+// past its timeout
+type CanceledError struct {
+	Timeout bool
+}
+
+func (e *CanceledError) Error() string {
+	if e.Timeout {
+		return "Canceling statement due to statement timeout"
+	}
+	return "Canceling statement due to user request"
+}
+
+// NewTx begins a transaction on the default database
+func NewTx() (*Tx, error) {
+	return DefaultDatabase().Begin()
+}
+
+// Begin starts a transaction whose tables are opened from the database
+func (db *Database) Begin() (*Tx, error) {
+	id, snap, err := transactions.begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{id: id, db: db, snap: snap}, nil
+}
+
+// Database is the database the tables of the transaction are opened from
+func (tx *Tx) Database() *Database {
+	return tx.db
+}
+
+// Table opens a table whose changes belong to the transaction
+func (tx *Tx) Table(name string) (*Table, error) {
+	key := tx.db.qualify(name)
+	if !tx.held[key] {
+		if tx.held == nil {
+			tx.held = make(map[string]bool)
+		}
+		lockFor(key).statement.RLock()
+		tx.held[key] = true
+	}
+	t, err := tx.db.GetTable(name)
+	if err != nil {
+		return nil, err
+	}
+	t.tx = tx
+	t.snap = tx.snap
+	return t, nil
+}
+
+// SetContext ties the running statement to ctx, EndStatement unties it
+func (tx *Tx) SetContext(ctx context.Context) {
+	tx.ctx = ctx
+}
+
+// Err returns a *CanceledError once the context of the running statement is
+// done
+func (tx *Tx) Err() error {
+	if tx == nil || tx.ctx == nil {
+		return nil
+	}
+	if err := tx.ctx.Err(); err != nil {
+		return &CanceledError{Timeout: errors.Is(err, context.DeadlineExceeded)}
+	}
+	return nil
+}
+
+// canceled is closed once the context of the running statement is done, nil
+// without one
+func (tx *Tx) canceled() <-chan struct{} {
+	if tx == nil || tx.ctx == nil {
+		return nil
+	}
+	return tx.ctx.Done()
+}
+
+// EndStatement lets go of the tables the last statement opened
+func (tx *Tx) EndStatement() {
+	for key := range tx.held {
+		lockFor(key).statement.RUnlock()
+	}
+	tx.held = nil
+	tx.ctx = nil
+}
+
+// Mark returns the current position of the transaction, RollbackTo undoes
+// every change made after it
+func (tx *Tx) Mark() int {
+	return len(tx.undo)
+}
+
+func (tx *Tx) record(t *Table, id string) {
+	if tx == nil || tx.done {
+		return
+	}
+	tx.undo = append(tx.undo, undoEntry{db: t.db, table: t.name, id: id})
+}
+
+// RollbackTo undoes the changes made after mark, newest first
+func (tx *Tx) RollbackTo(mark int) error {
+	for i := len(tx.undo) - 1; i >= mark; i-- {
+		entry := tx.undo[i]
+		t, err := entry.db.GetTable(entry.table)
+		if err != nil {
+			return fmt.Errorf("Error rolling back: %s", err)
+		}
+		err = t.revertVersion(tx, entry.id)
+		if err != nil {
+			return fmt.Errorf("Error rolling back: %s", err)
+		}
+		tx.undo = tx.undo[:i]
+	}
+	return nil
+}
+
+// Rollback undoes every change of the transaction
+func (tx *Tx) Rollback() error {
+	err := tx.RollbackTo(0)
+	tx.finish()
+	return err
+}
+
+// Commit makes the changes visible to the transactions starting after it,
+// they are already written. A transaction that changed rows is added to the
+// commit log first, it is rolled back when that fails
+func (tx *Tx) Commit() error {
+	if len(tx.undo) > 0 && !tx.done {
+		if err := transactions.commit(tx.id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	tx.undo = nil
+	tx.finish()
+	return nil
+}
+
+func (tx *Tx) finish() {
+	tx.EndStatement()
+	if !tx.done {
+		locks.releaseAll(tx.id)
+		transactions.end(tx.id)
+	}
+	tx.done = true
+}
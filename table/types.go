@@ -0,0 +1,191 @@
+package table
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Formats of the string properties holding dates, their values are stored in
+// a canonical UTC form so comparing them as strings orders them in time.
+// DATETIME and TIMESTAMP keep second precision
+const (
+	DateFormat     = "date"
+	DateTimeFormat = "date-time"
+	dateLayout     = "2006-01-02"
+	dateTimeLayout = "2006-01-02T15:04:05Z"
+)
+
+// Encoding of BLOB columns, their bytes are stored as base64 text
+const Base64Encoding = "base64"
+
+// Layouts accepted for date values, fractional seconds are accepted by all of
+// them. Values without a zone are taken as UTC
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	dateLayout,
+}
+
+// IsTime tells if the property holds a DATE, DATETIME or TIMESTAMP
+func (p JSONProperty) IsTime() bool {
+	return p.Type == "string" && (p.Format == DateFormat || p.Format == DateTimeFormat)
+}
+
+// SQLType names the type the values of the property come back as
+func (p JSONProperty) SQLType() string {
+	switch {
+	case p.IsTime() && p.Format == DateFormat:
+		return "DATE"
+	case p.IsTime():
+		return "TIMESTAMP"
+	case p.ContentEncoding == Base64Encoding:
+		return "BLOB"
+	}
+	switch p.Type {
+	case "boolean":
+		return "BOOLEAN"
+	case "integer":
+		return "INTEGER"
+	case "number":
+		return "DOUBLE"
+	case "string":
+		return "TEXT"
+	}
+	return "JSON"
+}
+
+// ParseTime reads the date and time forms SQL clients usually send
+func ParseTime(value string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		parsed, err := time.Parse(layout, strings.TrimSpace(value))
+		if err == nil {
+			return parsed.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid date: %s", value)
+}
+
+// formatTime writes a time in the canonical form of the property format
+func (p JSONProperty) formatTime(value time.Time) string {
+	if p.Format == DateFormat {
+		return value.UTC().Format(dateLayout)
+	}
+	return value.UTC().Format(dateTimeLayout)
+}
+
+// coerceValue converts a value to the representation the property stores,
+// 0 and 1 become booleans, numbers take the type of their column and dates
+// their canonical form. Values that cannot be converted are returned as
+// they are, ok tells them apart
+func (p JSONProperty) coerceValue(value interface{}) (interface{}, bool) {
+	switch {
+	case p.Type == "integer":
+		switch v := value.(type) {
+		case int64:
+			return v, true
+		case int:
+			return int64(v), true
+		case float64:
+			// 3.0 is an integer, 3.5 never equals one
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				return int64(v), true
+			}
+		}
+		return value, false
+	case p.Type == "number":
+		switch v := value.(type) {
+		case float64:
+			return v, true
+		case int64:
+			return float64(v), true
+		case int:
+			return float64(v), true
+		}
+		return value, false
+	case p.Type == "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v, true
+		case int64:
+			return v != 0, v == 0 || v == 1
+		case float64:
+			return v != 0, v == 0 || v == 1
+		case string:
+			switch strings.ToLower(v) {
+			case "true", "1":
+				return true, true
+			case "false", "0":
+				return false, true
+			}
+		}
+		return value, false
+	case p.IsTime():
+		text, ok := value.(string)
+		if !ok {
+			return value, false
+		}
+		parsed, err := ParseTime(text)
+		if err != nil {
+			return value, false
+		}
+		return p.formatTime(parsed), true
+	}
+	return value, true
+}
+
+// coerceValues converts the values of a row to the representation of their
+// columns, booleans that do not convert are left to the schema validation
+func coerceValues(jsonSchema JSONSchemaForValidation, jsonData map[string]interface{}) error {
+	for column, value := range jsonData {
+		prop, ok := jsonSchema.Properties[column]
+		if !ok || prop.Type == "integer" || prop.Type == "number" {
+			// Numbers stay float64 like every number read back from JSON
+			continue
+		}
+		coerced, ok := prop.coerceValue(value)
+		if !ok && prop.IsTime() {
+			return fmt.Errorf("Column %s expects a %s, found %v", column, prop.Format, value)
+		}
+		jsonData[column] = coerced
+
+		if prop.ContentEncoding == Base64Encoding {
+			text, ok := value.(string)
+			if !ok {
+				continue
+			}
+			if _, err := base64.StdEncoding.DecodeString(text); err != nil {
+				return fmt.Errorf("Column %s expects base64 encoded data", column)
+			}
+		}
+	}
+	return nil
+}
+
+// coerceClause converts the values a clause chain compares with, so
+// active = 1 matches booleans and dates compare in their canonical form
+func coerceClause(jsonSchema JSONSchemaForValidation, clause *WhereClause) {
+	for current := clause; current != nil; current = current.And {
+		if current.Or != nil {
+			coerceClause(jsonSchema, current.Or)
+		}
+		prop, ok := jsonSchema.Properties[current.Column]
+		if !ok || len(current.Path) > 0 {
+			continue
+		}
+		if values, ok := current.Value.([]interface{}); ok && prop.Type != "array" {
+			coerced := make([]interface{}, len(values))
+			for i, value := range values {
+				coerced[i], _ = prop.coerceValue(value)
+			}
+			current.Value = coerced
+			continue
+		}
+		current.Value, _ = prop.coerceValue(current.Value)
+	}
+}
@@ -0,0 +1,442 @@
+package table
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The system database keeps the tables of the server itself. Its directory
+// starts with a dot, which no database or table name can, and it has no
+// database file so it is neither listed nor opened by USE
+const systemDatabaseName = ".system"
+
+const usersTable = "users"
+
+const usersSchema = `{"properties": {"id": {"type": "string"}, "password": {"type": "string"}, "admin": {"type": "boolean"}}, "required": ["id", "password"]}`
+
+// Passwords are hashed with PBKDF2-SHA256 and a random salt, stored as
+// pbkdf2-sha256$iterations$salt$hash so the iterations can grow later
+const (
+	passwordScheme     = "pbkdf2-sha256"
+	passwordIterations = 100000
+	passwordSaltSize   = 16
+	passwordKeySize    = 32
+)
+
+// usersMu keeps the checks of CREATE, ALTER and DROP USER together with
+// their change
+var usersMu sync.Mutex
+
+// usersVersion changes with every change to the users, credential caches
+// forget what they verified before it
+var usersVersion atomic.Uint64
+
+// AuthError is returned when a user name and password do not match, it does
+// not tell which of them was wrong
+type AuthError struct {
+	User string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("Password authentication failed for user %s", e.User)
+}
+
+// PermissionError is returned when a user does something only an admin or
+// another user may do
+type PermissionError struct {
+	User   string
+	Action string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("Permission denied for user %s to %s", e.User, e.Action)
+}
+
+// User is a user of the server, admins manage the users and every
+// connection
+type User struct {
+	Name  string
+	Admin bool
+}
+
+func systemDatabase() *Database {
+	return &Database{Name: systemDatabaseName, Dir: filepath.Join(dataDir, systemDatabaseName)}
+}
+
+// users opens the users table, it is created with the first user. Without
+// create a missing table is nil
+func users(create bool) (*Table, error) {
+	db := systemDatabase()
+	if _, err := os.Stat(filepath.Join(db.tablePath(usersTable), "schema.json")); err != nil {
+		if !create {
+			return nil, nil
+		}
+		if err = os.MkdirAll(db.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("Error creating system directory: %s", err)
+		}
+		return db.NewTable(usersTable, usersSchema)
+	}
+	return db.GetTable(usersTable)
+}
+
+// HasUsers tells if any user was created, connections have to authenticate
+// from then on
+func HasUsers() (bool, error) {
+	list, err := ListUsers()
+	return len(list) > 0, err
+}
+
+// ListUsers returns the users by name
+func ListUsers() ([]User, error) {
+	t, err := users(false)
+	if t == nil || err != nil {
+		return nil, err
+	}
+	rows, err := t.SelectAll()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]User, 0, len(rows))
+	for _, row := range rows {
+		list = append(list, User{Name: fmt.Sprintf("%v", row["id"]), Admin: isAdmin(row)})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// isAdmin reads the admin flag of a user row, users created before there
+// were admins are all admins
+func isAdmin(row map[string]interface{}) bool {
+	admin, ok := row["admin"].(bool)
+	return admin || !ok
+}
+
+// IsAdmin tells if a user is an admin, false when it does not exist
+func IsAdmin(name string) (bool, error) {
+	t, err := users(false)
+	if t == nil || err != nil {
+		return false, err
+	}
+	row, err := t.GetById(name)
+	if err != nil {
+		return false, nil
+	}
+	return isAdmin(row), nil
+}
+
+// admins counts the admins among the users
+func admins(list []User) int {
+	n := 0
+	for _, user := range list {
+		if user.Admin {
+			n++
+		}
+	}
+	return n
+}
+
+// CreateUser adds a user with the given password. The first user is an
+// admin whatever admin says, somebody has to manage the others
+func CreateUser(name string, password string, admin bool) error {
+	if password == "" {
+		return fmt.Errorf("The password of user %s cannot be empty", name)
+	}
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	t, err := users(true)
+	if err != nil {
+		return err
+	}
+	if _, err = t.GetById(name); err == nil {
+		return fmt.Errorf("User %s already exists", name)
+	}
+	list, err := ListUsers()
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(map[string]interface{}{"id": name, "password": hash, "admin": admin || len(list) == 0})
+	if err != nil {
+		return fmt.Errorf("Error encoding user: %s", err)
+	}
+	defer usersVersion.Add(1)
+	return t.Insert(string(data))
+}
+
+// AlterUser changes the password of a user
+func AlterUser(name string, password string) error {
+	if password == "" {
+		return fmt.Errorf("The password of user %s cannot be empty", name)
+	}
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	t, err := users(false)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return fmt.Errorf("User %s does not exist", name)
+	}
+	if _, err = t.GetById(name); err != nil {
+		return fmt.Errorf("User %s does not exist", name)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	defer usersVersion.Add(1)
+	return t.Update(name, map[string]interface{}{"password": hash})
+}
+
+// SetAdmin makes a user an admin or takes it away, the last admin keeps it
+func SetAdmin(name string, admin bool) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	list, err := ListUsers()
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(list), func(i int) bool { return list[i].Name >= name })
+	if i == len(list) || list[i].Name != name {
+		return fmt.Errorf("User %s does not exist", name)
+	}
+	if !admin && list[i].Admin && admins(list) == 1 {
+		return fmt.Errorf("User %s is the last admin and has to stay one", name)
+	}
+	t, err := users(false)
+	if err != nil {
+		return err
+	}
+	defer usersVersion.Add(1)
+	return t.Update(name, map[string]interface{}{"admin": admin})
+}
+
+// DropUser removes a user, the last one stays or the server would take
+// connections without a password again, and so does the last admin
+func DropUser(name string) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	list, err := ListUsers()
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(list), func(i int) bool { return list[i].Name >= name })
+	if i == len(list) || list[i].Name != name {
+		return fmt.Errorf("User %s does not exist", name)
+	}
+	if len(list) == 1 {
+		return fmt.Errorf("User %s is the last user and cannot be dropped", name)
+	}
+	if list[i].Admin && admins(list) == 1 {
+		return fmt.Errorf("User %s is the last admin and cannot be dropped", name)
+	}
+	t, err := users(false)
+	if err != nil {
+		return err
+	}
+	defer usersVersion.Add(1)
+	return t.Delete(name)
+}
+
+// Authenticate checks the password of a user, a *AuthError tells they do
+// not match
+func Authenticate(name string, password string) error {
+	t, err := users(false)
+	if err != nil {
+		return err
+	}
+	hash, known := dummyHash(), false
+	if t != nil {
+		if row, err := t.GetById(name); err == nil {
+			hash, known = row["password"].(string)
+		}
+	}
+	// Unknown users are checked against a hash of their own, so they take
+	// as long to turn away as a wrong password
+	if !checkPassword(hash, password) || !known {
+		return &AuthError{User: name}
+	}
+	return nil
+}
+
+// CredentialCache remembers the names and passwords that authenticated
+// lately, so clients sending them with every request do not pay for PBKDF2
+// each time. They are kept as an HMAC with a key of the cache, and
+// forgotten after the time to live or once any user changes
+type CredentialCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	key     []byte
+	version uint64
+	expires map[string]time.Time
+}
+
+// NewCredentialCache returns a cache trusting credentials for ttl
+func NewCredentialCache(ttl time.Duration) (*CredentialCache, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("Error generating cache key: %s", err)
+	}
+	return &CredentialCache{ttl: ttl, key: key, expires: make(map[string]time.Time)}, nil
+}
+
+// credentialCacheSize is how many credentials a cache holds before it drops
+// the expired ones
+const credentialCacheSize = 1024
+
+// Authenticate checks the password of a user like the function of the same
+// name, unless it did already less than the time to live ago
+func (c *CredentialCache) Authenticate(name string, password string) error {
+	key := c.mac(name, password)
+	version := usersVersion.Load()
+	c.mu.Lock()
+	if c.version != version {
+		c.version = version
+		c.expires = make(map[string]time.Time)
+	}
+	expires, ok := c.expires[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(expires) {
+		return nil
+	}
+
+	if err := Authenticate(name, password); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A change to the users while checking may have made them wrong
+	if c.version != version || usersVersion.Load() != version {
+		return nil
+	}
+	now := time.Now()
+	if len(c.expires) >= credentialCacheSize {
+		for k, expires := range c.expires {
+			if !now.Before(expires) {
+				delete(c.expires, k)
+			}
+		}
+	}
+	if len(c.expires) < credentialCacheSize {
+		c.expires[key] = now.Add(c.ttl)
+	}
+	return nil
+}
+
+func (c *CredentialCache) mac(name string, password string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return string(mac.Sum(nil))
+}
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("Error generating salt: %s", err)
+	}
+	return hashWithSalt(password, salt), nil
+}
+
+func hashWithSalt(password string, salt []byte) string {
+	key := pbkdf2.Key([]byte(password), salt, passwordIterations, passwordKeySize, sha256.New)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// dummyHash stands for the password of users that do not exist
+var dummyHash = sync.OnceValue(func() string {
+	return hashWithSalt("", make([]byte, passwordSaltSize))
+})
+
+// parseHash reads the salt, iterations and key of a stored hash
+func parseHash(hash string) ([]byte, int, []byte, bool) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return nil, 0, nil, false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return nil, 0, nil, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, 0, nil, false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, 0, nil, false
+	}
+	return salt, iterations, key, true
+}
+
+// checkPassword hashes password with the salt and iterations of hash and
+// compares them in constant time
+func checkPassword(hash string, password string) bool {
+	salt, iterations, key, ok := parseHash(hash)
+	if !ok {
+		return false
+	}
+	derived := pbkdf2.Key([]byte(password), salt, iterations, len(key), sha256.New)
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// unknownSaltKey makes up the salts of users that do not exist, each keeps
+// the same one while the process runs
+var unknownSaltKey = sync.OnceValues(func() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("Error generating key: %s", err)
+	}
+	return key, nil
+})
+
+// SaltedPassword returns the salt, iterations and PBKDF2 key of the password
+// of a user, all SCRAM-SHA-256 needs to check a password without seeing it.
+// Unknown users get a salt of their own and a random key no password
+// matches, so they fail like a wrong password
+func SaltedPassword(name string) ([]byte, int, []byte, error) {
+	t, err := users(false)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if t != nil {
+		if row, err := t.GetById(name); err == nil {
+			hash, _ := row["password"].(string)
+			if salt, iterations, key, ok := parseHash(hash); ok {
+				return salt, iterations, key, nil
+			}
+		}
+	}
+	saltKey, err := unknownSaltKey()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	key := make([]byte, passwordKeySize)
+	if _, err = rand.Read(key); err != nil {
+		return nil, 0, nil, fmt.Errorf("Error generating key: %s", err)
+	}
+	mac := hmac.New(sha256.New, saltKey)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)[:passwordSaltSize], passwordIterations, key, nil
+}
@@ -0,0 +1,206 @@
+package table
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		// PBKDF2-HMAC-SHA256 vectors of RFC 7914, section 11
+		{
+			name:     "rfc 7914 one iteration",
+			hash:     "pbkdf2-sha256$1$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd+8xfHG4RbHjC9UJESBB06GXgw",
+			password: "passwd",
+			want:     true,
+		},
+		{
+			name:     "rfc 7914 80000 iterations",
+			hash:     "pbkdf2-sha256$80000$TmFDbA$TdzY9guYviGDDO5e8icB+WQaRBjQTAQUrv8Ih2s0q1ah1CWhIlgzVJrbhBtRybMXaicr3ruh0HhHj2Kzl/M8jQ",
+			password: "Password",
+			want:     true,
+		},
+		{
+			name:     "wrong password",
+			hash:     "pbkdf2-sha256$1$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd+8xfHG4RbHjC9UJESBB06GXgw",
+			password: "passwd2",
+		},
+		{
+			name:     "other scheme",
+			hash:     "bcrypt$1$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd+8xfHG4RbHjC9UJESBB06GXgw",
+			password: "passwd",
+		},
+		{
+			name:     "no iterations",
+			hash:     "pbkdf2-sha256$0$c2FsdA$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd+8xfHG4RbHjC9UJESBB06GXgw",
+			password: "passwd",
+		},
+		{
+			name:     "bad salt",
+			hash:     "pbkdf2-sha256$1$c2Fsd!$VawEblbjCJ/sFpHCJUS2BflBhSFt3gRl5oudV8INrLxJypzM8Xm2RZkWZLOdd+8xfHG4RbHjC9UJESBB06GXgw",
+			password: "passwd",
+		},
+		{
+			name:     "missing part",
+			hash:     "pbkdf2-sha256$1$c2FsdA",
+			password: "passwd",
+		},
+		{
+			name:     "empty",
+			password: "passwd",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkPassword(tt.hash, tt.password); got != tt.want {
+				t.Errorf("checkPassword = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	first, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Errorf("two hashes of the same password share a salt: %s", first)
+	}
+	if !strings.HasPrefix(first, "pbkdf2-sha256$100000$") {
+		t.Errorf("unexpected hash %s", first)
+	}
+	for _, hash := range []string{first, second} {
+		if !checkPassword(hash, "secret") || checkPassword(hash, "Secret") {
+			t.Errorf("hash %s does not check its own password", hash)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	if err := CreateUser("auth_known", "secret", false); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		ok       bool
+	}{
+		{name: "right password", user: "auth_known", password: "secret", ok: true},
+		{name: "wrong password", user: "auth_known", password: "Secret"},
+		{name: "empty password", user: "auth_known", password: ""},
+		{name: "unknown user", user: "auth_unknown", password: "secret"},
+		{name: "unknown user without password", user: "auth_unknown", password: ""},
+	}
+	elapsed := make(map[string]time.Duration)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			err := Authenticate(tt.user, tt.password)
+			elapsed[tt.name] = time.Since(start)
+			if tt.ok && err != nil {
+				t.Errorf("Authenticate: %s", err)
+			}
+			if _, isAuth := err.(*AuthError); !tt.ok && !isAuth {
+				t.Errorf("want an *AuthError, got %v", err)
+			}
+		})
+	}
+
+	// An unknown user hashes the password like a known one, far from the
+	// instant answer a lookup alone gives
+	if elapsed["unknown user"] < elapsed["wrong password"]/4 {
+		t.Errorf("unknown user answered in %s, a wrong password in %s", elapsed["unknown user"], elapsed["wrong password"])
+	}
+}
+
+func TestCredentialCache(t *testing.T) {
+	for _, name := range []string{"cache_keeper", "cache_user"} {
+		if err := CreateUser(name, "first", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache, err := NewCredentialCache(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, err := NewCredentialCache(time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		cache    *CredentialCache
+		change   func() error
+		password string
+		ok       bool
+		// cached tells if the credentials are cached once checked
+		cached bool
+	}{
+		{name: "first check", cache: cache, password: "first", ok: true, cached: true},
+		{name: "cached", cache: cache, password: "first", ok: true, cached: true},
+		{name: "wrong password", cache: cache, password: "second"},
+		{
+			name:     "password changed",
+			cache:    cache,
+			change:   func() error { return AlterUser("cache_user", "second") },
+			password: "first",
+		},
+		{name: "new password", cache: cache, password: "second", ok: true, cached: true},
+		{
+			name:     "other user changed",
+			cache:    cache,
+			change:   func() error { return SetAdmin("cache_keeper", true) },
+			password: "second",
+			ok:       true,
+			cached:   true,
+		},
+		{
+			name:     "user dropped",
+			cache:    cache,
+			change:   func() error { return DropUser("cache_user") },
+			password: "second",
+		},
+		{
+			name:     "expired",
+			cache:    short,
+			change:   func() error { return CreateUser("cache_user", "third", false) },
+			password: "third",
+			ok:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.change != nil {
+				if err := tt.change(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := tt.cache.Authenticate("cache_user", tt.password)
+			if tt.ok && err != nil {
+				t.Errorf("Authenticate: %s", err)
+			}
+			if _, isAuth := err.(*AuthError); !tt.ok && !isAuth {
+				t.Errorf("want an *AuthError, got %v", err)
+			}
+			time.Sleep(2 * time.Millisecond)
+			tt.cache.mu.Lock()
+			expires, ok := tt.cache.expires[tt.cache.mac("cache_user", tt.password)]
+			tt.cache.mu.Unlock()
+			if cached := ok && time.Now().Before(expires); cached != tt.cached {
+				t.Errorf("cached = %v, want %v", cached, tt.cached)
+			}
+		})
+	}
+}
@@ -0,0 +1,545 @@
+package table
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xeipuuv/gojsonschema"
+	"os"
+	"regexp"
+	"sort"
+)
+
+// Migration steps, they run in order on rows written under the previous
+// schema version
+const (
+	SetColumn    = "set"
+	DropColumn   = "drop"
+	RenameColumn = "rename"
+)
+
+// versionKey tags every stored row with the schema version it was written
+// under, it is removed before rows are handed out
+const versionKey = "_v"
+
+// Migration changes a single column of a row, Set stores the result of Expr
+// and Rename moves the value to To
+type Migration struct {
+	Op     string `json:"op"`
+	Column string `json:"column"`
+	To     string `json:"to,omitempty"`
+	Expr   *Expr  `json:"expr,omitempty"`
+}
+
+// SchemaVersion is an entry of the schema history, Migrations upgrade rows of
+// the previous version to this one
+type SchemaVersion struct {
+	Version    int             `json:"version"`
+	Schema     json.RawMessage `json:"schema"`
+	Migrations []Migration     `json:"migrations,omitempty"`
+}
+
+// loadVersions reads the schema history, tables created before it existed
+// only have their first version
+func (t *Table) loadVersions() error {
+	data, err := os.ReadFile(fmt.Sprintf("%s/versions.json", t.path))
+	if os.IsNotExist(err) {
+		t.versions = []SchemaVersion{{Version: 1, Schema: json.RawMessage(t.schema)}}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading schema versions: %s", err)
+	}
+	err = json.Unmarshal(data, &t.versions)
+	if err != nil {
+		return fmt.Errorf("Error unmarshalling schema versions: %s", err)
+	}
+	return nil
+}
+
+func (t *Table) saveVersions() error {
+	data, err := json.Marshal(t.versions)
+	if err != nil {
+		return fmt.Errorf("Error marshalling schema versions: %s", err)
+	}
+	err = writeFileAtomic(fmt.Sprintf("%s/versions.json", t.path), data)
+	if err != nil {
+		return fmt.Errorf("Error writing schema versions: %s", err)
+	}
+	return nil
+}
+
+// Version is the current schema version
+func (t *Table) Version() int {
+	return t.versions[len(t.versions)-1].Version
+}
+
+// SchemaVersions returns the schema history, oldest first
+func (t *Table) SchemaVersions() []SchemaVersion {
+	return t.versions
+}
+
+// upgradeRow removes the version tag of a stored row and runs the migrations
+// of every later version on it. Rows are only rewritten on their next update
+func (t *Table) upgradeRow(row map[string]interface{}) error {
+	version := 1
+	if tag, ok := row[versionKey].(float64); ok {
+		version = int(tag)
+	}
+	delete(row, versionKey)
+	if version >= t.Version() {
+		return nil
+	}
+
+	for _, schemaVersion := range t.versions {
+		if schemaVersion.Version <= version {
+			continue
+		}
+		err := applyMigrations(schemaVersion.Migrations, row)
+		if err != nil {
+			return fmt.Errorf("Error migrating row %v to version %d: %s", row["id"], schemaVersion.Version, err)
+		}
+	}
+	jsonSchema, err := t.getSchema()
+	if err != nil {
+		return err
+	}
+	removeNulls(row)
+	return coerceValues(jsonSchema, row)
+}
+
+func applyMigrations(migrations []Migration, row map[string]interface{}) error {
+	for _, migration := range migrations {
+		switch migration.Op {
+		case SetColumn:
+			value, err := migration.Expr.Eval(row)
+			if err != nil {
+				return err
+			}
+			// Round trip through JSON so values have the same types as stored ones
+			data, err := json.Marshal(value)
+			if err != nil {
+				return fmt.Errorf("Error marshalling data: %s", err)
+			}
+			err = json.Unmarshal(data, &value)
+			if err != nil {
+				return fmt.Errorf("Error unmarshalling data: %s", err)
+			}
+			row[migration.Column] = value
+		case DropColumn:
+			delete(row, migration.Column)
+		case RenameColumn:
+			if value, ok := row[migration.Column]; ok {
+				row[migration.To] = value
+				delete(row, migration.Column)
+			}
+		default:
+			return fmt.Errorf("Unknown migration %s", migration.Op)
+		}
+	}
+	return nil
+}
+
+// AlterSchema makes schema the new version of the table schema. Properties
+// missing from it are dropped from the rows, every other change has to leave
+// the existing rows valid once the migrations ran on them. Rows keep their
+// old version on disk and are upgraded when read, the indexes are rebuilt
+func (t *Table) AlterSchema(schema string, migrations []Migration) (int, error) {
+	_, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schema))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid schema: %s", err)
+	}
+	unlock, err := t.lockWrites()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	// The change is made on a copy of the table, sessions keep the shared one
+	// until it is dropped from the catalog once the change is done
+	err = t.detach()
+	if err != nil {
+		return 0, err
+	}
+	defer catalog.invalidate(t.key)
+	var newSchema JSONSchemaForValidation
+	err = json.Unmarshal([]byte(schema), &newSchema)
+	if err != nil {
+		return 0, fmt.Errorf("Error unmarshalling schema: %s", err)
+	}
+	oldSchema, err := t.getSchema()
+	if err != nil {
+		return 0, err
+	}
+	if newSchema.Properties["id"].Type != oldSchema.Properties["id"].Type {
+		return 0, fmt.Errorf("The id column cannot be changed")
+	}
+
+	renamed := make(map[string]string)
+	for _, migration := range migrations {
+		if migration.Column == "id" || migration.To == "id" {
+			return 0, fmt.Errorf("The id column cannot be changed")
+		}
+		if migration.Op == RenameColumn {
+			renamed[migration.Column] = migration.To
+		}
+	}
+	columns := make([]string, 0, len(oldSchema.Properties))
+	for column := range oldSchema.Properties {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	for _, column := range columns {
+		if _, ok := newSchema.Properties[column]; !ok && renamed[column] == "" {
+			migrations = append(migrations, Migration{Op: DropColumn, Column: column})
+		}
+	}
+
+	// Every stored version is migrated now to find incompatible changes before
+	// any is made, the result is what the indexes are rebuilt from
+	rows, err := t.everyVersion()
+	if err != nil {
+		return 0, err
+	}
+	candidate := &Table{tableHandle: newTableHandle(t.db, t.name, schema)}
+	for _, row := range rows {
+		err = applyMigrations(migrations, row)
+		if err == nil {
+			removeNulls(row)
+			err = coerceValues(newSchema, row)
+		}
+		if err == nil {
+			for _, column := range newSchema.Required {
+				if _, ok := row[column]; !ok {
+					err = &ConstraintError{Constraint: "NOT NULL", Columns: []string{column}, Message: "value cannot be null"}
+					break
+				}
+			}
+		}
+		if err == nil {
+			data, _ := json.Marshal(row)
+			err = candidate.ValidateDocument(string(data))
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Incompatible schema change, row %v would be invalid (%s), a migration is needed", row["id"], err)
+		}
+	}
+
+	// The history is written first, rows of the new version are only read
+	// once the schema file names it
+	version := t.Version() + 1
+	previous := t.versions
+	t.versions = append(t.versions[:len(t.versions):len(t.versions)], SchemaVersion{Version: version, Schema: json.RawMessage(schema), Migrations: migrations})
+	err = t.saveVersions()
+	if err != nil {
+		t.versions = previous
+		return 0, err
+	}
+	err = writeFileAtomic(fmt.Sprintf("%s/schema.json", t.path), []byte(schema))
+	if err != nil {
+		t.versions = previous
+		return 0, fmt.Errorf("Error writing schema to file: %s", err)
+	}
+	t.schema = schema
+
+	// Column sequences follow their column
+	for from, to := range renamed {
+		path := fmt.Sprintf("%s/%s_seq.bin", t.path, from)
+		err = os.Rename(path, fmt.Sprintf("%s/%s_seq.bin", t.path, to))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("Error renaming sequence of %s: %s", from, err)
+		}
+	}
+	return version, t.rebuildIndexes(rows, renamed)
+}
+
+// rebuildIndexes indexes the given rows again after a schema change, created
+// indexes follow renamed columns and go away with dropped ones
+func (t *Table) rebuildIndexes(rows []map[string]interface{}, renamed map[string]string) error {
+	jsonSchema, err := t.getSchema()
+	if err != nil {
+		return err
+	}
+
+	files, err := os.ReadDir(fmt.Sprintf("%s/indexes", t.path))
+	if err != nil {
+		return fmt.Errorf("Error reading indexes directory: %s", err)
+	}
+	for _, file := range files {
+		if file.Name() != "id_idx.bin" {
+			err = os.Remove(fmt.Sprintf("%s/indexes/%s", t.path, file.Name()))
+			if err != nil {
+				return fmt.Errorf("Error removing index file: %s", err)
+			}
+		}
+	}
+	for _, file := range columnIndexFiles(jsonSchema) {
+		err = writeFileAtomic(fmt.Sprintf("%s/indexes/%s", t.path, file), nil)
+		if err != nil {
+			return fmt.Errorf("Error creating index file: %s", err)
+		}
+	}
+
+	t.mu.Lock()
+	t.boolIndexes = make(map[string]*HashIndex[bool])
+	t.intIndexes = make(map[string]*HashIndex[int64])
+	t.floatIndexes = make(map[string]*HashIndex[float64])
+	t.stringIndexes = make(map[string]*BTreeStringIndex)
+	t.multikeyIndexes = make(map[string]*MultikeyIndex)
+	t.dateIndexes = make(map[string]*CompositeIndex)
+
+	renamedColumn := func(column string) (string, bool) {
+		if to, ok := renamed[column]; ok {
+			column = to
+		}
+		_, ok := jsonSchema.Properties[column]
+		return column, ok
+	}
+	for name, idx := range t.compositeIndexes {
+		columns := make([]string, len(idx.Columns))
+		for i, column := range idx.Columns {
+			var ok bool
+			columns[i], ok = renamedColumn(column)
+			if !ok {
+				columns = nil
+				break
+			}
+		}
+		delete(t.compositeIndexes, name)
+		if columns != nil {
+			t.compositeIndexes[name] = NewCompositeIndex(name, columns)
+		}
+	}
+	for name, idx := range t.pathIndexes {
+		column, ok := renamedColumn(idx.Column)
+		delete(t.pathIndexes, name)
+		if ok {
+			t.pathIndexes[name] = NewPathIndex(name, column, idx.Path, idx.AsText)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, row := range rows {
+		position, _ := t.position(fmt.Sprintf("%v", row["id"]))
+		err = t.IndexData(row, int64(position[0]), int(position[1]))
+		if err != nil {
+			return err
+		}
+	}
+	for name, idx := range t.compositeIndexes {
+		err = idx.SaveToFile(fmt.Sprintf("%s/indexes/c_%s_idx.bin", t.path, name))
+		if err != nil {
+			return fmt.Errorf("Error saving composite index: %s", err)
+		}
+	}
+	for name, idx := range t.pathIndexes {
+		err = idx.SaveToFile(fmt.Sprintf("%s/indexes/p_%s_idx.bin", t.path, name))
+		if err != nil {
+			return fmt.Errorf("Error saving path index: %s", err)
+		}
+	}
+	return nil
+}
+
+// schemaMap decodes the schema keeping every keyword, so column changes do
+// not lose the ones JSONSchemaForValidation ignores
+func (t *Table) schemaMap() (map[string]interface{}, map[string]interface{}, error) {
+	var schema map[string]interface{}
+	err := json.Unmarshal([]byte(t.schema), &schema)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error unmarshalling schema: %s", err)
+	}
+	properties, ok := schema["properties"].(map[string]interface{})
+	if !ok {
+		properties = make(map[string]interface{})
+		schema["properties"] = properties
+	}
+	return schema, properties, nil
+}
+
+func (t *Table) alterSchemaMap(schema map[string]interface{}, migrations []Migration) (int, error) {
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return 0, fmt.Errorf("Error marshalling schema: %s", err)
+	}
+	return t.AlterSchema(string(data), migrations)
+}
+
+func setRequired(schema map[string]interface{}, column string, required bool) {
+	var columns []interface{}
+	if list, ok := schema["required"].([]interface{}); ok {
+		for _, name := range list {
+			if name != column {
+				columns = append(columns, name)
+			}
+		}
+	}
+	if required {
+		columns = append(columns, column)
+	}
+	if len(columns) == 0 {
+		delete(schema, "required")
+		return
+	}
+	schema["required"] = columns
+}
+
+// AddColumn adds a column, using fills it on the existing rows. Without it a
+// NOT NULL column needs a default or an empty table
+func (t *Table) AddColumn(column string, prop map[string]interface{}, required bool, using *Expr) (int, error) {
+	schema, properties, err := t.schemaMap()
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := properties[column]; ok {
+		return 0, fmt.Errorf("Column %s already exists", column)
+	}
+	properties[column] = prop
+	setRequired(schema, column, required)
+
+	var migrations []Migration
+	if using == nil && prop["default"] != nil {
+		using = &Expr{Value: prop["default"]}
+	}
+	if using != nil {
+		migrations = append(migrations, Migration{Op: SetColumn, Column: column, Expr: using})
+	}
+	return t.alterSchemaMap(schema, migrations)
+}
+
+// ModifyColumn replaces the definition of a column, using converts the
+// existing values when the new type does not accept them as they are
+func (t *Table) ModifyColumn(column string, prop map[string]interface{}, required bool, using *Expr) (int, error) {
+	schema, properties, err := t.schemaMap()
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := properties[column]; !ok {
+		return 0, fmt.Errorf("Column %s does not exist", column)
+	}
+	if column == "id" {
+		return 0, fmt.Errorf("The id column cannot be changed")
+	}
+	properties[column] = prop
+	setRequired(schema, column, required)
+
+	var migrations []Migration
+	if using != nil {
+		migrations = append(migrations, Migration{Op: SetColumn, Column: column, Expr: using})
+	}
+	return t.alterSchemaMap(schema, migrations)
+}
+
+// DropColumn removes a column, it cannot be part of a constraint
+func (t *Table) DropColumn(column string) (int, error) {
+	schema, properties, err := t.schemaMap()
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := properties[column]; !ok {
+		return 0, fmt.Errorf("Column %s does not exist", column)
+	}
+	if column == "id" {
+		return 0, fmt.Errorf("The id column cannot be dropped")
+	}
+	jsonSchema, err := t.getSchema()
+	if err != nil {
+		return 0, err
+	}
+	for _, columns := range jsonSchema.UniqueKeys {
+		for _, name := range columns {
+			if name == column {
+				return 0, fmt.Errorf("Column %s is part of a unique key", column)
+			}
+		}
+	}
+	for _, check := range jsonSchema.Checks {
+		for _, name := range clauseColumns(check.Clause) {
+			if name == column {
+				return 0, fmt.Errorf("Column %s is used by CHECK %s", column, check.Expr)
+			}
+		}
+	}
+	for _, fk := range jsonSchema.ForeignKeys {
+		if fk.Column == column {
+			return 0, fmt.Errorf("Column %s is a foreign key", column)
+		}
+	}
+
+	delete(properties, column)
+	setRequired(schema, column, false)
+	return t.alterSchemaMap(schema, nil)
+}
+
+// RenameColumn renames a column and every constraint using it
+func (t *Table) RenameColumn(column string, newName string) (int, error) {
+	schema, properties, err := t.schemaMap()
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := properties[column]; !ok {
+		return 0, fmt.Errorf("Column %s does not exist", column)
+	}
+	if _, ok := properties[newName]; ok {
+		return 0, fmt.Errorf("Column %s already exists", newName)
+	}
+	if column == "id" || newName == "id" {
+		return 0, fmt.Errorf("The id column cannot be renamed")
+	}
+	jsonSchema, err := t.getSchema()
+	if err != nil {
+		return 0, err
+	}
+
+	properties[newName] = properties[column]
+	delete(properties, column)
+	if required, ok := schema["required"].([]interface{}); ok {
+		for i, name := range required {
+			if name == column {
+				required[i] = newName
+			}
+		}
+	}
+	if len(jsonSchema.UniqueKeys) > 0 {
+		for _, columns := range jsonSchema.UniqueKeys {
+			for i, name := range columns {
+				if name == column {
+					columns[i] = newName
+				}
+			}
+		}
+		schema["uniqueKeys"] = jsonSchema.UniqueKeys
+	}
+	if len(jsonSchema.Checks) > 0 {
+		for i := range jsonSchema.Checks {
+			renameClauseColumn(&jsonSchema.Checks[i].Clause, column, newName)
+			jsonSchema.Checks[i].Expr = renameInExpr(jsonSchema.Checks[i].Expr, column, newName)
+		}
+		schema["checks"] = jsonSchema.Checks
+	}
+	if len(jsonSchema.ForeignKeys) > 0 {
+		for i := range jsonSchema.ForeignKeys {
+			if jsonSchema.ForeignKeys[i].Column == column {
+				jsonSchema.ForeignKeys[i].Column = newName
+			}
+		}
+		schema["foreignKeys"] = jsonSchema.ForeignKeys
+	}
+
+	return t.alterSchemaMap(schema, []Migration{{Op: RenameColumn, Column: column, To: newName}})
+}
+
+func renameClauseColumn(clause *WhereClause, column string, newName string) {
+	for current := clause; current != nil; current = current.And {
+		if current.Column == column {
+			current.Column = newName
+		}
+		if current.Or != nil {
+			renameClauseColumn(current.Or, column, newName)
+		}
+	}
+}
+
+// renameInExpr renames whole word occurrences of a column in a CHECK text,
+// it is only used in messages
+func renameInExpr(expr string, column string, newName string) string {
+	return regexp.MustCompile(`\b`+regexp.QuoteMeta(column)+`\b`).ReplaceAllString(expr, newName)
+}
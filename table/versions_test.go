@@ -0,0 +1,62 @@
+package table
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestAlterSchema renames a column of a table holding rows. The rows are
+// upgraded when read, by the table that changed and by one opened afterwards
+func TestAlterSchema(t *testing.T) {
+	table := newTestTable(t, "", `{"properties": {"id": {"type": "integer"}, "a": {"type": "integer"}, "b": {"type": "string"}}}`)
+	mustInsert(t, table, `{"id": 1, "a": 1, "b": "x"}`, `{"id": 2, "a": 2}`)
+
+	_, err := table.AlterSchema(`{"properties": {"id": {"type": "integer"}, "a": {"type": "integer"}, "b": {"type": "string"}}, "required": ["b"]}`, nil)
+	if err == nil {
+		t.Fatal("expected the change to be refused, row 2 has no b")
+	}
+	if table.Version() != 1 {
+		t.Fatalf("refused change made version %d", table.Version())
+	}
+
+	version, err := table.AlterSchema(`{"properties": {"id": {"type": "integer"}, "c": {"type": "integer"}}}`, []Migration{{Op: RenameColumn, Column: "a", To: "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 || len(table.SchemaVersions()) != 2 {
+		t.Fatalf("got version %d and %d versions, want 2", version, len(table.SchemaVersions()))
+	}
+	mustInsert(t, table, `{"id": 3, "c": 3}`)
+
+	reopened, err := GetTable(table.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []*Table{table, reopened} {
+		rows, err := tt.SelectAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []map[string]interface{}{
+			{"id": float64(1), "c": float64(1)},
+			{"id": float64(2), "c": float64(2)},
+			{"id": float64(3), "c": float64(3)},
+		}
+		if !reflect.DeepEqual(rows, want) {
+			t.Errorf("got %v, want %v", rows, want)
+		}
+	}
+
+	tmp, err := filepath.Glob(filepath.Join(table.path, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmp) > 0 {
+		t.Errorf("temporary files left behind: %v", tmp)
+	}
+	if _, err = os.Stat(filepath.Join(table.path, "versions.json")); err != nil {
+		t.Errorf("versions not saved: %s", err)
+	}
+}
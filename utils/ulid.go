@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"crypto/rand"
+	"time"
+)
+
+// Crockford's base32, it keeps ULIDs sortable as plain strings
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULID returns a 26 characters ULID, 48 bits of milliseconds since epoch
+// followed by 80 random bits
+func NewULID() (string, error) {
+	var data [16]byte
+	ms := uint64(time.Now().UnixMilli())
+	for i := 5; i >= 0; i-- {
+		data[i] = byte(ms)
+		ms >>= 8
+	}
+	if _, err := rand.Read(data[6:]); err != nil {
+		return "", err
+	}
+
+	// 128 bits are encoded as 26 groups of 5 bits, the first one only has 3
+	out := make([]byte, 26)
+	var carry uint
+	var bits uint
+	pos := 25
+	for i := 15; i >= 0; i-- {
+		carry |= uint(data[i]) << bits
+		bits += 8
+		for bits >= 5 {
+			out[pos] = crockford[carry&31]
+			pos--
+			carry >>= 5
+			bits -= 5
+		}
+	}
+	out[pos] = crockford[carry&31]
+	return string(out), nil
+}
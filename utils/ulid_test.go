@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// ulidTime decodes the milliseconds of the first 10 characters of a ULID
+func ulidTime(t *testing.T, ulid string) time.Time {
+	t.Helper()
+	var ms int64
+	for _, c := range ulid[:10] {
+		i := strings.IndexRune(crockford, c)
+		if i < 0 {
+			t.Fatalf("%s has %c outside of Crockford's base32", ulid, c)
+		}
+		ms = ms<<5 | int64(i)
+	}
+	return time.UnixMilli(ms)
+}
+
+func TestNewULID(t *testing.T) {
+	before := time.Now().Truncate(time.Millisecond)
+	ulid, err := NewULID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+
+	tests := []struct {
+		name  string
+		check func() bool
+	}{
+		{"26 characters", func() bool { return len(ulid) == 26 }},
+		{"first character holds 3 bits", func() bool { return ulid[0] <= '7' }},
+		{"Crockford's base32", func() bool { return strings.Trim(ulid, crockford) == "" }},
+		{"timestamp of its creation", func() bool {
+			created := ulidTime(t, ulid)
+			return !created.Before(before) && !created.After(after)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.check() {
+				t.Errorf("%s fails", ulid)
+			}
+		})
+	}
+}
+
+func TestNewULIDSorts(t *testing.T) {
+	seen := make(map[string]bool)
+	previous := ""
+	for i := 0; i < 5; i++ {
+		ulid, err := NewULID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[ulid] {
+			t.Fatalf("%s generated twice", ulid)
+		}
+		seen[ulid] = true
+		if ulid <= previous {
+			t.Errorf("%s does not sort after %s", ulid, previous)
+		}
+		previous = ulid
+		time.Sleep(2 * time.Millisecond)
+	}
+}